@@ -0,0 +1,253 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"screw/tracks"
+	"screw/ws"
+	"strconv"
+)
+
+const (
+	defaultUsersLimit = 50
+	maxUsersLimit     = 200
+)
+
+var errSelf = errors.New("admins can't disable or delete themselves")
+
+// Jobs are the running processing jobs, ws.WS keeps them.
+type Jobs interface {
+	Jobs() []ws.RunningJob
+	Kill(id string) bool
+	KillUser(userID int64) int
+}
+
+// Admin is the API on-call uses to look after users, sessions and jobs.
+type Admin struct {
+	store store.Store
+	jobs  Jobs
+}
+
+func New(store store.Store, jobs Jobs) *Admin {
+	return &Admin{store: store, jobs: jobs}
+}
+
+func writeJSON(w http.ResponseWriter, v any) *herr.Error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return herr.Internal(err, "Error encoding response")
+	}
+	return nil
+}
+
+// target is the user of the {id} in the path.
+func (a *Admin) target(r *http.Request) (*store.User, *herr.Error) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, herr.BadRequest(err, "Invalid user id")
+	}
+	user, err := a.store.UserByID(userID)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return nil, herr.NotFound(err, "User not found")
+	} else if err != nil {
+		return nil, herr.Internal(err, "Error reading user from db")
+	}
+	return user, nil
+}
+
+// admin is the user making the request.
+func admin(r *http.Request) (*store.User, *herr.Error) {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return nil, herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	return result.User, nil
+}
+
+// HandleUsers lists users, ?q= searches their email and name.
+func (a *Admin) HandleUsers(w http.ResponseWriter, r *http.Request) *herr.Error {
+	query := r.URL.Query()
+	limit, offset := defaultUsersLimit, 0
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxUsersLimit {
+			return herr.BadRequest(err, "Invalid limit")
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return herr.BadRequest(err, "Invalid offset")
+		}
+	}
+
+	users, err := a.store.SearchUsers(query.Get("q"), limit, offset)
+	if err != nil {
+		return herr.Internal(err, "Error searching users")
+	}
+	return writeJSON(w, users)
+}
+
+func (a *Admin) HandleUser(w http.ResponseWriter, r *http.Request) *herr.Error {
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	identities, err := a.store.IdentitiesByUserID(user.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading identities from db")
+	}
+	return writeJSON(w, struct {
+		*store.User
+		Identities []*store.Identity `json:"identities"`
+	}{user, identities})
+}
+
+func (a *Admin) HandleUserSessions(w http.ResponseWriter, r *http.Request) *herr.Error {
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	sessions, err := a.store.SessionsByUserID(user.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading sessions from db")
+	}
+	return writeJSON(w, sessions)
+}
+
+// HandleRevokeSession logs the user out of one device.
+func (a *Admin) HandleRevokeSession(w http.ResponseWriter, r *http.Request) *herr.Error {
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	err := a.store.DeleteUserSession(user.ID, r.PathValue("session"))
+	if errors.Is(err, store.ErrSessionNotFound) {
+		return herr.NotFound(err, "Session not found")
+	} else if err != nil {
+		return herr.Internal(err, "Error revoking session")
+	}
+	slog.Info("Admin revoked session", "userID", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleRevokeSessions logs the user out everywhere.
+func (a *Admin) HandleRevokeSessions(w http.ResponseWriter, r *http.Request) *herr.Error {
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	if err := a.store.DeleteSessionByUserID(user.ID); err != nil {
+		return herr.Internal(err, "Error revoking sessions")
+	}
+	slog.Info("Admin revoked all sessions", "userID", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleDisableUser blocks the user from logging in, ends their sessions and
+// stops their running jobs.
+func (a *Admin) HandleDisableUser(w http.ResponseWriter, r *http.Request) *herr.Error {
+	return a.setDisabled(w, r, true)
+}
+
+func (a *Admin) HandleEnableUser(w http.ResponseWriter, r *http.Request) *herr.Error {
+	return a.setDisabled(w, r, false)
+}
+
+func (a *Admin) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) *herr.Error {
+	self, e := admin(r)
+	if e != nil {
+		return e
+	}
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	if user.ID == self.ID {
+		return herr.Conflict(errSelf, "Admin tried to disable themselves")
+	}
+	if err := a.store.SetUserDisabled(user.ID, disabled); err != nil {
+		return herr.Internal(err, "Error disabling user")
+	}
+	killed := 0
+	if disabled {
+		killed = a.jobs.KillUser(user.ID)
+	}
+	slog.Info("Admin changed user", "adminID", self.ID, "userID", user.ID, "disabled", disabled, "jobsKilled", killed)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleDeleteUser removes the account, its identities, sessions and tokens,
+// stops its running jobs and removes its stored ones.
+func (a *Admin) HandleDeleteUser(w http.ResponseWriter, r *http.Request) *herr.Error {
+	self, e := admin(r)
+	if e != nil {
+		return e
+	}
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	if user.ID == self.ID {
+		return herr.Conflict(errSelf, "Admin tried to delete themselves")
+	}
+	files, err := a.store.DeleteUser(user.ID)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return herr.NotFound(err, "User not found")
+	} else if err != nil {
+		return herr.Internal(err, "Error deleting user")
+	}
+	killed := a.jobs.KillUser(user.ID)
+	tracks.RemoveFiles(files)
+	slog.Info("Admin deleted user", "adminID", self.ID, "userID", user.ID, "email", user.Email, "jobsKilled", killed, "filesRemoved", len(files))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleResetTwoFactor turns two-factor authentication off for a user who
+// lost their authenticator app and recovery codes.
+func (a *Admin) HandleResetTwoFactor(w http.ResponseWriter, r *http.Request) *herr.Error {
+	self, e := admin(r)
+	if e != nil {
+		return e
+	}
+	user, e := a.target(r)
+	if e != nil {
+		return e
+	}
+	err := a.store.DeleteTOTP(user.ID)
+	if errors.Is(err, store.ErrTOTPNotFound) {
+		return herr.NotFound(err, "Two-factor authentication is not enabled")
+	} else if err != nil {
+		return herr.Internal(err, "Error resetting two-factor authentication")
+	}
+	slog.Info("Admin reset two-factor authentication", "adminID", self.ID, "userID", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a *Admin) HandleJobs(w http.ResponseWriter, r *http.Request) *herr.Error {
+	return writeJSON(w, a.jobs.Jobs())
+}
+
+// HandleKillJob stops a running job, nothing of it is saved.
+func (a *Admin) HandleKillJob(w http.ResponseWriter, r *http.Request) *herr.Error {
+	self, e := admin(r)
+	if e != nil {
+		return e
+	}
+	id := r.PathValue("id")
+	if !a.jobs.Kill(id) {
+		return herr.NotFound(errors.New("job not running"), "Job not found")
+	}
+	slog.Info("Admin killed job", "adminID", self.ID, "jobID", id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
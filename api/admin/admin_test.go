@@ -0,0 +1,231 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"screw/ws"
+	"strconv"
+	"testing"
+)
+
+type fakeJobs struct {
+	jobs        []ws.RunningJob
+	killed      []string
+	killedUsers []int64
+}
+
+func (f *fakeJobs) Jobs() []ws.RunningJob {
+	return f.jobs
+}
+
+func (f *fakeJobs) Kill(id string) bool {
+	for _, job := range f.jobs {
+		if job.ID == id {
+			f.killed = append(f.killed, id)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeJobs) KillUser(userID int64) int {
+	f.killedUsers = append(f.killedUsers, userID)
+	return 0
+}
+
+func setup(t *testing.T) (*http.ServeMux, store.Store, *fakeJobs, *store.User) {
+	t.Helper()
+	s, err := store.New("./test.db")
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Remove("./test.db"); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Failed to remove test database: %v", err)
+		}
+	})
+	adminID, err := s.CreateUser(&store.User{GoogleID: "admin", Email: "admin@example.com", Name: "On Call", Role: store.RoleAdmin})
+	if err != nil {
+		t.Fatalf("failed to create admin: %v", err)
+	}
+	self, _ := s.UserByID(adminID)
+
+	jobs := &fakeJobs{jobs: []ws.RunningJob{{ID: "job", Kind: "file", FileName: "song.wav"}}}
+	a := New(s, jobs)
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/admin/users", herr.W(a.HandleUsers))
+	mux.Handle("GET /api/admin/users/{id}", herr.W(a.HandleUser))
+	mux.Handle("DELETE /api/admin/users/{id}", herr.W(a.HandleDeleteUser))
+	mux.Handle("POST /api/admin/users/{id}/disable", herr.W(a.HandleDisableUser))
+	mux.Handle("POST /api/admin/users/{id}/enable", herr.W(a.HandleEnableUser))
+	mux.Handle("GET /api/admin/users/{id}/sessions", herr.W(a.HandleUserSessions))
+	mux.Handle("DELETE /api/admin/users/{id}/sessions", herr.W(a.HandleRevokeSessions))
+	mux.Handle("DELETE /api/admin/users/{id}/sessions/{session}", herr.W(a.HandleRevokeSession))
+	mux.Handle("DELETE /api/admin/users/{id}/2fa", herr.W(a.HandleResetTwoFactor))
+	mux.Handle("GET /api/admin/jobs", herr.W(a.HandleJobs))
+	mux.Handle("DELETE /api/admin/jobs/{id}", herr.W(a.HandleKillJob))
+	return mux, s, jobs, self
+}
+
+func serve(mux *http.ServeMux, self *store.User, method, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	ctx := context.WithValue(r.Context(), session.SessionContextKey, &session.SessionValidationResult{User: self})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r.WithContext(ctx))
+	return w
+}
+
+func TestUsers(t *testing.T) {
+	mux, s, _, self := setup(t)
+	userID, err := s.CreateUserWithIdentity(&store.User{GoogleID: "1", Email: "producer@example.com", Name: "Producer"}, &store.Identity{Provider: "google", Subject: "1"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	user := "/api/admin/users/" + strconv.FormatInt(userID, 10)
+
+	w := serve(mux, self, http.MethodGet, "/api/admin/users?q=produc")
+	var users []*store.User
+	if err := json.NewDecoder(w.Body).Decode(&users); err != nil || len(users) != 1 || users[0].ID != userID {
+		t.Errorf("expected to find the producer, got %+v, %v", users, err)
+	}
+	if w := serve(mux, self, http.MethodGet, "/api/admin/users?limit=1000"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a huge limit, got %d", w.Code)
+	}
+
+	w = serve(mux, self, http.MethodGet, user)
+	var detail struct {
+		Email      string            `json:"email"`
+		Identities []*store.Identity `json:"identities"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&detail); err != nil || detail.Email != "producer@example.com" || len(detail.Identities) != 1 {
+		t.Errorf("expected the user with their identity, got %+v, %v", detail, err)
+	}
+	if w := serve(mux, self, http.MethodGet, "/api/admin/users/99"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", w.Code)
+	}
+	if w := serve(mux, self, http.MethodGet, "/api/admin/users/me"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad id, got %d", w.Code)
+	}
+}
+
+func TestSessionsAndAccounts(t *testing.T) {
+	mux, s, jobs, self := setup(t)
+	userID, err := s.CreateUser(&store.User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	sm := session.NewManager(s, 30, 15)
+	sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	user := "/api/admin/users/" + strconv.FormatInt(userID, 10)
+
+	w := serve(mux, self, http.MethodGet, user+"/sessions")
+	var sessions []*store.Session
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil || len(sessions) != 2 {
+		t.Fatalf("expected two sessions, got %+v, %v", sessions, err)
+	}
+	if w := serve(mux, self, http.MethodDelete, user+"/sessions/"+sessions[0].ID); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 revoking a session, got %d", w.Code)
+	}
+	if w := serve(mux, self, http.MethodDelete, user+"/sessions/"+sessions[0].ID); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 revoking it again, got %d", w.Code)
+	}
+	if w := serve(mux, self, http.MethodDelete, user+"/sessions"); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 revoking all sessions, got %d", w.Code)
+	}
+	if sessions, _ := s.SessionsByUserID(userID); len(sessions) != 0 {
+		t.Errorf("expected no sessions left, got %d", len(sessions))
+	}
+
+	token, _ := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	if w := serve(mux, self, http.MethodPost, user+"/disable"); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 disabling, got %d", w.Code)
+	}
+	if result, err := sm.ValidateSessionToken(token); result != nil {
+		t.Errorf("expected the session of a disabled user to be gone, got %+v, %v", result, err)
+	}
+	if len(jobs.killedUsers) != 1 || jobs.killedUsers[0] != userID {
+		t.Errorf("expected the jobs of the disabled user to be stopped, got %v", jobs.killedUsers)
+	}
+	if w := serve(mux, self, http.MethodPost, user+"/enable"); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 enabling, got %d", w.Code)
+	}
+	if user, _ := s.UserByID(userID); user.Disabled {
+		t.Error("expected the user to be enabled")
+	}
+
+	if w := serve(mux, self, http.MethodDelete, user+"/2fa"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 resetting two-factor that is off, got %d", w.Code)
+	}
+	s.CreateTOTP(&store.TOTP{UserID: userID, Secret: "secret"})
+	s.ConfirmTOTP(userID, 1, []string{"code"})
+	if w := serve(mux, self, http.MethodDelete, user+"/2fa"); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 resetting two-factor, got %d", w.Code)
+	}
+	if _, err := s.TOTPByUserID(userID); !errors.Is(err, store.ErrTOTPNotFound) {
+		t.Errorf("expected two-factor to be off, got %v", err)
+	}
+
+	me := "/api/admin/users/" + strconv.FormatInt(self.ID, 10)
+	if w := serve(mux, self, http.MethodPost, me+"/disable"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 disabling yourself, got %d", w.Code)
+	}
+	if w := serve(mux, self, http.MethodDelete, me); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 deleting yourself, got %d", w.Code)
+	}
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "job.png"), filepath.Join(dir, "track.wav"), filepath.Join(dir, "track.png"), filepath.Join(dir, "track.hls", "opus", "index.m3u8")}
+	os.MkdirAll(filepath.Join(dir, "track.hls", "opus"), 0o755)
+	for _, file := range files {
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatalf("error writing %s: %v", file, err)
+		}
+	}
+	err = s.CreateJob(&store.Job{ID: "job-1", UserID: userID, Spectrogram: files[0]}, []*store.Track{
+		{ID: "track-1", Path: files[1], Spectrogram: files[2]},
+	})
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	if w := serve(mux, self, http.MethodDelete, user); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 deleting, got %d", w.Code)
+	}
+	if _, err := s.JobByID("job-1"); !errors.Is(err, store.ErrJobNotFound) {
+		t.Errorf("expected the jobs of the deleted user to be gone, got %v", err)
+	}
+	for _, file := range append(files, filepath.Join(dir, "track.hls")) {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", file, err)
+		}
+	}
+	if len(jobs.killedUsers) != 2 || jobs.killedUsers[1] != userID {
+		t.Errorf("expected the jobs of the deleted user to be stopped, got %v", jobs.killedUsers)
+	}
+	if w := serve(mux, self, http.MethodDelete, user); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting again, got %d", w.Code)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	mux, _, jobs, self := setup(t)
+
+	w := serve(mux, self, http.MethodGet, "/api/admin/jobs")
+	var running []ws.RunningJob
+	if err := json.NewDecoder(w.Body).Decode(&running); err != nil || len(running) != 1 || running[0].FileName != "song.wav" {
+		t.Errorf("expected the running job, got %+v, %v", running, err)
+	}
+	if w := serve(mux, self, http.MethodDelete, "/api/admin/jobs/job"); w.Code != http.StatusNoContent || len(jobs.killed) != 1 {
+		t.Errorf("expected the job to be killed, got %d %v", w.Code, jobs.killed)
+	}
+	if w := serve(mux, self, http.MethodDelete, "/api/admin/jobs/other"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a job that isn't running, got %d", w.Code)
+	}
+}
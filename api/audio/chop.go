@@ -0,0 +1,50 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Chop repeats the last Length beats of every Every beats, the chopped half
+// of chopped & screwed. Short lengths with many repeats make a stutter.
+type Chop struct {
+	BPM     float64 `json:"bpm"`     // tempo of the source, required
+	Every   float64 `json:"every"`   // beats in a chop cycle
+	Length  float64 `json:"length"`  // beats repeated at the end of a cycle
+	Repeats int     `json:"repeats"` // extra plays of the chopped beats
+	Offset  float64 `json:"offset"`  // seconds to the first downbeat
+}
+
+func (c Chop) withDefaults() Chop {
+	if c.Every == 0 {
+		c.Every = 8
+	}
+	if c.Length == 0 {
+		c.Length = 1
+	}
+	if c.Repeats == 0 {
+		c.Repeats = 1
+	}
+	return c
+}
+
+func (c Chop) validate() error {
+	// The tempo of the source is only detected once it went through, after
+	// the chops are cut.
+	if c.BPM == 0 {
+		return errors.New("chop bpm is required, the detected tempo comes too late to chop with")
+	}
+	if c.BPM < 40 || c.BPM > 300 {
+		return fmt.Errorf("chop bpm must be in [40, 300], got %v", c.BPM)
+	}
+	if c.Length <= 0 || c.Length >= c.Every {
+		return fmt.Errorf("chop length must be in (0, every), got %v and every %v", c.Length, c.Every)
+	}
+	if c.Repeats < 1 || c.Repeats > 16 {
+		return fmt.Errorf("chop repeats must be in [1, 16], got %d", c.Repeats)
+	}
+	if c.Offset < 0 {
+		return fmt.Errorf("chop offset must be positive, got %v", c.Offset)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"screw/dsp"
+)
+
+// Options control which part of the input gets processed and how it is
+// written. The zero value processes the whole stream.
+type Options struct {
+	Offset    float64 // seconds to skip before processing
+	Duration  float64 // seconds to process, 0 means until EOF
+	Variants  []Params
+	Format    string // name of the output format
+	Title     string // replaces the title tag, if the format has tags
+	CoverPath string // image replacing the cover art, if the format has art
+	DropCover bool
+	// Spectrograms are rendered when set. Only the ffmpeg processor
+	// renders them.
+	Spectrograms *Spectrograms
+	// Live input is processed with as little buffering as possible. It
+	// can't be combined with Offset and Duration.
+	Live *Live
+}
+
+// Bounded is whether only a window of Duration seconds is processed.
+func (o Options) Bounded() bool {
+	return o.Duration > 0
+}
+
+// Report is what a processor measured, once it stopped writing.
+type Report struct {
+	Source   dsp.Analysis
+	Variants []VariantReport
+	Warnings []string // the first lines ffmpeg logged without failing
+}
+
+type VariantReport struct {
+	Loudness float64 // integrated, LUFS, -Inf when silent
+	dsp.Analysis
+}
+
+// IRPath is the impulse response of the reverb, IR_PATH overrides it.
+func IRPath() string {
+	if envPath := os.Getenv("IR_PATH"); envPath != "" {
+		return envPath
+	}
+	return "api/audio/ir.wav"
+}
+
+// Spectrograms are the PNG files rendered once the whole input went
+// through, one for the source and one per variant.
+type Spectrograms struct {
+	Source   string
+	Variants []string
+}
+
+func (s *Spectrograms) Validate(variants int) error {
+	if s.Source == "" || len(s.Variants) != variants {
+		return fmt.Errorf("expected a source spectrogram and %d variant spectrograms, got %q and %d", variants, s.Source, len(s.Variants))
+	}
+	return nil
+}
+
+// Live is audio streamed from a microphone or a line input, processed as it
+// comes in instead of as a file.
+type Live struct {
+	Input      string `json:"input"`      // pcm (s16le), or webm or ogg holding Opus
+	SampleRate int    `json:"sampleRate"` // pcm only
+	Channels   int    `json:"channels"`   // pcm only
+}
+
+const maxLiveChannels = 2
+
+// Validate checks the input, and that the variants can run on a stream
+// without looking ahead.
+func (l *Live) Validate(opts Options, variants []Params) error {
+	if opts.Offset > 0 || opts.Bounded() {
+		return errors.New("live input can't be windowed")
+	}
+	switch l.Input {
+	case "pcm":
+		if l.SampleRate < 8000 || l.SampleRate > 192000 {
+			return fmt.Errorf("live sample rate must be within [8000, 192000], got %d", l.SampleRate)
+		}
+		if l.Channels < 1 || l.Channels > maxLiveChannels {
+			return fmt.Errorf("live channels must be within [1, %d], got %d", maxLiveChannels, l.Channels)
+		}
+	case "webm", "ogg":
+	default:
+		return fmt.Errorf("unknown live input %q", l.Input)
+	}
+	for i, p := range variants {
+		if p.Loudness != nil {
+			// loudnorm looks 3 seconds ahead.
+			return fmt.Errorf("variant %d: loudness normalization is not available live", i)
+		}
+	}
+	return nil
+}
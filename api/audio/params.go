@@ -0,0 +1,234 @@
+package audio
+
+import "fmt"
+
+const MaxVariants = 4
+
+const (
+	// ModeCoupled resamples, so slowing down also lowers the pitch like a
+	// record played at the wrong speed. Pitch is ignored.
+	ModeCoupled = "coupled"
+	// ModeIndependent changes tempo and pitch separately. Speed and Tempo
+	// only change the length, Pitch only the key.
+	ModeIndependent = "independent"
+
+	maxPitch = 12
+)
+
+// Params are the knobs of the slowed + reverb chain. Unset values fall back
+// to the preset, and the preset falls back to DefaultParams. The numbers are
+// pointers so an explicit 0 overrides the preset too: a HighPass or LowPass
+// of 0 turns that filter off and a Wet of 0 leaves the reverb out.
+type Params struct {
+	Preset   string    `json:"preset,omitempty"`
+	Speed    *float64  `json:"speed,omitempty"`
+	Tempo    *float64  `json:"tempo,omitempty"`
+	HighPass *float64  `json:"highPass,omitempty"`
+	LowPass  *float64  `json:"lowPass,omitempty"`
+	Dry      *float64  `json:"dry,omitempty"` // gain of the input to the reverb
+	Wet      *float64  `json:"wet,omitempty"` // gain of the reverb output
+	Mode     string    `json:"mode,omitempty"`
+	Pitch    *float64  `json:"pitch,omitempty"` // semitones, independent mode only
+	Loudness *Loudness `json:"loudness,omitempty"`
+	Chop     *Chop     `json:"chop,omitempty"`
+	Spatial  *Spatial  `json:"spatial,omitempty"`
+}
+
+// Loudness targets for the EBU R128 loudnorm stage. The stage runs single
+// pass since the audio is streamed.
+type Loudness struct {
+	I   float64 `json:"i"`   // integrated, LUFS
+	TP  float64 `json:"tp"`  // true peak, dBTP
+	LRA float64 `json:"lra"` // loudness range, LU
+}
+
+var DefaultLoudness = Loudness{I: -14, TP: -1, LRA: 11}
+
+const DefaultPreset = "slowed+reverb"
+
+var DefaultParams = Params{
+	Preset:   DefaultPreset,
+	Speed:    pointer(0.9),
+	Tempo:    pointer(0.97),
+	HighPass: pointer(40),
+	LowPass:  pointer(2300),
+	Dry:      pointer(10),
+	Wet:      pointer(10),
+	Mode:     ModeCoupled,
+}
+
+var Presets = map[string]Params{
+	DefaultPreset: DefaultParams,
+	"streaming":   withLoudness(DefaultParams, "streaming", DefaultLoudness),
+	"broadcast":   withLoudness(DefaultParams, "broadcast", Loudness{I: -23, TP: -1, LRA: 7}),
+	"slowed":      independent(DefaultParams, "slowed", 0.85, 0),
+	"pitched":     independent(DefaultParams, "pitched", 1, -2),
+	"8d":          withSpatial(DefaultParams, "8d", Spatial{Width: pointer(1.5), Pan: &AutoPan{}}),
+}
+
+func withSpatial(p Params, preset string, s Spatial) Params {
+	p.Preset = preset
+	p.Spatial = &s
+	return p
+}
+
+func independent(p Params, preset string, speed, pitch float64) Params {
+	p.Preset = preset
+	p.Mode = ModeIndependent
+	p.Speed = &speed
+	p.Tempo = pointer(1)
+	p.Pitch = &pitch
+	return p
+}
+
+func pointer(v float64) *float64 {
+	return &v
+}
+
+// or is v when set, otherwise a copy of def so the presets can't be changed
+// through the result.
+func or(v, def *float64) *float64 {
+	if v != nil || def == nil {
+		return v
+	}
+	return pointer(*def)
+}
+
+// Semitones is the pitch shift, none when Pitch is unset.
+func (p Params) Semitones() float64 {
+	if p.Pitch == nil {
+		return 0
+	}
+	return *p.Pitch
+}
+
+func withLoudness(p Params, preset string, l Loudness) Params {
+	p.Preset = preset
+	p.Loudness = &l
+	return p
+}
+
+func (p Params) WithDefaults() Params {
+	base := DefaultParams
+	if p.Preset == "" {
+		p.Preset = DefaultPreset
+	}
+	if preset, ok := Presets[p.Preset]; ok {
+		base = preset
+	}
+	p.Speed = or(p.Speed, base.Speed)
+	p.Tempo = or(p.Tempo, base.Tempo)
+	p.HighPass = or(p.HighPass, base.HighPass)
+	p.LowPass = or(p.LowPass, base.LowPass)
+	p.Dry = or(p.Dry, base.Dry)
+	p.Wet = or(p.Wet, base.Wet)
+	if p.Mode == "" {
+		p.Mode = base.Mode
+	}
+	if p.Mode == base.Mode {
+		p.Pitch = or(p.Pitch, base.Pitch)
+	}
+	if p.Loudness == nil {
+		p.Loudness = base.Loudness
+	}
+	if p.Loudness != nil {
+		l := *p.Loudness
+		if l.I == 0 {
+			l.I = DefaultLoudness.I
+		}
+		if l.TP == 0 {
+			l.TP = DefaultLoudness.TP
+		}
+		if l.LRA == 0 {
+			l.LRA = DefaultLoudness.LRA
+		}
+		p.Loudness = &l
+	}
+	if p.Chop != nil {
+		c := p.Chop.withDefaults()
+		p.Chop = &c
+	}
+	if p.Spatial == nil {
+		p.Spatial = base.Spatial
+	}
+	if p.Spatial != nil {
+		s := p.Spatial.withDefaults()
+		p.Spatial = &s
+	}
+	return p
+}
+
+func (p Params) Validate() error {
+	if _, ok := Presets[p.Preset]; !ok {
+		return fmt.Errorf("unknown preset %q", p.Preset)
+	}
+	if p.Speed == nil || p.Tempo == nil || p.HighPass == nil || p.LowPass == nil || p.Dry == nil || p.Wet == nil {
+		return fmt.Errorf("missing params, resolve them with WithDefaults first")
+	}
+	if speed := *p.Speed; speed <= 0 || speed > 2 {
+		return fmt.Errorf("speed must be in (0, 2], got %v", speed)
+	}
+	if tempo := *p.Tempo; tempo < 0.5 || tempo > 2 {
+		return fmt.Errorf("tempo must be in [0.5, 2], got %v", tempo)
+	}
+	highPass, lowPass := *p.HighPass, *p.LowPass
+	if highPass < 0 || lowPass < 0 || (highPass > 0 && lowPass > 0 && lowPass <= highPass) {
+		return fmt.Errorf("invalid band: highPass %v, lowPass %v", highPass, lowPass)
+	}
+	if dry, wet := *p.Dry, *p.Wet; dry < 0 || dry > 10 || wet < 0 || wet > 10 {
+		return fmt.Errorf("dry and wet must be in [0, 10], got %v and %v", dry, wet)
+	}
+	switch p.Mode {
+	case ModeCoupled:
+		if p.Semitones() != 0 {
+			return fmt.Errorf("pitch needs mode %q, got mode %q", ModeIndependent, p.Mode)
+		}
+	case ModeIndependent:
+		if pitch := p.Semitones(); pitch < -maxPitch || pitch > maxPitch {
+			return fmt.Errorf("pitch must be in [%d, %d] semitones, got %v", -maxPitch, maxPitch, pitch)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	if l := p.Loudness; l != nil {
+		if l.I < -70 || l.I > -5 {
+			return fmt.Errorf("integrated loudness must be in [-70, -5], got %v", l.I)
+		}
+		if l.TP < -9 || l.TP > 0 {
+			return fmt.Errorf("true peak must be in [-9, 0], got %v", l.TP)
+		}
+		if l.LRA < 1 || l.LRA > 50 {
+			return fmt.Errorf("loudness range must be in [1, 50], got %v", l.LRA)
+		}
+	}
+	if p.Chop != nil {
+		if err := p.Chop.validate(); err != nil {
+			return err
+		}
+	}
+	if p.Spatial != nil {
+		if err := p.Spatial.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolveVariants fills in defaults and validates every variant. No variants
+// means a single run with DefaultParams.
+func ResolveVariants(variants []Params) ([]Params, error) {
+	if len(variants) == 0 {
+		return []Params{DefaultParams}, nil
+	}
+	if len(variants) > MaxVariants {
+		return nil, fmt.Errorf("too many variants: %d, max is %d", len(variants), MaxVariants)
+	}
+	resolved := make([]Params, len(variants))
+	for i, v := range variants {
+		resolved[i] = v.WithDefaults()
+		if err := resolved[i].Validate(); err != nil {
+			return nil, fmt.Errorf("variant %d: %w", i, err)
+		}
+	}
+	return resolved, nil
+}
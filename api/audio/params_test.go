@@ -0,0 +1,90 @@
+package audio
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveVariants(t *testing.T) {
+	variants, err := ResolveVariants([]Params{{Speed: pointer(0.85)}, {Preset: "streaming"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *variants[0].Speed != 0.85 || *variants[0].Tempo != *DefaultParams.Tempo {
+		t.Errorf("expected overrides on top of defaults, got %+v", variants[0])
+	}
+	if variants[1].Loudness == nil || variants[1].Loudness.I != -14 {
+		t.Errorf("expected the streaming preset loudness, got %+v", variants[1].Loudness)
+	}
+
+	invalid := [][]Params{
+		{{Preset: "nope"}},
+		{{Speed: pointer(3)}},
+		{{Speed: pointer(0)}},
+		{{HighPass: pointer(3000), LowPass: pointer(2000)}},
+		{{HighPass: pointer(-1)}},
+		{{Wet: pointer(11)}},
+		{{Loudness: &Loudness{I: -80}}},
+		{{Chop: &Chop{}}},
+		{{Pitch: pointer(-2)}},
+		{{Mode: ModeIndependent, Pitch: pointer(13)}},
+		{{Mode: "nope"}},
+		{{Chop: &Chop{BPM: 90, Every: 2, Length: 2}}},
+		make([]Params, MaxVariants+1),
+	}
+	for _, v := range invalid {
+		if _, err := ResolveVariants(v); err == nil {
+			t.Errorf("expected error for %+v", v)
+		}
+	}
+}
+
+func TestExplicitZeroOverrides(t *testing.T) {
+	variants, err := ResolveVariants([]Params{
+		{Wet: pointer(0)},
+		{Dry: pointer(0)},
+		{HighPass: pointer(0), LowPass: pointer(0)},
+		{HighPass: pointer(3000), LowPass: pointer(0)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *variants[0].Wet != 0 || *variants[0].Dry != *DefaultParams.Dry {
+		t.Errorf("expected a wet of 0 to override the preset, got %v", *variants[0].Wet)
+	}
+	if *variants[1].Dry != 0 {
+		t.Errorf("expected a dry of 0 to override the preset, got %v", *variants[1].Dry)
+	}
+	if *variants[2].HighPass != 0 || *variants[2].LowPass != 0 {
+		t.Errorf("expected both filters to be off, got %v and %v", *variants[2].HighPass, *variants[2].LowPass)
+	}
+	if *variants[3].LowPass != 0 {
+		t.Errorf("expected the low-pass to be off, got %v", *variants[3].LowPass)
+	}
+	if *DefaultParams.Wet != 10 || *Presets[DefaultPreset].HighPass != 40 {
+		t.Errorf("expected the overrides to leave the presets alone, got %+v", DefaultParams)
+	}
+}
+
+func TestIndependentPreset(t *testing.T) {
+	variants, err := ResolveVariants([]Params{{Preset: "pitched"}, {Preset: "pitched", Mode: ModeCoupled}, {Preset: "pitched", Pitch: pointer(0)}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if variants[0].Mode != ModeIndependent || variants[0].Semitones() != -2 {
+		t.Errorf("expected the pitched preset, got %+v", variants[0])
+	}
+	if variants[1].Pitch != nil {
+		t.Errorf("expected no pitch in coupled mode, got %v", *variants[1].Pitch)
+	}
+	if variants[2].Pitch == nil || *variants[2].Pitch != 0 {
+		t.Errorf("expected a pitch of 0 to override the preset, got %+v", variants[2])
+	}
+}
+
+func TestChopNeedsBPM(t *testing.T) {
+	_, err := ResolveVariants([]Params{{Chop: &Chop{Every: 4, Length: 1}}})
+	if err == nil || !strings.Contains(err.Error(), "bpm is required") {
+		t.Errorf("expected a chop without a bpm to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// Spatial stages run on the mix after the speed change, in the order mid/side
+// EQ, widening, auto-pan. Unset stages are left out of the graph.
+type Spatial struct {
+	Width   *float64 `json:"width,omitempty"` // side level, 1 or unset leaves the mix as is, 0 is mono
+	Pan     *AutoPan `json:"pan,omitempty"`
+	MidSide *MidSide `json:"midSide,omitempty"`
+}
+
+// AutoPan moves the mix around the listener, the "8D audio" effect.
+type AutoPan struct {
+	Rate  float64 `json:"rate"`  // rotations per second
+	Depth float64 `json:"depth"` // 1 pans all the way
+}
+
+// MidSide EQ levels the center against the sides. SideHighPass keeps the low
+// end mono, which widening would otherwise smear.
+type MidSide struct {
+	Mid          float64 `json:"mid"`          // dB
+	Side         float64 `json:"side"`         // dB
+	SideHighPass float64 `json:"sideHighPass"` // Hz, 0 is off
+}
+
+const (
+	maxWidth       = 4
+	maxPanRate     = 5
+	minPanRate     = 0.01
+	maxMidSideGain = 12
+	maxSideCutoff  = 1000
+)
+
+func (s Spatial) withDefaults() Spatial {
+	if s.Width == nil {
+		s.Width = pointer(1)
+	} else {
+		s.Width = pointer(*s.Width)
+	}
+	if s.Pan != nil {
+		p := *s.Pan
+		if p.Rate == 0 {
+			p.Rate = 0.125
+		}
+		if p.Depth == 0 {
+			p.Depth = 1
+		}
+		s.Pan = &p
+	}
+	if s.MidSide != nil {
+		ms := *s.MidSide
+		s.MidSide = &ms
+	}
+	return s
+}
+
+func (s Spatial) validate() error {
+	if w := s.Width; w != nil && (*w < 0 || *w > maxWidth) {
+		return fmt.Errorf("width must be in [0, %d], got %v", maxWidth, *w)
+	}
+	if p := s.Pan; p != nil {
+		if p.Rate < minPanRate || p.Rate > maxPanRate {
+			return fmt.Errorf("pan rate must be in [%v, %d] Hz, got %v", minPanRate, maxPanRate, p.Rate)
+		}
+		if p.Depth < 0 || p.Depth > 1 {
+			return fmt.Errorf("pan depth must be in [0, 1], got %v", p.Depth)
+		}
+	}
+	if ms := s.MidSide; ms != nil {
+		if math.Abs(ms.Mid) > maxMidSideGain || math.Abs(ms.Side) > maxMidSideGain {
+			return fmt.Errorf("mid and side gains must be in [-%d, %d] dB, got %v and %v", maxMidSideGain, maxMidSideGain, ms.Mid, ms.Side)
+		}
+		if ms.SideHighPass < 0 || ms.SideHighPass > maxSideCutoff {
+			return fmt.Errorf("side highpass must be in [0, %d] Hz, got %v", maxSideCutoff, ms.SideHighPass)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package audio
+
+import "testing"
+
+func TestSpatialValidate(t *testing.T) {
+	invalid := []Spatial{
+		{Width: pointer(-1)},
+		{Width: pointer(5)},
+		{Pan: &AutoPan{Rate: 10}},
+		{Pan: &AutoPan{Depth: 2}},
+		{MidSide: &MidSide{Side: 20}},
+		{MidSide: &MidSide{SideHighPass: 5000}},
+	}
+	for _, s := range invalid {
+		if _, err := ResolveVariants([]Params{{Spatial: &s}}); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxCBORDepth bounds nesting, authenticators never go deeper than a few
+// levels.
+const maxCBORDepth = 8
+
+var errCBOR = errors.New("invalid CBOR")
+
+// decodeCBOR decodes the first item of data, and returns what follows it.
+// It covers what WebAuthn uses: definite lengths, integers, byte and text
+// strings, arrays, maps and simple values. Integers decode to int64, maps to
+// map[any]any keyed by int64 or string.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deep", errCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		for _, b := range data[:size] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("%w: indefinite or reserved length", errCBOR)
+	}
+
+	switch major {
+	case 0, 1:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		if major == 1 {
+			return -1 - int64(arg), data, nil
+		}
+		return int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: string longer than data", errCBOR)
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return data[:arg:arg], data[arg:], nil
+	case 4:
+		// Every item takes at least a byte.
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: array longer than data", errCBOR)
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			item, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, fmt.Errorf("%w: map longer than data", errCBOR)
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			key, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key %T", errCBOR, key)
+			}
+			if _, ok := m[key]; ok {
+				return nil, nil, fmt.Errorf("%w: duplicate map key %v", errCBOR, key)
+			}
+			value, rest, err := decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+			data = rest
+		}
+		return m, data, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
+
+// cborMap decodes data that holds exactly one map.
+func cborMap(data []byte) (map[any]any, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := item.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a map, got %T", errCBOR, item)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", errCBOR, len(rest))
+	}
+	return m, nil
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// Vectors from RFC 8949 appendix A.
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.hex)
+		got, rest, err := decodeCBOR(data)
+		if err != nil || len(rest) != 0 || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %#v, got %#v, %d left, %v", tt.hex, tt.want, got, len(rest), err)
+		}
+	}
+
+	rejects := []string{
+		"",                         // nothing
+		"18",                       // missing argument
+		"1bffffffffffffffff",       // above int64
+		"5f",                       // indefinite length
+		"45010203",                 // string longer than data
+		"9bffffffffffffffff",       // huge array
+		"a20102",                   // map missing an entry
+		"a201020103",               // duplicate key
+		"a1f401",                   // bool key
+		"c11a514b67b0",             // tag
+		"818181818181818181818100", // too deep
+	}
+	for _, h := range rejects {
+		data, _ := hex.DecodeString(h)
+		if _, _, err := decodeCBOR(data); !errors.Is(err, errCBOR) {
+			t.Errorf("%s: expected errCBOR, got %v", h, err)
+		}
+	}
+
+	data, _ := hex.DecodeString("a1010200")
+	if _, err := cborMap(data); !errors.Is(err, errCBOR) {
+		t.Errorf("expected trailing bytes to be rejected, got %v", err)
+	}
+}
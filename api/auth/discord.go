@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+const discordCDN = "https://cdn.discordapp.com"
+
+type Discord struct {
+	oauthClient
+	authUrl  string
+	tokenUrl string
+	apiUrl   string
+}
+
+func NewDiscord(cfg OAuthCfg) *Discord {
+	return &Discord{
+		oauthClient: newOAuthClient(cfg, []string{"identify", "email"}),
+		authUrl:     "https://discord.com/oauth2/authorize",
+		tokenUrl:    "https://discord.com/api/oauth2/token",
+		apiUrl:      "https://discord.com/api",
+	}
+}
+
+func (d *Discord) Name() string {
+	return "discord"
+}
+
+func (d *Discord) AuthURL(ctx context.Context, state, codeChallenge, nonce string) (string, error) {
+	return d.authURL(d.authUrl, state, codeChallenge, nil)
+}
+
+func (d *Discord) Profile(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error) {
+	token, err := d.exchange(ctx, d.tokenUrl, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		ID         string `json:"id"`
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Avatar     string `json:"avatar"`
+		Email      string `json:"email"`
+		Verified   bool   `json:"verified"`
+	}
+	if err := d.get(ctx, d.apiUrl+"/users/@me", token.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == "" {
+		return nil, errors.New("discord user has no id")
+	}
+
+	profile := &Profile{
+		Provider:      d.Name(),
+		Subject:       user.ID,
+		Email:         user.Email,
+		EmailVerified: user.Verified,
+		Name:          user.GlobalName,
+	}
+	if profile.Name == "" {
+		profile.Name = user.Username
+	}
+	if user.Avatar != "" {
+		profile.Picture = discordCDN + "/avatars/" + url.PathEscape(user.ID) + "/" + url.PathEscape(user.Avatar) + ".png"
+	}
+	return profile, nil
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDiscordLogin(t *testing.T) {
+	me := map[string]any{
+		"id":          "80351110224678912",
+		"username":    "producer",
+		"global_name": "Producer",
+		"avatar":      "8342729096ea3675442027381ff50dfe",
+		"email":       "producer@example.com",
+		"verified":    true,
+	}
+	m := newMockOAuth(t, true, map[string]any{"/users/@me": me})
+	d := NewDiscord(testOAuthCfg)
+	d.authUrl, d.tokenUrl, d.apiUrl = m.srv.URL+"/authorize", m.srv.URL+"/token", m.srv.URL
+	f := newTestFlow(d, setupStore(t))
+
+	login(t, f, m.authorize)
+	user, err := f.store.UserByGoogleID("discord:80351110224678912")
+	if err != nil {
+		t.Fatalf("expected the user to be created: %v", err)
+	}
+	want := discordCDN + "/avatars/80351110224678912/8342729096ea3675442027381ff50dfe.png"
+	if user.Name != "Producer" || user.Picture != want {
+		t.Errorf("expected the display name and avatar, got %+v", user)
+	}
+
+	m.mu.Lock()
+	me["verified"] = false
+	m.mu.Unlock()
+	if _, herr := runLogin(t, f, m.authorize); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unverified email to be refused, got %v", herr)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+type GitHub struct {
+	oauthClient
+	authUrl  string
+	tokenUrl string
+	apiUrl   string
+}
+
+func NewGitHub(cfg OAuthCfg) *GitHub {
+	client := newOAuthClient(cfg, []string{"read:user", "user:email"})
+	client.secretInForm = true
+	return &GitHub{
+		oauthClient: client,
+		authUrl:     "https://github.com/login/oauth/authorize",
+		tokenUrl:    "https://github.com/login/oauth/access_token",
+		apiUrl:      "https://api.github.com",
+	}
+}
+
+func (g *GitHub) Name() string {
+	return "github"
+}
+
+func (g *GitHub) AuthURL(ctx context.Context, state, codeChallenge, nonce string) (string, error) {
+	return g.authURL(g.authUrl, state, codeChallenge, nil)
+}
+
+// Profile reads the account and its primary email. The email on the account
+// is whatever the user made public, so it is not used.
+func (g *GitHub) Profile(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error) {
+	token, err := g.exchange(ctx, g.tokenUrl, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := g.get(ctx, g.apiUrl+"/user", token.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errors.New("github user has no id")
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := g.get(ctx, g.apiUrl+"/user/emails", token.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{
+		Provider: g.Name(),
+		Subject:  strconv.FormatInt(user.ID, 10),
+		Name:     user.Name,
+		Picture:  user.AvatarURL,
+	}
+	if profile.Name == "" {
+		profile.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email, profile.EmailVerified = email.Email, email.Verified
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func setupGitHub(t *testing.T, emails []map[string]any) (*Flow, *mockOAuth) {
+	t.Helper()
+	m := newMockOAuth(t, false, map[string]any{
+		"/user":        map[string]any{"id": 42, "login": "producer", "name": nil, "avatar_url": "https://avatars.example.com/42"},
+		"/user/emails": emails,
+	})
+	g := NewGitHub(testOAuthCfg)
+	g.authUrl, g.tokenUrl, g.apiUrl = m.srv.URL+"/authorize", m.srv.URL+"/token", m.srv.URL
+	return newTestFlow(g, setupStore(t)), m
+}
+
+func TestGitHubLogin(t *testing.T) {
+	f, m := setupGitHub(t, []map[string]any{
+		{"email": "public@example.com", "primary": false, "verified": true},
+		{"email": "producer@example.com", "primary": true, "verified": true},
+	})
+
+	login(t, f, m.authorize)
+	user, err := f.store.UserByGoogleID("github:42")
+	if err != nil {
+		t.Fatalf("expected the user to be created: %v", err)
+	}
+	if user.Email != "producer@example.com" || user.Name != "producer" || user.Picture != "https://avatars.example.com/42" {
+		t.Errorf("expected the primary email and the login as name, got %+v", user)
+	}
+
+	m.mu.Lock()
+	m.tokenError = "bad_verification_code"
+	m.mu.Unlock()
+	if _, herr := runLogin(t, f, m.authorize); herr == nil || herr.Code != http.StatusInternalServerError {
+		t.Errorf("expected a token error in a 200 to fail the login, got %v", herr)
+	}
+}
+
+func TestGitHubUnverifiedEmail(t *testing.T) {
+	f, m := setupGitHub(t, []map[string]any{
+		{"email": "producer@example.com", "primary": true, "verified": false},
+		{"email": "other@example.com", "primary": false, "verified": true},
+	})
+
+	if _, herr := runLogin(t, f, m.authorize); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unverified primary email to be refused, got %v", herr)
+	}
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+)
+
+// Identities lets users see and unlink the providers of their account.
+type Identities struct {
+	store store.Store
+}
+
+func NewIdentities(store store.Store) *Identities {
+	return &Identities{store: store}
+}
+
+func (i *Identities) HandleList(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	identities, err := i.store.IdentitiesByUserID(result.User.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading identities from db")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(identities); err != nil {
+		return herr.Internal(err, "Error encoding response")
+	}
+	return nil
+}
+
+func (i *Identities) HandleUnlink(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	err := i.store.DeleteIdentity(result.User.ID, r.PathValue("provider"), r.PathValue("subject"))
+	if errors.Is(err, store.ErrIdentityNotFound) {
+		return herr.NotFound(err, "Identity not found")
+	} else if errors.Is(err, store.ErrLastIdentity) {
+		return herr.Conflict(err, "Can't unlink the last identity")
+	} else if err != nil {
+		return herr.Internal(err, "Error unlinking identity")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
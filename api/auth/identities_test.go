@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"testing"
+)
+
+func TestIdentities(t *testing.T) {
+	s := setupStore(t)
+	i := NewIdentities(s)
+	user := &store.User{GoogleID: "1", Email: "producer@example.com", Name: "Producer"}
+	user.ID, _ = s.CreateUserWithIdentity(user, &store.Identity{Provider: "google", Subject: "1"})
+	s.CreateIdentity(&store.Identity{Provider: "github", Subject: "42", UserID: user.ID})
+
+	request := func(method, target string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		result := &session.SessionValidationResult{User: user}
+		return r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, result))
+	}
+	unlink := func(provider, subject string) *httptest.ResponseRecorder {
+		r := request(http.MethodDelete, "/api/identities/"+provider+"/"+subject)
+		r.SetPathValue("provider", provider)
+		r.SetPathValue("subject", subject)
+		w := httptest.NewRecorder()
+		herr.W(i.HandleUnlink).ServeHTTP(w, r)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	if herr := i.HandleList(w, request(http.MethodGet, "/api/identities")); herr != nil {
+		t.Fatalf("list failed: %v", herr.Error)
+	}
+	var identities []store.Identity
+	json.NewDecoder(w.Body).Decode(&identities)
+	if len(identities) != 2 {
+		t.Fatalf("expected two identities, got %+v", identities)
+	}
+
+	if w := unlink("github", "43"); w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown identity to be not found, got %d", w.Code)
+	}
+	if w := unlink("github", "42"); w.Code != http.StatusNoContent {
+		t.Errorf("expected the identity to be unlinked, got %d", w.Code)
+	}
+	if w := unlink("google", "1"); w.Code != http.StatusConflict {
+		t.Errorf("expected the last identity to be kept, got %d", w.Code)
+	}
+}
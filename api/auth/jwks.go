@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeysMaxAge = time.Hour
+	// An unknown kid refetches the keys, but not more often than this so a
+	// forged kid can't be used to hammer the IdP.
+	minKeysRefresh = time.Minute
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// signingKey is a key of the set with the algorithm the IdP signs with it,
+// empty when the JWK doesn't name one.
+type signingKey struct {
+	crypto.PublicKey
+	alg string
+}
+
+// keySet caches the signing keys of an IdP. Keys are refetched once the
+// cache expires, or early when a token names a key that isn't cached, which
+// is how rotations show up.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]signingKey
+	expires   time.Time
+	fetchedAt time.Time
+}
+
+func newKeySet(url string, client *http.Client) *keySet {
+	return &keySet{url: url, client: client}
+}
+
+func (ks *keySet) key(ctx context.Context, kid string) (signingKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	if now.After(ks.expires) {
+		if err := ks.fetch(ctx, now); err != nil {
+			return signingKey{}, err
+		}
+	}
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+	if now.Sub(ks.fetchedAt) < minKeysRefresh {
+		return signingKey{}, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	slog.Info("Unknown signing key, refetching JWKS", "kid", kid, "url", ks.url)
+	if err := ks.fetch(ctx, now); err != nil {
+		return signingKey{}, err
+	}
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+	return signingKey{}, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+}
+
+// lookup finds the key by kid. Tokens without a kid are only accepted when
+// the set holds a single key.
+func (ks *keySet) lookup(kid string) (signingKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func (ks *keySet) fetch(ctx context.Context, now time.Time) error {
+	ks.fetchedAt = now
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating JWKS request: %w", err)
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("error decoding JWKS: %w", err)
+	}
+	keys := make(map[string]signingKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("Skipping JWKS key", "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = signingKey{key, k.Alg}
+	}
+	ks.keys = keys
+	ks.expires = now.Add(maxAge(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(directive), "max-age=")
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.Atoi(value)
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultKeysMaxAge
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// The conversion rejects points that are not on the curve.
+		if _, err := key.ECDH(); err != nil {
+			return nil, fmt.Errorf("invalid %s point: %w", k.Crv, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
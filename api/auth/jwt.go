@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the clocks of the IdP and the server may drift apart.
+const clockSkew = time.Minute
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// IDClaims are the claims of an ID token used to log users in.
+type IDClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Picture       string   `json:"picture"`
+}
+
+// audience is either a single string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("invalid audience: %w", err)
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedClaims are what an ID token has to match.
+type expectedClaims struct {
+	issuer   string
+	clientID string
+	nonce    string
+	now      time.Time
+}
+
+func (c *IDClaims) validate(want expectedClaims) error {
+	if c.Issuer != want.issuer {
+		return fmt.Errorf("%w: issuer %q, expected %q", ErrInvalidToken, c.Issuer, want.issuer)
+	}
+	if !c.Audience.contains(want.clientID) {
+		return fmt.Errorf("%w: audience %v does not contain %q", ErrInvalidToken, c.Audience, want.clientID)
+	}
+	if len(c.Audience) > 1 && c.AuthorizedBy != "" && c.AuthorizedBy != want.clientID {
+		return fmt.Errorf("%w: authorized party %q", ErrInvalidToken, c.AuthorizedBy)
+	}
+	if c.Subject == "" {
+		return fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	if want.now.After(time.Unix(c.Expiry, 0).Add(clockSkew)) {
+		return fmt.Errorf("%w: expired at %d", ErrInvalidToken, c.Expiry)
+	}
+	if time.Unix(c.IssuedAt, 0).After(want.now.Add(clockSkew)) {
+		return fmt.Errorf("%w: issued in the future at %d", ErrInvalidToken, c.IssuedAt)
+	}
+	if c.Nonce != want.nonce {
+		return fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	return nil
+}
+
+// parseJWT splits a compact JWS and decodes its header and claims, without
+// verifying anything.
+func parseJWT(token string, claims any) (jwtHeader, []byte, []byte, error) {
+	var header jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrInvalidToken, len(parts))
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return header, nil, nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, nil, fmt.Errorf("%w: payload: %v", ErrInvalidToken, err)
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return header, nil, nil, fmt.Errorf("%w: payload: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	return header, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+// ecCurves are the curves of the ES algorithms, each only signs on its own.
+var ecCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+// verifySignature checks a JWS signature. Only asymmetric algorithms are
+// accepted, so a token can't be signed with the public key as an HMAC secret,
+// and only the algorithm the key is meant for.
+func verifySignature(alg string, key signingKey, signed, signature []byte) error {
+	if key.alg != "" && key.alg != alg {
+		return fmt.Errorf("%w: algorithm %q, the key is for %q", ErrInvalidToken, alg, key.alg)
+	}
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, signature, nil)
+		default:
+			err = fmt.Errorf("algorithm %q needs an EC key", alg)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if curve := k.Curve.Params().Name; ecCurves[alg] != curve {
+			return fmt.Errorf("%w: algorithm %q doesn't sign with %s", ErrInvalidToken, alg, curve)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("%w: invalid EC signature", ErrInvalidToken)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("%w: EC signature mismatch", ErrInvalidToken)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unsupported key type %T", ErrInvalidToken, key.PublicKey)
+}
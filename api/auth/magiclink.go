@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"screw/cryptoutil"
+	"screw/herr"
+	"screw/mail"
+	"screw/session"
+	"screw/store"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	magicLinkTTL   = 15 * time.Minute
+	maxEmailLength = 254
+)
+
+var errRateLimited = errors.New("too many login emails")
+
+// confirmPage posts the token of a link back. Mail scanners and link
+// previews follow links with a GET, so only the POST of the form uses it up.
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in to screw</title>
+</head>
+<body>
+<form method="post" action="/api/login/email/callback">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Log in to screw</button>
+</form>
+</body>
+</html>
+`))
+
+// limiter is a token bucket per key, like an email or an IP.
+type limiter struct {
+	limit rate.Limit
+	burst int
+
+	mu     sync.Mutex
+	keys   map[string]*rate.Limiter
+	pruned time.Time
+}
+
+func newLimiter(every time.Duration, burst int) *limiter {
+	return &limiter{limit: rate.Every(every), burst: burst, keys: make(map[string]*rate.Limiter)}
+}
+
+func (l *limiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// Buckets that filled up again are the same as new ones.
+	if now.Sub(l.pruned) > time.Minute {
+		for k, bucket := range l.keys {
+			if bucket.TokensAt(now) >= float64(l.burst) {
+				delete(l.keys, k)
+			}
+		}
+		l.pruned = now
+	}
+	bucket, ok := l.keys[key]
+	if !ok {
+		bucket = rate.NewLimiter(l.limit, l.burst)
+		l.keys[key] = bucket
+	}
+	return bucket.AllowN(now, 1)
+}
+
+// MagicLinks logs users in with a link sent to their email. Following the
+// link proves they own the address, so it signs up new users and logs in
+// the account with that email.
+type MagicLinks struct {
+	store      store.Store
+	sessionMgr *session.Manager
+	mailer     mail.Mailer
+	host       string
+	admins     []string
+	perEmail   *limiter
+	perIP      *limiter
+}
+
+type MagicLinksCfg struct {
+	Store       store.Store
+	SessionMgr  *session.Manager
+	Mailer      mail.Mailer
+	Host        string
+	AdminEmails []string
+}
+
+func NewMagicLinks(cfg MagicLinksCfg) *MagicLinks {
+	return &MagicLinks{
+		store:      cfg.Store,
+		sessionMgr: cfg.SessionMgr,
+		mailer:     cfg.Mailer,
+		host:       cfg.Host,
+		admins:     cfg.AdminEmails,
+		perEmail:   newLimiter(5*time.Minute, 3),
+		perIP:      newLimiter(time.Minute, 10),
+	}
+}
+
+// parseEmail takes a bare address, without a display name.
+func parseEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > maxEmailLength {
+		return "", fmt.Errorf("email longer than %d", maxEmailLength)
+	}
+	addr, err := netmail.ParseAddress(s)
+	if err != nil {
+		return "", err
+	}
+	if addr.Address != s {
+		return "", fmt.Errorf("expected a bare address, got %q", s)
+	}
+	return s, nil
+}
+
+// HandleRequest mails a login link. It answers the same whether or not the
+// email has an account.
+func (m *MagicLinks) HandleRequest(w http.ResponseWriter, r *http.Request) *herr.Error {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		return herr.BadRequest(err, "Invalid login email request")
+	}
+	email, err := parseEmail(req.Email)
+	if err != nil {
+		return herr.BadRequest(err, "Invalid email")
+	}
+	if !m.perIP.allow(m.sessionMgr.ClientIP(r)) || !m.perEmail.allow(strings.ToLower(email)) {
+		return herr.TooManyRequests(errRateLimited, "Login email rate limited")
+	}
+
+	token, err := cryptoutil.Random()
+	if err != nil {
+		return herr.Internal(err, "Error creating magic link token")
+	}
+	err = m.store.CreateMagicLink(&store.MagicLink{
+		ID:        cryptoutil.ID(token),
+		Email:     email,
+		ExpiresAt: time.Now().Add(magicLinkTTL).Unix(),
+	})
+	if err != nil {
+		return herr.Internal(err, "Error saving magic link")
+	}
+
+	link := m.host + "/api/login/email/callback?" + url.Values{"token": {token}}.Encode()
+	err = m.mailer.Send(r.Context(), mail.Message{
+		To:      email,
+		Subject: "Log in to screw",
+		Body: "Open this link to log in to screw:\n\n" + link + "\n\n" +
+			fmt.Sprintf("It works once, for %d minutes. If you didn't ask for it, ignore this email.\n", int(magicLinkTTL.Minutes())),
+	})
+	if err != nil {
+		return herr.Internal(err, "Error sending magic link")
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// HandleConfirm is the page of the link. It asks the user to log in, which
+// posts the token to HandleCallback.
+func (m *MagicLinks) HandleConfirm(w http.ResponseWriter, r *http.Request) *herr.Error {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return herr.BadRequest(errors.New("missing token"), "Missing data")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := confirmPage.Execute(w, token); err != nil {
+		return herr.Internal(err, "Error writing magic link page")
+	}
+	return nil
+}
+
+// HandleCallback uses up the link posted by the page and logs its email in.
+func (m *MagicLinks) HandleCallback(w http.ResponseWriter, r *http.Request) *herr.Error {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	token := r.PostFormValue("token")
+	if token == "" {
+		return herr.BadRequest(errors.New("missing token"), "Missing data")
+	}
+	link, err := m.store.ConsumeMagicLink(cryptoutil.ID(token))
+	if errors.Is(err, store.ErrMagicLinkInvalid) {
+		return herr.Unauthorized(err, "Invalid magic link")
+	} else if err != nil {
+		return herr.Internal(err, "Error reading magic link from db")
+	}
+
+	profile := &Profile{Provider: "email", Subject: strings.ToLower(link.Email), Email: link.Email, EmailVerified: true}
+	user, err := userOf(m.store, profile, true, m.admins)
+	if err != nil {
+		return herr.Internal(err, "Failed to get user")
+	}
+	if user.Disabled {
+		return herr.Forbidden(session.ErrUserDisabled, "Login of disabled user")
+	}
+	pending, err := m.sessionMgr.Login(w, r, user.ID)
+	if err != nil {
+		return herr.Internal(err, "Failed to create session")
+	}
+	slog.Info("Logged in with magic link", "userID", user.ID)
+	http.Redirect(w, r, afterLogin(m.host, pending), http.StatusSeeOther)
+	return nil
+}
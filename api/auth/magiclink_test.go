@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"screw/mail"
+	"screw/session"
+	"screw/store"
+	"strings"
+	"testing"
+)
+
+var linkPattern = regexp.MustCompile(`http://localhost/api/login/email/callback\?\S+`)
+
+type magicLinkTest struct {
+	t      *testing.T
+	store  store.Store
+	m      *MagicLinks
+	outbox *bytes.Buffer
+}
+
+func setupMagicLinks(t *testing.T) *magicLinkTest {
+	s := setupStore(t)
+	outbox := &bytes.Buffer{}
+	return &magicLinkTest{t: t, store: s, outbox: outbox, m: NewMagicLinks(MagicLinksCfg{
+		Store:       s,
+		SessionMgr:  session.NewManager(s, 30, 15),
+		Mailer:      mail.NewFile(outbox),
+		Host:        "http://localhost",
+		AdminEmails: []string{"admin@example.com"},
+	})}
+}
+
+// request asks for a link from ip and returns the status and the link mailed.
+func (mt *magicLinkTest) request(email, ip string) (int, string) {
+	mt.t.Helper()
+	mt.outbox.Reset()
+	r := httptest.NewRequest(http.MethodPost, "/api/login/email", strings.NewReader(`{"email": "`+email+`"}`))
+	r.RemoteAddr = ip + ":51234"
+	w := httptest.NewRecorder()
+	if e := mt.m.HandleRequest(w, r); e != nil {
+		return e.Code, ""
+	}
+	return w.Code, linkPattern.FindString(mt.outbox.String())
+}
+
+// follow opens the link and posts its token, like the page of the link.
+func (mt *magicLinkTest) follow(link string) (*httptest.ResponseRecorder, int) {
+	mt.t.Helper()
+	w := httptest.NewRecorder()
+	if e := mt.m.HandleConfirm(w, httptest.NewRequest(http.MethodGet, link, nil)); e != nil {
+		return w, e.Code
+	}
+	token := url.Values{"token": {tokenOf(link)}}
+	if !strings.Contains(w.Body.String(), `value="`+token.Get("token")+`"`) {
+		mt.t.Fatalf("expected the page to post the token, got %s", w.Body)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/login/email/callback", strings.NewReader(token.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	if e := mt.m.HandleCallback(w, r); e != nil {
+		return w, e.Code
+	}
+	return w, w.Code
+}
+
+func tokenOf(link string) string {
+	u, _ := url.Parse(link)
+	return u.Query().Get("token")
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	mt := setupMagicLinks(t)
+
+	code, link := mt.request("Producer@example.com", "10.0.0.1")
+	if code != http.StatusAccepted || link == "" {
+		t.Fatalf("expected a link to be mailed, got %d %q", code, mt.outbox.String())
+	}
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		if e := mt.m.HandleConfirm(w, httptest.NewRequest(http.MethodGet, link, nil)); e != nil || w.Header().Get("Set-Cookie") != "" {
+			t.Fatalf("expected opening the link to only show a page, got %v %v", e, w.Header())
+		}
+	}
+
+	w, code := mt.follow(link)
+	if code != http.StatusSeeOther || w.Header().Get("Location") != "http://localhost/about" {
+		t.Fatalf("expected a redirect to the app, got %d %s", code, w.Header().Get("Location"))
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), session.SessionCookieName+"=") {
+		t.Error("expected a session cookie")
+	}
+	user, err := mt.store.UserByIdentity("email", "producer@example.com")
+	if err != nil || user.Email != "Producer@example.com" || user.Role != store.RoleUser {
+		t.Fatalf("expected a new user, got %+v, %v", user, err)
+	}
+
+	if _, code := mt.follow(link); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 following the link twice, got %d", code)
+	}
+	if _, code := mt.follow("/api/login/email/callback?token=forged"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a forged token, got %d", code)
+	}
+
+	_, link = mt.request("producer@example.com", "10.0.0.1")
+	mt.follow(link)
+	if again, err := mt.store.UserByIdentity("email", "producer@example.com"); err != nil || again.ID != user.ID {
+		t.Errorf("expected the same user, got %+v, %v", again, err)
+	}
+
+	_, link = mt.request("admin@example.com", "10.0.0.1")
+	mt.follow(link)
+	if admin, err := mt.store.UserByEmail("admin@example.com"); err != nil || admin.Role != store.RoleAdmin {
+		t.Errorf("expected an admin, got %+v, %v", admin, err)
+	}
+
+	if err := mt.store.SetUserDisabled(user.ID, true); err != nil {
+		t.Fatalf("error disabling user: %v", err)
+	}
+	_, link = mt.request("producer@example.com", "10.0.0.2")
+	if _, code := mt.follow(link); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a disabled user, got %d", code)
+	}
+}
+
+func TestMagicLinkRequestRejects(t *testing.T) {
+	mt := setupMagicLinks(t)
+
+	for _, email := range []string{"", "producer", "Producer <producer@example.com>", strings.Repeat("a", 250) + "@example.com"} {
+		if code, _ := mt.request(email, "10.0.0.1"); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %q, got %d", email, code)
+		}
+	}
+
+	for i := range 3 {
+		if code, _ := mt.request("producer@example.com", "10.0.0.1"); code != http.StatusAccepted {
+			t.Fatalf("expected request %d to be allowed, got %d", i, code)
+		}
+	}
+	if code, _ := mt.request("PRODUCER@example.com", "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for the email from another IP, got %d", code)
+	}
+
+	for i := range 7 {
+		if code, _ := mt.request(string(rune('a'+i))+"@example.com", "10.0.0.1"); code != http.StatusAccepted {
+			t.Fatalf("expected request %d to be allowed, got %d", i, code)
+		}
+	}
+	if code, _ := mt.request("other@example.com", "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for the IP with another email, got %d", code)
+	}
+	if code, _ := mt.request("other@example.com", "10.0.0.3"); code != http.StatusAccepted {
+		t.Errorf("expected another IP to be allowed, got %d", code)
+	}
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuthCfg configures the providers with fixed endpoints, like GitHub.
+type OAuthCfg struct {
+	ClientID     string
+	ClientSecret string
+	CallbackURL  string
+	HTTPClient   *http.Client
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	ExpiresIn        int    `json:"expires_in"`
+	IDToken          string `json:"id_token,omitempty"`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// oauthClient is the authorization code flow with PKCE every provider
+// shares.
+type oauthClient struct {
+	clientID     string
+	clientSecret string
+	callbackURL  string
+	scopes       []string
+	// secretInForm sends the client credentials in the token request body
+	// instead of client_secret_basic, for providers that only take that.
+	secretInForm bool
+	client       *http.Client
+}
+
+func newOAuthClient(cfg OAuthCfg, scopes []string) oauthClient {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return oauthClient{
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		callbackURL:  cfg.CallbackURL,
+		scopes:       scopes,
+		client:       client,
+	}
+}
+
+func (c *oauthClient) authURL(endpoint, state, codeChallenge string, extra url.Values) (string, error) {
+	authorizationURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("error parsing authorization URL: %w", err)
+	}
+	query := authorizationURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", c.clientID)
+	query.Set("redirect_uri", c.callbackURL)
+	query.Set("state", state)
+	query.Set("code_challenge_method", "S256")
+	query.Set("code_challenge", codeChallenge)
+	query.Set("scope", strings.Join(c.scopes, " "))
+	for key, values := range extra {
+		query[key] = values
+	}
+	authorizationURL.RawQuery = query.Encode()
+	return authorizationURL.String(), nil
+}
+
+// exchange trades the code for tokens. Public clients, without a secret,
+// only send their ID.
+func (c *oauthClient) exchange(ctx context.Context, endpoint, code, codeVerifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.callbackURL},
+		"code_verifier": {codeVerifier},
+	}
+	basic := c.clientSecret != "" && !c.secretInForm
+	if !basic {
+		form.Set("client_id", c.clientID)
+		if c.clientSecret != "" {
+			form.Set("client_secret", c.clientSecret)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		basicAuth := url.QueryEscape(c.clientID) + ":" + url.QueryEscape(c.clientSecret)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error executing token request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("error decoding token response: %w", err)
+	}
+	// GitHub reports errors with a 200.
+	if token.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("token response has no access_token")
+	}
+	return &token, nil
+}
+
+// get reads a JSON API resource with the access token.
+func (c *oauthClient) get(ctx context.Context, endpoint, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", endpoint, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding %s: %w", endpoint, err)
+	}
+	return nil
+}
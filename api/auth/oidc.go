@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC logs users in with any OpenID Connect provider, like Keycloak or
+// Authentik. Endpoints and keys come from the provider discovery document,
+// and the ID token is verified instead of trusting a userinfo response.
+type OIDC struct {
+	oauthClient
+	name   string
+	issuer string
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+type OIDCCfg struct {
+	Name         string // the provider in routes and cookies, like keycloak
+	Issuer       string // discovery is read from Issuer/.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string // empty for public clients, PKCE still applies
+	CallbackURL  string
+	Scopes       []string // defaults to openid profile email
+	HTTPClient   *http.Client
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewOIDC(cfg OIDCCfg) *OIDC {
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	return &OIDC{
+		oauthClient: newOAuthClient(OAuthCfg{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			CallbackURL:  cfg.CallbackURL,
+			HTTPClient:   cfg.HTTPClient,
+		}, scopes),
+		name:   cfg.Name,
+		issuer: strings.TrimSuffix(cfg.Issuer, "/"),
+	}
+}
+
+func (o *OIDC) Name() string {
+	return o.name
+}
+
+// discover fetches the discovery document once. Failures are not cached, the
+// next login tries again.
+func (o *OIDC) discover(ctx context.Context) (*discovery, *keySet, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, o.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating discovery request: %w", err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("error fetching discovery document: status %d", resp.StatusCode)
+	}
+
+	var d discovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, nil, fmt.Errorf("error decoding discovery document: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != o.issuer {
+		return nil, nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, o.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, nil, errors.New("discovery document is missing endpoints")
+	}
+	o.discovery = &d
+	o.keys = newKeySet(d.JWKSURI, o.client)
+	return o.discovery, o.keys, nil
+}
+
+func (o *OIDC) AuthURL(ctx context.Context, state, codeChallenge, nonce string) (string, error) {
+	d, _, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return o.authURL(d.AuthorizationEndpoint, state, codeChallenge, url.Values{"nonce": {nonce}})
+}
+
+// Profile exchanges the code for an ID token and takes the profile from its
+// verified claims.
+func (o *OIDC) Profile(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error) {
+	d, _, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := o.exchange(ctx, d.TokenEndpoint, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	claims, err := o.verify(ctx, token.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Profile{
+		Provider:      o.name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// verify checks the signature of the ID token against the provider keys and
+// its claims against this client and login attempt.
+func (o *OIDC) verify(ctx context.Context, rawIDToken, nonce string) (*IDClaims, error) {
+	d, keys, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := &IDClaims{}
+	header, signed, signature, err := parseJWT(rawIDToken, claims)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, signed, signature); err != nil {
+		return nil, err
+	}
+	err = claims.validate(expectedClaims{
+		issuer:   d.Issuer,
+		clientID: o.clientID,
+		nonce:    nonce,
+		now:      time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"screw/cryptoutil"
+	"screw/session"
+	"screw/store"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is just enough of an OpenID provider to log in against.
+type mockIdP struct {
+	t      *testing.T
+	srv    *httptest.Server
+	issuer string
+
+	mu      sync.Mutex
+	key     crypto.Signer
+	kid     string
+	logins  map[string]url.Values // code -> authorization request
+	claims  map[string]any        // added to every ID token
+	alg     string                // of the tokens, RS256 or ES256 when empty
+	keyAlg  string                // published with the key
+	fetches int                   // of the JWKS
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	idp := &mockIdP{t: t, key: key, kid: "rsa-1", logins: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.issuer,
+			"authorization_endpoint": idp.issuer + "/authorize",
+			"token_endpoint":         idp.issuer + "/token",
+			"jwks_uri":               idp.issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", idp.handleJWKS)
+	mux.HandleFunc("POST /token", idp.handleToken)
+	idp.srv = httptest.NewServer(mux)
+	idp.issuer = idp.srv.URL
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *mockIdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.fetches++
+	jwk := map[string]string{"kid": idp.kid, "use": "sig"}
+	if idp.keyAlg != "" {
+		jwk["alg"] = idp.keyAlg
+	}
+	switch pub := idp.key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = b64(pub.N.Bytes())
+		jwk["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk["kty"], jwk["crv"] = "EC", "P-256"
+		jwk["x"] = b64(pub.X.FillBytes(make([]byte, 32)))
+		jwk["y"] = b64(pub.Y.FillBytes(make([]byte, 32)))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(map[string]any{"keys": []any{jwk}})
+}
+
+// authorize is what the user agent gets back after logging in at the IdP.
+func (idp *mockIdP) authorize(query url.Values) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	code := "code-" + query.Get("state")
+	idp.logins[code] = query
+	return code
+}
+
+func (idp *mockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+	idp.mu.Lock()
+	login, ok := idp.logins[r.FormValue("code")]
+	delete(idp.logins, r.FormValue("code"))
+	idp.mu.Unlock()
+	if !ok || cryptoutil.CreateS256CodeChallenge(r.FormValue("code_verifier")) != login.Get("code_challenge") {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     idp.idToken(map[string]any{"nonce": login.Get("nonce")}),
+	})
+}
+
+// idToken signs the default claims, with overrides. A nil override removes
+// the claim.
+func (idp *mockIdP) idToken(overrides map[string]any) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            idp.issuer,
+		"sub":            "sub-1",
+		"aud":            "client",
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"email":          "producer@example.com",
+		"email_verified": true,
+		"name":           "Producer",
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return idp.sign(claims)
+}
+
+func (idp *mockIdP) sign(claims map[string]any) string {
+	alg := idp.alg
+	if alg == "" {
+		alg = "RS256"
+		if _, ok := idp.key.(*ecdsa.PrivateKey); ok {
+			alg = "ES256"
+		}
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": idp.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	hash := crypto.SHA256
+	if strings.HasSuffix(alg, "384") {
+		hash = crypto.SHA384
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch key := idp.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		idp.t.Fatalf("error signing token: %v", err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func (idp *mockIdP) rotate(key crypto.Signer, kid string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key, idp.kid = key, kid
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func setupOIDC(t *testing.T) (*Flow, *OIDC, *mockIdP, store.Store) {
+	t.Helper()
+	s := setupStore(t)
+	idp := newMockIdP(t)
+	o := NewOIDC(OIDCCfg{
+		Name:         "mock",
+		Issuer:       idp.issuer,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		CallbackURL:  "http://localhost/api/login/mock/callback",
+	})
+	return newTestFlow(o, s), o, idp, s
+}
+
+func TestOIDCLogin(t *testing.T) {
+	f, _, idp, s := setupOIDC(t)
+
+	w := login(t, f, idp.authorize)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://localhost/about" {
+		t.Errorf("expected a redirect to the app, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	var sessionCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == session.SessionCookieName {
+			sessionCookie = cookie
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+
+	user, err := s.UserByGoogleID("mock:sub-1")
+	if err != nil {
+		t.Fatalf("expected the user to be created: %v", err)
+	}
+	if user.Email != "producer@example.com" || user.Name != "Producer" {
+		t.Errorf("expected the profile from the ID token, got %+v", user)
+	}
+
+	login(t, f, idp.authorize)
+	if again, err := s.UserByGoogleID("mock:sub-1"); err != nil || again.ID != user.ID {
+		t.Errorf("expected the same user on the next login, got %+v, %v", again, err)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	f, _, idp, _ := setupOIDC(t)
+
+	idp.claims = map[string]any{"email_verified": false}
+	if _, herr := runLogin(t, f, idp.authorize); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unverified email to be refused, got %v", herr)
+	}
+
+	idp.claims = map[string]any{"email_verified": true, "aud": "other"}
+	if _, herr := runLogin(t, f, idp.authorize); herr == nil || herr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a token for another client to be refused, got %v", herr)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	_, o, idp, _ := setupOIDC(t)
+	ctx := context.Background()
+
+	if _, err := o.verify(ctx, idp.idToken(map[string]any{"nonce": "n"}), "n"); err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+
+	valid := idp.idToken(map[string]any{"nonce": "n"})
+	parts := strings.Split(valid, ".")
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"wrong issuer", idp.idToken(map[string]any{"nonce": "n", "iss": "https://evil.example.com"})},
+		{"wrong audience", idp.idToken(map[string]any{"nonce": "n", "aud": "other"})},
+		{"other authorized party", idp.idToken(map[string]any{"nonce": "n", "aud": []string{"client", "other"}, "azp": "other"})},
+		{"expired", idp.idToken(map[string]any{"nonce": "n", "exp": time.Now().Add(-time.Hour).Unix()})},
+		{"issued in the future", idp.idToken(map[string]any{"nonce": "n", "iat": time.Now().Add(time.Hour).Unix()})},
+		{"wrong nonce", idp.idToken(map[string]any{"nonce": "other"})},
+		{"no subject", idp.idToken(map[string]any{"nonce": "n", "sub": nil})},
+		{"tampered payload", parts[0] + "." + b64([]byte(`{"iss":"x"}`)) + "." + parts[2]},
+		{"alg none", b64([]byte(`{"alg":"none","kid":"rsa-1"}`)) + "." + parts[1] + "."},
+		{"alg HS256", b64([]byte(`{"alg":"HS256","kid":"rsa-1"}`)) + "." + parts[1] + "." + parts[2]},
+		{"not a JWT", "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := o.verify(ctx, tt.token, "n"); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected an invalid token, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyAlgorithm(t *testing.T) {
+	ctx := context.Background()
+
+	_, o, idp, _ := setupOIDC(t)
+	idp.keyAlg = "RS256"
+	if _, err := o.verify(ctx, idp.idToken(map[string]any{"nonce": "n"}), "n"); err != nil {
+		t.Fatalf("expected a token with the algorithm of the key, got %v", err)
+	}
+
+	_, o, idp, _ = setupOIDC(t)
+	idp.keyAlg = "PS256"
+	if _, err := o.verify(ctx, idp.idToken(map[string]any{"nonce": "n"}), "n"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected a token with another algorithm than the key to be refused, got %v", err)
+	}
+
+	// A P-256 signature over a SHA-384 digest verifies, the curve has to
+	// match the algorithm.
+	_, o, idp, _ = setupOIDC(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	idp.rotate(ecKey, "ec-1")
+	idp.alg = "ES384"
+	if _, err := o.verify(ctx, idp.idToken(map[string]any{"nonce": "n"}), "n"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ES384 with a P-256 key to be refused, got %v", err)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	_, o, idp, _ := setupOIDC(t)
+	ctx := context.Background()
+
+	if _, err := o.verify(ctx, idp.idToken(map[string]any{"nonce": "n"}), "n"); err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+	if _, err := o.verify(ctx, idp.idToken(map[string]any{"nonce": "n"}), "n"); err != nil || idp.fetches != 1 {
+		t.Fatalf("expected the keys to be cached, got %d fetches, %v", idp.fetches, err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	idp.rotate(ecKey, "ec-1")
+	rotated := idp.idToken(map[string]any{"nonce": "n"})
+
+	// Right after a fetch an unknown kid is not worth asking for.
+	if _, err := o.verify(ctx, rotated, "n"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected an unknown key, got %v", err)
+	}
+	o.keys.fetchedAt = o.keys.fetchedAt.Add(-minKeysRefresh)
+	if _, err := o.verify(ctx, rotated, "n"); err != nil {
+		t.Fatalf("expected the rotated key to be fetched, got %v", err)
+	}
+	if idp.fetches != 2 {
+		t.Errorf("expected one refetch, got %d fetches", idp.fetches)
+	}
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// SHA1 vectors from RFC 6238 appendix B, the last 6 of their 8 digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok || step != tt.unix/totpPeriod {
+			t.Errorf("%d: expected %s to be valid, got step %d, %v", tt.unix, tt.code, step, ok)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	for _, drift := range []time.Duration{-totpPeriod * time.Second, totpPeriod * time.Second} {
+		if _, ok := verifyTOTP(secret, "081804", now.Add(drift)); !ok {
+			t.Errorf("expected a code %v off to be valid", drift)
+		}
+	}
+	for _, code := range []string{"081805", "81804", "0818040", ""} {
+		if _, ok := verifyTOTP(secret, code, now); ok {
+			t.Errorf("expected %q to be invalid", code)
+		}
+	}
+	if _, ok := verifyTOTP(secret, "081804", now.Add(2*totpPeriod*time.Second)); ok {
+		t.Error("expected a code two steps old to be invalid")
+	}
+	if _, ok := verifyTOTP("not base32!", "081804", now); ok {
+		t.Error("expected a broken secret to be refused")
+	}
+
+	uri, err := url.Parse(totpURI("screw", "producer@example.com", secret))
+	if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/screw:producer@example.com" {
+		t.Fatalf("expected an otpauth URI, got %v, %v", uri, err)
+	}
+	if query := uri.Query(); query.Get("secret") != secret || query.Get("issuer") != "screw" || query.Get("digits") != "6" {
+		t.Errorf("expected the secret and parameters in the query, got %v", query)
+	}
+}
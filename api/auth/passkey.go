@@ -0,0 +1,532 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	challengeTTL   = 5 * time.Minute
+	maxPasskeyName = 100
+
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+	flagExtensions   = 0x80
+)
+
+// ErrPasskey is a WebAuthn response that doesn't hold up.
+var ErrPasskey = errors.New("invalid passkey response")
+
+// Passkeys runs the WebAuthn ceremonies. Logged in users register passkeys
+// on their account, which then log them in without a provider. Only
+// attestation "none" is accepted, we don't restrict authenticator models.
+type Passkeys struct {
+	store      store.Store
+	sessionMgr *session.Manager
+	rpID       string
+	rpName     string
+	origins    []string
+	host       string
+}
+
+type PasskeysCfg struct {
+	Store      store.Store
+	SessionMgr *session.Manager
+	RPID       string   // host name the passkeys are bound to
+	RPName     string   // shown by the authenticator
+	Origins    []string // of the pages running the ceremonies
+	Host       string   // logins are sent on to the app there
+}
+
+func NewPasskeys(cfg PasskeysCfg) *Passkeys {
+	return &Passkeys{
+		store:      cfg.Store,
+		sessionMgr: cfg.SessionMgr,
+		rpID:       cfg.RPID,
+		rpName:     cfg.RPName,
+		origins:    cfg.Origins,
+		host:       cfg.Host,
+	}
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type credentialParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// creationOptions and requestOptions are the JSON forms browsers parse with
+// PublicKeyCredential.parseCreationOptionsFromJSON and
+// parseRequestOptionsFromJSON.
+type creationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParam      `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+type requestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// credential is what PublicKeyCredential.toJSON gives, with binary fields in
+// base64url.
+type credential struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // COSE key, for registrations
+}
+
+// decodeB64 takes base64url with or without padding.
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func userHandle(userID int64) string {
+	return base64.RawURLEncoding.EncodeToString(binary.BigEndian.AppendUint64(nil, uint64(userID)))
+}
+
+func (p *Passkeys) newChallenge(userID int64, kind string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating challenge: %w", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	err := p.store.CreateChallenge(&store.Challenge{
+		Challenge: challenge,
+		UserID:    userID,
+		Kind:      kind,
+		ExpiresAt: time.Now().Add(challengeTTL).Unix(),
+	})
+	return challenge, err
+}
+
+// verifyClientData checks the ceremony ran on our pages and answers a
+// challenge we issued, which is used up by it.
+func (p *Passkeys) verifyClientData(raw []byte, ceremony, kind string) (*store.Challenge, error) {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrPasskey, err)
+	}
+	if data.Type != ceremony {
+		return nil, fmt.Errorf("%w: client data type %q", ErrPasskey, data.Type)
+	}
+	if !slices.Contains(p.origins, data.Origin) {
+		return nil, fmt.Errorf("%w: origin %q", ErrPasskey, data.Origin)
+	}
+	challenge, err := p.store.ConsumeChallenge(data.Challenge, kind)
+	if errors.Is(err, store.ErrChallengeInvalid) {
+		return nil, fmt.Errorf("%w: %v", ErrPasskey, err)
+	}
+	return challenge, err
+}
+
+func (p *Passkeys) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrPasskey)
+	}
+	auth := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(p.rpID))
+	if !bytes.Equal(auth.rpIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: relying party mismatch", ErrPasskey)
+	}
+	if auth.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrPasskey)
+	}
+
+	rest := data[37:]
+	if auth.flags&flagAttestedData != 0 {
+		// AAGUID, then the length of the credential ID.
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested data too short", ErrPasskey)
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || len(rest) < idLength {
+			return nil, fmt.Errorf("%w: invalid credential ID", ErrPasskey)
+		}
+		auth.credentialID, rest = rest[:idLength], rest[idLength:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: public key: %v", ErrPasskey, err)
+		}
+		auth.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if auth.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extensions: %v", ErrPasskey, err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrPasskey)
+	}
+	return auth, nil
+}
+
+// parseCOSEKey supports ES256, and RS256 for Windows Hello.
+func parseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	m, err := cborMap(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key: %v", ErrPasskey, err)
+	}
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+	switch m[int64(3)] {
+	case int64(coseAlgES256):
+		x, y := param(-2), param(-3)
+		if m[int64(1)] != int64(2) || m[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: invalid ES256 key", ErrPasskey)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// The conversion rejects points that are not on the curve.
+		if _, err := key.ECDH(); err != nil {
+			return nil, fmt.Errorf("%w: invalid P-256 point: %v", ErrPasskey, err)
+		}
+		return key, nil
+	case int64(coseAlgRS256):
+		n, e := param(-1), param(-2)
+		exponent := new(big.Int).SetBytes(e)
+		if m[int64(1)] != int64(3) || len(n) < 256 || !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("%w: invalid RS256 key", ErrPasskey)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported algorithm %v", ErrPasskey, m[int64(3)])
+}
+
+// verifyAssertion checks the signature over the authenticator data and the
+// hash of the client data.
+func verifyAssertion(key crypto.PublicKey, authData, clientDataJSON, signature []byte) error {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(slices.Clip(authData), clientDataHash[:]...))
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("%w: signature mismatch", ErrPasskey)
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: %v", ErrPasskey, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unsupported key type %T", ErrPasskey, key)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) *herr.Error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return herr.Internal(err, "Error encoding response")
+	}
+	return nil
+}
+
+// HandleRegisterOptions starts adding a passkey to the account of the session.
+func (p *Passkeys) HandleRegisterOptions(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	passkeys, err := p.store.PasskeysByUserID(result.User.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading passkeys from db")
+	}
+	challenge, err := p.newChallenge(result.User.ID, "register")
+	if err != nil {
+		return herr.Internal(err, "Error creating challenge")
+	}
+
+	var options creationOptions
+	options.Challenge = challenge
+	options.RP.ID, options.RP.Name = p.rpID, p.rpName
+	options.User.ID = userHandle(result.User.ID)
+	options.User.Name, options.User.DisplayName = result.User.Email, result.User.Name
+	options.PubKeyCredParams = []credentialParam{{"public-key", coseAlgES256}, {"public-key", coseAlgRS256}}
+	options.Timeout = challengeTTL.Milliseconds()
+	options.ExcludeCredentials = []credentialDescriptor{}
+	for _, passkey := range passkeys {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{"public-key", passkey.ID})
+	}
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	options.Attestation = "none"
+	return writeJSON(w, http.StatusOK, map[string]any{"publicKey": options})
+}
+
+// HandleRegister finishes the registration ceremony and stores the passkey.
+func (p *Passkeys) HandleRegister(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	var req struct {
+		credential
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		return herr.BadRequest(err, "Invalid passkey registration")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	if len(req.Name) > maxPasskeyName {
+		return herr.BadRequest(fmt.Errorf("name longer than %d", maxPasskeyName), "Invalid passkey registration")
+	}
+
+	passkey, err := p.verifyRegistration(&req.credential, result.User.ID)
+	if errors.Is(err, ErrPasskey) {
+		return herr.BadRequest(err, "Invalid passkey registration")
+	} else if err != nil {
+		return herr.Internal(err, "Error verifying passkey registration")
+	}
+	passkey.Name = req.Name
+	if err := p.store.CreatePasskey(passkey); errors.Is(err, store.ErrPasskeyTaken) {
+		return herr.Conflict(err, "Passkey is already registered")
+	} else if err != nil {
+		return herr.Internal(err, "Error saving passkey")
+	}
+	slog.Info("Passkey registered", "userID", result.User.ID)
+	return writeJSON(w, http.StatusCreated, passkey)
+}
+
+func (p *Passkeys) verifyRegistration(cred *credential, userID int64) (*store.Passkey, error) {
+	clientDataJSON, err := decodeB64(cred.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrPasskey, err)
+	}
+	attestationObject, err := decodeB64(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrPasskey, err)
+	}
+	challenge, err := p.verifyClientData(clientDataJSON, "webauthn.create", "register")
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID != userID {
+		return nil, fmt.Errorf("%w: challenge of another user", ErrPasskey)
+	}
+
+	attestation, err := cborMap(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrPasskey, err)
+	}
+	if attestation["fmt"] != "none" {
+		return nil, fmt.Errorf("%w: attestation format %v", ErrPasskey, attestation["fmt"])
+	}
+	if statement, ok := attestation["attStmt"].(map[any]any); !ok || len(statement) != 0 {
+		return nil, fmt.Errorf("%w: attestation statement", ErrPasskey)
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := p.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return nil, fmt.Errorf("%w: no credential", ErrPasskey)
+	}
+	if _, err := parseCOSEKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(authData.credentialID)
+	if cred.ID != id {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrPasskey)
+	}
+	return &store.Passkey{
+		ID:        id,
+		UserID:    userID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// HandleLoginOptions starts a login. Passkeys are discoverable, so the
+// authenticator picks the account.
+func (p *Passkeys) HandleLoginOptions(w http.ResponseWriter, r *http.Request) *herr.Error {
+	challenge, err := p.newChallenge(0, "login")
+	if err != nil {
+		return herr.Internal(err, "Error creating challenge")
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{"publicKey": requestOptions{
+		Challenge:        challenge,
+		RPID:             p.rpID,
+		Timeout:          challengeTTL.Milliseconds(),
+		AllowCredentials: []credentialDescriptor{},
+		UserVerification: "preferred",
+	}})
+}
+
+// HandleLogin finishes the authentication ceremony with a session, pending
+// for users with two-factor authentication. The login is a fetch, so the
+// client navigates to next itself.
+func (p *Passkeys) HandleLogin(w http.ResponseWriter, r *http.Request) *herr.Error {
+	var cred credential
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&cred); err != nil {
+		return herr.BadRequest(err, "Invalid passkey login")
+	}
+	user, err := p.verifyLogin(&cred)
+	if errors.Is(err, ErrPasskey) || errors.Is(err, store.ErrPasskeyNotFound) {
+		return herr.Unauthorized(err, "Invalid passkey login")
+	} else if errors.Is(err, store.ErrSignCount) {
+		slog.Warn("Passkey sign count went backwards, it may be cloned", "passkeyID", cred.ID)
+		return herr.Unauthorized(err, "Invalid passkey login")
+	} else if err != nil {
+		return herr.Internal(err, "Error verifying passkey login")
+	}
+	if user.Disabled {
+		return herr.Forbidden(session.ErrUserDisabled, "Login of disabled user")
+	}
+	// User verification is only preferred, so a passkey may be the only
+	// factor and users with two-factor authentication still enter a code.
+	pending, err := p.sessionMgr.Login(w, r, user.ID)
+	if err != nil {
+		return herr.Internal(err, "Failed to create session")
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"pending2FA": pending,
+		"next":       afterLogin(p.host, pending),
+	})
+}
+
+func (p *Passkeys) verifyLogin(cred *credential) (*store.User, error) {
+	clientDataJSON, err := decodeB64(cred.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrPasskey, err)
+	}
+	rawAuthData, err := decodeB64(cred.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: authenticator data: %v", ErrPasskey, err)
+	}
+	signature, err := decodeB64(cred.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrPasskey, err)
+	}
+	if _, err := p.verifyClientData(clientDataJSON, "webauthn.get", "login"); err != nil {
+		return nil, err
+	}
+	authData, err := p.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey, user, err := p.store.PasskeyAndUserByID(cred.ID)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Response.UserHandle != "" && strings.TrimRight(cred.Response.UserHandle, "=") != userHandle(user.ID) {
+		return nil, fmt.Errorf("%w: user handle mismatch", ErrPasskey)
+	}
+	key, err := parseCOSEKey(passkey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAssertion(key, rawAuthData, clientDataJSON, signature); err != nil {
+		return nil, err
+	}
+	if err := p.store.UsePasskey(passkey.ID, authData.signCount, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (p *Passkeys) HandleList(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	passkeys, err := p.store.PasskeysByUserID(result.User.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading passkeys from db")
+	}
+	return writeJSON(w, http.StatusOK, passkeys)
+}
+
+func (p *Passkeys) HandleDelete(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	err := p.store.DeletePasskey(result.User.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrPasskeyNotFound) {
+		return herr.NotFound(err, "Passkey not found")
+	} else if err != nil {
+		return herr.Internal(err, "Error deleting passkey")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
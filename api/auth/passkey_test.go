@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"sort"
+	"testing"
+)
+
+// encodeCBOR covers what the test authenticator sends.
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, -1-v)
+		}
+		return head(0, v)
+	case string:
+		return append(head(3, len(v)), v...)
+	case []byte:
+		return append(head(2, len(v)), v...)
+	case map[any]any:
+		var keys [][]byte
+		for k := range v {
+			keys = append(keys, encodeCBOR(k))
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		out := head(5, len(v))
+		for _, k := range keys {
+			key, _, _ := decodeCBOR(k)
+			if i, ok := key.(int64); ok {
+				key = int(i)
+			}
+			out = append(append(out, k...), encodeCBOR(v[key])...)
+		}
+		return out
+	}
+	panic("unsupported CBOR type")
+}
+
+// authenticator is a software passkey.
+type authenticator struct {
+	t         *testing.T
+	id        []byte
+	key       *ecdsa.PrivateKey
+	rpID      string
+	origin    string
+	signCount uint32
+	handle    string
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{t: t, id: id, key: key, rpID: "localhost", origin: "http://localhost"}
+}
+
+func (a *authenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+func (a *authenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags|flagUserPresent)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *authenticator) register(options map[string]any, format string) map[string]any {
+	publicKey := options["publicKey"].(map[string]any)
+	a.handle = publicKey["user"].(map[string]any)["id"].(string)
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	coseKey := encodeCBOR(map[any]any{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+	attested := append(make([]byte, 16), binary.BigEndian.AppendUint16(nil, uint16(len(a.id)))...)
+	attested = append(append(attested, a.id...), coseKey...)
+	attestation := encodeCBOR(map[any]any{
+		"fmt":      format,
+		"attStmt":  map[any]any{},
+		"authData": a.authData(flagAttestedData, attested),
+	})
+	return map[string]any{
+		"id":   base64.RawURLEncoding.EncodeToString(a.id),
+		"type": "public-key",
+		"name": "Laptop",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", publicKey["challenge"].(string))),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+func (a *authenticator) login(options map[string]any) map[string]any {
+	a.signCount++
+	challenge := options["publicKey"].(map[string]any)["challenge"].(string)
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authData(0, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("error signing: %v", err)
+	}
+	return map[string]any{
+		"id":   base64.RawURLEncoding.EncodeToString(a.id),
+		"type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        a.handle,
+		},
+	}
+}
+
+type passkeyTest struct {
+	t        *testing.T
+	store    store.Store
+	passkeys *Passkeys
+	user     *store.User
+}
+
+func setupPasskeys(t *testing.T) *passkeyTest {
+	s := setupStore(t)
+	userID, err := s.CreateUser(&store.User{GoogleID: "1", Email: "producer@example.com", Name: "Producer"})
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	user, _ := s.UserByID(userID)
+	return &passkeyTest{t: t, store: s, user: user, passkeys: NewPasskeys(PasskeysCfg{
+		Store:      s,
+		SessionMgr: session.NewManager(s, 30, 15),
+		RPID:       "localhost",
+		RPName:     "screw",
+		Origins:    []string{"http://localhost"},
+		Host:       "http://localhost",
+	})}
+}
+
+// call runs a handler, as the user when loggedIn, and decodes the response.
+func (pt *passkeyTest) call(handler herr.W, body any, loggedIn bool) (*httptest.ResponseRecorder, map[string]any, *herr.Error) {
+	pt.t.Helper()
+	payload, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	if loggedIn {
+		r = r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, &session.SessionValidationResult{User: pt.user}))
+	}
+	w := httptest.NewRecorder()
+	e := handler(w, r)
+	var response map[string]any
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response, e
+}
+
+func (pt *passkeyTest) register(a *authenticator, format string) *herr.Error {
+	_, options, e := pt.call(pt.passkeys.HandleRegisterOptions, nil, true)
+	if e != nil {
+		pt.t.Fatalf("error getting registration options: %v", e.Error)
+	}
+	_, _, e = pt.call(pt.passkeys.HandleRegister, a.register(options, format), true)
+	return e
+}
+
+func (pt *passkeyTest) login(a *authenticator) (*httptest.ResponseRecorder, *herr.Error) {
+	_, options, e := pt.call(pt.passkeys.HandleLoginOptions, nil, false)
+	if e != nil {
+		pt.t.Fatalf("error getting login options: %v", e.Error)
+	}
+	w, _, e := pt.call(pt.passkeys.HandleLogin, a.login(options), false)
+	return w, e
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	pt := setupPasskeys(t)
+	a := newAuthenticator(t)
+	if e := pt.register(a, "none"); e != nil {
+		t.Fatalf("expected the passkey to register, got %v", e.Error)
+	}
+	passkeys, _ := pt.store.PasskeysByUserID(pt.user.ID)
+	if len(passkeys) != 1 || passkeys[0].Name != "Laptop" {
+		t.Fatalf("expected the passkey to be stored, got %+v", passkeys)
+	}
+	if e := pt.register(a, "none"); e == nil || e.Code != http.StatusConflict {
+		t.Errorf("expected 409 registering the passkey again, got %v", e)
+	}
+
+	w, e := pt.login(a)
+	if e != nil || w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+		t.Fatalf("expected a login without a redirect, got %d %s %v", w.Code, w.Header().Get("Location"), e)
+	}
+	var next struct {
+		Pending2FA bool   `json:"pending2FA"`
+		Next       string `json:"next"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&next); err != nil || next.Pending2FA || next.Next != "http://localhost/about" {
+		t.Errorf("expected the app as the next step, got %+v, %v", next, err)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == session.SessionCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+	result, err := session.NewManager(pt.store, 30, 15).ValidateSessionToken(cookie.Value)
+	if err != nil || result.User.ID != pt.user.ID {
+		t.Errorf("expected a session of the user, got %+v, %v", result, err)
+	}
+	if passkeys, _ := pt.store.PasskeysByUserID(pt.user.ID); passkeys[0].SignCount != 1 || passkeys[0].LastUsedAt == 0 {
+		t.Errorf("expected the sign count to be kept, got %+v", passkeys[0])
+	}
+
+	pt.store.CreateTOTP(&store.TOTP{UserID: pt.user.ID, Secret: "secret"})
+	pt.store.ConfirmTOTP(pt.user.ID, 1, nil)
+	w, e = pt.login(a)
+	if e != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected a pending login, got %d %v", w.Code, e)
+	}
+	next.Pending2FA, next.Next = false, ""
+	if err := json.NewDecoder(w.Body).Decode(&next); err != nil || !next.Pending2FA || next.Next != "http://localhost/login/2fa" {
+		t.Errorf("expected the login to ask for a second factor, got %+v, %v", next, err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == session.SessionCookieName {
+			if _, err := session.NewManager(pt.store, 30, 15).ValidateSessionToken(c.Value); !errors.Is(err, session.ErrPending2FA) {
+				t.Errorf("expected a pending session, got %v", err)
+			}
+		}
+	}
+}
+
+func TestPasskeyRejects(t *testing.T) {
+	pt := setupPasskeys(t)
+	a := newAuthenticator(t)
+
+	if e := pt.register(a, "packed"); e == nil || e.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an attestation other than none, got %v", e)
+	}
+	a.rpID = "evil.example.com"
+	if e := pt.register(a, "none"); e == nil || e.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for another relying party, got %v", e)
+	}
+	a.rpID = "localhost"
+	if e := pt.register(a, "none"); e != nil {
+		t.Fatalf("expected the passkey to register, got %v", e.Error)
+	}
+
+	// A login answers one challenge, once.
+	_, options, _ := pt.call(pt.passkeys.HandleLoginOptions, nil, false)
+	assertion := a.login(options)
+	if _, _, e := pt.call(pt.passkeys.HandleLogin, assertion, false); e != nil {
+		t.Fatalf("expected a login, got %v", e.Error)
+	}
+	if _, _, e := pt.call(pt.passkeys.HandleLogin, assertion, false); e == nil || e.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a replay, got %v", e)
+	}
+
+	a.signCount--
+	if _, e := pt.login(a); e == nil || e.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a sign count that didn't increase, got %v", e)
+	}
+
+	a.origin = "http://evil.example.com"
+	if _, e := pt.login(a); e == nil || e.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for another origin, got %v", e)
+	}
+	a.origin = "http://localhost"
+
+	other := newAuthenticator(t)
+	other.id, other.handle = a.id, a.handle
+	if _, e := pt.login(other); e == nil || e.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a signature of another key, got %v", e)
+	}
+
+	if err := pt.store.SetUserDisabled(pt.user.ID, true); err != nil {
+		t.Fatalf("error disabling user: %v", err)
+	}
+	if _, e := pt.login(a); e == nil || e.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a disabled user, got %v", e)
+	}
+}
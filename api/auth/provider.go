@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"screw/cryptoutil"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const loginCookieMaxAge = 10 * 60
+
+var loginCookies = []string{"oauth_state", "nonce", "code_verifier"}
+
+// errAccountExists is a login whose email belongs to another account while
+// the provider is not trusted to link it.
+var errAccountExists = errors.New("an account with this email exists")
+
+// Profile is who a provider says the user is.
+type Profile struct {
+	Provider      string
+	Subject       string // stable ID of the user at the provider
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// Provider is an OAuth 2 login. Flow takes care of the parts every provider
+// shares, so a provider only builds its authorization URL and turns a code
+// into a profile.
+type Provider interface {
+	// Name is used in routes and cookies, like google.
+	Name() string
+	AuthURL(ctx context.Context, state, codeChallenge, nonce string) (string, error)
+	// Profile exchanges the code. nonce is only checked by OpenID providers.
+	Profile(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error)
+}
+
+// Flow runs a login with a Provider: the state, nonce and PKCE cookies, the
+// user lookup and the session, pending for users with two-factor
+// authentication. Logged in users also link the provider to their account
+// through it.
+type Flow struct {
+	provider   Provider
+	store      store.Store
+	sessionMgr *session.Manager
+	host       string
+	trustEmail bool
+	admins     []string
+}
+
+type FlowCfg struct {
+	Store      store.Store
+	SessionMgr *session.Manager
+	Host       string
+	// TrustEmail is set for providers that make users prove they own their
+	// email. A first login with a verified email of an existing account is
+	// then linked to it, otherwise it is refused and the user has to log in
+	// and link the provider.
+	TrustEmail bool
+	// AdminEmails sign up with the admin role.
+	AdminEmails []string
+}
+
+func NewFlow(provider Provider, cfg FlowCfg) *Flow {
+	return &Flow{
+		provider:   provider,
+		store:      cfg.Store,
+		sessionMgr: cfg.SessionMgr,
+		host:       cfg.Host,
+		trustEmail: cfg.TrustEmail,
+		admins:     cfg.AdminEmails,
+	}
+}
+
+func (f *Flow) Name() string {
+	return f.provider.Name()
+}
+
+func (f *Flow) cookieName(value string) string {
+	return f.provider.Name() + "_" + value
+}
+
+func (f *Flow) setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.cookieName(name),
+		Value:    value,
+		Path:     "/api/login/" + f.provider.Name(),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (f *Flow) HandleLogin(w http.ResponseWriter, r *http.Request) *herr.Error {
+	// A link that was never finished must not turn this login into one.
+	f.setCookie(w, "link", "", -1)
+	return f.start(w, r, http.StatusFound)
+}
+
+// HandleLink starts the flow for the user of the session, to add the
+// provider to their account. It is a POST so other sites can't start it.
+func (f *Flow) HandleLink(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	f.setCookie(w, "link", strconv.FormatInt(result.User.ID, 10), loginCookieMaxAge)
+	return f.start(w, r, http.StatusSeeOther)
+}
+
+func (f *Flow) start(w http.ResponseWriter, r *http.Request, status int) *herr.Error {
+	state, err := cryptoutil.CreateState()
+	if err != nil {
+		return herr.Internal(err, "Failed to create OAuth state")
+	}
+	nonce, err := cryptoutil.CreateState()
+	if err != nil {
+		return herr.Internal(err, "Failed to create nonce")
+	}
+	codeVerifier, err := cryptoutil.CreateCodeVerifier()
+	if err != nil {
+		return herr.Internal(err, "Failed to create code verifier")
+	}
+
+	authorizationURL, err := f.provider.AuthURL(r.Context(), state, cryptoutil.CreateS256CodeChallenge(codeVerifier), nonce)
+	if err != nil {
+		return herr.Internal(err, "Failed to build authorization URL")
+	}
+
+	f.setCookie(w, "oauth_state", state, loginCookieMaxAge)
+	f.setCookie(w, "nonce", nonce, loginCookieMaxAge)
+	f.setCookie(w, "code_verifier", codeVerifier, loginCookieMaxAge)
+
+	http.Redirect(w, r, authorizationURL, status)
+	return nil
+}
+
+func (f *Flow) HandleCallBack(w http.ResponseWriter, r *http.Request) *herr.Error {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		return herr.BadRequest(errors.New(errCode), "Provider returned an error: "+query.Get("error_description"))
+	}
+	code, state := query.Get("code"), query.Get("state")
+
+	cookies := make(map[string]string)
+	for _, name := range loginCookies {
+		cookie, err := r.Cookie(f.cookieName(name))
+		if err != nil || cookie.Value == "" {
+			return herr.BadRequest(err, "Error getting "+name+" cookie")
+		}
+		cookies[name] = cookie.Value
+	}
+	if code == "" || state == "" {
+		return herr.BadRequest(errors.New("missing code or state"), "Missing data")
+	}
+	if state != cookies["oauth_state"] {
+		return herr.BadRequest(errors.New("state mismatch"), "States differ")
+	}
+	for _, name := range loginCookies {
+		f.setCookie(w, name, "", -1)
+	}
+	var linkUserID int64
+	if cookie, err := r.Cookie(f.cookieName("link")); err == nil {
+		f.setCookie(w, "link", "", -1)
+		linkUserID, _ = strconv.ParseInt(cookie.Value, 10, 64)
+	}
+
+	profile, err := f.provider.Profile(r.Context(), code, cookies["code_verifier"], cookies["nonce"])
+	if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrUnknownKey) {
+		return herr.Unauthorized(err, "Invalid ID token")
+	} else if err != nil {
+		return herr.Internal(err, "Failed to get user profile")
+	}
+	if linkUserID != 0 {
+		return f.link(w, r, linkUserID, profile)
+	}
+	if profile.Email == "" || !profile.EmailVerified {
+		return herr.BadRequest(errors.New("email not verified"), "User email not verified")
+	}
+
+	user, err := userOf(f.store, profile, f.trustEmail, f.admins)
+	if errors.Is(err, errAccountExists) {
+		return herr.Conflict(err, "Log in with a linked provider to add "+f.Name())
+	} else if err != nil {
+		return herr.Internal(err, "Failed to get user")
+	}
+	if user.Disabled {
+		return herr.Forbidden(session.ErrUserDisabled, "Login of disabled user")
+	}
+	pending, err := f.sessionMgr.Login(w, r, user.ID)
+	if err != nil {
+		return herr.Internal(err, "Failed to create session")
+	}
+	http.Redirect(w, r, afterLogin(f.host, pending), http.StatusFound)
+	return nil
+}
+
+// userOf finds the user of the profile, or creates it. An unknown identity
+// with the email of a user is added to it when the email is trusted.
+// Users with one of the admin emails sign up as admins.
+func userOf(s store.Store, profile *Profile, trustEmail bool, admins []string) (*store.User, error) {
+	user, err := s.UserByIdentity(profile.Provider, profile.Subject)
+	if !errors.Is(err, store.ErrUserNotFound) {
+		return user, err
+	}
+
+	identity := &store.Identity{Provider: profile.Provider, Subject: profile.Subject, Email: profile.Email}
+	user, err = s.UserByEmail(profile.Email)
+	if err == nil {
+		if !trustEmail {
+			return nil, errAccountExists
+		}
+		slog.Info("Linking identity by email", "provider", profile.Provider, "userID", user.ID)
+		identity.UserID = user.ID
+		if err := s.CreateIdentity(identity); err != nil {
+			return nil, err
+		}
+		return user, nil
+	} else if !errors.Is(err, store.ErrUserNotFound) {
+		return nil, err
+	}
+
+	name := profile.Name
+	if name == "" {
+		name = profile.Email
+	}
+	// The google_id column is unique, subjects of other providers are
+	// namespaced so they can't collide with a Google one.
+	key := profile.Subject
+	if profile.Provider != "google" {
+		key = profile.Provider + ":" + key
+	}
+	user = &store.User{GoogleID: key, Email: profile.Email, Name: name, Picture: profile.Picture, Role: store.RoleUser}
+	if slices.ContainsFunc(admins, func(email string) bool { return strings.EqualFold(email, profile.Email) }) {
+		slog.Info("Admin signed up", "email", profile.Email)
+		user.Role = store.RoleAdmin
+	}
+	user.ID, err = s.CreateUserWithIdentity(user, identity)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// link adds the identity to the user that started linking, as long as they
+// are still logged in.
+func (f *Flow) link(w http.ResponseWriter, r *http.Request, userID int64, profile *Profile) *herr.Error {
+	result, err := f.sessionMgr.GetCurrentSession(r)
+	if err != nil || result == nil || result.User.ID != userID {
+		return herr.Unauthorized(err, "Linking needs the session that started it")
+	}
+
+	linked, err := f.store.UserByIdentity(profile.Provider, profile.Subject)
+	if err == nil && linked.ID != userID {
+		return herr.Conflict(store.ErrIdentityTaken, "Identity is linked to another account")
+	} else if errors.Is(err, store.ErrUserNotFound) {
+		identity := &store.Identity{Provider: profile.Provider, Subject: profile.Subject, UserID: userID, Email: profile.Email}
+		if err := f.store.CreateIdentity(identity); errors.Is(err, store.ErrIdentityTaken) {
+			return herr.Conflict(err, "Identity is linked to another account")
+		} else if err != nil {
+			return herr.Internal(err, "Failed to link identity")
+		}
+	} else if err != nil {
+		return herr.Internal(err, "Error reading user from db")
+	}
+
+	http.Redirect(w, r, f.host+"/about", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,382 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"screw/cryptoutil"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"sync"
+	"testing"
+)
+
+func setupStore(t *testing.T) store.Store {
+	t.Helper()
+	s, err := store.New("./test.db")
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Remove("./test.db"); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Failed to remove test database: %v", err)
+		}
+	})
+	return s
+}
+
+func newTestFlow(p Provider, s store.Store) *Flow {
+	return NewFlow(p, FlowCfg{Store: s, SessionMgr: session.NewManager(s, 30, 15), Host: "http://localhost"})
+}
+
+// runLogin starts a login, lets authorize play the provider and returns the
+// callback response.
+func runLogin(t *testing.T, f *Flow, authorize func(url.Values) string) (*httptest.ResponseRecorder, *herr.Error) {
+	t.Helper()
+	return runFlow(t, f.HandleLogin, httptest.NewRequest(http.MethodGet, "/api/login/"+f.Name(), nil), f, authorize)
+}
+
+// runFlow is runLogin for any start of the flow. The cookies of r are sent
+// with the callback too.
+func runFlow(t *testing.T, start herr.W, r *http.Request, f *Flow, authorize func(url.Values) string) (*httptest.ResponseRecorder, *herr.Error) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if herr := start(w, r); herr != nil {
+		t.Fatalf("login failed: %v", herr.Error)
+	}
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("expected a redirect to the provider, got %q", w.Header().Get("Location"))
+	}
+	query := redirect.Query()
+	if query.Get("state") == "" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("expected a state and a PKCE challenge, got %v", query)
+	}
+
+	callback := url.Values{"code": {authorize(query)}, "state": {query.Get("state")}}
+	cr := httptest.NewRequest(http.MethodGet, "/api/login/"+f.Name()+"/callback?"+callback.Encode(), nil)
+	for _, cookie := range r.Cookies() {
+		cr.AddCookie(cookie)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			continue
+		}
+		if cookie.Path != "/api/login/"+f.Name() || !cookie.HttpOnly || cookie.MaxAge != loginCookieMaxAge {
+			t.Fatalf("expected a short lived cookie scoped to the login, got %+v", cookie)
+		}
+		cr.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	return w, f.HandleCallBack(w, cr)
+}
+
+func login(t *testing.T, f *Flow, authorize func(url.Values) string) *httptest.ResponseRecorder {
+	t.Helper()
+	w, herr := runLogin(t, f, authorize)
+	if herr != nil {
+		t.Fatalf("callback failed: %s: %v", herr.Desc, herr.Error)
+	}
+	return w
+}
+
+// fakeProvider hands out a fixed profile for the code it issued.
+type fakeProvider struct {
+	name    string
+	profile Profile
+	err     error
+
+	mu        sync.Mutex
+	challenge string
+}
+
+func (p *fakeProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeProvider) AuthURL(ctx context.Context, state, codeChallenge, nonce string) (string, error) {
+	query := url.Values{"state": {state}, "code_challenge": {codeChallenge}, "code_challenge_method": {"S256"}}
+	return "https://idp.example.com/authorize?" + query.Encode(), nil
+}
+
+func (p *fakeProvider) authorize(query url.Values) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.challenge = query.Get("code_challenge")
+	return "code"
+}
+
+func (p *fakeProvider) Profile(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if code != "code" || cryptoutil.CreateS256CodeChallenge(codeVerifier) != p.challenge {
+		return nil, errors.New("invalid_grant")
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	profile := p.profile
+	return &profile, nil
+}
+
+func TestFlowLogin(t *testing.T) {
+	s := setupStore(t)
+	profile := Profile{Subject: "1", Email: "producer@example.com", EmailVerified: true, Name: "Producer"}
+	google := &fakeProvider{name: "google", profile: profile}
+	google.profile.Provider = "google"
+
+	w := login(t, newTestFlow(google, s), google.authorize)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://localhost/about" {
+		t.Errorf("expected a redirect to the app, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cleared := map[string]bool{}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			cleared[cookie.Name] = true
+		}
+	}
+	if len(cleared) != len(loginCookies) {
+		t.Errorf("expected the login cookies to be cleared, got %v", cleared)
+	}
+	user, err := s.UserByGoogleID("1")
+	if err != nil {
+		t.Fatalf("expected the Google ID to be stored as is: %v", err)
+	}
+
+	login(t, newTestFlow(google, s), google.authorize)
+	if again, err := s.UserByGoogleID("1"); err != nil || again.ID != user.ID {
+		t.Errorf("expected the same user on the next login, got %+v, %v", again, err)
+	}
+
+	other := &fakeProvider{name: "other", profile: profile}
+	other.profile.Provider, other.profile.Email, other.profile.Name = "other", "other@example.com", ""
+	login(t, newTestFlow(other, s), other.authorize)
+	namespaced, err := s.UserByGoogleID("other:1")
+	if err != nil {
+		t.Fatalf("expected subjects of other providers to be namespaced: %v", err)
+	}
+	if namespaced.ID == user.ID || namespaced.Name != "other@example.com" {
+		t.Errorf("expected a new user named after the email, got %+v", namespaced)
+	}
+}
+
+func TestFlowAdminSignup(t *testing.T) {
+	s := setupStore(t)
+	p := &fakeProvider{name: "google", profile: Profile{Provider: "google", Subject: "1", Email: "Admin@Example.com", EmailVerified: true}}
+	f := NewFlow(p, FlowCfg{Store: s, SessionMgr: session.NewManager(s, 30, 15), Host: "http://localhost", AdminEmails: []string{"admin@example.com"}})
+
+	login(t, f, p.authorize)
+	admin, err := s.UserByGoogleID("1")
+	if err != nil || admin.Role != store.RoleAdmin {
+		t.Errorf("expected an admin, got %+v, %v", admin, err)
+	}
+
+	p.profile.Subject, p.profile.Email = "2", "producer@example.com"
+	login(t, f, p.authorize)
+	if user, err := s.UserByGoogleID("2"); err != nil || user.Role != store.RoleUser {
+		t.Errorf("expected a user, got %+v, %v", user, err)
+	}
+}
+
+func TestFlowCallbackRejects(t *testing.T) {
+	s := setupStore(t)
+	p := &fakeProvider{name: "fake", profile: Profile{Provider: "fake", Subject: "1", Email: "producer@example.com", EmailVerified: true}}
+	f := newTestFlow(p, s)
+
+	start := func() (*httptest.ResponseRecorder, url.Values) {
+		w := httptest.NewRecorder()
+		f.HandleLogin(w, httptest.NewRequest(http.MethodGet, "/api/login/fake", nil))
+		redirect, _ := url.Parse(w.Header().Get("Location"))
+		return w, url.Values{"code": {p.authorize(redirect.Query())}, "state": {redirect.Query().Get("state")}}
+	}
+	callback := func(w *httptest.ResponseRecorder, query url.Values, cookies bool) *herr.Error {
+		r := httptest.NewRequest(http.MethodGet, "/api/login/fake/callback?"+query.Encode(), nil)
+		if cookies {
+			for _, cookie := range w.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+		}
+		return f.HandleCallBack(httptest.NewRecorder(), r)
+	}
+
+	w, query := start()
+	query.Set("state", "forged")
+	if herr := callback(w, query, true); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected a forged state to be refused, got %v", herr)
+	}
+	w, query = start()
+	if herr := callback(w, query, false); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected a callback without cookies to be refused, got %v", herr)
+	}
+	w, _ = start()
+	if herr := callback(w, url.Values{"error": {"access_denied"}}, true); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected a provider error to be reported, got %v", herr)
+	}
+
+	p.profile.EmailVerified = false
+	w, query = start()
+	if herr := callback(w, query, true); herr == nil || herr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unverified email to be refused, got %v", herr)
+	}
+	p.err = ErrInvalidToken
+	w, query = start()
+	if herr := callback(w, query, true); herr == nil || herr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an invalid token to be unauthorized, got %v", herr)
+	}
+	if _, err := s.UserByGoogleID("fake:1"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("expected no user to be created, got %v", err)
+	}
+}
+
+// mockOAuth is a provider with fixed endpoints: a token endpoint checking
+// the client and PKCE, and JSON resources behind the access token.
+type mockOAuth struct {
+	srv *httptest.Server
+	// basic is whether the client authenticates with client_secret_basic,
+	// otherwise the secret is expected in the form.
+	basic bool
+
+	mu         sync.Mutex
+	challenges map[string]string // code -> code challenge
+	resources  map[string]any    // path -> JSON body
+	tokenError string            // reported with a 200, like GitHub does
+}
+
+func newMockOAuth(t *testing.T, basic bool, resources map[string]any) *mockOAuth {
+	t.Helper()
+	m := &mockOAuth{basic: basic, challenges: make(map[string]string), resources: resources}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", m.handleToken)
+	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		resource, ok := m.resources[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(resource)
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockOAuth) authorize(query url.Values) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := "code-" + query.Get("state")
+	m.challenges[code] = query.Get("code_challenge")
+	return code
+}
+
+func (m *mockOAuth) handleToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !m.basic {
+		id, secret, ok = r.PostFormValue("client_id"), r.PostFormValue("client_secret"), !ok
+	}
+	if !ok || id != "client" || secret != "secret" {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	challenge, ok := m.challenges[r.FormValue("code")]
+	delete(m.challenges, r.FormValue("code"))
+	if !ok || cryptoutil.CreateS256CodeChallenge(r.FormValue("code_verifier")) != challenge {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+	if m.tokenError != "" {
+		json.NewEncoder(w).Encode(map[string]string{"error": m.tokenError})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "bearer"})
+}
+
+var testOAuthCfg = OAuthCfg{ClientID: "client", ClientSecret: "secret", CallbackURL: "http://localhost/callback"}
+
+func TestFlowEmailMerge(t *testing.T) {
+	s := setupStore(t)
+	google := &fakeProvider{name: "google", profile: Profile{Provider: "google", Subject: "1", Email: "producer@example.com", EmailVerified: true}}
+	login(t, newTestFlow(google, s), google.authorize)
+	user, err := s.UserByIdentity("google", "1")
+	if err != nil {
+		t.Fatalf("expected the identity to be created: %v", err)
+	}
+
+	untrusted := &fakeProvider{name: "github", profile: Profile{Provider: "github", Subject: "42", Email: "Producer@example.com", EmailVerified: true}}
+	if _, herr := runLogin(t, newTestFlow(untrusted, s), untrusted.authorize); herr == nil || herr.Code != http.StatusConflict {
+		t.Errorf("expected an untrusted provider not to take over the account, got %v", herr)
+	}
+
+	trusted := &fakeProvider{name: "corp", profile: Profile{Provider: "corp", Subject: "a", Email: "Producer@example.com", EmailVerified: true}}
+	f := NewFlow(trusted, FlowCfg{Store: s, SessionMgr: session.NewManager(s, 30, 15), Host: "http://localhost", TrustEmail: true})
+	login(t, f, trusted.authorize)
+	if merged, err := s.UserByIdentity("corp", "a"); err != nil || merged.ID != user.ID {
+		t.Errorf("expected the verified email to link to the account, got %+v, %v", merged, err)
+	}
+	if identities, err := s.IdentitiesByUserID(user.ID); err != nil || len(identities) != 2 {
+		t.Errorf("expected two identities, got %v, %v", identities, err)
+	}
+}
+
+func TestFlowLink(t *testing.T) {
+	s := setupStore(t)
+	sm := session.NewManager(s, 30, 15)
+	google := &fakeProvider{name: "google", profile: Profile{Provider: "google", Subject: "1", Email: "producer@example.com", EmailVerified: true}}
+	login(t, newTestFlow(google, s), google.authorize)
+	user, _ := s.UserByIdentity("google", "1")
+
+	linkRequest := func(userID int64) *http.Request {
+		token, err := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+		if err != nil {
+			t.Fatalf("error creating session: %v", err)
+		}
+		result, err := sm.ValidateSessionToken(token)
+		if err != nil {
+			t.Fatalf("error validating session: %v", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/login/corp/link", nil)
+		r.AddCookie(&http.Cookie{Name: session.SessionCookieName, Value: token})
+		return r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, result))
+	}
+
+	// An unverified email is fine, the login at the provider is what counts.
+	corp := &fakeProvider{name: "corp", profile: Profile{Provider: "corp", Subject: "a", Email: "someone@corp.example.com"}}
+	f := newTestFlow(corp, s)
+	w, herr := runFlow(t, f.HandleLink, linkRequest(user.ID), f, corp.authorize)
+	if herr != nil {
+		t.Fatalf("link failed: %s: %v", herr.Desc, herr.Error)
+	}
+	if w.Code != http.StatusFound {
+		t.Errorf("expected a redirect to the app, got %d", w.Code)
+	}
+	if linked, err := s.UserByIdentity("corp", "a"); err != nil || linked.ID != user.ID {
+		t.Errorf("expected the identity to be linked, got %+v, %v", linked, err)
+	}
+	if _, herr := runFlow(t, f.HandleLink, linkRequest(user.ID), f, corp.authorize); herr != nil {
+		t.Errorf("expected linking twice to be fine, got %v", herr)
+	}
+
+	other := &store.User{GoogleID: "2", Email: "other@example.com", Name: "Other"}
+	other.ID, _ = s.CreateUserWithIdentity(other, &store.Identity{Provider: "google", Subject: "2"})
+	if _, herr := runFlow(t, f.HandleLink, linkRequest(other.ID), f, corp.authorize); herr == nil || herr.Code != http.StatusConflict {
+		t.Errorf("expected an identity of another account to be refused, got %v", herr)
+	}
+
+	r := linkRequest(user.ID)
+	r.Header.Del("Cookie")
+	if _, herr := runFlow(t, f.HandleLink, r, f, corp.authorize); herr == nil || herr.Code != http.StatusUnauthorized {
+		t.Errorf("expected linking without the session to be refused, got %v", herr)
+	}
+}
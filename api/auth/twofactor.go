@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"screw/cryptoutil"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 16 // base32 characters, 80 bits
+)
+
+var (
+	errInvalidCode  = errors.New("invalid two-factor code")
+	errTooManyCodes = errors.New("too many two-factor codes")
+)
+
+// TwoFactor is TOTP two-factor authentication. Users enroll an authenticator
+// app and get recovery codes for when they lose it. Logins of enrolled users
+// end in a pending session, HandleLogin turns it into a session once they
+// enter a code.
+type TwoFactor struct {
+	store      store.Store
+	sessionMgr *session.Manager
+	issuer     string
+	attempts   *limiter
+	now        func() time.Time
+}
+
+type TwoFactorCfg struct {
+	Store      store.Store
+	SessionMgr *session.Manager
+	Issuer     string // shown in authenticator apps
+}
+
+func NewTwoFactor(cfg TwoFactorCfg) *TwoFactor {
+	return &TwoFactor{
+		store:      cfg.Store,
+		sessionMgr: cfg.SessionMgr,
+		issuer:     cfg.Issuer,
+		attempts:   newLimiter(time.Minute, 5),
+		now:        time.Now,
+	}
+}
+
+// afterLogin is where a login sends the browser: the app, or the page that
+// asks for the second factor.
+func afterLogin(host string, pending bool) string {
+	if pending {
+		return host + "/login/2fa"
+	}
+	return host + "/about"
+}
+
+// newRecoveryCodes returns codes formatted for the user, and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	ids := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		random, err := cryptoutil.Random()
+		if err != nil {
+			return nil, nil, err
+		}
+		code := random[:recoveryCodeLength]
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		ids = append(ids, cryptoutil.ID(code))
+	}
+	return codes, ids, nil
+}
+
+// recoveryCodeID hashes a code the way the user may have typed it.
+func recoveryCodeID(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return cryptoutil.ID(code)
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, *herr.Error) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		return "", herr.BadRequest(err, "Invalid two-factor request")
+	}
+	if req.Code == "" {
+		return "", herr.BadRequest(errors.New("missing code"), "Missing data")
+	}
+	return strings.TrimSpace(req.Code), nil
+}
+
+// check takes a code of the authenticator app, or a recovery code, of a
+// user with two-factor authentication enabled. Codes work once.
+func (t *TwoFactor) check(totp *store.TOTP, code string) *herr.Error {
+	if !t.attempts.allow(strconv.FormatInt(totp.UserID, 10)) {
+		return herr.TooManyRequests(errTooManyCodes, "Two-factor attempts rate limited")
+	}
+	if len(code) == totpDigits {
+		step, ok := verifyTOTP(totp.Secret, code, t.now())
+		if !ok {
+			return herr.Unauthorized(errInvalidCode, "Invalid two-factor code")
+		}
+		if err := t.store.UseTOTPStep(totp.UserID, step); errors.Is(err, store.ErrTOTPStepUsed) {
+			return herr.Unauthorized(err, "Two-factor code already used")
+		} else if err != nil {
+			return herr.Internal(err, "Error saving two-factor code use")
+		}
+		return nil
+	}
+	err := t.store.UseRecoveryCode(totp.UserID, recoveryCodeID(code))
+	if errors.Is(err, store.ErrRecoveryCodeInvalid) {
+		return herr.Unauthorized(err, "Invalid recovery code")
+	} else if err != nil {
+		return herr.Internal(err, "Error using recovery code")
+	}
+	slog.Info("Recovery code used", "userID", totp.UserID)
+	return nil
+}
+
+func (t *TwoFactor) enabledTOTP(userID int64) (*store.TOTP, *herr.Error) {
+	totp, err := t.store.TOTPByUserID(userID)
+	if errors.Is(err, store.ErrTOTPNotFound) || (err == nil && totp.ConfirmedAt == 0) {
+		return nil, herr.NotFound(store.ErrTOTPNotFound, "Two-factor authentication is not enabled")
+	} else if err != nil {
+		return nil, herr.Internal(err, "Error reading two-factor from db")
+	}
+	return totp, nil
+}
+
+// HandleStatus tells whether two-factor authentication is on for the user,
+// and how many recovery codes they have left.
+func (t *TwoFactor) HandleStatus(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	totp, err := t.store.TOTPByUserID(result.User.ID)
+	if err != nil && !errors.Is(err, store.ErrTOTPNotFound) {
+		return herr.Internal(err, "Error reading two-factor from db")
+	}
+	count, err := t.store.RecoveryCodeCount(result.User.ID)
+	if err != nil {
+		return herr.Internal(err, "Error counting recovery codes")
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"enabled":        totp != nil && totp.ConfirmedAt != 0,
+		"recovery_codes": count,
+	})
+}
+
+// HandleEnroll gives the user a new secret for their authenticator app. It
+// protects logins once HandleConfirm gets a code of it.
+func (t *TwoFactor) HandleEnroll(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return herr.Internal(err, "Error creating two-factor secret")
+	}
+	err = t.store.CreateTOTP(&store.TOTP{UserID: result.User.ID, Secret: secret})
+	if errors.Is(err, store.ErrTOTPEnabled) {
+		return herr.Conflict(err, "Two-factor authentication is already enabled")
+	} else if err != nil {
+		return herr.Internal(err, "Error saving two-factor secret")
+	}
+	return writeJSON(w, http.StatusCreated, map[string]string{
+		"secret": secret,
+		"uri":    totpURI(t.issuer, result.User.Email, secret),
+	})
+}
+
+// HandleConfirm enables two-factor authentication with the first code of
+// the app. The recovery codes are only shown in its response.
+func (t *TwoFactor) HandleConfirm(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	code, e := decodeCode(w, r)
+	if e != nil {
+		return e
+	}
+	totp, err := t.store.TOTPByUserID(result.User.ID)
+	if errors.Is(err, store.ErrTOTPNotFound) {
+		return herr.NotFound(err, "No two-factor enrollment")
+	} else if err != nil {
+		return herr.Internal(err, "Error reading two-factor from db")
+	}
+	if totp.ConfirmedAt != 0 {
+		return herr.Conflict(store.ErrTOTPEnabled, "Two-factor authentication is already enabled")
+	}
+	step, ok := verifyTOTP(totp.Secret, code, t.now())
+	if !ok {
+		return herr.BadRequest(errInvalidCode, "Invalid two-factor code")
+	}
+
+	codes, ids, err := newRecoveryCodes()
+	if err != nil {
+		return herr.Internal(err, "Error creating recovery codes")
+	}
+	if err := t.store.ConfirmTOTP(result.User.ID, step, ids); errors.Is(err, store.ErrTOTPNotFound) {
+		return herr.Conflict(err, "Two-factor authentication is already enabled")
+	} else if err != nil {
+		return herr.Internal(err, "Error enabling two-factor authentication")
+	}
+	slog.Info("Two-factor authentication enabled", "userID", result.User.ID)
+	return writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// HandleDisable turns two-factor authentication off. It takes a code, so a
+// session left open somewhere is not enough.
+func (t *TwoFactor) HandleDisable(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	code, e := decodeCode(w, r)
+	if e != nil {
+		return e
+	}
+	totp, e := t.enabledTOTP(result.User.ID)
+	if e != nil {
+		return e
+	}
+	if e := t.check(totp, code); e != nil {
+		if e.Code == http.StatusUnauthorized {
+			e.Code = http.StatusForbidden
+		}
+		return e
+	}
+	if err := t.store.DeleteTOTP(result.User.ID); err != nil && !errors.Is(err, store.ErrTOTPNotFound) {
+		return herr.Internal(err, "Error disabling two-factor authentication")
+	}
+	slog.Info("Two-factor authentication disabled", "userID", result.User.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleLogin is the second step of a login: a code for the pending
+// session of the request.
+func (t *TwoFactor) HandleLogin(w http.ResponseWriter, r *http.Request) *herr.Error {
+	pending, err := t.sessionMgr.PendingSession(r)
+	if err != nil {
+		return herr.Unauthorized(err, "No login waiting for a second factor")
+	}
+	code, e := decodeCode(w, r)
+	if e != nil {
+		return e
+	}
+	totp, e := t.enabledTOTP(pending.User.ID)
+	if e != nil {
+		return e
+	}
+	if e := t.check(totp, code); e != nil {
+		return e
+	}
+	if err := t.sessionMgr.CompletePendingSession(w, r, pending); err != nil {
+		return herr.Internal(err, "Failed to create session")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
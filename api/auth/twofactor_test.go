@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"screw/herr"
+	"screw/session"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTwoFactor(t *testing.T) {
+	s := setupStore(t)
+	sm := session.NewManager(s, 30, 15)
+	tf := NewTwoFactor(TwoFactorCfg{Store: s, SessionMgr: sm, Issuer: "screw"})
+	clock := time.Unix(1700000000, 0)
+	tf.now = func() time.Time { return clock }
+
+	google := &fakeProvider{name: "google", profile: Profile{Provider: "google", Subject: "1", Email: "producer@example.com", EmailVerified: true}}
+	flow := NewFlow(google, FlowCfg{Store: s, SessionMgr: sm, Host: "http://localhost"})
+	if w := login(t, flow, google.authorize); w.Header().Get("Location") != "http://localhost/about" {
+		t.Fatalf("expected a login without two-factor to be complete, got %s", w.Header().Get("Location"))
+	}
+	user, err := s.UserByGoogleID("1")
+	if err != nil {
+		t.Fatalf("error reading user: %v", err)
+	}
+
+	call := func(handler herr.W, method, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		} else {
+			result := &session.SessionValidationResult{User: user}
+			r = r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, result))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	status := func() (enabled bool, codes int) {
+		var response struct {
+			Enabled       bool `json:"enabled"`
+			RecoveryCodes int  `json:"recovery_codes"`
+		}
+		json.NewDecoder(call(tf.HandleStatus, http.MethodGet, "", nil).Body).Decode(&response)
+		return response.Enabled, response.RecoveryCodes
+	}
+	var secret string
+	code := func() string {
+		key, _ := totpEncoding.DecodeString(secret)
+		return `{"code": "` + totpCode(key, totpStep(clock)) + `"}`
+	}
+
+	w := call(tf.HandleEnroll, http.MethodPost, "", nil)
+	var enrollment struct{ Secret, URI string }
+	json.NewDecoder(w.Body).Decode(&enrollment)
+	secret = enrollment.Secret
+	if w.Code != http.StatusCreated || secret == "" || !strings.Contains(enrollment.URI, "secret="+secret) {
+		t.Fatalf("expected a secret and its URI, got %d %+v", w.Code, enrollment)
+	}
+	if enabled, _ := status(); enabled {
+		t.Error("expected two-factor to wait for a code before it is enabled")
+	}
+	if w := call(tf.HandleConfirm, http.MethodPost, `{"code": "000000"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a wrong code to be refused, got %d", w.Code)
+	}
+	w = call(tf.HandleConfirm, http.MethodPost, code(), nil)
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.NewDecoder(w.Body).Decode(&confirmation)
+	if w.Code != http.StatusOK || len(confirmation.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected recovery codes, got %d %+v", w.Code, confirmation)
+	}
+	if enabled, codes := status(); !enabled || codes != recoveryCodeCount {
+		t.Errorf("expected two-factor to be enabled, got %v with %d codes", enabled, codes)
+	}
+	if w := call(tf.HandleEnroll, http.MethodPost, "", nil); w.Code != http.StatusConflict {
+		t.Errorf("expected a second enrollment to conflict, got %d", w.Code)
+	}
+
+	// startLogin logs in with the provider and returns the pending session.
+	startLogin := func() *http.Cookie {
+		t.Helper()
+		w := login(t, flow, google.authorize)
+		if w.Header().Get("Location") != "http://localhost/login/2fa" {
+			t.Fatalf("expected the login to ask for a second factor, got %s", w.Header().Get("Location"))
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == session.SessionCookieName {
+				return cookie
+			}
+		}
+		t.Fatal("expected a pending session cookie")
+		return nil
+	}
+
+	pending := startLogin()
+	if _, err := sm.ValidateSessionToken(pending.Value); !errors.Is(err, session.ErrPending2FA) {
+		t.Errorf("expected the pending session to grant nothing, got %v", err)
+	}
+	if sessions, _ := s.SessionsByUserID(user.ID); len(sessions) != 1 {
+		t.Errorf("expected only the first login in the device list, got %d", len(sessions))
+	}
+	if w := call(tf.HandleLogin, http.MethodPost, code(), &http.Cookie{Name: session.SessionCookieName, Value: "forged"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a login without a pending session to be refused, got %d", w.Code)
+	}
+	if w := call(tf.HandleLogin, http.MethodPost, `{"code": "000000"}`, pending); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", w.Code)
+	}
+	if w := call(tf.HandleLogin, http.MethodPost, code(), pending); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the code used to confirm to be refused, got %d", w.Code)
+	}
+	clock = clock.Add(totpPeriod * time.Second)
+	w = call(tf.HandleLogin, http.MethodPost, code(), pending)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the login to complete, got %d %s", w.Code, w.Body)
+	}
+	full := w.Result().Cookies()[0]
+	if full.Value == pending.Value {
+		t.Error("expected a new session token")
+	}
+	if result, err := sm.ValidateSessionToken(full.Value); err != nil || result.User.ID != user.ID {
+		t.Errorf("expected a full session, got %+v, %v", result, err)
+	}
+	if _, err := sm.ValidateSessionToken(pending.Value); err == nil {
+		t.Error("expected the pending session to be gone")
+	}
+
+	recovery := `{"code": "` + strings.ToUpper(strings.ReplaceAll(confirmation.RecoveryCodes[0], "-", " ")) + `"}`
+	pending = startLogin()
+	if w := call(tf.HandleLogin, http.MethodPost, recovery, pending); w.Code != http.StatusNoContent {
+		t.Errorf("expected a recovery code to log in, got %d", w.Code)
+	}
+	pending = startLogin()
+	if w := call(tf.HandleLogin, http.MethodPost, recovery, pending); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a recovery code to work once, got %d", w.Code)
+	}
+	if w := call(tf.HandleLogin, http.MethodPost, recovery, pending); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected attempts to be rate limited, got %d", w.Code)
+	}
+
+	tf.attempts = newLimiter(time.Minute, 5)
+	if w := call(tf.HandleDisable, http.MethodDelete, `{"code": "000000"}`, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected disabling with a wrong code to be refused, got %d", w.Code)
+	}
+	if w := call(tf.HandleDisable, http.MethodDelete, `{"code": "`+confirmation.RecoveryCodes[1]+`"}`, nil); w.Code != http.StatusNoContent {
+		t.Errorf("expected two-factor to be disabled, got %d", w.Code)
+	}
+	if enabled, codes := status(); enabled || codes != 0 {
+		t.Errorf("expected two-factor and the recovery codes to be gone, got %v with %d codes", enabled, codes)
+	}
+	if w := login(t, flow, google.authorize); w.Header().Get("Location") != "http://localhost/about" {
+		t.Errorf("expected logins to be complete again, got %s", w.Header().Get("Location"))
+	}
+}
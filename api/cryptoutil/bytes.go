@@ -1,6 +1,7 @@
 package cryptoutil
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
@@ -45,3 +46,14 @@ func CreateS256CodeChallenge(codeVerifier string) string {
 	hash := sha256.Sum256([]byte(codeVerifier))
 	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
+
+// Sign is an HMAC-SHA256 of message, for URLs handed out to clients.
+func Sign(key []byte, message string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func VerifySignature(key []byte, message, signature string) bool {
+	return hmac.Equal([]byte(Sign(key, message)), []byte(signature))
+}
@@ -0,0 +1,243 @@
+package dsp
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+)
+
+// AnalysisSampleRate is the rate Analyzer expects. Tempo and key only need
+// the lower part of the spectrum.
+const AnalysisSampleRate = 11025
+
+const (
+	onsetWindow = 512
+	onsetHop    = 128
+	chromaSize  = 4096
+	chromaHop   = chromaSize / 2
+	minBPM      = 60
+	maxBPM      = 200
+	minKeyFreq  = 55
+	maxKeyFreq  = 2000
+)
+
+type Analysis struct {
+	BPM float64 `json:"bpm,omitempty"` // 0 when there is no clear pulse
+	Key string  `json:"key,omitempty"` // like "A minor", empty for silence
+}
+
+// Analyzer estimates tempo and key of mono little endian float32 samples
+// written at AnalysisSampleRate. Tempo comes from the autocorrelation of a
+// spectral flux onset envelope, key from correlating a chroma vector with
+// the Krumhansl-Kessler key profiles.
+type Analyzer struct {
+	partial  []byte
+	samples  []float64 // not analyzed yet, samples[0] is sample number offset
+	offset   int
+	onsetAt  int // next onset frame start
+	chromaAt int // next chroma frame start
+
+	onsetWin  []float64
+	prevMag   []float64
+	envelope  []float64
+	chromaWin []float64
+	chroma    [12]float64
+}
+
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{
+		onsetWin:  hann(onsetWindow),
+		chromaWin: hann(chromaSize),
+	}
+}
+
+func (a *Analyzer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(a.partial) > 0 {
+		p = append(a.partial, p...)
+		a.partial = nil
+	}
+	for len(p) >= 4 {
+		a.samples = append(a.samples, float64(math.Float32frombits(binary.LittleEndian.Uint32(p))))
+		p = p[4:]
+	}
+	if len(p) > 0 {
+		a.partial = append([]byte(nil), p...)
+	}
+	a.process()
+	return n, nil
+}
+
+func (a *Analyzer) process() {
+	for a.onsetAt-a.offset+onsetWindow <= len(a.samples) {
+		start := a.onsetAt - a.offset
+		a.onsetFrame(a.samples[start : start+onsetWindow])
+		a.onsetAt += onsetHop
+	}
+	for a.chromaAt-a.offset+chromaSize <= len(a.samples) {
+		start := a.chromaAt - a.offset
+		a.chromaFrame(a.samples[start : start+chromaSize])
+		a.chromaAt += chromaHop
+	}
+
+	// Drop what neither kind of frame needs anymore.
+	if drop := min(a.onsetAt, a.chromaAt) - a.offset; drop > 0 {
+		a.samples = append(a.samples[:0], a.samples[drop:]...)
+		a.offset += drop
+	}
+}
+
+func (a *Analyzer) onsetFrame(frame []float64) {
+	mag := magnitudes(frame, a.onsetWin)
+	var flux float64
+	if a.prevMag != nil {
+		for i, m := range mag {
+			if d := math.Log1p(100*m) - math.Log1p(100*a.prevMag[i]); d > 0 {
+				flux += d
+			}
+		}
+	}
+	a.prevMag = mag
+	a.envelope = append(a.envelope, flux)
+}
+
+func (a *Analyzer) chromaFrame(frame []float64) {
+	mag := magnitudes(frame, a.chromaWin)
+	binHz := float64(AnalysisSampleRate) / chromaSize
+	for i := 1; i < len(mag); i++ {
+		f := float64(i) * binHz
+		if f < minKeyFreq || f > maxKeyFreq {
+			continue
+		}
+		// Pitch class with C as 0, A4 is 440Hz and pitch class 9.
+		pc := int(math.Round(12*math.Log2(f/440))) + 9
+		a.chroma[((pc%12)+12)%12] += mag[i] * mag[i]
+	}
+}
+
+func magnitudes(frame, window []float64) []float64 {
+	x := make([]complex128, len(frame))
+	for i, s := range frame {
+		x[i] = complex(s*window[i], 0)
+	}
+	FFT(x)
+	mag := make([]float64, len(x)/2+1)
+	for i := range mag {
+		mag[i] = cmplx.Abs(x[i])
+	}
+	return mag
+}
+
+func (a *Analyzer) Result() Analysis {
+	return Analysis{BPM: a.bpm(), Key: a.key()}
+}
+
+func (a *Analyzer) bpm() float64 {
+	env := a.envelope
+	frameRate := float64(AnalysisSampleRate) / onsetHop
+	minLag := int(math.Floor(60 * frameRate / maxBPM))
+	maxLag := int(math.Ceil(60 * frameRate / minBPM))
+	if len(env) < 2*maxLag {
+		return 0
+	}
+
+	var mean float64
+	for _, v := range env {
+		mean += v
+	}
+	mean /= float64(len(env))
+	centered := make([]float64, len(env))
+	var energy float64
+	for i, v := range env {
+		centered[i] = v - mean
+		energy += centered[i] * centered[i]
+	}
+	if energy == 0 {
+		return 0
+	}
+
+	ac := make([]float64, maxLag+2)
+	for lag := minLag - 1; lag <= maxLag+1; lag++ {
+		var sum float64
+		for i := lag; i < len(centered); i++ {
+			sum += centered[i] * centered[i-lag]
+		}
+		ac[lag] = sum / energy
+	}
+
+	// Weight lags towards 120 BPM so half and double tempos lose ties.
+	best, bestScore := 0, 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		bpm := 60 * frameRate / float64(lag)
+		weight := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120), 2))
+		if score := ac[lag] * weight; score > bestScore {
+			best, bestScore = lag, score
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+
+	// Parabolic interpolation around the peak for sub-frame precision.
+	lag := float64(best)
+	if l, c, r := ac[best-1], ac[best], ac[best+1]; l-2*c+r != 0 {
+		lag += 0.5 * (l - r) / (l - 2*c + r)
+	}
+	return math.Round(600*frameRate/lag) / 10
+}
+
+var (
+	pitchClasses = [12]string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+	keyModes     = []struct {
+		name    string
+		profile [12]float64
+	}{
+		{"major", [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}},
+		{"minor", [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}},
+	}
+)
+
+func (a *Analyzer) key() string {
+	var total float64
+	for _, c := range a.chroma {
+		total += c
+	}
+	if total == 0 {
+		return ""
+	}
+
+	bestKey, bestScore := "", math.Inf(-1)
+	for tonic := 0; tonic < 12; tonic++ {
+		for _, mode := range keyModes {
+			var rotated [12]float64
+			for i := range rotated {
+				rotated[i] = mode.profile[(i-tonic+12)%12]
+			}
+			if score := correlation(a.chroma[:], rotated[:]); score > bestScore {
+				bestKey, bestScore = pitchClasses[tonic]+" "+mode.name, score
+			}
+		}
+	}
+	return bestKey
+}
+
+func correlation(x, y []float64) float64 {
+	var mx, my float64
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= float64(len(x))
+	my /= float64(len(y))
+	var sxy, sxx, syy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+	return sxy / math.Sqrt(sxx*syy)
+}
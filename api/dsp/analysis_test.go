@@ -0,0 +1,70 @@
+package dsp
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// beat renders seconds of mono audio with a decaying click on every beat
+// over a sustained chord.
+func beat(bpm, seconds float64, chord ...float64) []byte {
+	n := int(seconds * AnalysisSampleRate)
+	period := 60 / bpm * AnalysisSampleRate
+	buf := make([]byte, 0, 4*n)
+	for i := 0; i < n; i++ {
+		t := float64(i) / AnalysisSampleRate
+		var x float64
+		for _, f := range chord {
+			x += 0.1 * math.Sin(2*math.Pi*f*t)
+		}
+		sinceBeat := math.Mod(float64(i), period) / AnalysisSampleRate
+		x += 0.5 * math.Exp(-sinceBeat*60) * math.Sin(2*math.Pi*1000*t)
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(x)))
+	}
+	return buf
+}
+
+func TestAnalyzer(t *testing.T) {
+	aMinor := []float64{220, 261.63, 329.63}
+	cMajor := []float64{261.63, 329.63, 392}
+
+	tests := []struct {
+		name  string
+		bpm   float64
+		chord []float64
+		key   string
+	}{
+		{"slow", 85, aMinor, "A minor"},
+		{"mid", 120, cMajor, "C major"},
+		{"fast", 140, aMinor, "A minor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			data := beat(tt.bpm, 20, tt.chord...)
+			for len(data) > 0 {
+				n := min(len(data), 4093) // not a multiple of the sample size
+				a.Write(data[:n])
+				data = data[n:]
+			}
+
+			got := a.Result()
+			if math.Abs(got.BPM-tt.bpm) > 1 {
+				t.Errorf("expected %v BPM, got %v", tt.bpm, got.BPM)
+			}
+			if got.Key != tt.key {
+				t.Errorf("expected key %q, got %q", tt.key, got.Key)
+			}
+		})
+	}
+}
+
+func TestAnalyzerSilence(t *testing.T) {
+	a := NewAnalyzer()
+	a.Write(make([]byte, 4*AnalysisSampleRate*10))
+	if got := a.Result(); got != (Analysis{}) {
+		t.Errorf("expected empty analysis for silence, got %+v", got)
+	}
+}
@@ -0,0 +1,49 @@
+package dsp
+
+import "math"
+
+// Biquad is a second order IIR filter in transposed direct form II, with
+// coefficients normalized so a0 is 1.
+type Biquad struct {
+	B0, B1, B2 float64
+	A1, A2     float64
+	z1, z2     float64
+}
+
+func (f *Biquad) Process(x float64) float64 {
+	y := f.B0*x + f.z1
+	f.z1 = f.B1*x - f.A1*y + f.z2
+	f.z2 = f.B2*x - f.A2*y
+	return y
+}
+
+func (f *Biquad) Reset() {
+	f.z1, f.z2 = 0, 0
+}
+
+// HighPass and LowPass are the filters from the RBJ audio EQ cookbook. A q of
+// 0.707 gives a Butterworth response, like ffmpeg's defaults.
+func HighPass(rate, freq, q float64) Biquad {
+	cos, alpha := cookbook(rate, freq, q)
+	return normalized(
+		(1+cos)/2, -(1 + cos), (1+cos)/2,
+		1+alpha, -2*cos, 1-alpha,
+	)
+}
+
+func LowPass(rate, freq, q float64) Biquad {
+	cos, alpha := cookbook(rate, freq, q)
+	return normalized(
+		(1-cos)/2, 1-cos, (1-cos)/2,
+		1+alpha, -2*cos, 1-alpha,
+	)
+}
+
+func cookbook(rate, freq, q float64) (cos, alpha float64) {
+	w := 2 * math.Pi * freq / rate
+	return math.Cos(w), math.Sin(w) / (2 * q)
+}
+
+func normalized(b0, b1, b2, a0, a1, a2 float64) Biquad {
+	return Biquad{B0: b0 / a0, B1: b1 / a0, B2: b2 / a0, A1: a1 / a0, A2: a2 / a0}
+}
@@ -0,0 +1,89 @@
+package dsp
+
+// Convolver convolves a stream with an impulse response using uniformly
+// partitioned overlap-save FFT convolution, so long reverb tails cost one
+// small FFT per block instead of one the size of the whole response.
+// Output comes out a block at a time and is as long as the input.
+type Convolver struct {
+	block   int
+	parts   [][]complex128 // spectra of the response partitions
+	history [][]complex128 // spectra of recent input frames, ring indexed by head
+	head    int
+	frame   []float64 // previous block followed by the current one
+	filled  int       // samples of the current block
+	in      int
+	out     int
+}
+
+// NewConvolver takes the impulse response and the block size, which has to
+// be a power of two.
+func NewConvolver(ir []float64, block int) *Convolver {
+	c := &Convolver{block: block, frame: make([]float64, 2*block)}
+	for start := 0; start < len(ir); start += block {
+		part := make([]complex128, 2*block)
+		for i, s := range ir[start:min(start+block, len(ir))] {
+			part[i] = complex(s, 0)
+		}
+		FFT(part)
+		c.parts = append(c.parts, part)
+		c.history = append(c.history, make([]complex128, 2*block))
+	}
+	return c
+}
+
+func (c *Convolver) Process(x []float64) []float64 {
+	c.in += len(x)
+	var y []float64
+	for len(x) > 0 {
+		n := copy(c.frame[c.block+c.filled:], x)
+		c.filled += n
+		x = x[n:]
+		if c.filled == c.block {
+			y = c.convolveBlock(y)
+		}
+	}
+	return y
+}
+
+// Flush convolves what is left of the last partial block.
+func (c *Convolver) Flush() []float64 {
+	if c.filled == 0 {
+		return nil
+	}
+	clear(c.frame[c.block+c.filled:])
+	c.filled = c.block
+	y := c.convolveBlock(nil)
+	extra := c.out - c.in
+	c.out = c.in
+	return y[:len(y)-extra]
+}
+
+func (c *Convolver) convolveBlock(y []float64) []float64 {
+	if len(c.parts) == 0 {
+		y = append(y, make([]float64, c.block)...)
+	} else {
+		c.head = (c.head + len(c.history) - 1) % len(c.history)
+		spectrum := c.history[c.head]
+		for i, s := range c.frame {
+			spectrum[i] = complex(s, 0)
+		}
+		FFT(spectrum)
+
+		acc := make([]complex128, 2*c.block)
+		for p, part := range c.parts {
+			past := c.history[(c.head+p)%len(c.history)]
+			for i := range acc {
+				acc[i] += part[i] * past[i]
+			}
+		}
+		IFFT(acc)
+		// Overlap-save, the first half wrapped around.
+		for _, v := range acc[c.block:] {
+			y = append(y, real(v))
+		}
+	}
+	c.out += c.block
+	copy(c.frame, c.frame[c.block:])
+	c.filled = 0
+	return y
+}
@@ -0,0 +1,39 @@
+package dsp
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestConvolver(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ir := make([]float64, 300)
+	for i := range ir {
+		ir[i] = rng.NormFloat64() * math.Exp(-float64(i)/50)
+	}
+	x := make([]float64, 1000)
+	for i := range x {
+		x[i] = rng.NormFloat64()
+	}
+
+	c := NewConvolver(ir, 64)
+	var got []float64
+	for start := 0; start < len(x); start += 97 {
+		got = append(got, c.Process(x[start:min(start+97, len(x))])...)
+	}
+	got = append(got, c.Flush()...)
+
+	if len(got) != len(x) {
+		t.Fatalf("expected %d samples, got %d", len(x), len(got))
+	}
+	for n := range x {
+		var want float64
+		for m := 0; m <= n && m < len(ir); m++ {
+			want += ir[m] * x[n-m]
+		}
+		if math.Abs(got[n]-want) > 1e-9 {
+			t.Fatalf("sample %d: expected %v, got %v", n, want, got[n])
+		}
+	}
+}
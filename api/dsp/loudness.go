@@ -0,0 +1,111 @@
+package dsp
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// LoudnessSampleRate is the rate the K-weighting coefficients are defined
+// for. Feed the meter audio resampled to it.
+const LoudnessSampleRate = 48000
+
+const (
+	blockSize        = LoudnessSampleRate / 10 // 100ms, a quarter of a gating block
+	absoluteGate     = -70.0
+	relativeGateDiff = -10.0
+)
+
+// LoudnessMeter measures integrated loudness as defined by ITU-R BS.1770-4
+// and EBU R128. It is an io.Writer of interleaved little endian float32
+// samples.
+type LoudnessMeter struct {
+	channels int
+	filters  [][2]Biquad
+	partial  []byte
+	sum      float64 // weighted sum of squares of the current 100ms block
+	count    int     // frames in the current 100ms block
+	quarters []float64
+	blocks   []float64 // mean square of every 400ms gating block
+}
+
+func NewLoudnessMeter(channels int) *LoudnessMeter {
+	m := &LoudnessMeter{channels: channels, filters: make([][2]Biquad, channels)}
+	for i := range m.filters {
+		m.filters[i] = kWeighting()
+	}
+	return m
+}
+
+// kWeighting returns the pre-filter and RLB high-pass from BS.1770 at 48kHz.
+func kWeighting() [2]Biquad {
+	return [2]Biquad{
+		{B0: 1.53512485958697, B1: -2.69169618940638, B2: 1.19839281085285, A1: -1.69065929318241, A2: 0.73248077421585},
+		{B0: 1, B1: -2, B2: 1, A1: -1.99004745483398, A2: 0.99007225036621},
+	}
+}
+
+func (m *LoudnessMeter) Write(p []byte) (int, error) {
+	n := len(p)
+	frameSize := 4 * m.channels
+	if len(m.partial) > 0 {
+		p = append(m.partial, p...)
+		m.partial = nil
+	}
+	for len(p) >= frameSize {
+		for ch := 0; ch < m.channels; ch++ {
+			x := float64(math.Float32frombits(binary.LittleEndian.Uint32(p[4*ch:])))
+			y := m.filters[ch][1].Process(m.filters[ch][0].Process(x))
+			m.sum += y * y
+		}
+		p = p[frameSize:]
+		m.count++
+		if m.count == blockSize {
+			m.endQuarter()
+		}
+	}
+	if len(p) > 0 {
+		m.partial = append([]byte(nil), p...)
+	}
+	return n, nil
+}
+
+func (m *LoudnessMeter) endQuarter() {
+	m.quarters = append(m.quarters, m.sum/blockSize)
+	m.sum, m.count = 0, 0
+	if len(m.quarters) < 4 {
+		return
+	}
+	q := m.quarters[len(m.quarters)-4:]
+	m.blocks = append(m.blocks, (q[0]+q[1]+q[2]+q[3])/4)
+	m.quarters = m.quarters[len(m.quarters)-3:]
+}
+
+// Integrated returns the gated loudness of everything written so far in
+// LUFS, or -Inf when nothing passes the gates.
+func (m *LoudnessMeter) Integrated() float64 {
+	relative := gatedMean(m.blocks, math.Inf(-1), absoluteGate)
+	if math.IsInf(relative, -1) {
+		return relative
+	}
+	return gatedMean(m.blocks, relative+relativeGateDiff, absoluteGate)
+}
+
+func gatedMean(blocks []float64, relativeGate, absoluteGate float64) float64 {
+	var sum float64
+	var n int
+	for _, z := range blocks {
+		l := loudness(z)
+		if l > absoluteGate && l > relativeGate {
+			sum += z
+			n++
+		}
+	}
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	return loudness(sum / float64(n))
+}
+
+func loudness(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
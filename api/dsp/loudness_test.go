@@ -0,0 +1,64 @@
+package dsp
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func stereoSine(freq, amplitude, seconds float64) []byte {
+	frames := int(seconds * LoudnessSampleRate)
+	buf := make([]byte, 0, frames*8)
+	for i := 0; i < frames; i++ {
+		x := float32(amplitude * math.Sin(2*math.Pi*freq*float64(i)/LoudnessSampleRate))
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(x))
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(x))
+	}
+	return buf
+}
+
+func TestIntegratedLoudness(t *testing.T) {
+	m := NewLoudnessMeter(2)
+	m.Write(stereoSine(997, 0.1, 5))
+
+	got := m.Integrated()
+	if math.Abs(got-(-20)) > 0.1 {
+		t.Errorf("expected about -20 LUFS for a -20 dBFS stereo sine, got %.2f", got)
+	}
+}
+
+func TestIntegratedLoudnessSplitWrites(t *testing.T) {
+	data := stereoSine(997, 0.5, 3)
+	whole := NewLoudnessMeter(2)
+	whole.Write(data)
+
+	split := NewLoudnessMeter(2)
+	for len(data) > 0 {
+		n := min(len(data), 1021) // not a multiple of the frame size
+		split.Write(data[:n])
+		data = data[n:]
+	}
+
+	if whole.Integrated() != split.Integrated() {
+		t.Errorf("expected split writes to match, got %v and %v", split.Integrated(), whole.Integrated())
+	}
+}
+
+func TestIntegratedLoudnessGating(t *testing.T) {
+	t.Run("silence", func(t *testing.T) {
+		m := NewLoudnessMeter(2)
+		m.Write(make([]byte, 8*LoudnessSampleRate*2))
+		if got := m.Integrated(); !math.IsInf(got, -1) {
+			t.Errorf("expected -Inf for silence, got %v", got)
+		}
+	})
+
+	t.Run("quiet tail is gated", func(t *testing.T) {
+		m := NewLoudnessMeter(2)
+		m.Write(stereoSine(997, 0.1, 5))
+		m.Write(stereoSine(997, 0.001, 5)) // -60 dBFS, below the relative gate
+		if got := m.Integrated(); math.Abs(got-(-20)) > 0.2 {
+			t.Errorf("expected the quiet part to be gated out, got %.2f", got)
+		}
+	})
+}
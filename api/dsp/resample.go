@@ -0,0 +1,101 @@
+package dsp
+
+import "math"
+
+const (
+	resampleZeros = 16  // zero crossings of the sinc on each side
+	kernelSteps   = 512 // kernel table entries per zero crossing
+)
+
+// kernel is a Hann windowed sinc from 0 to resampleZeros zero crossings.
+var kernel = func() []float64 {
+	k := make([]float64, resampleZeros*kernelSteps+2)
+	for i := range k {
+		x := float64(i) / kernelSteps
+		if x >= resampleZeros {
+			continue
+		}
+		sinc := 1.0
+		if x > 0 {
+			sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		k[i] = sinc * (0.5 + 0.5*math.Cos(math.Pi*x/resampleZeros))
+	}
+	return k
+}()
+
+// Resampler converts a stream of samples from one rate to another with a
+// windowed sinc. When downsampling the cutoff follows the new Nyquist so
+// nothing above it aliases back.
+type Resampler struct {
+	step   float64 // input samples per output sample
+	cutoff float64 // fraction of the input Nyquist that is kept
+	width  int     // input samples on each side of an output sample
+	buf    []float64
+	pos    float64 // position of the next output sample in buf
+	in     int
+	out    int
+}
+
+func NewResampler(from, to float64) *Resampler {
+	cutoff := math.Min(1, to/from)
+	width := int(math.Ceil(resampleZeros / cutoff))
+	return &Resampler{
+		step:   from / to,
+		cutoff: cutoff,
+		width:  width,
+		buf:    make([]float64, width),
+		pos:    float64(width),
+	}
+}
+
+// Process returns as many output samples as the input so far allows.
+func (r *Resampler) Process(x []float64) []float64 {
+	r.in += len(x)
+	r.buf = append(r.buf, x...)
+	return r.drain(nil)
+}
+
+// Flush returns the samples held back for the lookahead, so the output ends
+// up as long as the input at the new rate.
+func (r *Resampler) Flush() []float64 {
+	want := int(math.Round(float64(r.in) / r.step))
+	var y []float64
+	for r.out < want {
+		r.buf = append(r.buf, make([]float64, r.width+1+int(r.step))...)
+		y = r.drain(y)
+	}
+	if extra := r.out - want; extra > 0 {
+		y = y[:len(y)-extra]
+		r.out = want
+	}
+	return y
+}
+
+func (r *Resampler) drain(y []float64) []float64 {
+	for int(r.pos)+r.width < len(r.buf) {
+		y = append(y, r.sample())
+		r.out++
+		r.pos += r.step
+	}
+	if drop := int(r.pos) - r.width; drop > 0 {
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.pos -= float64(drop)
+	}
+	return y
+}
+
+func (r *Resampler) sample() float64 {
+	center := int(r.pos)
+	var sum float64
+	for k := center - r.width + 1; k <= center+r.width; k++ {
+		d := math.Abs(r.pos-float64(k)) * r.cutoff * kernelSteps
+		i := int(d)
+		if i >= len(kernel)-1 {
+			continue
+		}
+		frac := d - float64(i)
+		sum += r.buf[k] * (kernel[i] + frac*(kernel[i+1]-kernel[i]))
+	}
+	return sum * r.cutoff
+}
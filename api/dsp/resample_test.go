@@ -0,0 +1,53 @@
+package dsp
+
+import (
+	"math"
+	"testing"
+)
+
+func sine(freq, rate float64, n int) []float64 {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = math.Sin(2 * math.Pi * freq * float64(i) / rate)
+	}
+	return x
+}
+
+// zeroCrossingFreq estimates the frequency of a sine, skipping the edges.
+func zeroCrossingFreq(x []float64, rate float64) float64 {
+	x = x[len(x)/10 : len(x)*9/10]
+	var crossings int
+	for i := 1; i < len(x); i++ {
+		if (x[i-1] < 0) != (x[i] < 0) {
+			crossings++
+		}
+	}
+	return float64(crossings) / 2 / (float64(len(x)) / rate)
+}
+
+func TestResampler(t *testing.T) {
+	tests := []struct{ from, to float64 }{
+		{44100, 48000},
+		{48000, 44100},
+		{44100, 11025},
+		{44100 * 0.9, 44100},
+	}
+	for _, tt := range tests {
+		r := NewResampler(tt.from, tt.to)
+		in := sine(440, tt.from, int(tt.from))
+		var out []float64
+		for len(in) > 0 {
+			n := min(len(in), 1000)
+			out = append(out, r.Process(in[:n])...)
+			in = in[n:]
+		}
+		out = append(out, r.Flush()...)
+
+		if want := int(math.Round(tt.to)); len(out) != want {
+			t.Errorf("%v -> %v: expected %d samples, got %d", tt.from, tt.to, want, len(out))
+		}
+		if got := zeroCrossingFreq(out, tt.to); math.Abs(got-440) > 2 {
+			t.Errorf("%v -> %v: expected 440Hz, got %.1fHz", tt.from, tt.to, got)
+		}
+	}
+}
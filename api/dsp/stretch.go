@@ -0,0 +1,157 @@
+package dsp
+
+import "math"
+
+const (
+	stretchFrame  = 1024
+	stretchHop    = stretchFrame / 2
+	stretchSearch = 128
+)
+
+// Stretcher changes the tempo of a stream without changing its pitch with
+// WSOLA. Every output frame is taken from near where the tempo says it
+// should come from, at the offset that lines up best with how the previous
+// frame would have continued, and the frames are crossfaded. All channels
+// use the offsets found on their mix so they stay in phase.
+type Stretcher struct {
+	tempo  float64
+	window []float64
+	in     [][]float64 // input not needed anymore is dropped, in[c][0] is offset
+	offset int
+	pos    float64 // where the next frame should come from
+	prev   int     // where the previous frame came from, -1 before the first
+	tail   [][]float64
+	inN    int
+	outN   int
+}
+
+func NewStretcher(channels int, tempo float64) *Stretcher {
+	s := &Stretcher{
+		tempo:  tempo,
+		window: hann(stretchFrame),
+		in:     make([][]float64, channels),
+		tail:   make([][]float64, channels),
+		prev:   -1,
+	}
+	for c := range s.tail {
+		s.tail[c] = make([]float64, stretchHop)
+	}
+	return s
+}
+
+// Process takes one slice per channel, all of the same length.
+func (s *Stretcher) Process(x [][]float64) [][]float64 {
+	s.inN += len(x[0])
+	s.push(x)
+	return s.drain(nil)
+}
+
+// Flush plays out the input held back for the search and trims the output
+// to the length the tempo asks for.
+func (s *Stretcher) Flush() [][]float64 {
+	want := int(math.Round(float64(s.inN) / s.tempo))
+	y := make([][]float64, len(s.in))
+	pad := stretchFrame + 2*stretchSearch + int(math.Ceil(stretchHop*s.tempo))
+	for s.outN < want {
+		zeros := make([][]float64, len(s.in))
+		for c := range zeros {
+			zeros[c] = make([]float64, pad)
+		}
+		s.push(zeros)
+		y = s.drain(y)
+	}
+	if extra := s.outN - want; extra > 0 {
+		for c := range y {
+			y[c] = y[c][:len(y[c])-extra]
+		}
+		s.outN = want
+	}
+	return y
+}
+
+func (s *Stretcher) push(x [][]float64) {
+	for c := range s.in {
+		s.in[c] = append(s.in[c], x[c]...)
+	}
+}
+
+func (s *Stretcher) drain(y [][]float64) [][]float64 {
+	if y == nil {
+		y = make([][]float64, len(s.in))
+	}
+	for {
+		nominal := int(math.Round(s.pos))
+		end := nominal + stretchSearch + stretchFrame
+		if s.prev >= 0 {
+			end = max(end, s.prev+stretchHop+stretchHop)
+		}
+		if end > s.offset+len(s.in[0]) {
+			break
+		}
+
+		start := nominal
+		if s.prev >= 0 {
+			start = s.bestStart(nominal)
+		}
+		for c, in := range s.in {
+			frame := in[start-s.offset : start-s.offset+stretchFrame]
+			out := make([]float64, stretchHop)
+			for i := range out {
+				if s.prev < 0 {
+					out[i] = frame[i]
+				} else {
+					out[i] = s.tail[c][i] + frame[i]*s.window[i]
+				}
+				s.tail[c][i] = frame[stretchHop+i] * s.window[stretchHop+i]
+			}
+			y[c] = append(y[c], out...)
+		}
+		s.outN += stretchHop
+		s.prev = start
+		s.pos += stretchHop * s.tempo
+
+		keep := min(int(math.Round(s.pos))-stretchSearch, s.prev+stretchHop)
+		if drop := keep - s.offset; drop > 0 {
+			for c := range s.in {
+				s.in[c] = append(s.in[c][:0], s.in[c][drop:]...)
+			}
+			s.offset += drop
+		}
+	}
+	return y
+}
+
+// bestStart searches around nominal for the frame start whose beginning
+// correlates best with the natural continuation of the previous frame.
+func (s *Stretcher) bestStart(nominal int) int {
+	natural := s.mix(s.prev+stretchHop, stretchHop)
+	best, bestScore := nominal, math.Inf(-1)
+	lo := max(nominal-stretchSearch, s.offset)
+	candidates := s.mix(lo, nominal+stretchSearch-lo+stretchHop)
+	for start := lo; start <= nominal+stretchSearch; start++ {
+		var dot, energy float64
+		for i, v := range natural {
+			x := candidates[start-lo+i]
+			dot += v * x
+			energy += x * x
+		}
+		score := dot
+		if energy > 0 {
+			score /= math.Sqrt(energy)
+		}
+		if score > bestScore {
+			best, bestScore = start, score
+		}
+	}
+	return best
+}
+
+func (s *Stretcher) mix(start, n int) []float64 {
+	m := make([]float64, n)
+	for _, in := range s.in {
+		for i := range m {
+			m[i] += in[start-s.offset+i]
+		}
+	}
+	return m
+}
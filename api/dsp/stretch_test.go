@@ -0,0 +1,38 @@
+package dsp
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStretcher(t *testing.T) {
+	const rate = 44100
+	for _, tempo := range []float64{0.8, 1.25} {
+		s := NewStretcher(2, tempo)
+		in := sine(440, rate, 2*rate)
+		var out [][]float64
+		for start := 0; start < len(in); start += 4096 {
+			block := in[start:min(start+4096, len(in))]
+			out = appendChannels(out, s.Process([][]float64{block, block}))
+		}
+		out = appendChannels(out, s.Flush())
+
+		want := int(math.Round(2 * rate / tempo))
+		if len(out[0]) != want || len(out[1]) != want {
+			t.Errorf("tempo %v: expected %d samples, got %d and %d", tempo, want, len(out[0]), len(out[1]))
+		}
+		if got := zeroCrossingFreq(out[0], rate); math.Abs(got-440) > 5 {
+			t.Errorf("tempo %v: expected the pitch to stay at 440Hz, got %.1fHz", tempo, got)
+		}
+	}
+}
+
+func appendChannels(dst, src [][]float64) [][]float64 {
+	if dst == nil {
+		dst = make([][]float64, len(src))
+	}
+	for c := range src {
+		dst[c] = append(dst[c], src[c]...)
+	}
+	return dst
+}
@@ -0,0 +1,59 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"math"
+	"screw/audio"
+	"strings"
+)
+
+const (
+	// Chops are planned ahead since the length of a stream is unknown, past
+	// the horizon or the cycle cap the audio plays through unchopped.
+	maxChopHorizon = 20 * 60
+	maxChopCycles  = 256
+)
+
+// chopGraph cuts the stream at the edges of every chopped region with
+// asegment, splits each chopped region into 1+Repeats copies and concats
+// everything back in order. asegment only feeds the segment concat is
+// waiting on, so nothing but the repeated beats is buffered.
+func chopGraph(c audio.Chop, in, out, prefix string, horizon float64) string {
+	beat := 60 / c.BPM
+	cycle := c.Every * beat
+	cycles := int(math.Min(math.Ceil((horizon-c.Offset)/cycle), maxChopCycles))
+	if cycles < 1 {
+		return in + "anull" + out
+	}
+
+	segment := func(i int) string { return fmt.Sprintf("[%ss%d]", prefix, i) }
+	repeat := func(i, r int) string { return fmt.Sprintf("[%ss%dr%d]", prefix, i, r) }
+
+	var timestamps []string
+	for i := 0; i < cycles; i++ {
+		end := c.Offset + float64(i+1)*cycle
+		timestamps = append(timestamps, seconds(end-c.Length*beat), seconds(end))
+	}
+	segments := len(timestamps) + 1
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%sasegment=timestamps=%s", in, strings.Join(timestamps, "|"))
+	for i := 0; i < segments; i++ {
+		b.WriteString(segment(i))
+	}
+
+	var concat []string
+	for i := 0; i < segments; i++ {
+		if i%2 == 0 {
+			concat = append(concat, segment(i))
+			continue
+		}
+		fmt.Fprintf(&b, ";%sasplit=%d", segment(i), 1+c.Repeats)
+		for r := 0; r <= c.Repeats; r++ {
+			b.WriteString(repeat(i, r))
+			concat = append(concat, repeat(i, r))
+		}
+	}
+	fmt.Fprintf(&b, ";%sconcat=n=%d:v=0:a=1%s", strings.Join(concat, ""), len(concat), out)
+	return b.String()
+}
@@ -2,31 +2,53 @@ package ffmpeg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"screw/audio"
+	"screw/dsp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 type FFMPEG struct {
 	Stdin   io.WriteCloser
 	Stdout  io.ReadCloser
+	Outputs []io.ReadCloser // one per variant, Outputs[0] is Stdout
 	Stderr  io.ReadCloser
 	Ctx     context.Context
 	ErrChan chan error
-	Done    chan bool
-}
+	bounded bool
+	log     *logTail
+	// warnings are only touched by monitor until monitored is closed.
+	warnings []string
 
-func New(ctx context.Context) (*FFMPEG, error) {
-	irPath := "api/audio/ir.wav"
+	cmd       *exec.Cmd
+	monitored chan struct{}
+	waitOnce  sync.Once
+	waitErr   error
 
-	if envPath := os.Getenv("IR_PATH"); envPath != "" {
-		irPath = envPath
-	}
+	taps      []io.ReadCloser
+	tapping   sync.WaitGroup
+	meters    []*dsp.LoudnessMeter
+	analyzers []*dsp.Analyzer
+	source    *dsp.Analyzer
+}
+
+// flushed outputs are written packet by packet instead of in big blocks.
+func flushed(o audio.Options) bool {
+	return o.Bounded() || o.Live != nil
+}
 
-	absPath, err := filepath.Abs(irPath)
+func New(ctx context.Context, opts audio.Options) (*FFMPEG, error) {
+	absPath, err := filepath.Abs(audio.IRPath())
 	if err != nil {
 		slog.Error("Failed to get absolute path for IR", "error", err)
 		return nil, err
@@ -34,104 +56,321 @@ func New(ctx context.Context) (*FFMPEG, error) {
 
 	slog.Info("Using IR file", "path", absPath)
 
-	filterComplex := "[0:a][1:a]afir=dry=10:wet=10[reverbed];[reverbed]highpass=f=40,lowpass=f=2300[filtered];[filtered]asetrate=44100*0.9,aresample=44100,atempo=0.97[out]"
+	variants, err := audio.ResolveVariants(opts.Variants)
+	if err != nil {
+		return nil, err
+	}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg",
+	format, err := FormatByName(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Live != nil {
+		if err := validateLive(opts, format, variants); err != nil {
+			return nil, err
+		}
+	}
+
+	spectrum := opts.Spectrograms != nil
+	if spectrum {
+		if err := opts.Spectrograms.Validate(len(variants)); err != nil {
+			return nil, err
+		}
+	}
+
+	args := []string{
 		"-hide_banner",
-		"-loglevel", "error",
+		"-nostats",
+		// Never ask on stdin, it carries the audio.
+		"-y",
+		// Warnings are logged but only lines classify finds fatal fail.
+		"-loglevel", "level+warning",
+	}
+	// Input options, they only apply to the main audio on stdin.
+	if opts.Live != nil {
+		args = append(args, liveInputArgs(opts.Live)...)
+	}
+	if opts.Offset > 0 {
+		args = append(args, "-ss", seconds(opts.Offset))
+	}
+	if opts.Bounded() {
+		args = append(args, "-t", seconds(opts.Duration))
+	}
+	args = append(args,
 		"-i", "pipe:0", // Main audio
 		"-i", absPath, // IR file
-		"-filter_complex", filterComplex,
-		"-map", "[out]",
-		"-c:a", "aac",
-		"-b:a", "256k",
-		"-f", "adts",
-		"pipe:1",
 	)
+	coverStream := "0:v?"
+	if format.Cover && opts.CoverPath != "" {
+		args = append(args, "-i", opts.CoverPath)
+		coverStream = "2:v"
+	}
+	g := graph{
+		horizon:  maxChopHorizon,
+		spectrum: spectrum,
+		lowDelay: opts.Live != nil,
+	}
+	if opts.Bounded() {
+		g.horizon = opts.Duration
+	}
+	g.rubberband = slices.ContainsFunc(variants, func(p audio.Params) bool { return p.Mode == audio.ModeIndependent }) && hasRubberband()
+	args = append(args, "-filter_complex", filterComplex(variants, g))
+
+	// The first variant goes to stdout, the other variants and the PCM
+	// copies used for metering and analysis go to extra pipes.
+	pipes := &extraPipes{}
+	defer pipes.closeWriters()
+	var outputs, meterPipes, analysisPipes []io.ReadCloser
+	addTap := func(label string, channels, rate int) (io.ReadCloser, error) {
+		target, r, err := pipes.add()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args,
+			"-map", label,
+			"-f", "f32le",
+			"-ac", strconv.Itoa(channels),
+			"-ar", strconv.Itoa(rate),
+			target,
+		)
+		return r, nil
+	}
+	for i := range variants {
+		suffix := variantSuffix(i, len(variants))
+		target := "pipe:1"
+		if i > 0 {
+			var r io.ReadCloser
+			target, r, err = pipes.add()
+			if err != nil {
+				slog.Error("Failed to create variant pipe", "error", err)
+				pipes.closeReaders()
+				return nil, err
+			}
+			outputs = append(outputs, r)
+		}
+		args = append(args, outputArgs(format, opts, "[out"+suffix+"]", coverStream)...)
+		args = append(args, target)
+
+		meter, err := addTap("[meter"+suffix+"]", 2, dsp.LoudnessSampleRate)
+		if err != nil {
+			slog.Error("Failed to create meter pipe", "error", err)
+			pipes.closeReaders()
+			return nil, err
+		}
+		meterPipes = append(meterPipes, meter)
+
+		analysis, err := addTap("[analysis"+suffix+"]", 1, dsp.AnalysisSampleRate)
+		if err != nil {
+			slog.Error("Failed to create analysis pipe", "error", err)
+			pipes.closeReaders()
+			return nil, err
+		}
+		analysisPipes = append(analysisPipes, analysis)
+
+		if spectrum {
+			args = append(args, spectrogramArgs("[spectrogram"+suffix+"]", opts.Spectrograms.Variants[i])...)
+		}
+	}
+	if spectrum {
+		args = append(args, spectrogramArgs("[sourcespectrogram]", opts.Spectrograms.Source)...)
+	}
+
+	sourcePipe, err := addTap("[source]", 1, dsp.AnalysisSampleRate)
+	if err != nil {
+		slog.Error("Failed to create analysis pipe", "error", err)
+		pipes.closeReaders()
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.ExtraFiles = pipes.writers
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		slog.Error("Failed to create stdin pipe", "error", err)
+		pipes.closeReaders()
 		return nil, err
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		slog.Error("Failed to create stdout pipe", "error", err)
+		pipes.closeReaders()
 		return nil, err
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		slog.Error("Failed to create stderr pipe", "error", err)
+		pipes.closeReaders()
 		return nil, err
 	}
 
 	if err := cmd.Start(); err != nil {
 		slog.Error("Failed to start FFmpeg", "error", err)
+		pipes.closeReaders()
 		return nil, err
 	}
 
-	errChan := make(chan error, 3)
-	done := make(chan bool)
+	errChan := make(chan error, 3+len(variants))
 
 	f := &FFMPEG{
-		Stdin:   stdin,
-		Stdout:  stdout,
-		Stderr:  stderr,
-		Ctx:     ctx,
-		ErrChan: errChan,
-		Done:    done,
+		Stdin:     stdin,
+		Stdout:    stdout,
+		Outputs:   append([]io.ReadCloser{stdout}, outputs...),
+		Stderr:    stderr,
+		Ctx:       ctx,
+		ErrChan:   errChan,
+		bounded:   opts.Bounded(),
+		log:       newLogTail(),
+		cmd:       cmd,
+		monitored: make(chan struct{}),
+		source:    dsp.NewAnalyzer(),
+	}
+
+	for i := range variants {
+		meter, analyzer := dsp.NewLoudnessMeter(2), dsp.NewAnalyzer()
+		f.meters = append(f.meters, meter)
+		f.analyzers = append(f.analyzers, analyzer)
+		f.tap(meterPipes[i], meter)
+		f.tap(analysisPipes[i], analyzer)
 	}
+	f.tap(sourcePipe, f.source)
 
-	go f.monitor()
+	go func() {
+		defer close(f.monitored)
+		f.monitor()
+	}()
 	return f, nil
 }
 
-func (f *FFMPEG) monitor() {
-	buf := make([]byte, 1024)
-	for {
-		select {
-		case <-f.Ctx.Done():
-			return
-		default:
-			n, err := f.Stderr.Read(buf)
-			if n > 0 {
-				f.ErrChan <- fmt.Errorf("ffmpeg error: %s", string(buf[:n]))
-				return
-			}
-			if err != nil {
-				if err != io.EOF {
-					f.ErrChan <- fmt.Errorf("stderr read error: %w", err)
-				}
-				return
-			}
+func (f *FFMPEG) Streams() []io.ReadCloser { return f.Outputs }
+func (f *FFMPEG) Errors() chan error       { return f.ErrChan }
+
+// CloseInput closes stdin, so ffmpeg flushes what it has and exits.
+func (f *FFMPEG) CloseInput() error {
+	return f.Stdin.Close()
+}
+
+// ExitError is ffmpeg exiting unsuccessfully, with the last lines it logged.
+type ExitError struct {
+	Code int // -1 when it was killed
+	Tail []string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("ffmpeg exited with code %d\n%s", e.Code, strings.Join(e.Tail, "\n"))
+}
+
+// Wait reaps the process. Call it once the outputs are drained, it waits
+// for stderr and the taps too so nothing ffmpeg wrote is lost. Processing
+// only succeeded if it returns nil.
+func (f *FFMPEG) Wait() error {
+	f.waitOnce.Do(func() {
+		<-f.monitored
+		f.tapping.Wait()
+		err := f.cmd.Wait()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = &ExitError{Code: exitErr.ExitCode(), Tail: f.log.Lines()}
+		}
+		if err != nil {
+			slog.Error("ffmpeg failed", "err", err)
 		}
+		f.waitErr = err
+	})
+	return f.waitErr
+}
+
+func (f *FFMPEG) tap(pipe io.ReadCloser, w io.Writer) {
+	f.taps = append(f.taps, pipe)
+	f.tapping.Add(1)
+	go func() {
+		defer f.tapping.Done()
+		io.Copy(w, pipe)
+	}()
+}
+
+// Report waits for the taps and stderr to be drained, so only call it once
+// the process is done or killed.
+func (f *FFMPEG) Report() audio.Report {
+	f.tapping.Wait()
+	<-f.monitored
+	report := audio.Report{Source: f.source.Result(), Warnings: f.warnings}
+	for i, meter := range f.meters {
+		report.Variants = append(report.Variants, audio.VariantReport{
+			Loudness: meter.Integrated(),
+			Analysis: f.analyzers[i].Result(),
+		})
 	}
+	return report
 }
 
+// Close kills ffmpeg if it is still running and reaps it.
 func (f *FFMPEG) Close() {
 	f.Stdin.Close()
-	f.Stdout.Close()
-	f.Stderr.Close()
+	closeAll(f.Outputs)
+	closeAll(f.taps)
+	f.cmd.Process.Kill()
+	f.Wait()
 	slog.Info("Ffmpeg clean up done.")
 }
 
 func (f *FFMPEG) Write(p []byte) (int, error) {
 	n, err := f.Stdin.Write(p)
 	if err != nil {
-		f.ErrChan <- err
+		// A bounded run stops reading stdin once the window is processed,
+		// the rest of the input is expected to be rejected.
+		if f.bounded && (errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)) {
+			return n, err
+		}
+		f.fail(err)
 	}
 	return n, err
 }
 
-func (f *FFMPEG) Read(p []byte) (int, error) {
-	n, err := f.Stdout.Read(p)
-	if err != nil {
-		if err == io.EOF {
-			f.Done <- true
+// fail reports err on ErrChan without blocking, the first errors win.
+func (f *FFMPEG) fail(err error) {
+	select {
+	case f.ErrChan <- err:
+	default:
+	}
+}
+
+func closeAll(rcs []io.ReadCloser) {
+	for _, rc := range rcs {
+		rc.Close()
+	}
+}
+
+func seconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+// outputArgs are the options of the output of one variant, from the mapped
+// streams to the muxer.
+func outputArgs(format Format, opts audio.Options, out, coverStream string) []string {
+	args := []string{"-map", out}
+	if format.Cover && !opts.DropCover {
+		args = append(args,
+			"-map", coverStream,
+			"-c:v", "copy",
+			"-disposition:v", "attached_pic",
+		)
+	}
+	if format.Tags {
+		args = append(args, "-map_metadata", "0")
+		if opts.Title != "" {
+			args = append(args, "-metadata", "title="+opts.Title)
 		}
-		f.ErrChan <- err
 	}
-	return n, err
+	args = append(args, format.args...)
+	if opts.Live != nil {
+		args = append(args, liveFormats[format.Name]...)
+	}
+	if flushed(opts) {
+		args = append(args, "-flush_packets", "1")
+	}
+	return args
 }
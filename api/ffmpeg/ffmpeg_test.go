@@ -0,0 +1,60 @@
+package ffmpeg
+
+import (
+	"io"
+	"screw/audio"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteFailures(t *testing.T) {
+	r, w := io.Pipe()
+	r.Close()
+	f := &FFMPEG{Stdin: w, ErrChan: make(chan error, 1)}
+	// Nobody reads ErrChan, a blocking send would hang on the second write.
+	for range 3 {
+		if _, err := f.Write([]byte("input")); err == nil {
+			t.Fatal("expected writing to a closed stdin to fail")
+		}
+	}
+	if len(f.ErrChan) != 1 {
+		t.Errorf("expected the first failure to be reported, got %d", len(f.ErrChan))
+	}
+}
+
+func TestOutputArgsCover(t *testing.T) {
+	cover := []string{"-map", "2:v", "-c:v", "copy", "-disposition:v", "attached_pic"}
+	tests := []struct {
+		format string
+		cover  bool
+	}{
+		{"aac", false},
+		{"mp3", true},
+		{"m4a", false},
+		{"flac", true},
+		{"ogg", false},
+		{"pcm", false},
+		{"wav", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			format, err := FormatByName(tt.format)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			args := strings.Join(outputArgs(format, audio.Options{Format: tt.format}, "[out]", "2:v"), " ")
+			if got := strings.Contains(args, strings.Join(cover, " ")); got != tt.cover {
+				t.Errorf("expected cover %v, got %s", tt.cover, args)
+			}
+			if !tt.cover && strings.Contains(args, "-c:v") {
+				t.Errorf("expected no video stream, got %s", args)
+			}
+
+			dropped := outputArgs(format, audio.Options{Format: tt.format, DropCover: true}, "[out]", "2:v")
+			if slices.Contains(dropped, "2:v") {
+				t.Errorf("expected a dropped cover not to be mapped, got %v", dropped)
+			}
+		})
+	}
+}
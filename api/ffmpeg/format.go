@@ -0,0 +1,82 @@
+package ffmpeg
+
+import "fmt"
+
+type Format struct {
+	Name     string
+	Ext      string
+	MimeType string
+	Tags     bool // the container can carry tags
+	Cover    bool // the container can carry cover art when streamed
+	args     []string
+}
+
+const DefaultFormat = "aac"
+
+var Formats = map[string]Format{
+	"aac": {
+		Name:     "aac",
+		Ext:      ".aac",
+		MimeType: "audio/aac",
+		args:     []string{"-c:a", "aac", "-b:a", "256k", "-f", "adts"},
+	},
+	"mp3": {
+		Name:     "mp3",
+		Ext:      ".mp3",
+		MimeType: "audio/mpeg",
+		Tags:     true,
+		Cover:    true,
+		args:     []string{"-c:a", "libmp3lame", "-b:a", "320k", "-id3v2_version", "3", "-f", "mp3"},
+	},
+	"m4a": {
+		Name:     "m4a",
+		Ext:      ".m4a",
+		MimeType: "audio/mp4",
+		Tags:     true,
+		// stdout can't seek, so the moov atom has to be written up front.
+		// Fragmented MP4 has no place for an attached picture, so there is
+		// no cover.
+		args: []string{"-c:a", "aac", "-b:a", "256k", "-movflags", "frag_keyframe+empty_moov", "-f", "ipod"},
+	},
+	"flac": {
+		Name:     "flac",
+		Ext:      ".flac",
+		MimeType: "audio/flac",
+		Tags:     true,
+		Cover:    true,
+		args:     []string{"-c:a", "flac", "-f", "flac"},
+	},
+	"ogg": {
+		Name:     "ogg",
+		Ext:      ".ogg",
+		MimeType: "audio/ogg",
+		Tags:     true,
+		// Ogg covers are base64 tags the muxer doesn't write from a video
+		// stream, so there is no cover.
+		args: []string{"-c:a", "libopus", "-b:a", "192k", "-f", "ogg"},
+	},
+	// Raw samples, for live monitoring through the Web Audio API.
+	"pcm": {
+		Name:     "pcm",
+		Ext:      ".pcm",
+		MimeType: "audio/L16;rate=44100;channels=2",
+		args:     []string{"-c:a", "pcm_s16le", "-ar", "44100", "-ac", "2", "-f", "s16le"},
+	},
+	"wav": {
+		Name:     "wav",
+		Ext:      ".wav",
+		MimeType: "audio/wav",
+		args:     []string{"-c:a", "pcm_s16le", "-f", "wav"},
+	},
+}
+
+func FormatByName(name string) (Format, error) {
+	if name == "" {
+		name = DefaultFormat
+	}
+	format, ok := Formats[name]
+	if !ok {
+		return Format{}, fmt.Errorf("unknown format %q", name)
+	}
+	return format, nil
+}
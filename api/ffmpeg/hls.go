@@ -0,0 +1,87 @@
+package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// HLSCodec is how a stored track gets segmented for playback.
+type HLSCodec struct {
+	Name       string
+	SegmentExt string
+	args       []string
+}
+
+const (
+	DefaultHLSCodec = "aac"
+	HLSPlaylist     = "index.m3u8"
+	hlsSegmentTime  = "6"
+)
+
+var HLSCodecs = map[string]HLSCodec{
+	"aac": {
+		Name:       "aac",
+		SegmentExt: ".ts",
+		args:       []string{"-c:a", "aac", "-b:a", "192k", "-hls_segment_type", "mpegts"},
+	},
+	// Opus only fits in fragmented MP4 segments, with an init segment.
+	"opus": {
+		Name:       "opus",
+		SegmentExt: ".m4s",
+		args:       []string{"-c:a", "libopus", "-b:a", "160k", "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4"},
+	},
+}
+
+func HLSCodecByName(name string) (HLSCodec, error) {
+	if name == "" {
+		name = DefaultHLSCodec
+	}
+	codec, ok := HLSCodecs[name]
+	if !ok {
+		return HLSCodec{}, fmt.Errorf("unknown HLS codec %q", name)
+	}
+	return codec, nil
+}
+
+// PackageHLS segments input into a VOD playlist in dir. It writes to a
+// temporary directory first, so dir only exists once it is complete.
+func PackageHLS(ctx context.Context, input, dir string, codec HLSCodec) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return fmt.Errorf("error creating HLS parent dir: %w", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("error creating HLS temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	args := []string{
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "level+warning",
+		"-y",
+		"-i", input,
+		"-vn",
+	}
+	args = append(args, codec.args...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", hlsSegmentTime,
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(tmp, "segment%05d"+codec.SegmentExt),
+		filepath.Join(tmp, HLSPlaylist),
+	)
+	out, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error packaging HLS: %w\n%s", err, strings.TrimSpace(string(out)))
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return fmt.Errorf("error moving HLS dir: %w", err)
+	}
+	return nil
+}
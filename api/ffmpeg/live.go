@@ -0,0 +1,48 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"screw/audio"
+	"strconv"
+)
+
+const (
+	LiveFormat        = "pcm"
+	lowDelayPartition = 256
+)
+
+// liveFormats are the outputs that can be played back while they stream,
+// with what their encoder needs to keep the delay low.
+var liveFormats = map[string][]string{
+	"pcm": nil,
+	"ogg": {"-application", "lowdelay", "-frame_duration", "10", "-page_duration", "20000"},
+}
+
+// validateLive checks the live input and that the format can be played
+// back while it streams.
+func validateLive(opts audio.Options, format Format, variants []audio.Params) error {
+	if err := opts.Live.Validate(opts, variants); err != nil {
+		return err
+	}
+	if _, ok := liveFormats[format.Name]; !ok {
+		return fmt.Errorf("format %q can't be streamed live", format.Name)
+	}
+	return nil
+}
+
+// inputArgs keep ffmpeg from buffering the input to probe it.
+func liveInputArgs(l *audio.Live) []string {
+	args := []string{"-fflags", "nobuffer", "-flags", "low_delay", "-analyzeduration", "0"}
+	switch l.Input {
+	case "pcm":
+		return append(args,
+			"-probesize", "32",
+			"-f", "s16le",
+			"-ar", strconv.Itoa(l.SampleRate),
+			"-ac", strconv.Itoa(l.Channels),
+		)
+	case "webm":
+		return append(args, "-f", "matroska")
+	}
+	return append(args, "-f", l.Input)
+}
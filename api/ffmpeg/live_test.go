@@ -0,0 +1,66 @@
+package ffmpeg
+
+import (
+	"screw/audio"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLiveValidate(t *testing.T) {
+	variants, err := audio.ResolveVariants(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loud, err := audio.ResolveVariants([]audio.Params{{Preset: "streaming"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		live     audio.Live
+		format   string
+		variants []audio.Params
+		valid    bool
+	}{
+		{"pcm", audio.Live{Input: "pcm", SampleRate: 48000, Channels: 2}, "pcm", variants, true},
+		{"opus to ogg", audio.Live{Input: "webm"}, "ogg", variants, true},
+		{"pcm without a rate", audio.Live{Input: "pcm", Channels: 1}, "pcm", variants, false},
+		{"pcm with too many channels", audio.Live{Input: "pcm", SampleRate: 48000, Channels: 6}, "pcm", variants, false},
+		{"unknown input", audio.Live{Input: "mp3"}, "pcm", variants, false},
+		{"file only format", audio.Live{Input: "ogg"}, "m4a", variants, false},
+		{"loudness", audio.Live{Input: "ogg"}, "pcm", loud, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLive(audio.Options{Live: &tt.live}, Formats[tt.format], tt.variants)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLiveGraph(t *testing.T) {
+	live := audio.Live{Input: "pcm", SampleRate: 48000, Channels: 1}
+	args := liveInputArgs(&live)
+	for _, want := range [][]string{{"-fflags", "nobuffer"}, {"-f", "s16le"}, {"-ar", "48000"}, {"-ac", "1"}} {
+		i := slices.Index(args, want[0])
+		if i < 0 || args[i+1] != want[1] {
+			t.Errorf("expected %v in %v", want, args)
+		}
+	}
+
+	variants, err := audio.ResolveVariants(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[in][1:a]afir=dry=10:wet=10:minp=256[reverbed];"
+	if got := filterComplex(variants, graph{horizon: maxChopHorizon, lowDelay: true}); !strings.Contains(got, want) {
+		t.Errorf("expected a low delay reverb %s in\n%s", want, got)
+	}
+}
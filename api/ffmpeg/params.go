@@ -0,0 +1,129 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"screw/audio"
+	"strconv"
+	"strings"
+)
+
+// workingRate is the rate the input is resampled to before it is split. The
+// rate of a piped input is only known to ffmpeg, so the stages that change
+// the rate, see stretch, start from this one instead.
+const workingRate = 44100
+
+// filterComplex builds one chain per variant. The main audio is resampled to
+// workingRate and split so every chain gets its own copy, plus [source] to be
+// analyzed. With more
+// than one variant the IR is split too. Every chain ends in three pads,
+// [out] to be encoded, [meter] to be measured and [analysis] to be analyzed.
+// With spectrum, the source and every mix are also rendered to
+// [sourcespectrogram] and [spectrogram] pads.
+func filterComplex(variants []audio.Params, g graph) string {
+	n := len(variants)
+	taps := 1
+	if g.spectrum {
+		taps++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[0:a]aresample=%d,asplit=%d", workingRate, n+taps)
+	for i := range variants {
+		b.WriteString("[in" + variantSuffix(i, n) + "]")
+	}
+	b.WriteString("[source]")
+	if g.spectrum {
+		b.WriteString("[sourcespectrum];" + spectrogram("[sourcespectrum]", "[sourcespectrogram]"))
+	}
+	if n > 1 {
+		b.WriteString(";[1:a]asplit=" + strconv.Itoa(n))
+		for i := range variants {
+			fmt.Fprintf(&b, "[ir%d]", i)
+		}
+	}
+	for i, p := range variants {
+		suffix := variantSuffix(i, n)
+		ir := "[1:a]"
+		if n > 1 {
+			ir = fmt.Sprintf("[ir%d]", i)
+		}
+		b.WriteString(";")
+		b.WriteString(chain(p, "[in"+suffix+"]", ir, suffix, g))
+	}
+	return b.String()
+}
+
+func variantSuffix(i, n int) string {
+	if n == 1 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+// graph holds what shapes the filter graph besides the params of every
+// variant.
+type graph struct {
+	horizon    float64 // seconds of input the time based stages plan for
+	rubberband bool    // the independent mode can use the rubberband filter
+	spectrum   bool    // the source and every mix are rendered to spectrograms
+	lowDelay   bool    // live input, stages hold back as little audio as they can
+}
+
+// chain is the filter graph of a single variant.
+func chain(p audio.Params, in, ir, suffix string, g graph) string {
+	label := func(name string) string { return "[" + name + suffix + "]" }
+
+	var b strings.Builder
+	speedIn := in
+	if *p.Wet == 0 {
+		// No reverb, the IR still has to go somewhere.
+		fmt.Fprintf(&b, "%sanullsink;", ir)
+	} else {
+		// Smaller partitions cut the latency of the convolution at some CPU cost.
+		afir := fmt.Sprintf("afir=dry=%s:wet=%s", num(*p.Dry), num(*p.Wet))
+		if g.lowDelay {
+			afir += ":minp=" + strconv.Itoa(lowDelayPartition)
+		}
+		fmt.Fprintf(&b, "%s%s%s%s;", in, ir, afir, label("reverbed"))
+		speedIn = label("reverbed")
+	}
+
+	var band []string
+	if *p.HighPass > 0 {
+		band = append(band, "highpass=f="+num(*p.HighPass))
+	}
+	if *p.LowPass > 0 {
+		band = append(band, "lowpass=f="+num(*p.LowPass))
+	}
+	if len(band) > 0 {
+		fmt.Fprintf(&b, "%s%s%s;", speedIn, strings.Join(band, ","), label("filtered"))
+		speedIn = label("filtered")
+	}
+
+	// Chops are planned on the source beat grid, so they go before the
+	// speed change.
+	if p.Chop != nil {
+		b.WriteString(chopGraph(*p.Chop, speedIn, label("chopped"), "chop"+suffix, g.horizon))
+		b.WriteString(";")
+		speedIn = label("chopped")
+	}
+
+	b.WriteString(speedIn + stretch(p, g.rubberband))
+	if p.Spatial != nil {
+		b.WriteString(spatialStages(*p.Spatial))
+	}
+	if l := p.Loudness; l != nil {
+		// loudnorm upsamples to 192kHz, bring it back down.
+		fmt.Fprintf(&b, ",loudnorm=I=%s:TP=%s:LRA=%s,aresample=%d", num(l.I), num(l.TP), num(l.LRA), workingRate)
+	}
+	if !g.spectrum {
+		fmt.Fprintf(&b, "%s;%sasplit=3%s%s%s", label("mix"), label("mix"), label("out"), label("meter"), label("analysis"))
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%s;%sasplit=4%s%s%s%s;", label("mix"), label("mix"), label("out"), label("meter"), label("analysis"), label("spectrum"))
+	b.WriteString(spectrogram(label("spectrum"), label("spectrogram")))
+	return b.String()
+}
+
+func num(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,110 @@
+package ffmpeg
+
+import (
+	"screw/audio"
+	"strings"
+	"testing"
+)
+
+func TestFilterComplexDefault(t *testing.T) {
+	variants, err := audio.ResolveVariants(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "[0:a]aresample=44100,asplit=2[in][source];" +
+		"[in][1:a]afir=dry=10:wet=10[reverbed];" +
+		"[reverbed]highpass=f=40,lowpass=f=2300[filtered];" +
+		"[filtered]asetrate=44100*0.9,aresample=44100,atempo=0.97[mix];" +
+		"[mix]asplit=3[out][meter][analysis]"
+	if got := filterComplex(variants, graph{horizon: maxChopHorizon}); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestFilterComplexExplicitZero(t *testing.T) {
+	tests := []struct {
+		name   string
+		params audio.Params
+		want   string
+	}{
+		{"no reverb", audio.Params{Wet: pointer(0)},
+			"[1:a]anullsink;[in]highpass=f=40,lowpass=f=2300[filtered];[filtered]asetrate"},
+		{"no high-pass", audio.Params{HighPass: pointer(0)},
+			"[in][1:a]afir=dry=10:wet=10[reverbed];[reverbed]lowpass=f=2300[filtered];[filtered]asetrate"},
+		{"no low-pass", audio.Params{LowPass: pointer(0)},
+			"[in][1:a]afir=dry=10:wet=10[reverbed];[reverbed]highpass=f=40[filtered];[filtered]asetrate"},
+		{"no dry", audio.Params{Dry: pointer(0), HighPass: pointer(0), LowPass: pointer(0)},
+			"[in][1:a]afir=dry=0:wet=10[reverbed];[reverbed]asetrate"},
+		{"nothing", audio.Params{Wet: pointer(0), HighPass: pointer(0), LowPass: pointer(0)},
+			"[1:a]anullsink;[in]asetrate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants, err := audio.ResolveVariants([]audio.Params{tt.params})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := filterComplex(variants, graph{horizon: maxChopHorizon})
+			if _, chain, _ := strings.Cut(got, ";"); !strings.HasPrefix(chain, tt.want) {
+				t.Errorf("expected the chain to start with\n%s\ngot\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterComplexSpectrum(t *testing.T) {
+	variants, err := audio.ResolveVariants(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "[0:a]aresample=44100,asplit=3[in][source][sourcespectrum];" +
+		"[sourcespectrum]" + spectrumPic + "[sourcespectrogram];" +
+		"[in][1:a]afir=dry=10:wet=10[reverbed];" +
+		"[reverbed]highpass=f=40,lowpass=f=2300[filtered];" +
+		"[filtered]asetrate=44100*0.9,aresample=44100,atempo=0.97[mix];" +
+		"[mix]asplit=4[out][meter][analysis][spectrum];" +
+		"[spectrum]" + spectrumPic + "[spectrogram]"
+	if got := filterComplex(variants, graph{horizon: maxChopHorizon, spectrum: true}); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestChopGraph(t *testing.T) {
+	chop := audio.Chop{BPM: 120, Every: 4, Length: 1, Repeats: 2}
+	graph := chopGraph(chop, "[in]", "[out]", "c", 4)
+
+	// Two cycles of 2s, chopping the last beat of each.
+	if !strings.HasPrefix(graph, "[in]asegment=timestamps=1.500|2.000|3.500|4.000[cs0]") {
+		t.Errorf("unexpected segments: %s", graph)
+	}
+	if !strings.HasSuffix(graph, "concat=n=9:v=0:a=1[out]") {
+		t.Errorf("expected 3 plain segments and 2 chops played 3 times, got: %s", graph)
+	}
+	if got := chopGraph(chop, "[in]", "[out]", "c", 0); got != "[in]anull[out]" {
+		t.Errorf("expected passthrough with no horizon, got %s", got)
+	}
+}
+
+func TestStretch(t *testing.T) {
+	tests := []struct {
+		name       string
+		params     audio.Params
+		rubberband bool
+		want       string
+	}{
+		{"coupled", audio.Params{Mode: audio.ModeCoupled, Speed: pointer(0.9), Tempo: pointer(0.97)}, true, "asetrate=44100*0.9,aresample=44100,atempo=0.97"},
+		{"tempo only", audio.Params{Mode: audio.ModeIndependent, Speed: pointer(0.8), Tempo: pointer(1)}, false, "atempo=0.8"},
+		{"very slow", audio.Params{Mode: audio.ModeIndependent, Speed: pointer(0.2), Tempo: pointer(1)}, false, "atempo=0.5,atempo=0.5,atempo=0.8"},
+		{"octave down", audio.Params{Mode: audio.ModeIndependent, Speed: pointer(1), Tempo: pointer(1), Pitch: pointer(-12)}, false, "asetrate=44100*0.5,aresample=44100,atempo=2"},
+		{"rubberband", audio.Params{Mode: audio.ModeIndependent, Speed: pointer(0.5), Tempo: pointer(1), Pitch: pointer(12)}, true, "rubberband=tempo=0.5:pitch=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stretch(tt.params, tt.rubberband); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
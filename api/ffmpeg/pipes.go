@@ -0,0 +1,37 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"os"
+)
+
+// extraPipes hands out the file descriptors after stderr to the child.
+type extraPipes struct {
+	readers []*os.File
+	writers []*os.File
+}
+
+// add returns the ffmpeg target for a new pipe and the end we read from.
+func (p *extraPipes) add() (string, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", nil, err
+	}
+	p.readers = append(p.readers, r)
+	p.writers = append(p.writers, w)
+	// ExtraFiles[i] becomes fd 3+i in the child.
+	return fmt.Sprintf("pipe:%d", 2+len(p.writers)), r, nil
+}
+
+// closeWriters must run once the child started, it holds its own copies.
+func (p *extraPipes) closeWriters() {
+	for _, w := range p.writers {
+		w.Close()
+	}
+}
+
+func (p *extraPipes) closeReaders() {
+	for _, r := range p.readers {
+		r.Close()
+	}
+}
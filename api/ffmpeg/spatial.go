@@ -0,0 +1,39 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"math"
+	"screw/audio"
+	"strings"
+)
+
+// spatialStages is a filter chain to append to the mix, starting with a
+// comma, or nothing if no stage is set. The stages need two channels.
+func spatialStages(s audio.Spatial) string {
+	var stages []string
+	if ms := s.MidSide; ms != nil {
+		// Encode to mid/side, filter the sides, decode back with the gains.
+		stages = append(stages, "pan=stereo|c0=0.5*c0+0.5*c1|c1=0.5*c0-0.5*c1")
+		if ms.SideHighPass > 0 {
+			stages = append(stages, "highpass=f="+num(ms.SideHighPass)+":channels=FR")
+		}
+		mid, side := num(gain(ms.Mid)), num(gain(ms.Side))
+		stages = append(stages, fmt.Sprintf("pan=stereo|c0=%s*c0+%s*c1|c1=%s*c0-%s*c1", mid, side, mid, side))
+	}
+	if w := s.Width; w != nil && *w != 1 {
+		stages = append(stages, "extrastereo=m="+num(*w))
+	}
+	if p := s.Pan; p != nil {
+		// Both channels follow the same LFO half a cycle apart.
+		stages = append(stages, fmt.Sprintf("apulsator=mode=sine:hz=%s:amount=%s:offset_l=0:offset_r=0.5", num(p.Rate), num(p.Depth)))
+	}
+	if len(stages) == 0 {
+		return ""
+	}
+	return ",aformat=channel_layouts=stereo," + strings.Join(stages, ",")
+}
+
+// gain converts dB to a linear factor, rounded to keep the graph readable.
+func gain(db float64) float64 {
+	return math.Round(math.Pow(10, db/20)*1e6) / 1e6
+}
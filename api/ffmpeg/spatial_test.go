@@ -0,0 +1,70 @@
+package ffmpeg
+
+import (
+	"screw/audio"
+	"strings"
+	"testing"
+)
+
+func TestSpatialStages(t *testing.T) {
+	tests := []struct {
+		name    string
+		spatial audio.Spatial
+		want    string
+	}{
+		{"unset", audio.Spatial{}, ""},
+		{
+			"widen",
+			audio.Spatial{Width: pointer(1.8)},
+			",aformat=channel_layouts=stereo,extrastereo=m=1.8",
+		},
+		{
+			"mono",
+			audio.Spatial{Width: pointer(0)},
+			",aformat=channel_layouts=stereo,extrastereo=m=0",
+		},
+		{
+			"8d",
+			audio.Spatial{Pan: &audio.AutoPan{}},
+			",aformat=channel_layouts=stereo,apulsator=mode=sine:hz=0.125:amount=1:offset_l=0:offset_r=0.5",
+		},
+		{
+			"mid/side",
+			audio.Spatial{MidSide: &audio.MidSide{Mid: 0, Side: 6, SideHighPass: 120}},
+			",aformat=channel_layouts=stereo," +
+				"pan=stereo|c0=0.5*c0+0.5*c1|c1=0.5*c0-0.5*c1," +
+				"highpass=f=120:channels=FR," +
+				"pan=stereo|c0=1*c0+1.995262*c1|c1=1*c0-1.995262*c1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spatialStages(*audio.Params{Spatial: &tt.spatial}.WithDefaults().Spatial); got != tt.want {
+				t.Errorf("expected\n%s\ngot\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSpatialPreset(t *testing.T) {
+	variants, err := audio.ResolveVariants([]audio.Params{{Preset: "8d", Spatial: &audio.Spatial{Width: pointer(2), Pan: &audio.AutoPan{Rate: 0.25}}}, {Preset: "8d"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := variants[0].Spatial.Pan; p.Rate != 0.25 || p.Depth != 1 {
+		t.Errorf("expected the pan rate override with the default depth, got %+v", p)
+	}
+
+	got := filterComplex(variants, graph{horizon: maxChopHorizon})
+	want := "[filtered1]asetrate=44100*0.9,aresample=44100,atempo=0.97" +
+		",aformat=channel_layouts=stereo,extrastereo=m=1.5,apulsator=mode=sine:hz=0.125:amount=1:offset_l=0:offset_r=0.5" +
+		"[mix1]"
+	if !strings.Contains(got, want) {
+		t.Errorf("expected the spatial stages after the speed change\n%s\nin\n%s", want, got)
+	}
+
+}
+
+func pointer(v float64) *float64 {
+	return &v
+}
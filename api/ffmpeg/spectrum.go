@@ -0,0 +1,15 @@
+package ffmpeg
+
+// A log frequency axis gives the 40 Hz highpass as much room as the
+// lowpass in the kHz range. The channels are mixed down first, the filter
+// keeps every sample in memory until the end of the input.
+const spectrumPic = "aformat=channel_layouts=mono,showspectrumpic=s=1024x512:scale=log:fscale=log"
+
+func spectrogram(in, out string) string {
+	return in + spectrumPic + out
+}
+
+// spectrogramArgs writes the single frame of a [spectrogram] pad to path.
+func spectrogramArgs(label, path string) []string {
+	return []string{"-map", label, "-frames:v", "1", "-c:v", "png", "-update", "1", path}
+}
@@ -0,0 +1,198 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	logTailLines   = 40
+	maxLogLineSize = 512
+	// maxLogScanSize is where a line without an end is cut, the scanner
+	// gives up on longer tokens.
+	maxLogScanSize = 64 << 10
+	// maxWarnings is how many warnings make it into the Report.
+	maxWarnings = 20
+)
+
+type LogKind int
+
+const (
+	// LogWarning is anything ffmpeg logs and carries on after, like a
+	// corrupt frame it skips.
+	LogWarning LogKind = iota
+	// LogFatal means the input can't be read or ffmpeg gave up.
+	LogFatal
+	// LogUnsupportedCodec means a decoder or encoder is missing.
+	LogUnsupportedCodec
+)
+
+func (k LogKind) String() string {
+	switch k {
+	case LogFatal:
+		return "fatal decode error"
+	case LogUnsupportedCodec:
+		return "unsupported codec"
+	}
+	return "warning"
+}
+
+var (
+	// -loglevel level+warning prefixes every line with its level.
+	logLevel = regexp.MustCompile(`\[(panic|fatal|error|warning)\] `)
+
+	unsupportedCodecLines = []string{
+		"unknown decoder",
+		"unknown encoder",
+		") not found", // Decoder (codec x) not found for input stream
+		"unsupported codec",
+		"codec not currently supported",
+	}
+	// Corrupt packets get skipped, even when the reason sounds fatal.
+	recoverableLines = []string{
+		"error while decoding stream",
+	}
+	fatalLines = []string{
+		"invalid data found when processing input",
+		"could not find codec parameters",
+		"moov atom not found",
+		"error opening input",
+		"error during demuxing",
+		"does not contain any stream",
+		"conversion failed",
+		"nothing was written into output file",
+	}
+)
+
+func classify(line string) LogKind {
+	lower := strings.ToLower(line)
+	for _, s := range recoverableLines {
+		if strings.Contains(lower, s) {
+			return LogWarning
+		}
+	}
+	for _, s := range unsupportedCodecLines {
+		if strings.Contains(lower, s) {
+			return LogUnsupportedCodec
+		}
+	}
+	for _, s := range fatalLines {
+		if strings.Contains(lower, s) {
+			return LogFatal
+		}
+	}
+	if m := logLevel.FindStringSubmatch(line); m != nil && (m[1] == "fatal" || m[1] == "panic") {
+		return LogFatal
+	}
+	return LogWarning
+}
+
+// Error is a failure ffmpeg logged, with the lines it logged before it.
+type Error struct {
+	Kind LogKind
+	Line string
+	Tail []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ffmpeg %s: %s\n%s", e.Kind, e.Line, strings.Join(e.Tail, "\n"))
+}
+
+// logTail keeps the last lines ffmpeg logged.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogTail() *logTail {
+	return &logTail{lines: make([]string, logTailLines)}
+}
+
+func truncateLine(line string) string {
+	if len(line) > maxLogLineSize {
+		return line[:maxLogLineSize] + "..."
+	}
+	return line
+}
+
+func (t *logTail) add(line string) {
+	line = truncateLine(line)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	t.full = t.full || t.next == 0
+}
+
+// Lines returns the tail, oldest first.
+func (t *logTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		return append([]string(nil), t.lines[:t.next]...)
+	}
+	return append(append([]string(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// scanLogLines splits on \n and on the \r ffmpeg uses to redraw a line.
+// Lines longer than maxLogScanSize come in pieces.
+func scanLogLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if len(data) >= maxLogScanSize {
+		return len(data), data, nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// monitor drains stderr until ffmpeg closes it, so ffmpeg never blocks on a
+// full pipe. Warnings are collected for the Report, the first fatal line is
+// sent to ErrChan with the tail of the log.
+func (f *FFMPEG) monitor() {
+	scanner := bufio.NewScanner(f.Stderr)
+	scanner.Buffer(make([]byte, 4096), maxLogScanSize)
+	scanner.Split(scanLogLines)
+	failed := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		f.log.add(line)
+
+		kind := classify(line)
+		if kind == LogWarning {
+			slog.Warn("ffmpeg", "line", line)
+			if len(f.warnings) < maxWarnings {
+				f.warnings = append(f.warnings, truncateLine(line))
+			}
+			continue
+		}
+		if failed {
+			continue
+		}
+		failed = true
+		tail := f.log.Lines()
+		slog.Error("ffmpeg failed", "kind", kind.String(), "line", line, "tail", tail)
+		f.fail(&Error{Kind: kind, Line: line, Tail: tail})
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		slog.Warn("Error reading ffmpeg stderr", "err", err)
+		// ffmpeg still blocks if nobody reads what it logs.
+		io.Copy(io.Discard, f.Stderr)
+	}
+}
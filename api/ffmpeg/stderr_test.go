@@ -0,0 +1,98 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		line string
+		want LogKind
+	}{
+		{"[mp3float @ 0x55d0] [error] Header missing", LogWarning},
+		{"[aac @ 0x55d0] [warning] Queue input is backward in time", LogWarning},
+		{"[error] Error while decoding stream #0:0: Invalid data found when processing input", LogWarning},
+		{"[in#0 @ 0x55d0] [error] Error opening input: Invalid data found when processing input", LogFatal},
+		{"[mov,mp4,m4a,3gp,3g2,mj2 @ 0x55d0] [error] moov atom not found", LogFatal},
+		{"[fatal] Some other failure", LogFatal},
+		{"[error] Decoder (codec ape) not found for input stream #0:0", LogUnsupportedCodec},
+		{"[error] Unknown encoder 'libmp3lame'", LogUnsupportedCodec},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.line); got != tt.want {
+			t.Errorf("%q: expected %v, got %v", tt.line, tt.want, got)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	r, w := io.Pipe()
+	f := &FFMPEG{Stderr: r, ErrChan: make(chan error, 3), log: newLogTail()}
+	done := make(chan struct{})
+	go func() {
+		f.monitor()
+		close(done)
+	}()
+
+	for i := range logTailLines {
+		fmt.Fprintf(w, "[mp3float @ 0x1] [error] Header missing %d\n", i)
+	}
+	select {
+	case err := <-f.ErrChan:
+		t.Fatalf("expected warnings not to fail, got %v", err)
+	default:
+	}
+
+	fmt.Fprint(w, "[error] Error opening input: Invalid data found when processing input\r")
+	// stderr keeps being drained after a failure.
+	fmt.Fprint(w, "[fatal] Conversion failed!\n")
+	w.Close()
+	<-done
+
+	if len(f.ErrChan) != 1 {
+		t.Fatalf("expected exactly one failure, got %d", len(f.ErrChan))
+	}
+	var ffmpegErr *Error
+	if err := <-f.ErrChan; !errors.As(err, &ffmpegErr) || ffmpegErr.Kind != LogFatal {
+		t.Fatalf("expected a fatal ffmpeg error, got %v", err)
+	}
+	if len(ffmpegErr.Tail) != logTailLines || !strings.HasSuffix(ffmpegErr.Tail[0], "Header missing 1") {
+		t.Errorf("expected the last %d lines in the tail, got %q", logTailLines, ffmpegErr.Tail)
+	}
+	if !strings.Contains(ffmpegErr.Error(), "Header missing 39") {
+		t.Errorf("expected the tail in the message, got %q", ffmpegErr.Error())
+	}
+	if len(f.warnings) != maxWarnings || !strings.HasSuffix(f.warnings[0], "Header missing 0") {
+		t.Errorf("expected the first %d warnings to be kept, got %q", maxWarnings, f.warnings)
+	}
+}
+
+func TestMonitorLongLines(t *testing.T) {
+	r, w := io.Pipe()
+	f := &FFMPEG{Stderr: r, ErrChan: make(chan error, 1), log: newLogTail()}
+	done := make(chan struct{})
+	go func() {
+		f.monitor()
+		close(done)
+	}()
+
+	// Longer than the scanner takes, stderr has to be drained past it.
+	fmt.Fprint(w, "[warning] "+strings.Repeat("x", 4*maxLogScanSize)+"\n")
+	fmt.Fprint(w, "[fatal] Conversion failed!\n")
+	w.Close()
+	<-done
+
+	var ffmpegErr *Error
+	if err := <-f.ErrChan; !errors.As(err, &ffmpegErr) || ffmpegErr.Line != "[fatal] Conversion failed!" {
+		t.Fatalf("expected the line after the long one to fail, got %v", err)
+	}
+	for _, line := range ffmpegErr.Tail {
+		if len(line) > maxLogLineSize+len("...") {
+			t.Errorf("expected lines to be cut in the tail, got %d bytes", len(line))
+		}
+	}
+}
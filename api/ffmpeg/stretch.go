@@ -0,0 +1,60 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"screw/audio"
+	"strings"
+	"sync"
+)
+
+// hasRubberband reports whether the ffmpeg binary has the rubberband filter
+// compiled in. Most distro builds don't.
+var hasRubberband = sync.OnceValue(func() bool {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "rubberband" {
+			return true
+		}
+	}
+	return false
+})
+
+// stretch is the speed stage of a variant.
+func stretch(p audio.Params, rubberband bool) string {
+	if p.Mode != audio.ModeIndependent {
+		return fmt.Sprintf("asetrate=%d*%s,aresample=%d,atempo=%s", workingRate, num(*p.Speed), workingRate, num(*p.Tempo))
+	}
+
+	tempo := *p.Speed * *p.Tempo
+	ratio := math.Pow(2, p.Semitones()/12)
+	if rubberband {
+		return fmt.Sprintf("rubberband=tempo=%s:pitch=%s", num(tempo), num(ratio))
+	}
+	if p.Semitones() == 0 {
+		return atempo(tempo)
+	}
+	// Resampling shifts the pitch and the tempo by the same ratio, atempo
+	// takes the tempo back to where it should be.
+	return fmt.Sprintf("asetrate=%d*%s,aresample=%d,%s", workingRate, num(ratio), workingRate, atempo(tempo/ratio))
+}
+
+// atempo chains as many atempo filters as needed, each one only keeps its
+// quality in [0.5, 2].
+func atempo(factor float64) string {
+	var stages []string
+	for factor < 0.5 {
+		stages = append(stages, "atempo=0.5")
+		factor /= 0.5
+	}
+	for factor > 2 {
+		stages = append(stages, "atempo=2")
+		factor /= 2
+	}
+	factor = math.Round(factor*1e6) / 1e6
+	return strings.Join(append(stages, "atempo="+num(factor)), ",")
+}
@@ -52,6 +52,42 @@ func Unauthorized(err error, desc string) *Error {
 	}
 }
 
+func Forbidden(err error, desc string) *Error {
+	return &Error{
+		HTTPMessage: "Forbidden",
+		Desc:        desc,
+		Code:        http.StatusForbidden,
+		Error:       err,
+	}
+}
+
+func NotFound(err error, desc string) *Error {
+	return &Error{
+		HTTPMessage: "Not found",
+		Desc:        desc,
+		Code:        http.StatusNotFound,
+		Error:       err,
+	}
+}
+
+func Conflict(err error, desc string) *Error {
+	return &Error{
+		HTTPMessage: "Conflict",
+		Desc:        desc,
+		Code:        http.StatusConflict,
+		Error:       err,
+	}
+}
+
+func TooManyRequests(err error, desc string) *Error {
+	return &Error{
+		HTTPMessage: "Too many requests",
+		Desc:        desc,
+		Code:        http.StatusTooManyRequests,
+		Error:       err,
+	}
+}
+
 func WS(conn *websocket.Conn, err error, desc string) {
 	code := websocket.CloseInternalServerErr
 	if errors.Is(err, context.Canceled) {
@@ -0,0 +1,123 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Mailer delivers messages to users.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// checkHeaders keeps user input from adding headers.
+func checkHeaders(msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("header with a line break")
+	}
+	return nil
+}
+
+type SMTPCfg struct {
+	Host     string
+	Port     string // defaults to 587
+	Username string
+	Password string
+	From     string
+}
+
+// SMTP sends through a relay, with STARTTLS when the server offers it.
+// net/smtp refuses to send the password over a connection without TLS,
+// except to localhost.
+type SMTP struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTP(cfg SMTPCfg) *SMTP {
+	if cfg.Port == "" {
+		cfg.Port = "587"
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return &SMTP{addr: net.JoinHostPort(cfg.Host, cfg.Port), host: cfg.Host, auth: auth, from: cfg.From}
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+	// smtp.SendMail doesn't take a context, it is checked before dialing.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, format(s.from, msg, time.Now())); err != nil {
+		return fmt.Errorf("error sending mail: %w", err)
+	}
+	return nil
+}
+
+// File writes messages instead of sending them, for development and tests.
+type File struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewFile(w io.Writer) *File {
+	return &File{w: w}
+}
+
+// OpenFile appends messages to the file at path.
+func OpenFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening mail file: %w", err)
+	}
+	return NewFile(f), nil
+}
+
+func (f *File) Send(ctx context.Context, msg Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(append(format("screw", msg, time.Now()), "\r\n\r\n"...)); err != nil {
+		return fmt.Errorf("error writing mail: %w", err)
+	}
+	slog.Info("Mail written", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	msg := Message{To: "producer@example.com", Subject: "Log in to screw ✓", Body: "Hi\nthere"}
+	got := string(format("screw <noreply@example.com>", msg, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+	for _, want := range []string{
+		"From: screw <noreply@example.com>\r\n",
+		"To: producer@example.com\r\n",
+		"Subject: =?utf-8?q?Log_in_to_screw_=E2=9C=93?=\r\n",
+		"Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+		"\r\n\r\nHi\r\nthere",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewFile(&buf)
+	if err := f.Send(context.Background(), Message{To: "producer@example.com", Subject: "Hi", Body: "link"}); err != nil {
+		t.Fatalf("error sending: %v", err)
+	}
+	if !strings.Contains(buf.String(), "To: producer@example.com") || !strings.Contains(buf.String(), "link") {
+		t.Errorf("expected the message in the file, got %q", buf.String())
+	}
+
+	err := f.Send(context.Background(), Message{To: "producer@example.com\r\nBcc: victim@example.com", Subject: "Hi"})
+	if err == nil {
+		t.Error("expected a header injection to be refused")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"screw/server"
+	"strings"
 )
 
 func main() {
@@ -13,8 +14,47 @@ func main() {
 		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
 		Env:          os.Getenv("ENV"),
 		DBPath:       "dev.db",
+		TracksDir:    "data/tracks",
+		Processor:    os.Getenv("PROCESSOR"),
+		SigningKey:   os.Getenv("SIGNING_KEY"),
+		OIDC: server.OIDCCfg{
+			Name:         os.Getenv("OIDC_NAME"),
+			Issuer:       os.Getenv("OIDC_ISSUER"),
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			TrustEmail:   os.Getenv("OIDC_TRUST_EMAIL") == "true",
+		},
+		GitHub: server.ClientCfg{
+			ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
+			ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		},
+		Discord: server.ClientCfg{
+			ClientID:     os.Getenv("DISCORD_CLIENT_ID"),
+			ClientSecret: os.Getenv("DISCORD_CLIENT_SECRET"),
+		},
+		AdminEmails:    list(os.Getenv("ADMIN_EMAILS")),
+		TrustedProxies: list(os.Getenv("TRUSTED_PROXIES")),
+		Mail: server.MailCfg{
+			SMTPHost:     os.Getenv("SMTP_HOST"),
+			SMTPPort:     os.Getenv("SMTP_PORT"),
+			SMTPUsername: os.Getenv("SMTP_USERNAME"),
+			SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+			From:         os.Getenv("MAIL_FROM"),
+			File:         os.Getenv("MAIL_FILE"),
+		},
 	}
 	s := server.New(cfg)
 	ctx := context.Background()
 	s.Start(ctx)
 }
+
+// list splits a comma separated variable, like ADMIN_EMAILS.
+func list(env string) []string {
+	var items []string
+	for _, item := range strings.Split(env, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
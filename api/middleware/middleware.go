@@ -49,8 +49,8 @@ func CORS(allowedOrigins map[string]bool) Middleware {
 			_, allowed := allowedOrigins[origin]
 			if allowed {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 				w.Header().Set("Access-Control-Allow-Credentials", "true")
 			}
 
@@ -64,15 +64,22 @@ func CORS(allowedOrigins map[string]bool) Middleware {
 	}
 }
 
-func Protect(protectedRoutes map[string]bool, sm *session.Manager) Middleware {
+// Protect puts the user of the request on the context. Protected routes need
+// a session cookie or an API token, other routes take an API token when one
+// is sent. Every authenticated route needs an entry in routePermissions, and
+// is only allowed when the role of the user, and the scopes of a token, grant
+// it. Routes without one are refused, so a new handler is closed until it is
+// given a permission.
+func Protect(protectedRoutes map[string]bool, routePermissions map[string]string, sm *session.Manager) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if _, protected := protectedRoutes[r.URL.Path]; !protected {
+			_, hasToken := session.BearerToken(r)
+			if protected, _ := matchRoute(protectedRoutes, r.URL.Path); !protected && !hasToken {
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			result, err := sm.GetCurrentSession(r)
+			result, err := sm.Authenticate(r)
 			if err != nil {
 				slog.Error("Error getting session", "error", err)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -83,6 +90,12 @@ func Protect(protectedRoutes map[string]bool, sm *session.Manager) Middleware {
 				http.Error(w, "No active session", http.StatusUnauthorized)
 				return
 			}
+			permission, ok := matchRoute(routePermissions, r.URL.Path)
+			if !ok || !result.Can(permission) {
+				slog.Error("Permission denied", "path", r.URL.Path, "permission", permission, "userID", result.User.ID, "role", result.User.Role)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
 			// add user data to context
 			ctx := context.WithValue(r.Context(), session.SessionContextKey, result)
 			next.ServeHTTP(w, r.WithContext(ctx))
@@ -90,7 +103,26 @@ func Protect(protectedRoutes map[string]bool, sm *session.Manager) Middleware {
 	}
 }
 
-func RateLimit(rps float64, burst int) Middleware {
+// matchRoute matches paths exactly, except for routes ending in a slash
+// which match everything below them, like in a ServeMux. The longest of
+// those wins.
+func matchRoute[V any](routes map[string]V, path string) (V, bool) {
+	if v, ok := routes[path]; ok {
+		return v, true
+	}
+	var match V
+	longest := ""
+	for route, v := range routes {
+		if strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) && len(route) > len(longest) {
+			match, longest = v, route
+		}
+	}
+	return match, longest != ""
+}
+
+// RateLimit limits the requests of every client, told apart by the address
+// sm.ClientIP finds so a client can't pick its own key with X-Forwarded-For.
+func RateLimit(rps float64, burst int, sm *session.Manager) Middleware {
 	type limiterEntry struct {
 		limiter  *rate.Limiter
 		lastSeen time.Time
@@ -116,15 +148,7 @@ func RateLimit(rps float64, burst int) Middleware {
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := r.Header.Get("X-Forwarded-For")
-			if ip == "" {
-				ip = r.RemoteAddr
-				if strings.Contains(ip, "[") {
-					ip = strings.Split(strings.Split(ip, "]")[0], "[")[1]
-				} else {
-					ip = strings.Split(ip, ":")[0]
-				}
-			}
+			ip := sm.ClientIP(r)
 
 			var entry *limiterEntry
 			value, loaded := limiters.Load(ip)
@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"screw/session"
+	"screw/store"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProtect(t *testing.T) {
+	s, err := store.New("./test.db")
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer func() {
+		if err := os.Remove("./test.db"); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Failed to remove test database: %v", err)
+		}
+	}()
+	userID, err := s.CreateUser(&store.User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	sm := session.NewManager(s, 30, 15)
+	cookie, _ := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	jobsToken, _, _ := sm.CreateAPIToken(userID, "batch", []string{store.PermJobsWrite}, 0)
+	profileToken, _, _ := sm.CreateAPIToken(userID, "whoami", []string{store.PermProfileRead}, 0)
+	adminID, err := s.CreateUser(&store.User{GoogleID: "2", Email: "admin@example.com", Role: store.RoleAdmin})
+	if err != nil {
+		t.Fatalf("failed to create admin: %v", err)
+	}
+	adminCookie, _ := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), adminID)
+	adminJobsToken, _, _ := sm.CreateAPIToken(adminID, "batch", []string{store.PermJobsWrite}, 0)
+
+	handler := Protect(
+		map[string]bool{"/api/ws": true, "/api/login/session": true, "/api/tokens": true, "/api/sessions/": true, "/api/admin/": true},
+		map[string]string{
+			"/api/ws":            store.PermJobsWrite,
+			"/api/login/session": store.PermProfileRead,
+			"/api/tokens":        store.PermAccount,
+			"/api/admin/users/":  store.PermAdminUsers,
+			"/api/admin/users":   store.PermAdminUsers,
+		},
+		sm,
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if result, ok := session.FromContext(r.Context()); ok && result.User.ID != userID && result.User.ID != adminID {
+			t.Errorf("expected the user on the context, got %+v", result.User)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie string
+		token  string
+		want   int
+	}{
+		{"open route", "/api/open", "", "", http.StatusOK},
+		{"jobs without credentials", "/api/ws", "", "", http.StatusUnauthorized},
+		{"jobs with cookie", "/api/ws", cookie, "", http.StatusOK},
+		{"protected without credentials", "/api/login/session", "", "", http.StatusUnauthorized},
+		{"protected subtree", "/api/sessions/abc", "", "", http.StatusUnauthorized},
+		{"cookie", "/api/tokens", cookie, "", http.StatusOK},
+		{"token with scope", "/api/ws", "", jobsToken, http.StatusOK},
+		{"token without scope", "/api/ws", "", profileToken, http.StatusForbidden},
+		{"token on protected route", "/api/login/session", "", profileToken, http.StatusOK},
+		{"token on cookie only route", "/api/tokens", "", jobsToken, http.StatusForbidden},
+		{"user on admin route", "/api/admin/users", cookie, "", http.StatusForbidden},
+		{"admin on admin route", "/api/admin/users", adminCookie, "", http.StatusOK},
+		{"admin token without scope", "/api/admin/users", "", adminJobsToken, http.StatusForbidden},
+		{"admin on route without permission", "/api/admin/other", adminCookie, "", http.StatusForbidden},
+		{"cookie on route without permission", "/api/sessions/abc", cookie, "", http.StatusForbidden},
+		{"token on route without permission", "/api/open", "", jobsToken, http.StatusForbidden},
+		{"unknown token on open route", "/api/open", "", session.APITokenPrefix + "unknown", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: session.SessionCookieName, Value: tt.cookie})
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	handler := CORS(map[string]bool{"http://localhost:3001": true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the preflight to be answered by CORS")
+	}))
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/sessions/abc", nil)
+	r.Header.Set("Origin", "http://localhost:3001")
+	r.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+	r.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3001" {
+		t.Fatalf("expected the origin to be allowed, got %d %v", w.Code, w.Header())
+	}
+	if methods := strings.Split(w.Header().Get("Access-Control-Allow-Methods"), ", "); !slices.Contains(methods, http.MethodDelete) {
+		t.Errorf("expected DELETE to be allowed, got %v", methods)
+	}
+	if headers := strings.Split(w.Header().Get("Access-Control-Allow-Headers"), ", "); !slices.Contains(headers, "Authorization") {
+		t.Errorf("expected the Authorization header to be allowed, got %v", headers)
+	}
+
+	r.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected another origin not to be allowed, got %v", w.Header())
+	}
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	sm := session.NewManager(nil, 30, 15)
+	if err := sm.TrustProxies([]string{"10.0.0.1/32"}); err != nil {
+		t.Fatalf("error trusting proxy: %v", err)
+	}
+	handler := RateLimit(0.001, 1, sm)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(remoteAddr, forwardedFor string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/profile", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A direct client can't get a new bucket by making up a forwarded address.
+	if code := get("203.0.113.7:1234", "198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("expected the first request to pass, got %d", code)
+	}
+	if code := get("203.0.113.7:1234", "198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Errorf("expected a spoofed X-Forwarded-For to be limited, got %d", code)
+	}
+
+	// Behind the trusted proxy every client has its own bucket.
+	if code := get("10.0.0.1:5678", "198.51.100.3"); code != http.StatusOK {
+		t.Errorf("expected a client behind the proxy to pass, got %d", code)
+	}
+	if code := get("10.0.0.1:5678", "198.51.100.4"); code != http.StatusOK {
+		t.Errorf("expected another client behind the proxy to pass, got %d", code)
+	}
+	if code := get("10.0.0.1:5678", "198.51.100.3"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the first client behind the proxy to be limited, got %d", code)
+	}
+}
@@ -0,0 +1,240 @@
+package native
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"screw/audio"
+	"screw/dsp"
+	"sync"
+)
+
+const (
+	// OutputRate matches the aresample=44100 of the ffmpeg chain.
+	OutputRate = 44100
+
+	convolutionBlock = 4096
+	butterworthQ     = 0.707
+)
+
+// supported rejects the stages only the ffmpeg chain has.
+func supported(p audio.Params) error {
+	if p.Loudness != nil {
+		return errors.New("loudness normalization is not supported by the native processor")
+	}
+	if p.Spatial != nil {
+		return errors.New("spatial stages are not supported by the native processor")
+	}
+	if p.Chop != nil {
+		return errors.New("chops are not supported by the native processor")
+	}
+	return nil
+}
+
+// chain is the native version of one ffmpeg variant chain: convolution
+// reverb, band filters, the rate change and the tempo change.
+type chain struct {
+	convolvers []*dsp.Convolver // nil without reverb
+	gain       float64
+	highpass   []dsp.Biquad // nil when the filter is off
+	lowpass    []dsp.Biquad // nil when the filter is off
+	resamplers []*dsp.Resampler
+	stretcher  *dsp.Stretcher // nil when the tempo doesn't change
+}
+
+func newChain(p audio.Params, ir [][]float64, channels, rate int) *chain {
+	// Like afir, dry is the gain of the input to the convolution and wet
+	// the gain of its output. There is no dry path in the mix, and without
+	// wet the source goes through as is.
+	c := &chain{gain: 1}
+	if *p.Wet != 0 {
+		c.gain = *p.Dry * *p.Wet
+	}
+
+	// The same rate and tempo change as the ffmpeg fallback without
+	// rubberband, see ffmpeg.stretch.
+	rateChange, tempo := *p.Speed, *p.Tempo
+	if p.Mode == audio.ModeIndependent {
+		rateChange = math.Pow(2, p.Semitones()/12)
+		tempo = *p.Speed * *p.Tempo / rateChange
+	}
+
+	nyquist := float64(rate) / 2
+	for ch := 0; ch < channels; ch++ {
+		if *p.Wet != 0 {
+			c.convolvers = append(c.convolvers, dsp.NewConvolver(ir[ch%len(ir)], convolutionBlock))
+		}
+		if *p.HighPass > 0 {
+			c.highpass = append(c.highpass, dsp.HighPass(float64(rate), *p.HighPass, butterworthQ))
+		}
+		if *p.LowPass > 0 {
+			c.lowpass = append(c.lowpass, dsp.LowPass(float64(rate), math.Min(*p.LowPass, 0.95*nyquist), butterworthQ))
+		}
+		c.resamplers = append(c.resamplers, dsp.NewResampler(float64(rate)*rateChange, OutputRate))
+	}
+	if tempo != 1 {
+		c.stretcher = dsp.NewStretcher(channels, tempo)
+	}
+	return c
+}
+
+// process takes a block of source samples and returns what the chain has
+// ready at OutputRate. The final block flushes every stage.
+func (c *chain) process(block [][]float64, final bool) [][]float64 {
+	out := make([][]float64, len(block))
+	for ch, x := range block {
+		wet := x
+		if c.convolvers != nil {
+			wet = c.convolvers[ch].Process(x)
+			if final {
+				wet = append(wet, c.convolvers[ch].Flush()...)
+			}
+		}
+
+		mixed := make([]float64, len(wet))
+		for i, w := range wet {
+			s := c.gain * w
+			if c.highpass != nil {
+				s = c.highpass[ch].Process(s)
+			}
+			if c.lowpass != nil {
+				s = c.lowpass[ch].Process(s)
+			}
+			mixed[i] = s
+		}
+
+		out[ch] = c.resamplers[ch].Process(mixed)
+		if final {
+			out[ch] = append(out[ch], c.resamplers[ch].Flush()...)
+		}
+	}
+
+	if c.stretcher == nil {
+		return out
+	}
+	stretched := c.stretcher.Process(out)
+	if final {
+		for ch, rest := range c.stretcher.Flush() {
+			stretched[ch] = append(stretched[ch], rest...)
+		}
+	}
+	return stretched
+}
+
+// tap feeds a copy of the audio to one of the dsp meters at the rate it
+// wants.
+type tap struct {
+	resamplers []*dsp.Resampler
+	w          io.Writer
+}
+
+func newTap(channels int, from, to float64, w io.Writer) *tap {
+	t := &tap{w: w}
+	for ch := 0; ch < channels; ch++ {
+		t.resamplers = append(t.resamplers, dsp.NewResampler(from, to))
+	}
+	return t
+}
+
+func (t *tap) write(block [][]float64, final bool) {
+	out := make([][]float64, len(block))
+	for ch, x := range block {
+		out[ch] = t.resamplers[ch].Process(x)
+		if final {
+			out[ch] = append(out[ch], t.resamplers[ch].Flush()...)
+		}
+	}
+	t.w.Write(float32LE(out...))
+}
+
+func mono(block [][]float64) []float64 {
+	m := make([]float64, len(block[0]))
+	for _, x := range block {
+		for i, s := range x {
+			m[i] += s / float64(len(block))
+		}
+	}
+	return m
+}
+
+// stereo is what the loudness meter gets, mono is played on both sides and
+// anything past the first two channels is left out.
+func stereo(block [][]float64) [][]float64 {
+	if len(block) == 1 {
+		return [][]float64{block[0], block[0]}
+	}
+	return block[:2]
+}
+
+type irKey struct {
+	path string
+	rate int
+}
+
+var (
+	irMu    sync.Mutex
+	irCache = map[irKey][][]float64{}
+)
+
+// loadIR reads the impulse response at the given rate. Like afir with irnorm=1
+// and irlink, every channel is scaled by the largest sum of absolute values of
+// a channel. Responses are cached by path and rate.
+func loadIR(path string, rate int) ([][]float64, error) {
+	irMu.Lock()
+	defer irMu.Unlock()
+	if ir, ok := irCache[irKey{path, rate}]; ok {
+		return ir, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening IR: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	format, size, err := readWAVHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading IR: %w", err)
+	}
+	var data []byte
+	if size < 0 {
+		data, err = io.ReadAll(r)
+	} else {
+		data = make([]byte, size)
+		_, err = io.ReadFull(r, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading IR: %w", err)
+	}
+
+	ir := format.decode(data, make([][]float64, format.channels))
+	var loudest float64
+	for ch, x := range ir {
+		if format.rate != rate {
+			r := dsp.NewResampler(float64(format.rate), float64(rate))
+			x = append(r.Process(x), r.Flush()...)
+			ir[ch] = x
+		}
+		var sum float64
+		for _, s := range x {
+			sum += math.Abs(s)
+		}
+		loudest = math.Max(loudest, sum)
+	}
+	if loudest == 0 {
+		return nil, errors.New("IR is silent")
+	}
+	scale := 1 / loudest
+	for _, x := range ir {
+		for i := range x {
+			x[i] *= scale
+		}
+	}
+
+	irCache[irKey{path, rate}] = ir
+	return ir, nil
+}
@@ -0,0 +1,236 @@
+package native
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"screw/audio"
+	"screw/dsp"
+)
+
+// Format is the only output the native processor can write.
+const Format = "wav"
+
+const blockFrames = 4096
+
+// Processor runs the slowed + reverb chain in process, without ffmpeg. It
+// reads WAV and writes 16 bit WAV at OutputRate. It mirrors ffmpeg.FFMPEG:
+// the upload is written to it, every variant is read from its own output.
+type Processor struct {
+	input    *io.PipeWriter
+	reader   *io.PipeReader
+	outputs  []io.ReadCloser
+	writers  []*io.PipeWriter
+	errChan  chan error
+	bounded  bool
+	finished chan struct{}
+	err      error
+	report   audio.Report
+}
+
+func New(ctx context.Context, opts audio.Options) (*Processor, error) {
+	if opts.Live != nil {
+		return nil, errors.New("live input is not supported by the native processor")
+	}
+	if opts.Format != Format {
+		return nil, fmt.Errorf("format %q is not supported by the native processor, use %q", opts.Format, Format)
+	}
+	variants, err := audio.ResolveVariants(opts.Variants)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range variants {
+		if err := supported(v); err != nil {
+			return nil, fmt.Errorf("variant %d: %w", i, err)
+		}
+	}
+
+	reader, input := io.Pipe()
+	p := &Processor{
+		input:    input,
+		reader:   reader,
+		errChan:  make(chan error, 2+len(variants)),
+		bounded:  opts.Duration > 0,
+		finished: make(chan struct{}),
+	}
+	for range variants {
+		r, w := io.Pipe()
+		p.outputs = append(p.outputs, r)
+		p.writers = append(p.writers, w)
+	}
+
+	context.AfterFunc(ctx, p.Close)
+	go p.run(ctx, opts, variants)
+	return p, nil
+}
+
+func (p *Processor) Streams() []io.ReadCloser { return p.outputs }
+func (p *Processor) Errors() chan error       { return p.errChan }
+
+func (p *Processor) CloseInput() error {
+	return p.input.Close()
+}
+
+// Wait returns the error that stopped processing, if any.
+func (p *Processor) Wait() error {
+	<-p.finished
+	return p.err
+}
+
+func (p *Processor) Write(b []byte) (int, error) {
+	n, err := p.input.Write(b)
+	if err != nil {
+		if p.bounded && errors.Is(err, io.ErrClosedPipe) {
+			return n, err
+		}
+		p.fail(err)
+	}
+	return n, err
+}
+
+// Report waits for the chains to be flushed.
+func (p *Processor) Report() audio.Report {
+	<-p.finished
+	return p.report
+}
+
+func (p *Processor) Close() {
+	p.input.Close()
+	p.reader.Close()
+	for _, output := range p.outputs {
+		output.Close()
+	}
+}
+
+func (p *Processor) fail(err error) {
+	select {
+	case p.errChan <- err:
+	default:
+	}
+}
+
+func (p *Processor) run(ctx context.Context, opts audio.Options, variants []audio.Params) {
+	err := p.process(ctx, opts, variants)
+	for _, w := range p.writers {
+		w.CloseWithError(err)
+	}
+	if err != nil {
+		p.fail(err)
+	}
+	p.err = err
+	close(p.finished)
+
+	// Whatever follows the samples, or the rest of the upload past a
+	// preview, is not needed but the client still sends it.
+	io.Copy(io.Discard, p.reader)
+}
+
+func (p *Processor) process(ctx context.Context, opts audio.Options, variants []audio.Params) error {
+	in := bufio.NewReaderSize(p.reader, 64<<10)
+	format, remaining, err := readWAVHeader(in)
+	if err != nil {
+		return err
+	}
+	rate := float64(format.rate)
+	slog.Info("Native processing", "channels", format.channels, "rate", format.rate, "bits", format.bits)
+
+	ir, err := loadIR(audio.IRPath(), format.rate)
+	if err != nil {
+		return err
+	}
+
+	source := dsp.NewAnalyzer()
+	sourceTap := newTap(1, rate, dsp.AnalysisSampleRate, source)
+	var (
+		chains    []*chain
+		meters    []*dsp.LoudnessMeter
+		analyzers []*dsp.Analyzer
+		meterTaps []*tap
+		analysis  []*tap
+	)
+	for i, v := range variants {
+		meter, analyzer := dsp.NewLoudnessMeter(2), dsp.NewAnalyzer()
+		chains = append(chains, newChain(v, ir, format.channels, format.rate))
+		meters = append(meters, meter)
+		analyzers = append(analyzers, analyzer)
+		meterTaps = append(meterTaps, newTap(2, OutputRate, dsp.LoudnessSampleRate, meter))
+		analysis = append(analysis, newTap(1, OutputRate, dsp.AnalysisSampleRate, analyzer))
+		if _, err := p.writers[i].Write(wavHeader(format.channels, OutputRate)); err != nil {
+			return err
+		}
+	}
+
+	skip := int64(opts.Offset * rate)
+	limit := int64(-1)
+	if opts.Duration > 0 {
+		limit = int64(opts.Duration * rate)
+	}
+
+	frameSize := int64(format.frameSize())
+	buf := make([]byte, blockFrames*frameSize)
+	for final := false; !final; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := int64(len(buf))
+		if remaining >= 0 {
+			n = min(n, remaining-remaining%frameSize)
+		}
+		read, err := io.ReadFull(in, buf[:n])
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			final = true
+		case err != nil:
+			return fmt.Errorf("error reading input: %w", err)
+		}
+		if remaining >= 0 {
+			remaining -= int64(read)
+			final = final || remaining < frameSize
+		}
+
+		block := format.decode(buf[:read], make([][]float64, format.channels))
+		frames := int64(len(block[0]))
+		if drop := min(skip, frames); drop > 0 {
+			for ch := range block {
+				block[ch] = block[ch][drop:]
+			}
+			skip -= drop
+			frames -= drop
+		}
+		if limit >= 0 {
+			if frames >= limit {
+				for ch := range block {
+					block[ch] = block[ch][:limit]
+				}
+				frames, final = limit, true
+			}
+			limit -= frames
+		}
+
+		sourceTap.write([][]float64{mono(block)}, final)
+		for i, c := range chains {
+			out := c.process(block, final)
+			meterTaps[i].write(stereo(out), final)
+			analysis[i].write([][]float64{mono(out)}, final)
+			if len(out[0]) == 0 {
+				continue
+			}
+			if _, err := p.writers[i].Write(encode(out)); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.report = audio.Report{Source: source.Result()}
+	for i, meter := range meters {
+		p.report.Variants = append(p.report.Variants, audio.VariantReport{
+			Loudness: meter.Integrated(),
+			Analysis: analyzers[i].Result(),
+		})
+	}
+	return nil
+}
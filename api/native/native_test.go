@@ -0,0 +1,152 @@
+package native
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"screw/audio"
+	"testing"
+)
+
+func testWAV(seconds float64) []byte {
+	const rate = 44100
+	frames := int(seconds * rate)
+	left := make([]float64, frames)
+	right := make([]float64, frames)
+	for i := range left {
+		t := float64(i) / rate
+		left[i] = 0.3 * math.Sin(2*math.Pi*220*t)
+		right[i] = 0.3 * math.Sin(2*math.Pi*330*t)
+	}
+	b := wavHeader(2, rate)
+	// A known length, like any WAV file saved to disk.
+	binary.LittleEndian.PutUint32(b[40:], uint32(4*frames))
+	return append(b, encode([][]float64{left, right})...)
+}
+
+func process(t *testing.T, opts audio.Options, input []byte) ([][]byte, audio.Report) {
+	t.Helper()
+	t.Setenv("IR_PATH", "../audio/ir.wav")
+
+	p, err := New(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	go func() {
+		for len(input) > 0 {
+			n := min(len(input), 10000)
+			if _, err := p.Write(input[:n]); err != nil {
+				return
+			}
+			input = input[n:]
+		}
+	}()
+
+	outputs := make([][]byte, len(p.Streams()))
+	errs := make(chan error, len(outputs))
+	for i, stream := range p.Streams() {
+		go func() {
+			var err error
+			outputs[i], err = io.ReadAll(stream)
+			errs <- err
+		}()
+	}
+	for range outputs {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error reading output: %v", err)
+		}
+	}
+	return outputs, p.Report()
+}
+
+func TestProcessor(t *testing.T) {
+	outputs, report := process(t, audio.Options{
+		Format:   Format,
+		Variants: []audio.Params{{}, {Preset: "slowed"}},
+	}, testWAV(3))
+
+	wantSeconds := []float64{3 / 0.9 / 0.97, 3 / 0.85}
+	for i, output := range outputs {
+		format, size, err := readWAVHeader(bytes.NewReader(output))
+		if err != nil {
+			t.Fatalf("variant %d: invalid wav output: %v", i, err)
+		}
+		if format.rate != OutputRate || format.channels != 2 || size != -1 {
+			t.Errorf("variant %d: unexpected format %+v, size %d", i, format, size)
+		}
+		seconds := float64(len(output)-44) / 4 / OutputRate
+		if math.Abs(seconds-wantSeconds[i]) > 0.01 {
+			t.Errorf("variant %d: expected %.3fs of audio, got %.3fs", i, wantSeconds[i], seconds)
+		}
+	}
+
+	if len(report.Variants) != 2 {
+		t.Fatalf("expected a report for both variants, got %+v", report)
+	}
+	for i, v := range report.Variants {
+		if math.IsInf(v.Loudness, 0) || v.Loudness > 0 {
+			t.Errorf("variant %d: expected a measured loudness, got %v", i, v.Loudness)
+		}
+	}
+}
+
+func TestProcessorPreview(t *testing.T) {
+	outputs, _ := process(t, audio.Options{Format: Format, Offset: 1, Duration: 1}, testWAV(3))
+
+	seconds := float64(len(outputs[0])-44) / 4 / OutputRate
+	if want := 1 / 0.9 / 0.97; math.Abs(seconds-want) > 0.01 {
+		t.Errorf("expected %.3fs of audio, got %.3fs", want, seconds)
+	}
+}
+
+func TestChainExplicitZero(t *testing.T) {
+	zero := 0.0
+	variants, err := audio.ResolveVariants([]audio.Params{{Wet: &zero, HighPass: &zero, LowPass: &zero}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := newChain(variants[0], [][]float64{{1}}, 2, OutputRate)
+	if c.convolvers != nil || c.gain != 1 {
+		t.Errorf("expected no reverb with a wet of 0, got gain %v", c.gain)
+	}
+	if c.highpass != nil || c.lowpass != nil {
+		t.Error("expected the filters to be off")
+	}
+
+	block := [][]float64{make([]float64, 1000), make([]float64, 1000)}
+	block[0][0] = 1
+	out := c.process(block, true)
+	if len(out) != 2 || len(out[0]) == 0 {
+		t.Fatalf("expected audio from both channels, got %d channels", len(out))
+	}
+}
+
+func TestProcessorRejects(t *testing.T) {
+	invalid := []audio.Options{
+		{Format: "mp3"},
+		{Format: Format, Variants: []audio.Params{{Preset: "streaming"}}},
+		{Format: Format, Variants: []audio.Params{{Chop: &audio.Chop{BPM: 90}}}},
+	}
+	for _, opts := range invalid {
+		if _, err := New(context.Background(), opts); err == nil {
+			t.Errorf("expected error for %+v", opts)
+		}
+	}
+
+	p, err := New(context.Background(), audio.Options{Format: Format})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer p.Close()
+	go p.Write([]byte("ID3 this is not a wav file"))
+	if _, err := io.ReadAll(p.Streams()[0]); err == nil {
+		t.Error("expected an error for input that is not wav")
+	}
+	if err := <-p.Errors(); err == nil {
+		t.Error("expected the error on the error channel")
+	}
+}
@@ -0,0 +1,179 @@
+package native
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xfffe
+
+	// Streamed WAVs don't know their length up front. Readers take the
+	// maximum size as until EOF.
+	wavUnknownSize = math.MaxUint32
+)
+
+// wavFormat is the fmt chunk of a WAV file.
+type wavFormat struct {
+	channels int
+	rate     int
+	bits     int
+	float    bool
+}
+
+func (f wavFormat) frameSize() int {
+	return f.channels * f.bits / 8
+}
+
+// readWAVHeader reads up to the start of the samples. The size of the data
+// chunk is -1 when the writer streamed it and didn't know it.
+func readWAVHeader(r io.Reader) (wavFormat, int64, error) {
+	var format wavFormat
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return format, 0, fmt.Errorf("error reading wav header: %w", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return format, 0, errors.New("input is not a wav file")
+	}
+
+	var haveFormat bool
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return format, 0, fmt.Errorf("error reading wav chunk: %w", err)
+		}
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return format, 0, fmt.Errorf("invalid wav fmt chunk size %d", size)
+			}
+			chunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return format, 0, fmt.Errorf("error reading wav fmt chunk: %w", err)
+			}
+			var err error
+			if format, err = parseWAVFormat(chunk); err != nil {
+				return format, 0, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return format, 0, errors.New("wav data before fmt chunk")
+			}
+			if size == 0 || size == wavUnknownSize {
+				size = -1
+			}
+			return format, size, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return format, 0, fmt.Errorf("error skipping wav %q chunk: %w", id, err)
+			}
+		}
+	}
+}
+
+func parseWAVFormat(chunk []byte) (wavFormat, error) {
+	tag := binary.LittleEndian.Uint16(chunk[0:2])
+	format := wavFormat{
+		channels: int(binary.LittleEndian.Uint16(chunk[2:4])),
+		rate:     int(binary.LittleEndian.Uint32(chunk[4:8])),
+		bits:     int(binary.LittleEndian.Uint16(chunk[14:16])),
+	}
+	if tag == wavExtensible && len(chunk) >= 26 {
+		// The sub format GUID starts with the plain format tag.
+		tag = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+
+	switch {
+	case tag == wavPCM && (format.bits == 8 || format.bits == 16 || format.bits == 24 || format.bits == 32):
+	case tag == wavFloat && (format.bits == 32 || format.bits == 64):
+		format.float = true
+	default:
+		return format, fmt.Errorf("unsupported wav encoding: format %d, %d bits", tag, format.bits)
+	}
+	if format.channels < 1 || format.channels > 8 {
+		return format, fmt.Errorf("unsupported wav channel count %d", format.channels)
+	}
+	if format.rate < 8000 || format.rate > 192000 {
+		return format, fmt.Errorf("unsupported wav sample rate %d", format.rate)
+	}
+	return format, nil
+}
+
+// decode appends the samples of whole frames in b to one slice per channel.
+func (f wavFormat) decode(b []byte, channels [][]float64) [][]float64 {
+	size := f.bits / 8
+	frames := len(b) / f.frameSize()
+	for i := 0; i < frames; i++ {
+		for c := range channels {
+			s := b[(i*f.channels+c)*size:]
+			var x float64
+			switch {
+			case f.float && size == 4:
+				x = float64(math.Float32frombits(binary.LittleEndian.Uint32(s)))
+			case f.float:
+				x = math.Float64frombits(binary.LittleEndian.Uint64(s))
+			case size == 1:
+				x = (float64(s[0]) - 128) / 128
+			case size == 2:
+				x = float64(int16(binary.LittleEndian.Uint16(s))) / (1 << 15)
+			case size == 3:
+				x = float64(int32(uint32(s[0])<<8|uint32(s[1])<<16|uint32(s[2])<<24)>>8) / (1 << 23)
+			default:
+				x = float64(int32(binary.LittleEndian.Uint32(s))) / (1 << 31)
+			}
+			channels[c] = append(channels[c], x)
+		}
+	}
+	return channels
+}
+
+// wavHeader is the header of a 16 bit PCM stream of unknown length.
+func wavHeader(channels, rate int) []byte {
+	b := make([]byte, 0, 44)
+	b = append(b, "RIFF"...)
+	b = binary.LittleEndian.AppendUint32(b, wavUnknownSize)
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, wavPCM)
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate*channels*2))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels*2))
+	b = binary.LittleEndian.AppendUint16(b, 16)
+	b = append(b, "data"...)
+	return binary.LittleEndian.AppendUint32(b, wavUnknownSize)
+}
+
+// encode interleaves the channels into 16 bit PCM, clipping what's over
+// full scale.
+func encode(channels [][]float64) []byte {
+	b := make([]byte, 0, 2*len(channels)*len(channels[0]))
+	for i := range channels[0] {
+		for _, ch := range channels {
+			x := math.Round(math.Max(-1, math.Min(1, ch[i])) * math.MaxInt16)
+			b = binary.LittleEndian.AppendUint16(b, uint16(int16(x)))
+		}
+	}
+	return b
+}
+
+// float32LE interleaves the channels the way the dsp meters want them.
+func float32LE(channels ...[]float64) []byte {
+	b := make([]byte, 0, 4*len(channels)*len(channels[0]))
+	for i := range channels[0] {
+		for _, ch := range channels {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(ch[i])))
+		}
+	}
+	return b
+}
@@ -2,17 +2,25 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
+	"screw/admin"
 	"screw/auth"
+	"screw/cryptoutil"
 	"screw/herr"
+	"screw/mail"
 	mw "screw/middleware"
 	"screw/session"
 	"screw/store"
+	"screw/tracks"
 	"screw/ws"
+	"slices"
 	"sync"
 	"time"
 
@@ -21,16 +29,23 @@ import (
 )
 
 type server struct {
-	addr            string
-	clientId        string
-	clientSecret    string
-	env             string
-	store           store.Store
-	sessionManager  *session.Manager
-	ws              *ws.WS
-	google          *auth.Google
-	CORSAllowed     map[string]bool
-	protectedRoutes map[string]bool
+	addr             string
+	clientId         string
+	clientSecret     string
+	env              string
+	store            store.Store
+	sessionManager   *session.Manager
+	ws               *ws.WS
+	tracks           *tracks.Tracks
+	logins           []*auth.Flow
+	identities       *auth.Identities
+	passkeys         *auth.Passkeys
+	magicLinks       *auth.MagicLinks
+	twoFactor        *auth.TwoFactor
+	admin            *admin.Admin
+	CORSAllowed      map[string]bool
+	protectedRoutes  map[string]bool
+	routePermissions map[string]string
 }
 
 type ServerCfg struct {
@@ -39,66 +54,316 @@ type ServerCfg struct {
 	ClientSecret string
 	Env          string
 	DBPath       string
+	TracksDir    string
+	Processor    string // key of ws.Backends, defaults to ffmpeg
+	SigningKey   string // signs segment URLs, random when empty
+	OIDC         OIDCCfg
+	GitHub       ClientCfg
+	Discord      ClientCfg
+	AdminEmails  []string // users with these emails get the admin role
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies,
+	// the client IPs they pass on in headers are used.
+	TrustedProxies []string
+	Mail           MailCfg
+}
+
+// MailCfg enables email login when SMTPHost or File is set. File is for
+// development, mails are appended to it instead of being sent.
+type MailCfg struct {
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	From         string
+	File         string
+}
+
+// ClientCfg enables a login provider when ClientID is set.
+type ClientCfg struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// OIDCCfg enables login with a generic OpenID Connect provider when Issuer
+// is set.
+type OIDCCfg struct {
+	Name         string // defaults to oidc, routes are /api/login/{Name}
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	TrustEmail   bool // link first logins to accounts with the same email
 }
 
 func New(cfg ServerCfg) *server {
-	store, err := store.New(cfg.DBPath)
+	db, err := store.New(cfg.DBPath)
 	if err != nil {
 		log.Panicln("something went wrong creating the store:", err)
 	}
-	sessionManager := session.NewManager(store, 30, 15)
-	ws := ws.New(store)
-	googleCfg := auth.GoogleCgf{
+	sessionManager := session.NewManager(db, 30, 15)
+	if err := sessionManager.TrustProxies(cfg.TrustedProxies); err != nil {
+		log.Panicln("something went wrong reading the trusted proxies:", err)
+	}
+	if cfg.Processor == "" {
+		cfg.Processor = ws.DefaultBackend
+	}
+	backend, ok := ws.Backends[cfg.Processor]
+	if !ok {
+		log.Panicln("unknown processor:", cfg.Processor)
+	}
+	ws := ws.New(db, cfg.TracksDir, backend)
+	signingKey := []byte(cfg.SigningKey)
+	if len(signingKey) == 0 {
+		key, err := cryptoutil.Random()
+		if err != nil {
+			log.Panicln("something went wrong creating the signing key:", err)
+		}
+		slog.Warn("SIGNING_KEY is not set, signed URLs won't survive a restart")
+		signingKey = []byte(key)
+	}
+	seedAdmins(db, cfg.AdminEmails)
+	flowCfg := auth.FlowCfg{
+		Store:       db,
+		SessionMgr:  sessionManager,
+		Host:        cfg.Addr,
+		AdminEmails: cfg.AdminEmails,
+	}
+	// Google only returns addresses its users proved they own. GitHub and
+	// Discord logins with the email of an account have to be linked to it.
+	googleFlowCfg := flowCfg
+	googleFlowCfg.TrustEmail = true
+	logins := []*auth.Flow{auth.NewFlow(auth.NewGoogle(auth.OAuthCfg{
 		ClientID:     cfg.ClientId,
 		ClientSecret: cfg.ClientSecret,
-		Host:         cfg.Addr,
 		CallbackURL:  cfg.Addr + "/api/login/google/callback",
-		SessionMgr:   sessionManager,
-		Store:        store,
+	}), googleFlowCfg)}
+	if cfg.GitHub.ClientID != "" {
+		logins = append(logins, auth.NewFlow(auth.NewGitHub(auth.OAuthCfg{
+			ClientID:     cfg.GitHub.ClientID,
+			ClientSecret: cfg.GitHub.ClientSecret,
+			CallbackURL:  cfg.Addr + "/api/login/github/callback",
+		}), flowCfg))
+	}
+	if cfg.Discord.ClientID != "" {
+		logins = append(logins, auth.NewFlow(auth.NewDiscord(auth.OAuthCfg{
+			ClientID:     cfg.Discord.ClientID,
+			ClientSecret: cfg.Discord.ClientSecret,
+			CallbackURL:  cfg.Addr + "/api/login/discord/callback",
+		}), flowCfg))
+	}
+	if cfg.OIDC.Issuer != "" {
+		if cfg.OIDC.Name == "" {
+			cfg.OIDC.Name = "oidc"
+		}
+		oidcFlowCfg := flowCfg
+		oidcFlowCfg.TrustEmail = cfg.OIDC.TrustEmail
+		logins = append(logins, auth.NewFlow(auth.NewOIDC(auth.OIDCCfg{
+			Name:         cfg.OIDC.Name,
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			CallbackURL:  cfg.Addr + "/api/login/" + cfg.OIDC.Name + "/callback",
+		}), oidcFlowCfg))
+	}
+	var mailer mail.Mailer
+	if cfg.Mail.SMTPHost != "" {
+		mailer = mail.NewSMTP(mail.SMTPCfg{
+			Host:     cfg.Mail.SMTPHost,
+			Port:     cfg.Mail.SMTPPort,
+			Username: cfg.Mail.SMTPUsername,
+			Password: cfg.Mail.SMTPPassword,
+			From:     cfg.Mail.From,
+		})
+	} else if cfg.Mail.File != "" {
+		file, err := mail.OpenFile(cfg.Mail.File)
+		if err != nil {
+			log.Panicln("something went wrong opening the mail file:", err)
+		}
+		mailer = file
+	}
+	var magicLinks *auth.MagicLinks
+	if mailer != nil {
+		magicLinks = auth.NewMagicLinks(auth.MagicLinksCfg{
+			Store:       db,
+			SessionMgr:  sessionManager,
+			Mailer:      mailer,
+			Host:        cfg.Addr,
+			AdminEmails: cfg.AdminEmails,
+		})
 	}
-	google := auth.NewGoogle(googleCfg)
 	CORSAllowed := map[string]bool{
 		cfg.Addr + ":3001": true,
 		cfg.Addr:           true,
 	}
+	// Passkeys are bound to the host name of the site.
+	var passkeys *auth.Passkeys
+	if addr, err := url.Parse(cfg.Addr); err == nil && addr.Hostname() != "" {
+		passkeys = auth.NewPasskeys(auth.PasskeysCfg{
+			Store:      db,
+			SessionMgr: sessionManager,
+			RPID:       addr.Hostname(),
+			RPName:     "screw",
+			Origins:    slices.Collect(maps.Keys(CORSAllowed)),
+			Host:       cfg.Addr,
+		})
+	} else {
+		slog.Warn("ADDR has no host name, passkeys are disabled", "addr", cfg.Addr)
+	}
 	protectedRoutes := map[string]bool{
+		"/api/ws":            true,
+		"/api/jobs/":         true,
+		"/api/tracks/":       true,
 		"/api/login/session": true,
 		"/api/logout":        true,
+		"/api/identities":    true,
+		"/api/identities/":   true,
+		"/api/sessions":      true,
+		"/api/sessions/":     true,
+		"/api/tokens":        true,
+		"/api/tokens/":       true,
+		"/api/passkeys":      true,
+		"/api/passkeys/":     true,
+		"/api/2fa":           true,
+		"/api/2fa/":          true,
+		"/api/admin/":        true,
+	}
+	// Permissions routes need. Authenticated routes without one are refused,
+	// and API tokens can't have PermAccount.
+	routePermissions := map[string]string{
+		"/api/ws":            store.PermJobsWrite,
+		"/api/jobs/":         store.PermJobsWrite,
+		"/api/tracks/":       store.PermJobsWrite,
+		"/api/login/session": store.PermProfileRead,
+		"/api/logout":        store.PermAccount,
+		"/api/identities":    store.PermAccount,
+		"/api/identities/":   store.PermAccount,
+		"/api/sessions":      store.PermAccount,
+		"/api/sessions/":     store.PermAccount,
+		"/api/tokens":        store.PermAccount,
+		"/api/tokens/":       store.PermAccount,
+		"/api/passkeys":      store.PermAccount,
+		"/api/passkeys/":     store.PermAccount,
+		"/api/2fa":           store.PermAccount,
+		"/api/2fa/":          store.PermAccount,
+		"/api/admin/users":   store.PermAdminUsers,
+		"/api/admin/users/":  store.PermAdminUsers,
+		"/api/admin/jobs":    store.PermAdminJobs,
+		"/api/admin/jobs/":   store.PermAdminJobs,
+	}
+	for _, login := range logins {
+		protectedRoutes["/api/login/"+login.Name()+"/link"] = true
+		routePermissions["/api/login/"+login.Name()+"/link"] = store.PermAccount
 	}
 	return &server{
-		addr:            cfg.Addr,
-		clientId:        cfg.ClientId,
-		clientSecret:    cfg.ClientSecret,
-		env:             cfg.Env,
-		store:           store,
-		sessionManager:  sessionManager,
-		ws:              ws,
-		google:          google,
-		CORSAllowed:     CORSAllowed,
-		protectedRoutes: protectedRoutes,
+		addr:             cfg.Addr,
+		clientId:         cfg.ClientId,
+		clientSecret:     cfg.ClientSecret,
+		env:              cfg.Env,
+		store:            db,
+		sessionManager:   sessionManager,
+		ws:               ws,
+		tracks:           tracks.New(db, signingKey),
+		logins:           logins,
+		identities:       auth.NewIdentities(db),
+		passkeys:         passkeys,
+		magicLinks:       magicLinks,
+		twoFactor:        auth.NewTwoFactor(auth.TwoFactorCfg{Store: db, SessionMgr: sessionManager, Issuer: "screw"}),
+		admin:            admin.New(db, ws),
+		CORSAllowed:      CORSAllowed,
+		protectedRoutes:  protectedRoutes,
+		routePermissions: routePermissions,
 	}
 }
 
-func (s *server) Start(ctx context.Context) {
+// seedAdmins gives the admin role to the existing users of emails. Users that
+// sign up later get it on their first login.
+func seedAdmins(db store.Store, emails []string) {
+	for _, email := range emails {
+		user, err := db.UserByEmail(email)
+		if errors.Is(err, store.ErrUserNotFound) {
+			slog.Info("Admin has not signed up yet", "email", email)
+			continue
+		} else if err != nil {
+			log.Panicln("something went wrong reading admin:", err)
+		}
+		if user.Role == store.RoleAdmin {
+			continue
+		}
+		if err := db.SetUserRole(user.ID, store.RoleAdmin); err != nil {
+			log.Panicln("something went wrong seeding admin:", err)
+		}
+		slog.Info("Seeded admin", "email", email, "userID", user.ID)
+	}
+}
+
+func (s *server) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.Handle("/api/ws", herr.W(s.ws.Handle))
-	mux.Handle("GET /api/login/google", herr.W(s.google.HandleLogin))
-	mux.Handle("GET /api/login/google/callback", herr.W(s.google.HandleCallBack))
+	mux.Handle("GET /api/jobs/{id}/spectrogram.png", herr.W(s.tracks.HandleJobSpectrogram))
+	mux.Handle("GET /api/tracks/{id}/spectrogram.png", herr.W(s.tracks.HandleTrackSpectrogram))
+	mux.Handle("GET /api/tracks/{id}/playlist.m3u8", herr.W(s.tracks.HandlePlaylist))
+	for _, login := range s.logins {
+		mux.Handle("GET /api/login/"+login.Name(), herr.W(login.HandleLogin))
+		mux.Handle("GET /api/login/"+login.Name()+"/callback", herr.W(login.HandleCallBack))
+		mux.Handle("POST /api/login/"+login.Name()+"/link", herr.W(login.HandleLink))
+	}
+	if s.magicLinks != nil {
+		mux.Handle("POST /api/login/email", herr.W(s.magicLinks.HandleRequest))
+		mux.Handle("GET /api/login/email/callback", herr.W(s.magicLinks.HandleConfirm))
+		mux.Handle("POST /api/login/email/callback", herr.W(s.magicLinks.HandleCallback))
+	}
+	if s.passkeys != nil {
+		mux.Handle("POST /api/login/passkey/options", herr.W(s.passkeys.HandleLoginOptions))
+		mux.Handle("POST /api/login/passkey", herr.W(s.passkeys.HandleLogin))
+		mux.Handle("GET /api/passkeys", herr.W(s.passkeys.HandleList))
+		mux.Handle("POST /api/passkeys/options", herr.W(s.passkeys.HandleRegisterOptions))
+		mux.Handle("POST /api/passkeys", herr.W(s.passkeys.HandleRegister))
+		mux.Handle("DELETE /api/passkeys/{id}", herr.W(s.passkeys.HandleDelete))
+	}
+	mux.Handle("POST /api/login/2fa", herr.W(s.twoFactor.HandleLogin))
+	mux.Handle("GET /api/2fa", herr.W(s.twoFactor.HandleStatus))
+	mux.Handle("POST /api/2fa", herr.W(s.twoFactor.HandleEnroll))
+	mux.Handle("POST /api/2fa/confirm", herr.W(s.twoFactor.HandleConfirm))
+	mux.Handle("DELETE /api/2fa", herr.W(s.twoFactor.HandleDisable))
+	mux.Handle("GET /api/identities", herr.W(s.identities.HandleList))
+	mux.Handle("DELETE /api/identities/{provider}/{subject}", herr.W(s.identities.HandleUnlink))
 	mux.Handle("GET /api/login/session", herr.W(s.sessionManager.HandleCurrentSession))
 	mux.Handle("POST /api/logout", herr.W(s.sessionManager.HandleLogout))
+	mux.Handle("GET /api/sessions", herr.W(s.sessionManager.HandleSessions))
+	mux.Handle("DELETE /api/sessions/{id}", herr.W(s.sessionManager.HandleRevokeSession))
+	mux.Handle("GET /api/tokens", herr.W(s.sessionManager.HandleAPITokens))
+	mux.Handle("POST /api/tokens", herr.W(s.sessionManager.HandleCreateAPIToken))
+	mux.Handle("DELETE /api/tokens/{id}", herr.W(s.sessionManager.HandleDeleteAPIToken))
+	mux.Handle("GET /api/admin/users", herr.W(s.admin.HandleUsers))
+	mux.Handle("GET /api/admin/users/{id}", herr.W(s.admin.HandleUser))
+	mux.Handle("DELETE /api/admin/users/{id}", herr.W(s.admin.HandleDeleteUser))
+	mux.Handle("POST /api/admin/users/{id}/disable", herr.W(s.admin.HandleDisableUser))
+	mux.Handle("POST /api/admin/users/{id}/enable", herr.W(s.admin.HandleEnableUser))
+	mux.Handle("GET /api/admin/users/{id}/sessions", herr.W(s.admin.HandleUserSessions))
+	mux.Handle("DELETE /api/admin/users/{id}/sessions", herr.W(s.admin.HandleRevokeSessions))
+	mux.Handle("DELETE /api/admin/users/{id}/sessions/{session}", herr.W(s.admin.HandleRevokeSession))
+	mux.Handle("DELETE /api/admin/users/{id}/2fa", herr.W(s.admin.HandleResetTwoFactor))
+	mux.Handle("GET /api/admin/jobs", herr.W(s.admin.HandleJobs))
+	mux.Handle("DELETE /api/admin/jobs/{id}", herr.W(s.admin.HandleKillJob))
 	mux.Handle("GET /metrics", promhttp.Handler())
-	server := mw.Chain(
-		mux,
-		mw.RateLimit(15, 50), // add 15 requests per second to bucket, 50 in burst for chunk request
+
+	// Segments are authorized by their signed URL alone, so players and
+	// CDNs fetch them without a session.
+	signed := http.NewServeMux()
+	signed.Handle("GET /api/tracks/{id}/hls/{codec}/{name}", herr.W(s.tracks.HandleSegment))
+	signed.Handle("/", mw.Protect(s.protectedRoutes, s.routePermissions, s.sessionManager)(mux))
+	return mw.Chain(
+		signed,
+		mw.RateLimit(15, 50, s.sessionManager), // add 15 requests per second to bucket, 50 in burst for chunk request
 		mw.Logger(),
 		mw.CORS(s.CORSAllowed),
-		mw.Protect(s.protectedRoutes, s.sessionManager),
 		mw.Metrics(),
 	)
+}
 
+func (s *server) Start(ctx context.Context) {
 	httpServer := &http.Server{
 		Addr:    s.addr,
-		Handler: server,
+		Handler: s.handler(),
 	}
 
 	go func() {
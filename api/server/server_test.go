@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"screw/session"
+	"screw/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupServer(t *testing.T) *server {
+	t.Helper()
+	t.Cleanup(func() {
+		if err := os.Remove("./test.db"); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Failed to remove test database: %v", err)
+		}
+	})
+	return New(ServerCfg{Addr: "http://localhost", DBPath: "./test.db", TracksDir: t.TempDir(), SigningKey: "key"})
+}
+
+func TestSignedSegments(t *testing.T) {
+	s := setupServer(t)
+	h := s.handler()
+
+	userID, err := s.store.CreateUser(&store.User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	cookie, err := s.sessionManager.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+
+	// The track is packaged up front, ffmpeg is not needed to serve it.
+	dir := t.TempDir()
+	hls := filepath.Join(dir, "track-0.hls", "opus")
+	if err := os.MkdirAll(hls, 0o755); err != nil {
+		t.Fatalf("error creating HLS dir: %v", err)
+	}
+	files := map[string]string{
+		"index.m3u8":       "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:6.000000,\nsegment00000.m4s\n#EXT-X-ENDLIST\n",
+		"init.mp4":         "init",
+		"segment00000.m4s": "first",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(hls, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("error writing %s: %v", name, err)
+		}
+	}
+	err = s.store.CreateJob(&store.Job{ID: "job-1", UserID: userID, CreatedAt: time.Now().Unix()}, []*store.Track{
+		{ID: "track-0", Path: filepath.Join(dir, "track-0.ogg")},
+	})
+	if err != nil {
+		t.Fatalf("error creating job: %v", err)
+	}
+
+	get := func(path, cookie string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: session.SessionCookieName, Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	if rec := get("/api/tracks/track-0/playlist.m3u8?codec=opus", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the playlist to need a session, got %d", rec.Code)
+	}
+	rec := get("/api/tracks/track-0/playlist.m3u8?codec=opus", cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the playlist, got %d", rec.Code)
+	}
+	var segment string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "/api/tracks/track-0/hls/opus/segment00000.m4s?") {
+			segment = line
+		}
+	}
+	if segment == "" {
+		t.Fatalf("expected a signed segment URL in\n%s", rec.Body.String())
+	}
+
+	if rec := get(segment, ""); rec.Code != http.StatusOK || rec.Body.String() != "first" {
+		t.Errorf("expected the signed segment without a session, got %d %q", rec.Code, rec.Body.String())
+	}
+	unsigned, _, _ := strings.Cut(segment, "?")
+	if rec := get(unsigned, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a segment without a signature to be refused, got %d", rec.Code)
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"screw/cryptoutil"
 	"screw/herr"
 	"screw/store"
+	"strings"
 	"time"
 )
 
@@ -17,17 +20,44 @@ const (
 	SessionContextKey = "session"
 	SessionCookieName = "session"
 	oneDayInHours     = 24
+
+	maxUserAgentLength = 512
+	// lastSeenInterval limits how often a request writes last_seen_at.
+	lastSeenInterval = 5 * time.Minute
+	// pendingSessionTTL is how long a user has to enter their second factor.
+	pendingSessionTTL = 10 * time.Minute
+)
+
+var (
+	// ErrUserDisabled is a login or token of a user an admin disabled.
+	ErrUserDisabled = errors.New("user is disabled")
+	// ErrPending2FA is a session whose user has not entered their second
+	// factor yet.
+	ErrPending2FA = errors.New("session is waiting for a second factor")
 )
 
 type Manager struct {
 	store                   store.Store
 	sessionExpirationInDays int64
 	refreshThresholdInDays  int64
+	trustedProxies          []netip.Prefix
 }
 
+// SessionValidationResult is who made a request. Requests authenticated with
+// an API token have no Session.
 type SessionValidationResult struct {
-	Session *store.Session `json:"session"`
-	User    *store.User    `json:"user"`
+	Session *store.Session  `json:"session"`
+	User    *store.User     `json:"user"`
+	Token   *store.APIToken `json:"token,omitempty"`
+}
+
+// Can is whether the request is allowed what the permission covers: the role
+// of the user has to grant it, and so does the scope of an API token.
+func (r *SessionValidationResult) Can(permission string) bool {
+	if r.User == nil || !r.User.Can(permission) {
+		return false
+	}
+	return r.Token == nil || r.Token.HasScope(permission)
 }
 
 func NewManager(store store.Store, sessionExpirationInDays int64, refreshThresholdInDays int64) *Manager {
@@ -38,19 +68,47 @@ func NewManager(store store.Store, sessionExpirationInDays int64, refreshThresho
 	}
 }
 
-func (m *Manager) CreateSession(w http.ResponseWriter, userID int64) (string, error) {
+// CreateSession logs the user in on the device of r. Sessions on other
+// devices stay valid.
+func (m *Manager) CreateSession(w http.ResponseWriter, r *http.Request, userID int64) (string, error) {
+	return m.createSession(w, r, userID, m.newExpiresAt(), false)
+}
+
+// Login starts the session of a user who passed a login. Users with
+// two-factor authentication get a pending session, which grants nothing
+// until CompletePendingSession, and pending is true.
+func (m *Manager) Login(w http.ResponseWriter, r *http.Request, userID int64) (pending bool, err error) {
+	totp, err := m.store.TOTPByUserID(userID)
+	if errors.Is(err, store.ErrTOTPNotFound) || (err == nil && totp.ConfirmedAt == 0) {
+		_, err := m.CreateSession(w, r, userID)
+		return false, err
+	} else if err != nil {
+		return false, fmt.Errorf("error reading totp: %w", err)
+	}
+	if _, err := m.createSession(w, r, userID, time.Now().Add(pendingSessionTTL).Unix(), true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *Manager) createSession(w http.ResponseWriter, r *http.Request, userID, expiresAt int64, pending bool) (string, error) {
 	token, err := cryptoutil.Random()
 	if err != nil {
 		return "", err
 	}
-	err = m.InvalidateUserSessions(userID)
-	if err != nil {
-		slog.Warn("Error deleting old sessions", "err", err)
-	}
 
-	sessionID := cryptoutil.ID(token)
-	expiresAt := m.newExpiresAt()
-	session, err := m.store.CreateSession(sessionID, userID, expiresAt)
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	session, err := m.store.CreateSession(&store.Session{
+		ID:         cryptoutil.ID(token),
+		UserID:     userID,
+		ExpiresAt:  expiresAt,
+		UserAgent:  userAgent,
+		IP:         m.ClientIP(r),
+		Pending2FA: pending,
+	})
 	if err != nil {
 		return "", fmt.Errorf("error creating session: %w", err)
 	}
@@ -58,29 +116,92 @@ func (m *Manager) CreateSession(w http.ResponseWriter, userID int64) (string, er
 	return token, nil
 }
 
-func (m *Manager) newExpiresAt() int64 {
-	return time.Now().Add(time.Duration(m.sessionExpirationInDays) * oneDayInHours * time.Hour).Unix()
+// TrustProxies sets the addresses or CIDR ranges of the reverse proxies in
+// front of the server. ClientIP only reads the headers they set.
+func (m *Manager) TrustProxies(proxies []string) error {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return fmt.Errorf("error parsing trusted proxy %q: %w", proxy, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	m.trustedProxies = prefixes
+	return nil
 }
 
-func (m *Manager) ValidateSessionToken(token string) (*SessionValidationResult, error) {
-	if token == "" {
-		return nil, fmt.Errorf("empty session token")
+func (m *Manager) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
 	}
+	addr = addr.Unmap()
+	for _, prefix := range m.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
 
-	sessionID := cryptoutil.ID(token)
-	session, user, err := m.store.SessionAndUserBySessionID(sessionID)
+// ClientIP is the address of the device. Behind a trusted proxy it is the one
+// the proxy passes on in X-Real-IP, or the last address X-Forwarded-For got
+// from outside the trusted proxies. Anyone else could send those headers, so
+// otherwise it is the address of the connection.
+func (m *Manager) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !m.trusted(ip) {
+		return ip
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !m.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (m *Manager) newExpiresAt() int64 {
+	return time.Now().Add(time.Duration(m.sessionExpirationInDays) * oneDayInHours * time.Hour).Unix()
+}
+
+// ValidateSessionToken returns the logged in user of the session. Pending
+// sessions are refused with ErrPending2FA.
+func (m *Manager) ValidateSessionToken(token string) (*SessionValidationResult, error) {
+	session, user, err := m.sessionOf(token)
+	if err != nil || session == nil {
 		return nil, err
 	}
+	if session.Pending2FA {
+		return nil, ErrPending2FA
+	}
 
 	now := time.Now()
 	expiresAt := time.Unix(session.ExpiresAt, 0)
 
-	if now.After(expiresAt) {
-		if err := m.store.DeleteSessionBySessionID(session.ID); err != nil {
-			return nil, fmt.Errorf("error deleting expired session: %w", err)
+	if now.Sub(time.Unix(session.LastSeenAt, 0)) > lastSeenInterval {
+		if err := m.store.TouchSession(session.ID, now.Unix()); err != nil {
+			slog.Warn("Error updating session last seen", "err", err)
+		} else {
+			session.LastSeenAt = now.Unix()
 		}
-		return nil, nil
 	}
 
 	thresholdDuration := time.Duration(m.refreshThresholdInDays) * oneDayInHours * time.Hour
@@ -98,6 +219,54 @@ func (m *Manager) ValidateSessionToken(token string) (*SessionValidationResult,
 	return &SessionValidationResult{Session: session, User: user}, nil
 }
 
+// sessionOf looks the session of token up. Sessions that expired or whose
+// user is disabled are deleted, and nil is returned.
+func (m *Manager) sessionOf(token string) (*store.Session, *store.User, error) {
+	if token == "" {
+		return nil, nil, fmt.Errorf("empty session token")
+	}
+
+	session, user, err := m.store.SessionAndUserBySessionID(cryptoutil.ID(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	if time.Now().After(time.Unix(session.ExpiresAt, 0)) || user.Disabled {
+		if err := m.store.DeleteSessionBySessionID(session.ID); err != nil {
+			return nil, nil, fmt.Errorf("error deleting expired session: %w", err)
+		}
+		return nil, nil, nil
+	}
+	return session, user, nil
+}
+
+// PendingSession returns the session of r that waits for a second factor.
+func (m *Manager) PendingSession(r *http.Request) (*SessionValidationResult, error) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting session cookie: %w", err)
+	}
+	session, user, err := m.sessionOf(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || !session.Pending2FA {
+		return nil, errors.New("no pending session")
+	}
+	return &SessionValidationResult{Session: session, User: user}, nil
+}
+
+// CompletePendingSession logs the user of a pending session in, once they
+// entered their second factor. The session gets a new token.
+func (m *Manager) CompletePendingSession(w http.ResponseWriter, r *http.Request, pending *SessionValidationResult) error {
+	if err := m.store.DeleteSessionBySessionID(pending.Session.ID); err != nil {
+		return fmt.Errorf("error deleting pending session: %w", err)
+	}
+	if _, err := m.CreateSession(w, r, pending.User.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (m *Manager) InvalidateSession(sessionID string) error {
 	return m.store.DeleteSessionBySessionID(sessionID)
 }
@@ -148,6 +317,19 @@ func (m *Manager) GetCurrentSession(r *http.Request) (*SessionValidationResult,
 	return result, nil
 }
 
+// Authenticate takes an API token from the Authorization header, or the
+// session cookie when there is none.
+func (m *Manager) Authenticate(r *http.Request) (*SessionValidationResult, error) {
+	if token, ok := BearerToken(r); ok {
+		result, err := m.ValidateAPIToken(token)
+		if err != nil {
+			return nil, fmt.Errorf("error validating api token: %w", err)
+		}
+		return result, nil
+	}
+	return m.GetCurrentSession(r)
+}
+
 func FromContext(ctx context.Context) (*SessionValidationResult, bool) {
 	session, ok := ctx.Value(SessionContextKey).(*SessionValidationResult)
 	return session, ok
@@ -191,3 +373,51 @@ func (m *Manager) HandleLogout(w http.ResponseWriter, r *http.Request) *herr.Err
 	m.DeleteSessionCookie(w)
 	return nil
 }
+
+type deviceSession struct {
+	*store.Session
+	Current bool `json:"current"`
+}
+
+// HandleSessions lists the devices the user is logged in on.
+func (m *Manager) HandleSessions(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	sessions, err := m.store.SessionsByUserID(result.User.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading sessions from db")
+	}
+
+	response := make([]deviceSession, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, deviceSession{Session: session, Current: session.ID == result.Session.ID})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return herr.Internal(err, "Error encoding response")
+	}
+	return nil
+}
+
+// HandleRevokeSession logs one device of the user out.
+func (m *Manager) HandleRevokeSession(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	sessionID := r.PathValue("id")
+	err := m.store.DeleteUserSession(result.User.ID, sessionID)
+	if errors.Is(err, store.ErrSessionNotFound) {
+		return herr.NotFound(err, "Session not found")
+	} else if err != nil {
+		return herr.Internal(err, "Error revoking session")
+	}
+
+	if sessionID == result.Session.ID {
+		m.DeleteSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
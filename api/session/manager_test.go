@@ -3,6 +3,7 @@ package session_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -46,7 +47,7 @@ func TestSessionCreation(t *testing.T) {
 	m := session.NewManager(s, 30, 15)
 
 	w := httptest.NewRecorder()
-	token, err := m.CreateSession(w, userID)
+	token, err := m.CreateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
 	if err != nil {
 		t.Fatalf("failed to create session: %v", err)
 	}
@@ -75,7 +76,7 @@ func TestSessionValidation(t *testing.T) {
 
 	t.Run("valid token", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		token, err := m.CreateSession(w, user.ID)
+		token, err := m.CreateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), user.ID)
 		if err != nil {
 			t.Fatalf("failed to create session: %v", err)
 		}
@@ -116,7 +117,7 @@ func TestSessionExpiration(t *testing.T) {
 	m := session.NewManager(s, 1, 1)
 
 	w := httptest.NewRecorder()
-	token, err := m.CreateSession(w, userID)
+	token, err := m.CreateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
 	if err != nil {
 		t.Fatalf("failed to create session: %v", err)
 	}
@@ -147,13 +148,13 @@ func TestSessionInvalidation(t *testing.T) {
 
 	t.Run("invalidate user sessions", func(t *testing.T) {
 		w1 := httptest.NewRecorder()
-		token1, err := m.CreateSession(w1, user.ID)
+		token1, err := m.CreateSession(w1, httptest.NewRequest(http.MethodGet, "/", nil), user.ID)
 		if err != nil {
 			t.Fatalf("failed to create first session: %v", err)
 		}
 
 		w2 := httptest.NewRecorder()
-		token2, err := m.CreateSession(w2, user.ID)
+		token2, err := m.CreateSession(w2, httptest.NewRequest(http.MethodGet, "/", nil), user.ID)
 		if err != nil {
 			t.Fatalf("failed to create second session: %v", err)
 		}
@@ -189,7 +190,7 @@ func TestSessionRefresh(t *testing.T) {
 		m := session.NewManager(s, 30, 7)
 
 		w := httptest.NewRecorder()
-		token, err := m.CreateSession(w, userID)
+		token, err := m.CreateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
 		if err != nil {
 			t.Fatalf("failed to create session: %v", err)
 		}
@@ -222,7 +223,7 @@ func TestSessionRefresh(t *testing.T) {
 		m := session.NewManager(s, 30, 7)
 
 		w := httptest.NewRecorder()
-		token, err := m.CreateSession(w, userID)
+		token, err := m.CreateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
 		if err != nil {
 			t.Fatalf("failed to create session: %v", err)
 		}
@@ -257,7 +258,7 @@ func TestGetCurrentSession(t *testing.T) {
 
 	t.Run("valid session", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		token, err := m.CreateSession(w, userID)
+		token, err := m.CreateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
 		if err != nil {
 			t.Fatalf("failed to create session: %v", err)
 		}
@@ -399,3 +400,236 @@ func TestHandleLogout(t *testing.T) {
 		}
 	})
 }
+
+func TestMultipleDevices(t *testing.T) {
+	s, user, _ := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+
+	laptop := httptest.NewRequest(http.MethodGet, "/", nil)
+	laptop.Header.Set("User-Agent", "Firefox")
+	laptop.RemoteAddr = "203.0.113.7:40312"
+	laptopToken, err := m.CreateSession(httptest.NewRecorder(), laptop, user.ID)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	phone := httptest.NewRequest(http.MethodGet, "/", nil)
+	phone.Header.Set("User-Agent", "Safari")
+	phone.RemoteAddr = "198.51.100.2:51234"
+	if _, err := m.CreateSession(httptest.NewRecorder(), phone, user.ID); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	result, err := m.ValidateSessionToken(laptopToken)
+	if err != nil || result == nil {
+		t.Fatalf("expected logging in on a phone to keep the laptop logged in, got %v", err)
+	}
+	if result.Session.UserAgent != "Firefox" || result.Session.IP != "203.0.113.7" || result.Session.CreatedAt == 0 {
+		t.Errorf("expected the device to be recorded, got %+v", result.Session)
+	}
+
+	sessions, err := s.SessionsByUserID(user.ID)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v, %v", sessions, err)
+	}
+	for _, sess := range sessions {
+		if sess.UserAgent == "Safari" && sess.IP != "198.51.100.2" {
+			t.Errorf("expected the remote address without port, got %q", sess.IP)
+		}
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	s, user, _ := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+
+	token, err := m.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), user.ID)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	result, _ := m.ValidateSessionToken(token)
+	old := time.Now().Add(-time.Hour).Unix()
+	if err := s.TouchSession(result.Session.ID, old); err != nil {
+		t.Fatalf("failed to touch session: %v", err)
+	}
+
+	result, err = m.ValidateSessionToken(token)
+	if err != nil {
+		t.Fatalf("failed to validate session: %v", err)
+	}
+	if result.Session.LastSeenAt <= old {
+		t.Error("expected last seen to be updated")
+	}
+	sessions, _ := s.SessionsByUserID(user.ID)
+	if len(sessions) != 1 || sessions[0].LastSeenAt != result.Session.LastSeenAt {
+		t.Errorf("expected last seen to be stored, got %+v", sessions)
+	}
+}
+
+func TestHandleSessions(t *testing.T) {
+	s, user, _ := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+
+	other := &store.User{GoogleID: "other", Email: "other@example.com", Name: "Other"}
+	other.ID, _ = s.CreateUser(other)
+	otherToken, _ := m.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), other.ID)
+	otherResult, _ := m.ValidateSessionToken(otherToken)
+
+	tokens := make([]string, 2)
+	for i := range tokens {
+		tokens[i], _ = m.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), user.ID)
+	}
+	current, _ := m.ValidateSessionToken(tokens[0])
+	request := func(method, target, id string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.SetPathValue("id", id)
+		return r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, current))
+	}
+
+	w := httptest.NewRecorder()
+	if err := m.HandleSessions(w, request(http.MethodGet, "/api/sessions", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var sessions []struct {
+		ID      string `json:"id"`
+		Current bool   `json:"current"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected the 2 sessions of the user, got %+v", sessions)
+	}
+	var otherDevice string
+	for _, sess := range sessions {
+		if sess.Current != (sess.ID == current.Session.ID) {
+			t.Errorf("expected only the session of the request to be current, got %+v", sess)
+		}
+		if !sess.Current {
+			otherDevice = sess.ID
+		}
+	}
+
+	if err := m.HandleRevokeSession(httptest.NewRecorder(), request(http.MethodDelete, "/api/sessions/x", otherResult.Session.ID)); err == nil || err.Code != http.StatusNotFound {
+		t.Errorf("expected a session of another user to be not found, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	if err := m.HandleRevokeSession(w, request(http.MethodDelete, "/api/sessions/x", otherDevice)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.ValidateSessionToken(tokens[1]); err == nil {
+		t.Error("expected the revoked session to be invalid")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("expected the cookie to be kept when revoking another device")
+	}
+
+	w = httptest.NewRecorder()
+	if err := m.HandleRevokeSession(w, request(http.MethodDelete, "/api/sessions/x", current.Session.ID)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge != -1 {
+		t.Error("expected the cookie to be deleted when revoking the current session")
+	}
+}
+
+func TestPendingSession(t *testing.T) {
+	s, _, userID := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+
+	login := func() (bool, *http.Request) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		pending, err := m.Login(w, httptest.NewRequest(http.MethodGet, "/", nil), userID)
+		if err != nil {
+			t.Fatalf("failed to log in: %v", err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(w.Result().Cookies()[0])
+		return pending, r
+	}
+
+	if pending, r := login(); pending {
+		t.Error("expected users without two-factor to be logged in")
+	} else if _, err := m.PendingSession(r); err == nil {
+		t.Error("expected a full session not to be pending")
+	}
+
+	s.CreateTOTP(&store.TOTP{UserID: userID, Secret: "secret"})
+	if pending, _ := login(); pending {
+		t.Error("expected an enrollment that is not confirmed to be ignored")
+	}
+	s.ConfirmTOTP(userID, 1, nil)
+	pending, r := login()
+	if !pending {
+		t.Fatal("expected a pending session")
+	}
+	if _, err := m.Authenticate(r); !errors.Is(err, session.ErrPending2FA) {
+		t.Errorf("expected the pending session to grant nothing, got %v", err)
+	}
+	result, err := m.PendingSession(r)
+	if err != nil || result.User.ID != userID {
+		t.Fatalf("expected the pending session, got %+v, %v", result, err)
+	}
+	if time.Until(time.Unix(result.Session.ExpiresAt, 0)) > time.Hour {
+		t.Errorf("expected the pending session to be short lived, expires at %d", result.Session.ExpiresAt)
+	}
+
+	w := httptest.NewRecorder()
+	if err := m.CompletePendingSession(w, r, result); err != nil {
+		t.Fatalf("failed to complete session: %v", err)
+	}
+	if _, err := m.PendingSession(r); err == nil {
+		t.Error("expected the pending session to be gone")
+	}
+	if result, err := m.ValidateSessionToken(w.Result().Cookies()[0].Value); err != nil || result.User.ID != userID {
+		t.Errorf("expected a full session, got %+v, %v", result, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s, _, _ := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+	if err := m.TrustProxies([]string{"10.0.0.1", "172.16.0.0/12"}); err != nil {
+		t.Fatalf("failed to trust proxies: %v", err)
+	}
+	if err := m.TrustProxies([]string{"proxy"}); err == nil {
+		t.Error("expected a proxy that is not an address to be refused")
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "198.51.100.2:51234", "", "", "198.51.100.2"},
+		{"spoofed X-Real-IP", "198.51.100.2:51234", "203.0.113.7", "", "198.51.100.2"},
+		{"spoofed X-Forwarded-For", "198.51.100.2:51234", "", "203.0.113.7", "198.51.100.2"},
+		{"X-Real-IP of proxy", "10.0.0.1:51234", "203.0.113.7", "", "203.0.113.7"},
+		{"X-Forwarded-For of proxy", "172.16.4.2:51234", "", "203.0.113.7", "203.0.113.7"},
+		{"X-Forwarded-For through proxies", "10.0.0.1:51234", "", "192.0.2.1, 203.0.113.7, 172.16.4.2", "203.0.113.7"},
+		{"proxy without headers", "10.0.0.1:51234", "", "", "10.0.0.1"},
+		{"IPv6", "[2001:db8::1]:51234", "203.0.113.7", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := m.ClientIP(r); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"screw/cryptoutil"
+	"screw/herr"
+	"screw/store"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API tokens start with a prefix so they are easy to spot in scripts and by
+// secret scanners.
+const APITokenPrefix = "screw_"
+
+const (
+	maxAPITokenName     = 100
+	maxAPITokenLifetime = 365 // days
+)
+
+// Scopes are the permissions an API token can be limited to. A token never
+// grants more than the role of its user.
+var Scopes = []string{store.PermJobsWrite, store.PermProfileRead, store.PermAdminUsers, store.PermAdminJobs}
+
+var ErrAPITokenExpired = errors.New("api token expired")
+
+// BearerToken is the token of an Authorization: Bearer header.
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// CreateAPIToken returns the token, which is not stored anywhere, so it is
+// shown to the user once.
+func (m *Manager) CreateAPIToken(userID int64, name string, scopes []string, expiresAt int64) (string, *store.APIToken, error) {
+	random, err := cryptoutil.Random()
+	if err != nil {
+		return "", nil, err
+	}
+	token := APITokenPrefix + random
+	apiToken := &store.APIToken{
+		ID:        cryptoutil.ID(token),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := m.store.CreateAPIToken(apiToken); err != nil {
+		return "", nil, fmt.Errorf("error creating api token: %w", err)
+	}
+	return token, apiToken, nil
+}
+
+func (m *Manager) ValidateAPIToken(token string) (*SessionValidationResult, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, fmt.Errorf("not an api token")
+	}
+	apiToken, user, err := m.store.APITokenAndUserByID(cryptoutil.ID(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	now := time.Now()
+	if apiToken.ExpiresAt != 0 && now.After(time.Unix(apiToken.ExpiresAt, 0)) {
+		return nil, ErrAPITokenExpired
+	}
+	if now.Sub(time.Unix(apiToken.LastUsedAt, 0)) > lastSeenInterval {
+		if err := m.store.TouchAPIToken(apiToken.ID, now.Unix()); err != nil {
+			slog.Warn("Error updating api token last used", "err", err)
+		} else {
+			apiToken.LastUsedAt = now.Unix()
+		}
+	}
+	return &SessionValidationResult{User: user, Token: apiToken}, nil
+}
+
+func (m *Manager) HandleAPITokens(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	tokens, err := m.store.APITokensByUserID(result.User.ID)
+	if err != nil {
+		return herr.Internal(err, "Error reading api tokens from db")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		return herr.Internal(err, "Error encoding response")
+	}
+	return nil
+}
+
+type createAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 for a token that doesn't expire
+}
+
+func (req *createAPITokenRequest) validate(user *store.User) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenName {
+		return fmt.Errorf("name must be 1 to %d characters", maxAPITokenName)
+	}
+	if len(req.Scopes) == 0 {
+		return errors.New("at least one scope is needed")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+		if !user.Can(scope) {
+			return fmt.Errorf("scope %q is not granted to the user", scope)
+		}
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenLifetime {
+		return fmt.Errorf("expires_in_days must be 0 to %d", maxAPITokenLifetime)
+	}
+	return nil
+}
+
+// HandleCreateAPIToken responds with the token. It can't be read again.
+func (m *Manager) HandleCreateAPIToken(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	var req createAPITokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		return herr.BadRequest(err, "Invalid api token request")
+	}
+	if err := req.validate(result.User); err != nil {
+		return herr.BadRequest(err, "Invalid api token request")
+	}
+
+	var expiresAt int64
+	if req.ExpiresInDays > 0 {
+		expiresAt = time.Now().Add(time.Duration(req.ExpiresInDays) * oneDayInHours * time.Hour).Unix()
+	}
+	token, apiToken, err := m.CreateAPIToken(result.User.ID, req.Name, slices.Compact(slices.Sorted(slices.Values(req.Scopes))), expiresAt)
+	if err != nil {
+		return herr.Internal(err, "Error creating api token")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	response := struct {
+		Token    string          `json:"token"`
+		APIToken *store.APIToken `json:"api_token"`
+	}{token, apiToken}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return herr.Internal(err, "Error encoding response")
+	}
+	return nil
+}
+
+func (m *Manager) HandleDeleteAPIToken(w http.ResponseWriter, r *http.Request) *herr.Error {
+	result, ok := FromContext(r.Context())
+	if !ok {
+		return herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	err := m.store.DeleteAPIToken(result.User.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrAPITokenNotFound) {
+		return herr.NotFound(err, "API token not found")
+	} else if err != nil {
+		return herr.Internal(err, "Error deleting api token")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
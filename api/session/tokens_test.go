@@ -0,0 +1,127 @@
+package session_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"screw/session"
+	"screw/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	s, user, _ := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+
+	token, apiToken, err := m.CreateAPIToken(user.ID, "batch", []string{store.PermJobsWrite}, 0)
+	if err != nil {
+		t.Fatalf("failed to create api token: %v", err)
+	}
+	if !strings.HasPrefix(token, session.APITokenPrefix) || apiToken.ID == token {
+		t.Errorf("expected a prefixed token stored by its hash, got %q and %q", token, apiToken.ID)
+	}
+
+	result, err := m.ValidateAPIToken(token)
+	if err != nil {
+		t.Fatalf("failed to validate api token: %v", err)
+	}
+	if result.User.ID != user.ID || result.Session != nil || !result.Token.HasScope(store.PermJobsWrite) {
+		t.Errorf("expected the user and scopes of the token without a session, got %+v", result)
+	}
+	if result.Token.LastUsedAt == 0 {
+		t.Error("expected the token use to be recorded")
+	}
+
+	if _, err := m.ValidateAPIToken(session.APITokenPrefix + "unknown"); !errors.Is(err, store.ErrAPITokenNotFound) {
+		t.Errorf("expected an unknown token to be refused, got %v", err)
+	}
+	if _, err := m.ValidateAPIToken(strings.TrimPrefix(token, session.APITokenPrefix)); err == nil {
+		t.Error("expected a token without prefix to be refused")
+	}
+
+	expired, _, err := m.CreateAPIToken(user.ID, "old", []string{store.PermJobsWrite}, time.Now().Add(-time.Minute).Unix())
+	if err != nil {
+		t.Fatalf("failed to create api token: %v", err)
+	}
+	if _, err := m.ValidateAPIToken(expired); !errors.Is(err, session.ErrAPITokenExpired) {
+		t.Errorf("expected an expired token to be refused, got %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if result, err := m.Authenticate(r); err != nil || result.Token == nil {
+		t.Errorf("expected the bearer token to authenticate, got %+v, %v", result, err)
+	}
+}
+
+func TestHandleAPITokens(t *testing.T) {
+	s, user, _ := setupTest(t)
+	defer cleanupTestDB(t)
+	m := session.NewManager(s, 30, 15)
+
+	request := func(method, target, body string) *http.Request {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		result := &session.SessionValidationResult{User: user, Session: &store.Session{ID: "test", UserID: user.ID}}
+		return r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, result))
+	}
+
+	invalid := []string{
+		`{"name": "", "scopes": ["jobs:write"]}`,
+		`{"name": "batch", "scopes": []}`,
+		`{"name": "batch", "scopes": ["jobs:delete"]}`,
+		`{"name": "batch", "scopes": ["admin:users"]}`,
+		`{"name": "batch", "scopes": ["jobs:write"], "expires_in_days": 1000}`,
+		`not json`,
+	}
+	for _, body := range invalid {
+		if err := m.HandleCreateAPIToken(httptest.NewRecorder(), request(http.MethodPost, "/api/tokens", body)); err == nil || err.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %v", body, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"name": "batch", "scopes": ["jobs:write", "profile:read", "jobs:write"], "expires_in_days": 30}`
+	if err := m.HandleCreateAPIToken(w, request(http.MethodPost, "/api/tokens", body)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var created struct {
+		Token    string         `json:"token"`
+		APIToken store.APIToken `json:"api_token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if w.Code != http.StatusCreated || created.Token == "" || len(created.APIToken.Scopes) != 2 || created.APIToken.ExpiresAt == 0 {
+		t.Fatalf("expected the token once with its scopes and expiry, got %d %+v", w.Code, created)
+	}
+
+	w = httptest.NewRecorder()
+	if err := m.HandleAPITokens(w, request(http.MethodGet, "/api/tokens", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte(created.Token)) {
+		t.Error("expected the token not to be listed")
+	}
+	var tokens []store.APIToken
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || len(tokens) != 1 || tokens[0].Name != "batch" {
+		t.Fatalf("expected the token to be listed, got %+v, %v", tokens, err)
+	}
+
+	r := request(http.MethodDelete, "/api/tokens/x", "")
+	r.SetPathValue("id", created.APIToken.ID)
+	if err := m.HandleDeleteAPIToken(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.ValidateAPIToken(created.Token); err == nil {
+		t.Error("expected the deleted token to be refused")
+	}
+	if err := m.HandleDeleteAPIToken(httptest.NewRecorder(), r); err == nil || err.Code != http.StatusNotFound {
+		t.Errorf("expected deleting twice to be not found, got %v", err)
+	}
+}
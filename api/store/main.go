@@ -3,12 +3,50 @@ package store
 type Store interface {
 	CreateUser(user *User) (int64, error)
 	UserByGoogleID(googleID string) (*User, error)
-	DeleteUser(userID int64) error
-	CreateSession(sessionID string, userID int64, expiresAt int64) (*Session, error)
+	DeleteUser(userID int64) ([]string, error)
+	SetUserRole(userID int64, role string) error
+	SetUserDisabled(userID int64, disabled bool) error
+	UserByID(userID int64) (*User, error)
+	SearchUsers(query string, limit, offset int) ([]*User, error)
+	UserByEmail(email string) (*User, error)
+	UserByIdentity(provider, subject string) (*User, error)
+	CreateUserWithIdentity(user *User, identity *Identity) (int64, error)
+	CreateIdentity(identity *Identity) error
+	IdentitiesByUserID(userID int64) ([]*Identity, error)
+	DeleteIdentity(userID int64, provider, subject string) error
+	CreateSession(session *Session) (*Session, error)
 	DeleteSessionByUserID(userID int64) (err error)
 	DeleteSessionBySessionID(sessionID string) (err error)
+	DeleteUserSession(userID int64, sessionID string) error
+	SessionsByUserID(userID int64) ([]*Session, error)
 	SessionAndUserBySessionID(sessionID string) (*Session, *User, error)
 	RefreshSession(sessionID string, newExpiresAt int64) error
+	TouchSession(sessionID string, lastSeenAt int64) error
+	CreateAPIToken(token *APIToken) error
+	APITokensByUserID(userID int64) ([]*APIToken, error)
+	APITokenAndUserByID(tokenID string) (*APIToken, *User, error)
+	TouchAPIToken(tokenID string, lastUsedAt int64) error
+	DeleteAPIToken(userID int64, tokenID string) error
+	CreatePasskey(passkey *Passkey) error
+	PasskeysByUserID(userID int64) ([]*Passkey, error)
+	PasskeyAndUserByID(passkeyID string) (*Passkey, *User, error)
+	UsePasskey(passkeyID string, signCount uint32, lastUsedAt int64) error
+	DeletePasskey(userID int64, passkeyID string) error
+	CreateChallenge(challenge *Challenge) error
+	ConsumeChallenge(challenge, kind string) (*Challenge, error)
+	CreateMagicLink(link *MagicLink) error
+	ConsumeMagicLink(linkID string) (*MagicLink, error)
+	CreateTOTP(totp *TOTP) error
+	TOTPByUserID(userID int64) (*TOTP, error)
+	ConfirmTOTP(userID, step int64, recoveryCodeIDs []string) error
+	UseTOTPStep(userID, step int64) error
+	DeleteTOTP(userID int64) error
+	UseRecoveryCode(userID int64, codeID string) error
+	RecoveryCodeCount(userID int64) (int, error)
+	CreateJob(job *Job, tracks []*Track) error
+	TracksByJobID(jobID string) ([]*Track, error)
+	JobByID(jobID string) (*Job, error)
+	TrackByID(trackID string) (*Track, error)
 }
 
 func New(dbPath string) (Store, error) {
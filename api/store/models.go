@@ -2,14 +2,114 @@ package store
 
 type User struct {
 	ID       int64  `json:"id"`
-	GoogleID string `json:"google_id"`
+	GoogleID string `json:"google_id"` // key of the identity the user signed up with
 	Email    string `json:"email"`
 	Name     string `json:"name"`
 	Picture  string `json:"picture"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
 }
 
-type Session struct {
-	ID        string `json:"id"`
+// Identity is an account at a login provider, linked to a user.
+type Identity struct {
+	Provider  string `json:"provider"`
+	Subject   string `json:"subject"`
 	UserID    int64  `json:"user_id"`
-	ExpiresAt int64  `json:"expires_at"`
+	Email     string `json:"email"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type Session struct {
+	ID         string `json:"id"`
+	UserID     int64  `json:"user_id"`
+	ExpiresAt  int64  `json:"expires_at"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+	Pending2FA bool   `json:"-"` // waiting for the second factor, grants nothing
+}
+
+// APIToken is a personal access token. Only the hash of the token is kept,
+// as its ID.
+type APIToken struct {
+	ID         string   `json:"id"`
+	UserID     int64    `json:"user_id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	ExpiresAt  int64    `json:"expires_at"` // 0 for tokens that don't expire
+	LastUsedAt int64    `json:"last_used_at"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Passkey is a WebAuthn credential. PublicKey is the COSE key of the
+// authenticator.
+type Passkey struct {
+	ID         string `json:"id"` // base64url credential ID
+	UserID     int64  `json:"user_id"`
+	PublicKey  []byte `json:"-"`
+	SignCount  uint32 `json:"sign_count"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+}
+
+// Challenge is a WebAuthn challenge waiting for its answer. UserID is set
+// for registrations.
+type Challenge struct {
+	Challenge string
+	UserID    int64
+	Kind      string // register or login
+	ExpiresAt int64
+}
+
+// MagicLink is an email login link. Only the hash of its token is kept, as
+// its ID.
+type MagicLink struct {
+	ID        string
+	Email     string
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+// TOTP is the authenticator app of a user. It protects their logins once
+// confirmed, ConfirmedAt is 0 while they enroll.
+type TOTP struct {
+	UserID      int64
+	Secret      string // base32
+	CreatedAt   int64
+	ConfirmedAt int64
+	LastStep    int64 // time step of the last code used, so codes work once
+}
+
+type Job struct {
+	ID          string  `json:"id"`
+	UserID      int64   `json:"user_id"` // 0 for jobs from before jobs had owners
+	FileName    string  `json:"file_name"`
+	MimeType    string  `json:"mime_type"`
+	CreatedAt   int64   `json:"created_at"`
+	BPM         float64 `json:"bpm"`
+	Key         string  `json:"key"`
+	Spectrogram string  `json:"spectrogram"` // path of the source PNG, if rendered
+}
+
+type Track struct {
+	ID          string  `json:"id"`
+	JobID       string  `json:"job_id"`
+	Variant     int     `json:"variant"`
+	Params      string  `json:"params"`
+	Path        string  `json:"path"`
+	Size        int64   `json:"size"`
+	BPM         float64 `json:"bpm"`
+	Key         string  `json:"key"`
+	Spectrogram string  `json:"spectrogram"` // path of the PNG, if rendered
 }
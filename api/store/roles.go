@@ -0,0 +1,40 @@
+package store
+
+// Permissions are granted to users through their role, and to API tokens
+// through their scopes.
+const (
+	PermJobsWrite   = "jobs:write"   // process audio
+	PermProfileRead = "profile:read" // read your own account
+	PermAdminUsers  = "admin:users"  // manage the accounts of others
+	PermAdminJobs   = "admin:jobs"   // see and stop the jobs of others
+	// PermAccount manages your own logins, sessions and tokens. It is not a
+	// token scope, so only sessions have it.
+	PermAccount = "account"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var Roles = map[string][]string{
+	RoleUser:  {PermJobsWrite, PermProfileRead, PermAccount},
+	RoleAdmin: {PermJobsWrite, PermProfileRead, PermAccount, PermAdminUsers, PermAdminJobs},
+}
+
+// Can is whether the role of the user grants the permission.
+func (u *User) Can(permission string) bool {
+	for _, p := range Roles[u.role()] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) role() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -54,7 +56,9 @@ func (s *sqliteStore) initializeTables() error {
             google_id TEXT NOT NULL UNIQUE,
             email TEXT NOT NULL UNIQUE,
             name TEXT NOT NULL,
-            picture TEXT NOT NULL
+            picture TEXT NOT NULL,
+            role TEXT NOT NULL DEFAULT 'user',
+            disabled INTEGER NOT NULL DEFAULT 0
         )
     `)
 	if err != nil {
@@ -68,17 +72,213 @@ func (s *sqliteStore) initializeTables() error {
 		return fmt.Errorf("error creating google_id index: %w", err)
 	}
 
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS identity (
+            provider TEXT NOT NULL,
+            subject TEXT NOT NULL,
+            user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+            email TEXT NOT NULL DEFAULT '',
+            created_at INTEGER NOT NULL,
+            PRIMARY KEY(provider, subject)
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating identity table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE INDEX IF NOT EXISTS identity_user_id_index ON identity(user_id)
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating identity user_id index: %w", err)
+	}
+
+	// Users from before identities were keyed by google_id, a Google subject
+	// or provider:subject for the other providers. Every user keeps at least
+	// one identity, so this only picks up those users.
+	_, err = s.db.Exec(`
+        INSERT INTO identity (provider, subject, user_id, email, created_at)
+        SELECT
+            CASE WHEN instr(google_id, ':') > 0 THEN substr(google_id, 1, instr(google_id, ':') - 1) ELSE 'google' END,
+            CASE WHEN instr(google_id, ':') > 0 THEN substr(google_id, instr(google_id, ':') + 1) ELSE google_id END,
+            id, email, CAST(strftime('%s', 'now') AS INTEGER)
+        FROM user
+        WHERE NOT EXISTS (SELECT 1 FROM identity WHERE identity.user_id = user.id)
+    `)
+	if err != nil {
+		return fmt.Errorf("error migrating google_id to identities: %w", err)
+	}
+
 	_, err = s.db.Exec(`
         CREATE TABLE IF NOT EXISTS session (
             id TEXT NOT NULL PRIMARY KEY,
             user_id INTEGER NOT NULL REFERENCES user(id),
-            expires_at INTEGER NOT NULL
+            expires_at INTEGER NOT NULL,
+            user_agent TEXT NOT NULL DEFAULT '',
+            ip TEXT NOT NULL DEFAULT '',
+            created_at INTEGER NOT NULL DEFAULT 0,
+            last_seen_at INTEGER NOT NULL DEFAULT 0,
+            pending_2fa INTEGER NOT NULL DEFAULT 0
         )
     `)
 	if err != nil {
 		return fmt.Errorf("error creating session table: %w", err)
 	}
 
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS api_token (
+            id TEXT NOT NULL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            scopes TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL DEFAULT 0,
+            last_used_at INTEGER NOT NULL DEFAULT 0
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating api_token table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS passkey (
+            id TEXT NOT NULL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+            public_key BLOB NOT NULL,
+            sign_count INTEGER NOT NULL DEFAULT 0,
+            name TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            last_used_at INTEGER NOT NULL DEFAULT 0
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating passkey table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS webauthn_challenge (
+            challenge TEXT NOT NULL PRIMARY KEY,
+            user_id INTEGER NOT NULL DEFAULT 0,
+            kind TEXT NOT NULL,
+            expires_at INTEGER NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating webauthn_challenge table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS magic_link (
+            id TEXT NOT NULL PRIMARY KEY,
+            email TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating magic_link table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS totp (
+            user_id INTEGER NOT NULL PRIMARY KEY REFERENCES user(id) ON DELETE CASCADE,
+            secret TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            confirmed_at INTEGER NOT NULL DEFAULT 0,
+            last_step INTEGER NOT NULL DEFAULT 0
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating totp table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS recovery_code (
+            user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+            id TEXT NOT NULL,
+            PRIMARY KEY(user_id, id)
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating recovery_code table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS job (
+            id TEXT NOT NULL PRIMARY KEY,
+            user_id INTEGER NOT NULL DEFAULT 0,
+            file_name TEXT NOT NULL,
+            mime_type TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            bpm REAL NOT NULL DEFAULT 0,
+            key TEXT NOT NULL DEFAULT '',
+            spectrogram TEXT NOT NULL DEFAULT ''
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating job table: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+        CREATE TABLE IF NOT EXISTS track (
+            id TEXT NOT NULL PRIMARY KEY,
+            job_id TEXT NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+            variant INTEGER NOT NULL,
+            params TEXT NOT NULL,
+            path TEXT NOT NULL,
+            size INTEGER NOT NULL,
+            bpm REAL NOT NULL DEFAULT 0,
+            key TEXT NOT NULL DEFAULT '',
+            spectrogram TEXT NOT NULL DEFAULT '',
+            UNIQUE(job_id, variant)
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating track table: %w", err)
+	}
+
+	columns := []struct{ table, column, definition string }{
+		{"job", "bpm", "REAL NOT NULL DEFAULT 0"},
+		{"job", "key", "TEXT NOT NULL DEFAULT ''"},
+		{"track", "bpm", "REAL NOT NULL DEFAULT 0"},
+		{"track", "key", "TEXT NOT NULL DEFAULT ''"},
+		{"job", "spectrogram", "TEXT NOT NULL DEFAULT ''"},
+		{"track", "spectrogram", "TEXT NOT NULL DEFAULT ''"},
+		{"session", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+		{"session", "ip", "TEXT NOT NULL DEFAULT ''"},
+		{"session", "created_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"session", "last_seen_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"user", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"session", "pending_2fa", "INTEGER NOT NULL DEFAULT 0"},
+		{"job", "user_id", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := s.addColumn(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addColumn brings tables created by older versions up to date.
+func (s *sqliteStore) addColumn(table, column, definition string) error {
+	var exists bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)",
+		table, column,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking column %s.%s: %w", table, column, err)
+	}
+	if exists {
+		return nil
+	}
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -86,11 +286,11 @@ func (s *sqliteStore) CreateUser(user *User) (int64, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	query := `
-        INSERT INTO user (google_id, email, name, picture)
-        VALUES (?, ?, ?, ?)
+        INSERT INTO user (google_id, email, name, picture, role)
+        VALUES (?, ?, ?, ?, ?)
     `
 	var result sql.Result
-	result, err := s.db.Exec(query, user.GoogleID, user.Email, user.Name, user.Picture)
+	result, err := s.db.Exec(query, user.GoogleID, user.Email, user.Name, user.Picture, user.role())
 	if err != nil {
 		return 0, fmt.Errorf("error creating user: %w", err)
 	}
@@ -109,10 +309,10 @@ func (s *sqliteStore) UserByGoogleID(googleID string) (*User, error) {
 	defer s.mutex.Unlock()
 	user := &User{}
 	err := s.db.QueryRow(`
-        SELECT id, google_id, email, name, picture
+        SELECT id, google_id, email, name, picture, role, disabled
         FROM user
         WHERE google_id = ?
-    `, googleID).Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture)
+    `, googleID).Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture, &user.Role, &user.Disabled)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrUserNotFound
@@ -124,27 +324,29 @@ func (s *sqliteStore) UserByGoogleID(googleID string) (*User, error) {
 	return user, nil
 }
 
-func (s *sqliteStore) DeleteUser(userID int64) error {
+func (s *sqliteStore) SetUserRole(userID int64, role string) error {
+	if _, ok := Roles[role]; !ok {
+		return fmt.Errorf("unknown role %q", role)
+	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	result, err := s.db.Exec("DELETE FROM user WHERE id = ?", userID)
+	result, err := s.db.Exec("UPDATE user SET role = ? WHERE id = ?", role, userID)
 	if err != nil {
-		return fmt.Errorf("error deleting user: %w", err)
+		return fmt.Errorf("error setting user role: %w", err)
 	}
-
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("error getting rows affected: %w", err)
 	}
-
 	if rowsAffected == 0 {
-		return fmt.Errorf("user not found")
+		return ErrUserNotFound
 	}
-
 	return nil
 }
 
-func (s *sqliteStore) CreateSession(sessionID string, userID int64, expiresAt int64) (*Session, error) {
+// DeleteUser removes the user with everything that logs them in and their
+// jobs. It returns the files of the jobs, for the caller to remove from disk.
+func (s *sqliteStore) DeleteUser(userID int64) ([]string, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	tx, err := s.db.Begin()
@@ -153,98 +355,1127 @@ func (s *sqliteStore) CreateSession(sessionID string, userID int64, expiresAt in
 	}
 	defer tx.Rollback()
 
-	var exists bool
-	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE id = ?)", userID).Scan(&exists)
+	rows, err := tx.Query(`
+        SELECT spectrogram FROM job WHERE user_id = ?
+        UNION ALL
+        SELECT t.path FROM track t JOIN job j ON t.job_id = j.id WHERE j.user_id = ?
+        UNION ALL
+        SELECT t.spectrogram FROM track t JOIN job j ON t.job_id = j.id WHERE j.user_id = ?
+    `, userID, userID, userID)
 	if err != nil {
-		return nil, fmt.Errorf("error checking user existence: %w", err)
+		return nil, fmt.Errorf("error getting user job files: %w", err)
 	}
-	if !exists {
-		return nil, ErrUserNotFound
+	defer rows.Close()
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return nil, fmt.Errorf("error scanning user job file: %w", err)
+		}
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user job files: %w", err)
 	}
 
-	query := "INSERT INTO session (id, user_id, expires_at) VALUES (?, ?, ?)"
-	_, err = tx.Exec(query, sessionID, userID, expiresAt)
+	// Tracks go with their jobs.
+	for _, table := range []string{"session", "api_token", "identity", "passkey", "totp", "recovery_code", "job"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return nil, fmt.Errorf("error deleting user %ss: %w", table, err)
+		}
+	}
+	result, err := tx.Exec("DELETE FROM user WHERE id = ?", userID)
 	if err != nil {
-		return nil, fmt.Errorf("error creating session: %w", err)
+		return nil, fmt.Errorf("error deleting user: %w", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		return nil, fmt.Errorf("error committing transaction: %w", err)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("error getting rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrUserNotFound
 	}
 
-	session := &Session{
-		ID:        sessionID,
-		UserID:    userID,
-		ExpiresAt: expiresAt,
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
 	}
-	return session, nil
+	return files, nil
 }
 
-func (s *sqliteStore) DeleteSessionByUserID(userID int64) error {
+// SetUserDisabled blocks the user from logging in, or lets them again.
+// Disabling also ends their sessions.
+func (s *sqliteStore) SetUserDisabled(userID int64, disabled bool) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	_, err := s.db.Exec("DELETE FROM session WHERE user_id = ?", userID)
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("error deleting session by userID: %w", err)
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE user SET disabled = ? WHERE id = ?", disabled, userID)
+	if err != nil {
+		return fmt.Errorf("error disabling user: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	if disabled {
+		if _, err := tx.Exec("DELETE FROM session WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("error deleting user sessions: %w", err)
+		}
 	}
 
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
 	return nil
 }
 
-func (s *sqliteStore) DeleteSessionBySessionID(sessionID string) error {
+func (s *sqliteStore) UserByID(userID int64) (*User, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	_, err := s.db.Exec("DELETE FROM session WHERE id = ?", sessionID)
+	user := &User{}
+	err := s.db.QueryRow(`
+        SELECT id, google_id, email, name, picture, role, disabled
+        FROM user
+        WHERE id = ?
+    `, userID).Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture, &user.Role, &user.Disabled)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("error deleting session by sessionID: %w", err)
+		return nil, fmt.Errorf("error getting user by id: %w", err)
 	}
-	return nil
+	return user, nil
 }
 
-func (s *sqliteStore) SessionAndUserBySessionID(sessionID string) (*Session, *User, error) {
+// SearchUsers lists users whose email or name contain query, all of them when
+// it is empty, by ID.
+func (s *sqliteStore) SearchUsers(query string, limit, offset int) ([]*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	rows, err := s.db.Query(`
+        SELECT id, google_id, email, name, picture, role, disabled
+        FROM user
+        WHERE email LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\'
+        ORDER BY id
+        LIMIT ? OFFSET ?
+    `, pattern, pattern, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("error searching users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user := &User{}
+		if err := rows.Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture, &user.Role, &user.Disabled); err != nil {
+			return nil, fmt.Errorf("error scanning user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating users: %w", err)
+	}
+	return users, nil
+}
+
+func (s *sqliteStore) UserByEmail(email string) (*User, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	session := &Session{}
 	user := &User{}
+	err := s.db.QueryRow(`
+        SELECT id, google_id, email, name, picture, role, disabled
+        FROM user
+        WHERE email = ? COLLATE NOCASE
+    `, email).Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture, &user.Role, &user.Disabled)
 
-	query := `
-        SELECT session.id, session.user_id, session.expires_at, user.id, user.google_id, user.email, user.name, user.picture
-        FROM session
-        INNER JOIN user ON session.user_id = user.id
-        WHERE session.id = ?
-    `
-	err := s.db.QueryRow(query, sessionID).Scan(
-		&session.ID,
-		&session.UserID,
-		&session.ExpiresAt,
-		&user.ID,
-		&user.GoogleID,
-		&user.Email,
-		&user.Name,
-		&user.Picture,
-	)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting user by email: %w", err)
+	}
+	return user, nil
+}
+
+func (s *sqliteStore) UserByIdentity(provider, subject string) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := &User{}
+	err := s.db.QueryRow(`
+        SELECT user.id, user.google_id, user.email, user.name, user.picture, user.role, user.disabled
+        FROM identity
+        INNER JOIN user ON identity.user_id = user.id
+        WHERE identity.provider = ? AND identity.subject = ?
+    `, provider, subject).Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture, &user.Role, &user.Disabled)
 
 	if err == sql.ErrNoRows {
-		return nil, nil, fmt.Errorf("session not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("error getting session and user: %w", err)
+		return nil, fmt.Errorf("error getting user by identity: %w", err)
 	}
+	return user, nil
+}
 
-	return session, user, nil
+var (
+	ErrIdentityTaken    = errors.New("identity is linked to another user")
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrLastIdentity     = errors.New("can't remove the last identity of a user")
+)
+
+// CreateUserWithIdentity creates a user and links its first identity.
+func (s *sqliteStore) CreateUserWithIdentity(user *User, identity *Identity) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+        INSERT INTO user (google_id, email, name, picture, role)
+        VALUES (?, ?, ?, ?, ?)
+    `, user.GoogleID, user.Email, user.Name, user.Picture, user.role())
+	if err != nil {
+		return 0, fmt.Errorf("error creating user: %w", err)
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error getting last insert id: %w", err)
+	}
+	identity.UserID = userID
+	if err := insertIdentity(tx, identity); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return userID, nil
 }
 
-func (s *sqliteStore) RefreshSession(sessionID string, newExpiresAt int64) error {
+func (s *sqliteStore) CreateIdentity(identity *Identity) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	query := "UPDATE session SET expires_at = ? WHERE id = ?"
-	_, err := s.db.Exec(query, newExpiresAt, sessionID)
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("error updating session: %w", err)
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertIdentity(tx, identity); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func insertIdentity(tx *sql.Tx, identity *Identity) error {
+	var exists bool
+	err := tx.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM identity WHERE provider = ? AND subject = ?)",
+		identity.Provider, identity.Subject,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking identity existence: %w", err)
+	}
+	if exists {
+		return ErrIdentityTaken
+	}
+
+	if identity.CreatedAt == 0 {
+		identity.CreatedAt = time.Now().Unix()
+	}
+	_, err = tx.Exec(`
+        INSERT INTO identity (provider, subject, user_id, email, created_at)
+        VALUES (?, ?, ?, ?, ?)
+    `, identity.Provider, identity.Subject, identity.UserID, identity.Email, identity.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating identity: %w", err)
 	}
 	return nil
 }
 
+func (s *sqliteStore) IdentitiesByUserID(userID int64) ([]*Identity, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows, err := s.db.Query(`
+        SELECT provider, subject, user_id, email, created_at
+        FROM identity
+        WHERE user_id = ?
+        ORDER BY created_at, provider
+    `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		identity := &Identity{}
+		err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning identity: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating identities: %w", err)
+	}
+	return identities, nil
+}
+
+// DeleteIdentity unlinks an identity from the user. The last one is kept so
+// the user can still log in.
+func (s *sqliteStore) DeleteIdentity(userID int64, provider, subject string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM identity WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return fmt.Errorf("error counting identities: %w", err)
+	}
+	result, err := tx.Exec(
+		"DELETE FROM identity WHERE user_id = ? AND provider = ? AND subject = ?",
+		userID, provider, subject,
+	)
+	if err != nil {
+		return fmt.Errorf("error deleting identity: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+	if count <= 1 {
+		return ErrLastIdentity
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) CreateSession(session *Session) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE id = ?)", session.UserID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("error checking user existence: %w", err)
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	if session.CreatedAt == 0 {
+		session.CreatedAt = time.Now().Unix()
+	}
+	if session.LastSeenAt == 0 {
+		session.LastSeenAt = session.CreatedAt
+	}
+	query := `
+        INSERT INTO session (id, user_id, expires_at, user_agent, ip, created_at, last_seen_at, pending_2fa)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `
+	_, err = tx.Exec(query, session.ID, session.UserID, session.ExpiresAt,
+		session.UserAgent, session.IP, session.CreatedAt, session.LastSeenAt, session.Pending2FA)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return session, nil
+}
+
+func (s *sqliteStore) DeleteSessionByUserID(userID int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.db.Exec("DELETE FROM session WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("error deleting session by userID: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) DeleteSessionBySessionID(sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.db.Exec("DELETE FROM session WHERE id = ?", sessionID)
+	if err != nil {
+		return fmt.Errorf("error deleting session by sessionID: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserSession deletes a session only if it belongs to the user.
+func (s *sqliteStore) DeleteUserSession(userID int64, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result, err := s.db.Exec("DELETE FROM session WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting user session: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// SessionsByUserID lists the sessions of a user that have not expired, the
+// most recently used first. Sessions waiting for a second factor are left
+// out, they are not logged in yet.
+func (s *sqliteStore) SessionsByUserID(userID int64) ([]*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows, err := s.db.Query(`
+        SELECT id, user_id, expires_at, user_agent, ip, created_at, last_seen_at
+        FROM session
+        WHERE user_id = ? AND expires_at > ? AND pending_2fa = 0
+        ORDER BY last_seen_at DESC
+    `, userID, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error getting sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session := &Session{}
+		err := rows.Scan(&session.ID, &session.UserID, &session.ExpiresAt,
+			&session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (s *sqliteStore) SessionAndUserBySessionID(sessionID string) (*Session, *User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session := &Session{}
+	user := &User{}
+
+	query := `
+        SELECT session.id, session.user_id, session.expires_at, session.user_agent, session.ip,
+            session.created_at, session.last_seen_at, session.pending_2fa, user.id, user.google_id, user.email, user.name, user.picture, user.role, user.disabled
+        FROM session
+        INNER JOIN user ON session.user_id = user.id
+        WHERE session.id = ?
+    `
+	err := s.db.QueryRow(query, sessionID).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.ExpiresAt,
+		&session.UserAgent,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&session.Pending2FA,
+		&user.ID,
+		&user.GoogleID,
+		&user.Email,
+		&user.Name,
+		&user.Picture,
+		&user.Role,
+		&user.Disabled,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting session and user: %w", err)
+	}
+
+	return session, user, nil
+}
+
+var ErrSessionNotFound = errors.New("session not found")
+
+func (s *sqliteStore) TouchSession(sessionID string, lastSeenAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.db.Exec("UPDATE session SET last_seen_at = ? WHERE id = ?", lastSeenAt, sessionID)
+	if err != nil {
+		return fmt.Errorf("error touching session: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) RefreshSession(sessionID string, newExpiresAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	query := "UPDATE session SET expires_at = ? WHERE id = ?"
+	_, err := s.db.Exec(query, newExpiresAt, sessionID)
+	if err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	}
+	return nil
+}
+
+var ErrAPITokenNotFound = errors.New("api token not found")
+
+func (s *sqliteStore) CreateAPIToken(token *APIToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if token.CreatedAt == 0 {
+		token.CreatedAt = time.Now().Unix()
+	}
+	_, err := s.db.Exec(`
+        INSERT INTO api_token (id, user_id, name, scopes, created_at, expires_at, last_used_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, token.ID, token.UserID, token.Name, strings.Join(token.Scopes, " "),
+		token.CreatedAt, token.ExpiresAt, token.LastUsedAt)
+	if err != nil {
+		return fmt.Errorf("error creating api token: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) APITokensByUserID(userID int64) ([]*APIToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows, err := s.db.Query(`
+        SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+        FROM api_token
+        WHERE user_id = ?
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		token := &APIToken{}
+		var scopes string
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes,
+			&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning api token: %w", err)
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating api tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+func (s *sqliteStore) APITokenAndUserByID(tokenID string) (*APIToken, *User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token := &APIToken{}
+	user := &User{}
+	var scopes string
+	err := s.db.QueryRow(`
+        SELECT api_token.id, api_token.user_id, api_token.name, api_token.scopes, api_token.created_at,
+            api_token.expires_at, api_token.last_used_at, user.id, user.google_id, user.email, user.name, user.picture, user.role, user.disabled
+        FROM api_token
+        INNER JOIN user ON api_token.user_id = user.id
+        WHERE api_token.id = ?
+    `, tokenID).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&scopes,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&user.ID,
+		&user.GoogleID,
+		&user.Email,
+		&user.Name,
+		&user.Picture,
+		&user.Role,
+		&user.Disabled,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrAPITokenNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting api token and user: %w", err)
+	}
+	token.Scopes = strings.Fields(scopes)
+	return token, user, nil
+}
+
+func (s *sqliteStore) TouchAPIToken(tokenID string, lastUsedAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.db.Exec("UPDATE api_token SET last_used_at = ? WHERE id = ?", lastUsedAt, tokenID)
+	if err != nil {
+		return fmt.Errorf("error touching api token: %w", err)
+	}
+	return nil
+}
+
+// DeleteAPIToken revokes a token only if it belongs to the user.
+func (s *sqliteStore) DeleteAPIToken(userID int64, tokenID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result, err := s.db.Exec("DELETE FROM api_token WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting api token: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+var (
+	ErrPasskeyTaken     = errors.New("passkey is already registered")
+	ErrPasskeyNotFound  = errors.New("passkey not found")
+	ErrChallengeInvalid = errors.New("challenge is unknown, used or expired")
+	ErrSignCount        = errors.New("passkey sign count did not increase")
+)
+
+func (s *sqliteStore) CreatePasskey(passkey *Passkey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM passkey WHERE id = ?)", passkey.ID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking passkey existence: %w", err)
+	}
+	if exists {
+		return ErrPasskeyTaken
+	}
+
+	if passkey.CreatedAt == 0 {
+		passkey.CreatedAt = time.Now().Unix()
+	}
+	_, err = s.db.Exec(`
+        INSERT INTO passkey (id, user_id, public_key, sign_count, name, created_at, last_used_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, passkey.ID, passkey.UserID, passkey.PublicKey, passkey.SignCount, passkey.Name,
+		passkey.CreatedAt, passkey.LastUsedAt)
+	if err != nil {
+		return fmt.Errorf("error creating passkey: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) PasskeysByUserID(userID int64) ([]*Passkey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows, err := s.db.Query(`
+        SELECT id, user_id, public_key, sign_count, name, created_at, last_used_at
+        FROM passkey
+        WHERE user_id = ?
+        ORDER BY created_at
+    `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		passkey := &Passkey{}
+		err := rows.Scan(&passkey.ID, &passkey.UserID, &passkey.PublicKey, &passkey.SignCount,
+			&passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning passkey: %w", err)
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating passkeys: %w", err)
+	}
+	return passkeys, nil
+}
+
+func (s *sqliteStore) PasskeyAndUserByID(passkeyID string) (*Passkey, *User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	passkey := &Passkey{}
+	user := &User{}
+	err := s.db.QueryRow(`
+        SELECT passkey.id, passkey.user_id, passkey.public_key, passkey.sign_count, passkey.name,
+            passkey.created_at, passkey.last_used_at, user.id, user.google_id, user.email, user.name,
+            user.picture, user.role, user.disabled
+        FROM passkey
+        INNER JOIN user ON passkey.user_id = user.id
+        WHERE passkey.id = ?
+    `, passkeyID).Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.PublicKey,
+		&passkey.SignCount,
+		&passkey.Name,
+		&passkey.CreatedAt,
+		&passkey.LastUsedAt,
+		&user.ID,
+		&user.GoogleID,
+		&user.Email,
+		&user.Name,
+		&user.Picture,
+		&user.Role,
+		&user.Disabled,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrPasskeyNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting passkey and user: %w", err)
+	}
+	return passkey, user, nil
+}
+
+// UsePasskey records a login. The sign count only moves forward, a count
+// that doesn't hints at a cloned authenticator and returns ErrSignCount.
+func (s *sqliteStore) UsePasskey(passkeyID string, signCount uint32, lastUsedAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result, err := s.db.Exec(`
+        UPDATE passkey SET sign_count = ?, last_used_at = ?
+        WHERE id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))
+    `, signCount, lastUsedAt, passkeyID, signCount, signCount)
+	if err != nil {
+		return fmt.Errorf("error updating passkey: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrSignCount
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeletePasskey(userID int64, passkeyID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result, err := s.db.Exec("DELETE FROM passkey WHERE id = ? AND user_id = ?", passkeyID, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting passkey: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// CreateChallenge stores a WebAuthn challenge, and drops the expired ones.
+func (s *sqliteStore) CreateChallenge(challenge *Challenge) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.db.Exec("DELETE FROM webauthn_challenge WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		return fmt.Errorf("error deleting expired challenges: %w", err)
+	}
+	_, err := s.db.Exec(`
+        INSERT INTO webauthn_challenge (challenge, user_id, kind, expires_at)
+        VALUES (?, ?, ?, ?)
+    `, challenge.Challenge, challenge.UserID, challenge.Kind, challenge.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("error creating challenge: %w", err)
+	}
+	return nil
+}
+
+// ConsumeChallenge removes the challenge, so it answers one ceremony only.
+func (s *sqliteStore) ConsumeChallenge(challenge, kind string) (*Challenge, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := &Challenge{}
+	err := s.db.QueryRow(`
+        DELETE FROM webauthn_challenge
+        WHERE challenge = ? AND kind = ?
+        RETURNING challenge, user_id, kind, expires_at
+    `, challenge, kind).Scan(&c.Challenge, &c.UserID, &c.Kind, &c.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrChallengeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error consuming challenge: %w", err)
+	}
+	if time.Now().Unix() > c.ExpiresAt {
+		return nil, ErrChallengeInvalid
+	}
+	return c, nil
+}
+
+var ErrMagicLinkInvalid = errors.New("magic link is unknown, used or expired")
+
+// CreateMagicLink stores a login link, and drops the expired ones.
+func (s *sqliteStore) CreateMagicLink(link *MagicLink) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now().Unix()
+	if _, err := s.db.Exec("DELETE FROM magic_link WHERE expires_at < ?", now); err != nil {
+		return fmt.Errorf("error deleting expired magic links: %w", err)
+	}
+	if link.CreatedAt == 0 {
+		link.CreatedAt = now
+	}
+	_, err := s.db.Exec(`
+        INSERT INTO magic_link (id, email, created_at, expires_at)
+        VALUES (?, ?, ?, ?)
+    `, link.ID, link.Email, link.CreatedAt, link.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("error creating magic link: %w", err)
+	}
+	return nil
+}
+
+// ConsumeMagicLink removes the link, so it logs in once.
+func (s *sqliteStore) ConsumeMagicLink(linkID string) (*MagicLink, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	link := &MagicLink{}
+	err := s.db.QueryRow(`
+        DELETE FROM magic_link
+        WHERE id = ?
+        RETURNING id, email, created_at, expires_at
+    `, linkID).Scan(&link.ID, &link.Email, &link.CreatedAt, &link.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error consuming magic link: %w", err)
+	}
+	if time.Now().Unix() > link.ExpiresAt {
+		return nil, ErrMagicLinkInvalid
+	}
+	return link, nil
+}
+
+var (
+	ErrTOTPNotFound        = errors.New("totp not found")
+	ErrTOTPEnabled         = errors.New("totp is already enabled")
+	ErrTOTPStepUsed        = errors.New("totp code was already used")
+	ErrRecoveryCodeInvalid = errors.New("recovery code is unknown or used")
+)
+
+// CreateTOTP starts an enrollment, replacing one that was never confirmed.
+func (s *sqliteStore) CreateTOTP(totp *TOTP) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if totp.CreatedAt == 0 {
+		totp.CreatedAt = time.Now().Unix()
+	}
+	result, err := s.db.Exec(`
+        INSERT INTO totp (user_id, secret, created_at)
+        VALUES (?, ?, ?)
+        ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at
+        WHERE totp.confirmed_at = 0
+    `, totp.UserID, totp.Secret, totp.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating totp: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+func (s *sqliteStore) TOTPByUserID(userID int64) (*TOTP, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	totp := &TOTP{}
+	err := s.db.QueryRow(`
+        SELECT user_id, secret, created_at, confirmed_at, last_step
+        FROM totp
+        WHERE user_id = ?
+    `, userID).Scan(&totp.UserID, &totp.Secret, &totp.CreatedAt, &totp.ConfirmedAt, &totp.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting totp: %w", err)
+	}
+	return totp, nil
+}
+
+// ConfirmTOTP enables the enrollment of the user once they entered a code
+// of step, and gives them new recovery codes. Only their hashes are kept.
+func (s *sqliteStore) ConfirmTOTP(userID, step int64, recoveryCodeIDs []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+        UPDATE totp SET confirmed_at = ?, last_step = ?
+        WHERE user_id = ? AND confirmed_at = 0
+    `, time.Now().Unix(), step, userID)
+	if err != nil {
+		return fmt.Errorf("error confirming totp: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_code WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	for _, id := range recoveryCodeIDs {
+		if _, err := tx.Exec("INSERT INTO recovery_code (user_id, id) VALUES (?, ?)", userID, id); err != nil {
+			return fmt.Errorf("error creating recovery code: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records a code of step as used. Codes of that step and the
+// ones before it are refused after.
+func (s *sqliteStore) UseTOTPStep(userID, step int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result, err := s.db.Exec(`
+        UPDATE totp SET last_step = ?
+        WHERE user_id = ? AND confirmed_at != 0 AND last_step < ?
+    `, step, userID, step)
+	if err != nil {
+		return fmt.Errorf("error using totp step: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPStepUsed
+	}
+	return nil
+}
+
+// DeleteTOTP turns two-factor authentication off for the user, with their
+// recovery codes.
+func (s *sqliteStore) DeleteTOTP(userID int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_code WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	result, err := tx.Exec("DELETE FROM totp WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("error deleting totp: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPNotFound
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the code, so it works once.
+func (s *sqliteStore) UseRecoveryCode(userID int64, codeID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result, err := s.db.Exec("DELETE FROM recovery_code WHERE user_id = ? AND id = ?", userID, codeID)
+	if err != nil {
+		return fmt.Errorf("error using recovery code: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+func (s *sqliteStore) RecoveryCodeCount(userID int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM recovery_code WHERE user_id = ?", userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting recovery codes: %w", err)
+	}
+	return count, nil
+}
+
+func (s *sqliteStore) CreateJob(job *Job, tracks []*Track) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO job (id, user_id, file_name, mime_type, created_at, bpm, key, spectrogram) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.UserID, job.FileName, job.MimeType, job.CreatedAt, job.BPM, job.Key, job.Spectrogram,
+	)
+	if err != nil {
+		return fmt.Errorf("error creating job: %w", err)
+	}
+
+	for _, track := range tracks {
+		_, err = tx.Exec(
+			"INSERT INTO track (id, job_id, variant, params, path, size, bpm, key, spectrogram) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			track.ID, job.ID, track.Variant, track.Params, track.Path, track.Size, track.BPM, track.Key, track.Spectrogram,
+		)
+		if err != nil {
+			return fmt.Errorf("error creating track: %w", err)
+		}
+		track.JobID = job.ID
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) TracksByJobID(jobID string) ([]*Track, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows, err := s.db.Query(`
+        SELECT id, job_id, variant, params, path, size, bpm, key, spectrogram
+        FROM track
+        WHERE job_id = ?
+        ORDER BY variant
+    `, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tracks: %w", err)
+	}
+	defer rows.Close()
+
+	var tracks []*Track
+	for rows.Next() {
+		track := &Track{}
+		err := rows.Scan(&track.ID, &track.JobID, &track.Variant, &track.Params, &track.Path, &track.Size, &track.BPM, &track.Key, &track.Spectrogram)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning track: %w", err)
+		}
+		tracks = append(tracks, track)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tracks: %w", err)
+	}
+	return tracks, nil
+}
+
+var (
+	ErrJobNotFound   = errors.New("job not found")
+	ErrTrackNotFound = errors.New("track not found")
+)
+
+func (s *sqliteStore) JobByID(jobID string) (*Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job := &Job{}
+	err := s.db.QueryRow(`
+        SELECT id, user_id, file_name, mime_type, created_at, bpm, key, spectrogram
+        FROM job
+        WHERE id = ?
+    `, jobID).Scan(&job.ID, &job.UserID, &job.FileName, &job.MimeType, &job.CreatedAt, &job.BPM, &job.Key, &job.Spectrogram)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting job: %w", err)
+	}
+	return job, nil
+}
+
+func (s *sqliteStore) TrackByID(trackID string) (*Track, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	track := &Track{}
+	err := s.db.QueryRow(`
+        SELECT id, job_id, variant, params, path, size, bpm, key, spectrogram
+        FROM track
+        WHERE id = ?
+    `, trackID).Scan(&track.ID, &track.JobID, &track.Variant, &track.Params, &track.Path, &track.Size, &track.BPM, &track.Key, &track.Spectrogram)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrTrackNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting track: %w", err)
+	}
+	return track, nil
+}
+
 func (s *sqliteStore) DeleteTag(tagID string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
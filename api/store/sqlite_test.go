@@ -1,8 +1,12 @@
 package store
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"testing"
 	"time"
 )
@@ -109,7 +113,7 @@ func TestDeleteUser(t *testing.T) {
 		t.Fatalf("Failed to create test user: %v", err)
 	}
 
-	err = store.DeleteUser(id)
+	_, err = store.DeleteUser(id)
 	if err != nil {
 		t.Fatalf("Failed to delete user: %v", err)
 	}
@@ -119,7 +123,7 @@ func TestDeleteUser(t *testing.T) {
 		t.Error("Expected error when getting deleted user, got nil")
 	}
 
-	err = store.DeleteUser(4444)
+	_, err = store.DeleteUser(4444)
 	if err == nil {
 		t.Error("Expected error when deleting non-existent user, got nil")
 	}
@@ -168,7 +172,7 @@ func TestCreateSession(t *testing.T) {
 
 	sessionID := "12345"
 	expiresAt := time.Now().Add(24 * time.Hour).Unix()
-	session, err := store.CreateSession(sessionID, userID, expiresAt)
+	session, err := store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
@@ -182,12 +186,12 @@ func TestCreateSession(t *testing.T) {
 		t.Errorf("Expected expires at %d, got %d", expiresAt, session.ExpiresAt)
 	}
 
-	_, err = store.CreateSession("123453", int64(9999), expiresAt)
+	_, err = store.CreateSession(&Session{ID: "123453", UserID: 9999, ExpiresAt: expiresAt})
 	if err == nil {
 		t.Error("Expected error when creating session for non-existent user, got nil")
 	}
 
-	_, err = store.CreateSession(sessionID, userID, expiresAt)
+	_, err = store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 	if err == nil {
 		t.Error("Expected error when creating duplicate session, got nil")
 	}
@@ -210,7 +214,7 @@ func TestDeleteSessionByUserID(t *testing.T) {
 
 	sessionID := "1234"
 	expiresAt := time.Now().Add(24 * time.Hour).Unix()
-	_, err = store.CreateSession(sessionID, userID, expiresAt)
+	_, err = store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
@@ -248,7 +252,7 @@ func TestDeleteSessionBySessionID(t *testing.T) {
 
 	sessionID := "12345"
 	expiresAt := time.Now().Add(24 * time.Hour).Unix()
-	_, err = store.CreateSession(sessionID, userID, expiresAt)
+	_, err = store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
@@ -286,7 +290,7 @@ func TestSessionAndUserBySessionID(t *testing.T) {
 
 	sessionID := "12345"
 	expiresAt := time.Now().Add(24 * time.Hour).Unix()
-	_, err = store.CreateSession(sessionID, userID, expiresAt)
+	_, err = store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
@@ -339,7 +343,7 @@ func TestRefreshSession(t *testing.T) {
 
 	sessionID := "12345"
 	expiresAt := time.Now().Add(24 * time.Hour).Unix()
-	_, err = store.CreateSession(sessionID, userID, expiresAt)
+	_, err = store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
@@ -387,7 +391,7 @@ func TestConcurrentSessionOperations(t *testing.T) {
 		go func(i int) {
 			sessionID := fmt.Sprintf("sessionID-%d", i)
 			expiresAt := baseTime.Add(time.Duration(i) * time.Hour).Unix()
-			_, err := store.CreateSession(sessionID, userID, expiresAt)
+			_, err := store.CreateSession(&Session{ID: sessionID, UserID: userID, ExpiresAt: expiresAt})
 			if err != nil {
 				t.Errorf("Failed to create session in goroutine: %v", err)
 			}
@@ -406,3 +410,591 @@ func TestConcurrentSessionOperations(t *testing.T) {
 		<-done
 	}
 }
+
+func TestCreateJob(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	job := &Job{
+		ID:        "job-1",
+		FileName:  "beat.mp3",
+		MimeType:  "audio/mpeg",
+		CreatedAt: time.Now().Unix(),
+		BPM:       140,
+		Key:       "A minor",
+	}
+	tracks := []*Track{
+		{ID: "track-1", Variant: 1, Params: `{"speed":0.85}`, Path: "data/tracks/track-1.aac", Size: 2048, BPM: 115.7, Key: "F# minor"},
+		{ID: "track-0", Variant: 0, Params: `{"speed":0.9}`, Path: "data/tracks/track-0.aac", Size: 1024, BPM: 122.2, Key: "G minor"},
+	}
+
+	err := store.CreateJob(job, tracks)
+	if err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+
+	got, err := store.TracksByJobID(job.ID)
+	if err != nil {
+		t.Fatalf("Failed to get tracks: %v", err)
+	}
+	if len(got) != len(tracks) {
+		t.Fatalf("Expected %d tracks, got %d", len(tracks), len(got))
+	}
+	for i, track := range got {
+		if track.Variant != i {
+			t.Errorf("Expected tracks ordered by variant, got variant %d at %d", track.Variant, i)
+		}
+		if track.JobID != job.ID {
+			t.Errorf("Expected job ID %s, got %s", job.ID, track.JobID)
+		}
+	}
+	if got[0].Params != tracks[1].Params {
+		t.Errorf("Expected params %s, got %s", tracks[1].Params, got[0].Params)
+	}
+	if got[0].BPM != tracks[1].BPM || got[0].Key != tracks[1].Key {
+		t.Errorf("Expected %v BPM in %s, got %v BPM in %s", tracks[1].BPM, tracks[1].Key, got[0].BPM, got[0].Key)
+	}
+
+	err = store.CreateJob(&Job{ID: "job-2", CreatedAt: job.CreatedAt}, []*Track{
+		{ID: "track-2", Variant: 0, Path: "a"},
+		{ID: "track-3", Variant: 0, Path: "b"},
+	})
+	if err == nil {
+		t.Error("Expected error when creating duplicate variant, got nil")
+	}
+
+	got, err = store.TracksByJobID("job-2")
+	if err != nil {
+		t.Fatalf("Failed to get tracks: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected failed job to be rolled back, got %d tracks", len(got))
+	}
+}
+
+func TestJobAndTrackByID(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	job := &Job{ID: "job-1", UserID: 7, CreatedAt: time.Now().Unix(), Spectrogram: "data/tracks/job-1.png"}
+	tracks := []*Track{{ID: "track-0", Path: "data/tracks/track-0.aac", Spectrogram: "data/tracks/track-0.png"}}
+	if err := store.CreateJob(job, tracks); err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+
+	gotJob, err := store.JobByID(job.ID)
+	if err != nil {
+		t.Fatalf("Failed to get job: %v", err)
+	}
+	if gotJob.Spectrogram != job.Spectrogram || gotJob.UserID != job.UserID {
+		t.Errorf("Expected spectrogram %s of user %d, got %+v", job.Spectrogram, job.UserID, gotJob)
+	}
+	gotTrack, err := store.TrackByID("track-0")
+	if err != nil {
+		t.Fatalf("Failed to get track: %v", err)
+	}
+	if gotTrack.JobID != job.ID || gotTrack.Spectrogram != tracks[0].Spectrogram {
+		t.Errorf("Expected track of %s with spectrogram %s, got %+v", job.ID, tracks[0].Spectrogram, gotTrack)
+	}
+
+	if _, err := store.JobByID("nope"); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+	if _, err := store.TrackByID("nope"); err != ErrTrackNotFound {
+		t.Errorf("Expected ErrTrackNotFound, got %v", err)
+	}
+}
+
+func TestAddColumnToOldTables(t *testing.T) {
+	db, err := sql.Open("sqlite3", "./test.db")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+        CREATE TABLE job (
+            id TEXT NOT NULL PRIMARY KEY,
+            file_name TEXT NOT NULL,
+            mime_type TEXT NOT NULL,
+            created_at INTEGER NOT NULL
+        )
+    `)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old job table: %v", err)
+	}
+
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	err = store.CreateJob(&Job{ID: "job-1", CreatedAt: time.Now().Unix(), BPM: 90, Key: "C major"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create job on migrated table: %v", err)
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	user := &User{GoogleID: "1", Email: "producer@example.com", Name: "Producer"}
+	id, err := store.CreateUserWithIdentity(user, &Identity{Provider: "google", Subject: "1", Email: user.Email})
+	if err != nil {
+		t.Fatalf("Failed to create user with identity: %v", err)
+	}
+	if got, err := store.UserByIdentity("google", "1"); err != nil || got.ID != id {
+		t.Errorf("Expected user %d by identity, got %+v, %v", id, got, err)
+	}
+	if _, err := store.UserByIdentity("github", "1"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if got, err := store.UserByEmail("Producer@Example.com"); err != nil || got.ID != id {
+		t.Errorf("Expected user %d by email regardless of case, got %+v, %v", id, got, err)
+	}
+
+	other := &User{GoogleID: "2", Email: "other@example.com", Name: "Other"}
+	if _, err := store.CreateUserWithIdentity(other, &Identity{Provider: "google", Subject: "1"}); !errors.Is(err, ErrIdentityTaken) {
+		t.Errorf("Expected ErrIdentityTaken, got %v", err)
+	}
+	if _, err := store.UserByEmail(other.Email); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected the user of a taken identity to be rolled back, got %v", err)
+	}
+
+	if err := store.CreateIdentity(&Identity{Provider: "github", Subject: "42", UserID: id}); err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	identities, err := store.IdentitiesByUserID(id)
+	if err != nil || len(identities) != 2 {
+		t.Fatalf("Expected 2 identities, got %v, %v", identities, err)
+	}
+
+	if err := store.DeleteIdentity(id, "github", "43"); !errors.Is(err, ErrIdentityNotFound) {
+		t.Errorf("Expected ErrIdentityNotFound, got %v", err)
+	}
+	if err := store.DeleteIdentity(id, "github", "42"); err != nil {
+		t.Errorf("Failed to delete identity: %v", err)
+	}
+	if err := store.DeleteIdentity(id, "google", "1"); !errors.Is(err, ErrLastIdentity) {
+		t.Errorf("Expected ErrLastIdentity, got %v", err)
+	}
+	if _, err := store.UserByIdentity("google", "1"); err != nil {
+		t.Errorf("Expected the last identity to be kept, got %v", err)
+	}
+}
+
+func TestMigrateGoogleIDToIdentities(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	googleID, _ := store.CreateUser(&User{GoogleID: "123", Email: "google@example.com"})
+	oidcID, _ := store.CreateUser(&User{GoogleID: "keycloak:abc:def", Email: "oidc@example.com"})
+
+	// Opening the database again runs the migration.
+	store, err := newSQLiteStore("./test.db")
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if user, err := store.UserByIdentity("google", "123"); err != nil || user.ID != googleID {
+		t.Errorf("Expected the Google ID to become a google identity, got %+v, %v", user, err)
+	}
+	if user, err := store.UserByIdentity("keycloak", "abc:def"); err != nil || user.ID != oidcID {
+		t.Errorf("Expected the namespaced ID to become a keycloak identity, got %+v, %v", user, err)
+	}
+
+	store.CreateIdentity(&Identity{Provider: "github", Subject: "42", UserID: googleID})
+	store.DeleteIdentity(googleID, "google", "123")
+	if store, err = newSQLiteStore("./test.db"); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if _, err := store.UserByIdentity("google", "123"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected an unlinked identity to stay unlinked, got %v", err)
+	}
+}
+
+func TestSessionsByUserID(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	userID, err := store.CreateUser(&User{GoogleID: "1", Email: "test@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	otherID, _ := store.CreateUser(&User{GoogleID: "2", Email: "other@example.com"})
+	now := time.Now()
+	sessions := []*Session{
+		{ID: "laptop", UserID: userID, ExpiresAt: now.Add(time.Hour).Unix(), UserAgent: "Firefox", IP: "203.0.113.7", LastSeenAt: now.Add(-time.Hour).Unix()},
+		{ID: "phone", UserID: userID, ExpiresAt: now.Add(time.Hour).Unix(), UserAgent: "Safari"},
+		{ID: "expired", UserID: userID, ExpiresAt: now.Add(-time.Hour).Unix()},
+		{ID: "other", UserID: otherID, ExpiresAt: now.Add(time.Hour).Unix()},
+	}
+	for _, session := range sessions {
+		if _, err := store.CreateSession(session); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+
+	got, err := store.SessionsByUserID(userID)
+	if err != nil {
+		t.Fatalf("Failed to get sessions: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "phone" || got[1].ID != "laptop" {
+		t.Fatalf("Expected the live sessions, most recently seen first, got %+v", got)
+	}
+	if got[1].UserAgent != "Firefox" || got[1].IP != "203.0.113.7" || got[1].CreatedAt == 0 {
+		t.Errorf("Expected the device to be stored, got %+v", got[1])
+	}
+
+	if err := store.DeleteUserSession(userID, "other"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound for a session of another user, got %v", err)
+	}
+	if err := store.DeleteUserSession(userID, "laptop"); err != nil {
+		t.Errorf("Failed to delete session: %v", err)
+	}
+	if _, _, err := store.SessionAndUserBySessionID("laptop"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected the session to be deleted, got %v", err)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	userID, err := store.CreateUser(&User{GoogleID: "1", Email: "test@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	token := &APIToken{ID: "hash", UserID: userID, Name: "batch", Scopes: []string{"jobs:write", "profile:read"}}
+	if err := store.CreateAPIToken(token); err != nil {
+		t.Fatalf("Failed to create api token: %v", err)
+	}
+	if err := store.CreateAPIToken(&APIToken{ID: "other", UserID: 9999, Name: "x"}); err == nil {
+		t.Error("Expected error when creating api token for non-existent user, got nil")
+	}
+
+	got, user, err := store.APITokenAndUserByID("hash")
+	if err != nil {
+		t.Fatalf("Failed to get api token: %v", err)
+	}
+	if user.ID != userID || got.Name != "batch" || len(got.Scopes) != 2 || got.CreatedAt == 0 {
+		t.Errorf("Expected the stored token, got %+v", got)
+	}
+	if err := store.TouchAPIToken("hash", 42); err != nil {
+		t.Fatalf("Failed to touch api token: %v", err)
+	}
+	tokens, err := store.APITokensByUserID(userID)
+	if err != nil || len(tokens) != 1 || tokens[0].LastUsedAt != 42 {
+		t.Fatalf("Expected the token with its last use, got %+v, %v", tokens, err)
+	}
+
+	if err := store.DeleteAPIToken(userID+1, "hash"); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Errorf("Expected ErrAPITokenNotFound for another user, got %v", err)
+	}
+	if err := store.DeleteAPIToken(userID, "hash"); err != nil {
+		t.Errorf("Failed to delete api token: %v", err)
+	}
+	if _, _, err := store.APITokenAndUserByID("hash"); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Errorf("Expected ErrAPITokenNotFound, got %v", err)
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	id, err := store.CreateUser(&User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	user, err := store.UserByGoogleID("1")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if user.Role != RoleUser || !user.Can(PermJobsWrite) || user.Can(PermAdminUsers) {
+		t.Errorf("Expected new users to have the user role, got %q", user.Role)
+	}
+
+	if err := store.SetUserRole(id, RoleAdmin); err != nil {
+		t.Fatalf("Failed to set role: %v", err)
+	}
+	user, _ = store.UserByGoogleID("1")
+	if user.Role != RoleAdmin || !user.Can(PermAdminUsers) || !user.Can(PermJobsWrite) {
+		t.Errorf("Expected the admin role, got %q", user.Role)
+	}
+
+	if err := store.SetUserRole(id, "owner"); err == nil {
+		t.Error("Expected error for an unknown role")
+	}
+	if err := store.SetUserRole(id+1, RoleAdmin); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if (&User{Role: "owner"}).Can(PermJobsWrite) {
+		t.Error("Expected unknown roles to have no permissions")
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	for i, name := range []string{"Ada Lovelace", "Grace Hopper", "100% Producer"} {
+		email := fmt.Sprintf("user%d@example.com", i)
+		if _, err := store.CreateUser(&User{GoogleID: fmt.Sprint(i), Email: email, Name: name}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query         string
+		limit, offset int
+		want          []string
+	}{
+		{"", 10, 0, []string{"Ada Lovelace", "Grace Hopper", "100% Producer"}},
+		{"", 1, 1, []string{"Grace Hopper"}},
+		{"hop", 10, 0, []string{"Grace Hopper"}},
+		{"USER2@", 10, 0, []string{"100% Producer"}},
+		{"%", 10, 0, []string{"100% Producer"}},
+		{"_", 10, 0, []string{}},
+	}
+	for _, tt := range tests {
+		users, err := store.SearchUsers(tt.query, tt.limit, tt.offset)
+		if err != nil {
+			t.Fatalf("Failed to search users: %v", err)
+		}
+		names := []string{}
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+			t.Errorf("Search %q: expected %v, got %v", tt.query, tt.want, names)
+		}
+	}
+}
+
+func TestDisableAndDeleteUser(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	id, err := store.CreateUserWithIdentity(&User{GoogleID: "1", Email: "producer@example.com"}, &Identity{Provider: "google", Subject: "1"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	if _, err := store.CreateSession(&Session{ID: "session", UserID: id, ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := store.CreateAPIToken(&APIToken{ID: "token", UserID: id, Name: "batch", Scopes: []string{PermJobsWrite}}); err != nil {
+		t.Fatalf("Failed to create api token: %v", err)
+	}
+
+	if err := store.SetUserDisabled(id, true); err != nil {
+		t.Fatalf("Failed to disable user: %v", err)
+	}
+	user, err := store.UserByID(id)
+	if err != nil || !user.Disabled {
+		t.Errorf("Expected a disabled user, got %+v, %v", user, err)
+	}
+	if _, _, err := store.SessionAndUserBySessionID("session"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected disabling to end sessions, got %v", err)
+	}
+	if _, user, err := store.APITokenAndUserByID("token"); err != nil || !user.Disabled {
+		t.Errorf("Expected the token to show the user disabled, got %+v, %v", user, err)
+	}
+	if err := store.SetUserDisabled(id, false); err != nil {
+		t.Fatalf("Failed to enable user: %v", err)
+	}
+	if user, _ := store.UserByID(id); user.Disabled {
+		t.Error("Expected the user to be enabled")
+	}
+	if err := store.SetUserDisabled(id+1, true); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	if _, err := store.CreateSession(&Session{ID: "session", UserID: id, ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	err = store.CreateJob(&Job{ID: "job", UserID: id, Spectrogram: "job.png"}, []*Track{
+		{ID: "track", Variant: 0, Path: "track.wav", Spectrogram: "track.png"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+	files, err := store.DeleteUser(id)
+	if err != nil {
+		t.Fatalf("Failed to delete user with sessions: %v", err)
+	}
+	slices.Sort(files)
+	if want := []string{"job.png", "track.png", "track.wav"}; !slices.Equal(files, want) {
+		t.Errorf("Expected the files of the jobs %v, got %v", want, files)
+	}
+	if _, err := store.JobByID("job"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Expected the job to be deleted, got %v", err)
+	}
+	if _, err := store.TrackByID("track"); !errors.Is(err, ErrTrackNotFound) {
+		t.Errorf("Expected the track to be deleted, got %v", err)
+	}
+	if _, err := store.UserByID(id); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if _, _, err := store.APITokenAndUserByID("token"); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Errorf("Expected the api token to be deleted, got %v", err)
+	}
+	if _, err := store.UserByIdentity("google", "1"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected the identity to be deleted, got %v", err)
+	}
+	if _, err := store.DeleteUser(id); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestPasskeysAndChallenges(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	userID, err := store.CreateUser(&User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	future := time.Now().Add(time.Minute).Unix()
+	for _, c := range []*Challenge{
+		{Challenge: "register", UserID: userID, Kind: "register", ExpiresAt: future},
+		{Challenge: "login", Kind: "login", ExpiresAt: future},
+		{Challenge: "expired", Kind: "login", ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+	} {
+		if err := store.CreateChallenge(c); err != nil {
+			t.Fatalf("Failed to create challenge: %v", err)
+		}
+	}
+	if _, err := store.ConsumeChallenge("register", "login"); !errors.Is(err, ErrChallengeInvalid) {
+		t.Errorf("Expected a challenge of another kind to be invalid, got %v", err)
+	}
+	if c, err := store.ConsumeChallenge("register", "register"); err != nil || c.UserID != userID {
+		t.Errorf("Expected the registration challenge, got %+v, %v", c, err)
+	}
+	if _, err := store.ConsumeChallenge("register", "register"); !errors.Is(err, ErrChallengeInvalid) {
+		t.Errorf("Expected a challenge to be used once, got %v", err)
+	}
+	if _, err := store.ConsumeChallenge("expired", "login"); !errors.Is(err, ErrChallengeInvalid) {
+		t.Errorf("Expected an expired challenge to be invalid, got %v", err)
+	}
+
+	passkey := &Passkey{ID: "credential", UserID: userID, PublicKey: []byte{1, 2, 3}, Name: "Laptop"}
+	if err := store.CreatePasskey(passkey); err != nil {
+		t.Fatalf("Failed to create passkey: %v", err)
+	}
+	if err := store.CreatePasskey(passkey); !errors.Is(err, ErrPasskeyTaken) {
+		t.Errorf("Expected ErrPasskeyTaken, got %v", err)
+	}
+	// Authenticators without a counter always send 0.
+	for _, count := range []uint32{0, 0} {
+		if err := store.UsePasskey("credential", count, time.Now().Unix()); err != nil {
+			t.Errorf("Expected sign count %d to be accepted, got %v", count, err)
+		}
+	}
+	if err := store.UsePasskey("credential", 5, time.Now().Unix()); err != nil {
+		t.Errorf("Expected an increasing sign count to be accepted, got %v", err)
+	}
+	for _, count := range []uint32{5, 4, 0} {
+		if err := store.UsePasskey("credential", count, time.Now().Unix()); !errors.Is(err, ErrSignCount) {
+			t.Errorf("Expected sign count %d to be rejected, got %v", count, err)
+		}
+	}
+	got, user, err := store.PasskeyAndUserByID("credential")
+	if err != nil || got.SignCount != 5 || user.ID != userID || !bytes.Equal(got.PublicKey, passkey.PublicKey) {
+		t.Errorf("Expected the passkey with its user, got %+v, %+v, %v", got, user, err)
+	}
+
+	if err := store.DeletePasskey(userID+1, "credential"); !errors.Is(err, ErrPasskeyNotFound) {
+		t.Errorf("Expected passkeys of other users not to be deleted, got %v", err)
+	}
+	if err := store.DeletePasskey(userID, "credential"); err != nil {
+		t.Errorf("Failed to delete passkey: %v", err)
+	}
+	if passkeys, _ := store.PasskeysByUserID(userID); len(passkeys) != 0 {
+		t.Errorf("Expected no passkeys, got %d", len(passkeys))
+	}
+}
+
+func TestMagicLinks(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	for _, link := range []*MagicLink{
+		{ID: "valid", Email: "producer@example.com", ExpiresAt: time.Now().Add(time.Minute).Unix()},
+		{ID: "expired", Email: "producer@example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+	} {
+		if err := store.CreateMagicLink(link); err != nil {
+			t.Fatalf("Failed to create magic link: %v", err)
+		}
+	}
+	if link, err := store.ConsumeMagicLink("valid"); err != nil || link.Email != "producer@example.com" {
+		t.Errorf("Expected the magic link, got %+v, %v", link, err)
+	}
+	if _, err := store.ConsumeMagicLink("valid"); !errors.Is(err, ErrMagicLinkInvalid) {
+		t.Errorf("Expected a magic link to be used once, got %v", err)
+	}
+	if _, err := store.ConsumeMagicLink("expired"); !errors.Is(err, ErrMagicLinkInvalid) {
+		t.Errorf("Expected an expired magic link to be invalid, got %v", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	store := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	userID, err := store.CreateUser(&User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if _, err := store.TOTPByUserID(userID); !errors.Is(err, ErrTOTPNotFound) {
+		t.Errorf("Expected ErrTOTPNotFound, got %v", err)
+	}
+	for _, secret := range []string{"first", "second"} {
+		if err := store.CreateTOTP(&TOTP{UserID: userID, Secret: secret}); err != nil {
+			t.Fatalf("Failed to create totp: %v", err)
+		}
+	}
+	if err := store.UseTOTPStep(userID, 10); !errors.Is(err, ErrTOTPStepUsed) {
+		t.Errorf("Expected codes to be refused before confirming, got %v", err)
+	}
+	if err := store.ConfirmTOTP(userID, 10, []string{"a", "b"}); err != nil {
+		t.Fatalf("Failed to confirm totp: %v", err)
+	}
+	if totp, err := store.TOTPByUserID(userID); err != nil || totp.Secret != "second" || totp.ConfirmedAt == 0 || totp.LastStep != 10 {
+		t.Errorf("Expected the second secret to be confirmed, got %+v, %v", totp, err)
+	}
+	if err := store.CreateTOTP(&TOTP{UserID: userID, Secret: "third"}); !errors.Is(err, ErrTOTPEnabled) {
+		t.Errorf("Expected ErrTOTPEnabled, got %v", err)
+	}
+	if err := store.ConfirmTOTP(userID, 11, nil); !errors.Is(err, ErrTOTPNotFound) {
+		t.Errorf("Expected a second confirmation to fail, got %v", err)
+	}
+
+	for _, step := range []int64{10, 9} {
+		if err := store.UseTOTPStep(userID, step); !errors.Is(err, ErrTOTPStepUsed) {
+			t.Errorf("Expected step %d to be refused, got %v", step, err)
+		}
+	}
+	if err := store.UseTOTPStep(userID, 11); err != nil {
+		t.Errorf("Expected a later step to be accepted, got %v", err)
+	}
+
+	if err := store.UseRecoveryCode(userID, "a"); err != nil {
+		t.Errorf("Failed to use recovery code: %v", err)
+	}
+	if err := store.UseRecoveryCode(userID, "a"); !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Errorf("Expected a recovery code to work once, got %v", err)
+	}
+	if count, err := store.RecoveryCodeCount(userID); err != nil || count != 1 {
+		t.Errorf("Expected one recovery code left, got %d, %v", count, err)
+	}
+
+	if err := store.DeleteTOTP(userID); err != nil {
+		t.Fatalf("Failed to delete totp: %v", err)
+	}
+	if count, _ := store.RecoveryCodeCount(userID); count != 0 {
+		t.Errorf("Expected the recovery codes to be deleted, got %d", count)
+	}
+	if err := store.DeleteTOTP(userID); !errors.Is(err, ErrTOTPNotFound) {
+		t.Errorf("Expected ErrTOTPNotFound, got %v", err)
+	}
+}
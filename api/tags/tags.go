@@ -0,0 +1,163 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+// Title looks for the title tag in the first bytes of an upload. It knows
+// ID3v2 (MP3), FLAC and Ogg Vorbis/Opus comments. Containers that keep their
+// tags at the end of the file, like most M4A, are not found.
+func Title(head []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return id3Title(head)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return flacTitle(head)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return oggTitle(head)
+	}
+	return "", false
+}
+
+func id3Title(head []byte) (string, bool) {
+	if len(head) < 10 {
+		return "", false
+	}
+	version := head[3]
+	flags := head[5]
+	end := min(len(head), 10+syncsafe(head[6:10]))
+	pos := 10
+	if flags&0x40 != 0 && version >= 3 && len(head) >= 14 {
+		// Extended header, v2.4 counts its own size bytes, v2.3 doesn't.
+		size := int(binary.BigEndian.Uint32(head[10:14]))
+		if version == 4 {
+			size = syncsafe(head[10:14])
+		} else {
+			size += 4
+		}
+		pos += size
+	}
+
+	idLen, headerLen, titleID := 4, 10, "TIT2"
+	if version == 2 {
+		idLen, headerLen, titleID = 3, 6, "TT2"
+	}
+
+	for pos+headerLen <= end {
+		id := string(head[pos : pos+idLen])
+		if id[0] == 0 {
+			break // padding
+		}
+		var size int
+		switch version {
+		case 2:
+			size = int(head[pos+3])<<16 | int(head[pos+4])<<8 | int(head[pos+5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(head[pos+4 : pos+8]))
+		default:
+			size = syncsafe(head[pos+4 : pos+8])
+		}
+		body := pos + headerLen
+		if size < 0 || body+size > len(head) {
+			return "", false
+		}
+		if id == titleID && size > 1 {
+			title := id3Text(head[body], head[body+1:body+size])
+			return title, title != ""
+		}
+		pos = body + size
+	}
+	return "", false
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func id3Text(encoding byte, b []byte) string {
+	switch encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		order := binary.ByteOrder(binary.BigEndian)
+		if encoding == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			b = b[2:]
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			units = append(units, order.Uint16(b[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case 3: // UTF-8
+		return strings.TrimRight(string(b), "\x00")
+	default: // ISO-8859-1
+		runes := make([]rune, 0, len(b))
+		for _, c := range b {
+			runes = append(runes, rune(c))
+		}
+		return strings.TrimRight(string(runes), "\x00")
+	}
+}
+
+func flacTitle(head []byte) (string, bool) {
+	pos := 4
+	for pos+4 <= len(head) {
+		last := head[pos]&0x80 != 0
+		blockType := head[pos] & 0x7f
+		size := int(head[pos+1])<<16 | int(head[pos+2])<<8 | int(head[pos+3])
+		pos += 4
+		if blockType == 4 { // VORBIS_COMMENT
+			if pos+size > len(head) {
+				return "", false
+			}
+			return vorbisCommentTitle(head[pos : pos+size])
+		}
+		if last {
+			break
+		}
+		pos += size
+	}
+	return "", false
+}
+
+// oggTitle reads the comment header right after its packet signature. Long
+// comment packets span pages and are cut off, the title is usually early
+// enough to be found anyway.
+func oggTitle(head []byte) (string, bool) {
+	for _, signature := range []string{"\x03vorbis", "OpusTags"} {
+		if i := bytes.Index(head, []byte(signature)); i >= 0 {
+			return vorbisCommentTitle(head[i+len(signature):])
+		}
+	}
+	return "", false
+}
+
+func vorbisCommentTitle(b []byte) (string, bool) {
+	if len(b) < 4 {
+		return "", false
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(b))
+	pos := 4 + vendorLen
+	if pos+4 > len(b) {
+		return "", false
+	}
+	count := int(binary.LittleEndian.Uint32(b[pos:]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(b); i++ {
+		size := int(binary.LittleEndian.Uint32(b[pos:]))
+		pos += 4
+		if size < 0 || pos+size > len(b) {
+			return "", false
+		}
+		key, value, ok := strings.Cut(string(b[pos:pos+size]), "=")
+		if ok && strings.EqualFold(key, "title") && value != "" {
+			return value, true
+		}
+		pos += size
+	}
+	return "", false
+}
@@ -0,0 +1,96 @@
+package tags
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func id3v23(frames ...[]byte) []byte {
+	var body []byte
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	body = append(body, make([]byte, 16)...) // padding
+	size := len(body)
+	head := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(head, body...)
+}
+
+func id3Frame(id string, data []byte) []byte {
+	frame := []byte(id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data)))
+	frame = append(frame, 0, 0)
+	return append(frame, data...)
+}
+
+func vorbisComments(comments ...string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 6)
+	b = append(b, "vendor"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(comments)))
+	for _, c := range comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+func TestTitle(t *testing.T) {
+	flacComments := vorbisComments("ARTIST=Someone", "TITLE=Night Drive")
+	flac := append([]byte("fLaC"), 0x00, 0, 0, 2, 0xaa, 0xbb) // STREAMINFO, truncated
+	flac = append(flac, 0x84, 0, 0, byte(len(flacComments)))
+	flac = append(flac, flacComments...)
+
+	tests := []struct {
+		name string
+		head []byte
+		want string
+		ok   bool
+	}{
+		{
+			name: "id3 latin1",
+			head: id3v23(id3Frame("TPE1", []byte("\x00Someone")), id3Frame("TIT2", []byte("\x00Night Drive"))),
+			want: "Night Drive",
+			ok:   true,
+		},
+		{
+			name: "id3 utf16",
+			head: id3v23(id3Frame("TIT2", []byte{1, 0xff, 0xfe, 'N', 0, 0xed, 0, 'a', 0})),
+			want: "Nía",
+			ok:   true,
+		},
+		{
+			name: "id3 without title",
+			head: id3v23(id3Frame("TPE1", []byte("\x00Someone"))),
+		},
+		{
+			name: "flac",
+			head: flac,
+			want: "Night Drive",
+			ok:   true,
+		},
+		{
+			name: "opus",
+			head: append([]byte("OggS\x00\x00garbageOpusTags"), vorbisComments("title=Night Drive")...),
+			want: "Night Drive",
+			ok:   true,
+		},
+		{
+			name: "truncated",
+			head: id3v23(id3Frame("TIT2", []byte("\x00Night Drive")))[:15],
+		},
+		{
+			name: "no tags",
+			head: []byte{0xff, 0xfb, 0x90, 0x00},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Title(tt.head)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
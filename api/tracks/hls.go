@@ -0,0 +1,197 @@
+package tracks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"screw/cryptoutil"
+	"screw/ffmpeg"
+	"screw/herr"
+	"screw/store"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment URLs outlive the playlist by a long movie, not by days.
+const segmentURLTTL = 6 * time.Hour
+
+var mapURI = regexp.MustCompile(`URI="([^"]+)"`)
+
+// HandlePlaylist packages the track into HLS on the first request and
+// serves the playlist with every segment behind a signed URL. Only users who
+// may see the track get one.
+func (t *Tracks) HandlePlaylist(w http.ResponseWriter, r *http.Request) *herr.Error {
+	codec, err := ffmpeg.HLSCodecByName(r.URL.Query().Get("codec"))
+	if err != nil {
+		return herr.BadRequest(err, "Unknown HLS codec")
+	}
+	track, e := t.track(r, r.PathValue("id"))
+	if e != nil {
+		return e
+	}
+
+	dir, err := t.packaged(r.Context(), track, codec)
+	if err != nil {
+		return herr.Internal(err, "Error packaging HLS")
+	}
+	playlist, err := os.ReadFile(filepath.Join(dir, ffmpeg.HLSPlaylist))
+	if err != nil {
+		return herr.Internal(err, "Error reading playlist")
+	}
+
+	expires := time.Now().Add(segmentURLTTL).Unix()
+	signed := signPlaylist(playlist, func(name string) string {
+		return t.segmentURL(track.ID, codec.Name, name, expires)
+	})
+	// The signatures expire, so the playlist can't be cached for long.
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(signed)
+	return nil
+}
+
+// HandleSegment serves a segment of a playlist handed out by HandlePlaylist.
+func (t *Tracks) HandleSegment(w http.ResponseWriter, r *http.Request) *herr.Error {
+	id, codecName, name := r.PathValue("id"), r.PathValue("codec"), r.PathValue("name")
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return herr.BadRequest(err, "Invalid segment expiry")
+	}
+	if time.Now().Unix() > expires {
+		return herr.Unauthorized(errors.New("segment URL expired"), "Segment URL expired")
+	}
+	if !cryptoutil.VerifySignature(t.signingKey, segmentMessage(id, codecName, name, expires), query.Get("sig")) {
+		return herr.Unauthorized(errors.New("invalid segment signature"), "Invalid segment signature")
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return herr.BadRequest(fmt.Errorf("invalid segment name %q", name), "Invalid segment name")
+	}
+
+	codec, err := ffmpeg.HLSCodecByName(codecName)
+	if err != nil {
+		return herr.BadRequest(err, "Unknown HLS codec")
+	}
+	track, err := t.store.TrackByID(id)
+	if errors.Is(err, store.ErrTrackNotFound) {
+		return herr.NotFound(err, "Track not found")
+	}
+	if err != nil {
+		return herr.Internal(err, "Error getting track")
+	}
+
+	path := filepath.Join(hlsDir(track, codec), name)
+	if _, err := os.Stat(path); err != nil {
+		return herr.NotFound(err, "Segment not found")
+	}
+	switch filepath.Ext(name) {
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+	case ".m4s", ".mp4":
+		w.Header().Set("Content-Type", "audio/mp4")
+	}
+	// A segment never changes once packaged, and its URL is all a cache needs.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, path)
+	return nil
+}
+
+func (t *Tracks) segmentURL(id, codec, name string, expires int64) string {
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {cryptoutil.Sign(t.signingKey, segmentMessage(id, codec, name, expires))},
+	}
+	return "/api/tracks/" + id + "/hls/" + codec + "/" + name + "?" + query.Encode()
+}
+
+func segmentMessage(id, codec, name string, expires int64) string {
+	return strings.Join([]string{id, codec, name, strconv.FormatInt(expires, 10)}, "/")
+}
+
+// signPlaylist replaces every segment and init segment with its signed URL.
+func signPlaylist(playlist []byte, sign func(name string) string) []byte {
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			line = mapURI.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + sign(mapURI.FindStringSubmatch(attr)[1]) + `"`
+			})
+		case !strings.HasPrefix(line, "#"):
+			line = sign(line)
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// hlsDir sits next to the track, one directory per codec.
+func hlsDir(track *store.Track, codec ffmpeg.HLSCodec) string {
+	return filepath.Join(hlsRoot(track.Path), codec.Name)
+}
+
+func hlsRoot(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".hls"
+}
+
+// RemoveFiles deletes files of jobs from disk, with the HLS packages made
+// of tracks.
+func RemoveFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.RemoveAll(hlsRoot(path)); err != nil {
+			slog.Error("Error removing HLS packages", "path", path, "err", err)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Error removing job file", "path", path, "err", err)
+		}
+	}
+}
+
+// packaged returns the HLS directory of the track, packaging it first if
+// needed. Concurrent requests for the same track wait for one ffmpeg run.
+func (t *Tracks) packaged(ctx context.Context, track *store.Track, codec ffmpeg.HLSCodec) (string, error) {
+	dir := hlsDir(track, codec)
+	for {
+		t.mu.Lock()
+		if _, err := os.Stat(filepath.Join(dir, ffmpeg.HLSPlaylist)); err == nil {
+			t.mu.Unlock()
+			return dir, nil
+		}
+		done, busy := t.packaging[dir]
+		if !busy {
+			done = make(chan struct{})
+			t.packaging[dir] = done
+		}
+		t.mu.Unlock()
+
+		if busy {
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		slog.Info("Packaging HLS", "track", track.ID, "codec", codec.Name)
+		err := ffmpeg.PackageHLS(ctx, track.Path, dir, codec)
+		t.mu.Lock()
+		delete(t.packaging, dir)
+		close(done)
+		t.mu.Unlock()
+		return dir, err
+	}
+}
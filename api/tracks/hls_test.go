@@ -0,0 +1,107 @@
+package tracks_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"screw/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The track is packaged up front, ffmpeg is not needed to serve it.
+const opusPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:6.000000,
+segment00000.m4s
+#EXTINF:2.500000,
+segment00001.m4s
+#EXT-X-ENDLIST
+`
+
+func TestPlaylist(t *testing.T) {
+	st, h := setupTest(t)
+	owner, other, admin := createUsers(t, st)
+
+	dir := t.TempDir()
+	hls := filepath.Join(dir, "track-0.hls", "opus")
+	if err := os.MkdirAll(hls, 0o755); err != nil {
+		t.Fatalf("error creating HLS dir: %v", err)
+	}
+	files := map[string]string{
+		"index.m3u8":       opusPlaylist,
+		"init.mp4":         "init",
+		"segment00000.m4s": "first",
+		"segment00001.m4s": "second",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(hls, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("error writing %s: %v", name, err)
+		}
+	}
+	err := st.CreateJob(&store.Job{ID: "job-1", UserID: owner.ID, CreatedAt: time.Now().Unix()}, []*store.Track{
+		{ID: "track-0", Path: filepath.Join(dir, "track-0.ogg")},
+	})
+	if err != nil {
+		t.Fatalf("error creating job: %v", err)
+	}
+
+	if rec := get(h, "/api/tracks/track-0/playlist.m3u8?codec=opus", other); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the track of another user to be not found, got %d", rec.Code)
+	}
+	if rec := get(h, "/api/tracks/track-0/playlist.m3u8?codec=opus", admin); rec.Code != http.StatusOK {
+		t.Errorf("expected admins to get the playlist, got %d", rec.Code)
+	}
+	rec := get(h, "/api/tracks/track-0/playlist.m3u8?codec=opus", owner)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the playlist, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Errorf("expected an HLS playlist, got %s", rec.Header().Get("Content-Type"))
+	}
+
+	var urls []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if uri, ok := strings.CutPrefix(line, `#EXT-X-MAP:URI="`); ok {
+			urls = append(urls, strings.TrimSuffix(uri, `"`))
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	want := []string{"init", "first", "second"}
+	if len(urls) != len(want) {
+		t.Fatalf("expected %d signed URLs, got %v", len(want), urls)
+	}
+	for i, url := range urls {
+		if !strings.HasPrefix(url, "/api/tracks/track-0/hls/opus/") || !strings.Contains(url, "sig=") {
+			t.Errorf("expected a signed segment URL, got %s", url)
+		}
+		rec := get(h, url, owner)
+		if rec.Code != http.StatusOK || rec.Body.String() != want[i] {
+			t.Errorf("%s: expected %q, got %d %q", url, want[i], rec.Code, rec.Body.String())
+		}
+	}
+
+	rejected := []string{
+		strings.Replace(urls[1], "sig=", "sig=x", 1),
+		strings.Replace(urls[1], "segment00000", "segment00001", 1),
+		"/api/tracks/track-0/hls/opus/segment00000.m4s?expires=1&sig=x",
+		"/api/tracks/track-0/hls/opus/segment00000.m4s",
+	}
+	for _, url := range rejected {
+		if rec := get(h, url, owner); rec.Code == http.StatusOK {
+			t.Errorf("%s: expected the segment to be refused", url)
+		}
+	}
+
+	if rec := get(h, "/api/tracks/track-0/playlist.m3u8?codec=nope", owner); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown codec to be refused, got %d", rec.Code)
+	}
+	if rec := get(h, "/api/tracks/nope/playlist.m3u8", owner); rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown track to be not found, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package tracks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"sync"
+)
+
+// Tracks serves what was stored for finished jobs.
+type Tracks struct {
+	store      store.Store
+	signingKey []byte // signs segment URLs
+
+	mu        sync.Mutex
+	packaging map[string]chan struct{} // HLS dirs being packaged
+}
+
+func New(store store.Store, signingKey []byte) *Tracks {
+	return &Tracks{
+		store:      store,
+		signingKey: signingKey,
+		packaging:  make(map[string]chan struct{}),
+	}
+}
+
+// job is the job of id, if the user of the request may see it: their own,
+// or any job for admins. Jobs of others are not found.
+func (t *Tracks) job(r *http.Request, id string) (*store.Job, *herr.Error) {
+	result, ok := session.FromContext(r.Context())
+	if !ok {
+		return nil, herr.Unauthorized(errors.New("no session"), "No session data on context")
+	}
+	job, err := t.store.JobByID(id)
+	if errors.Is(err, store.ErrJobNotFound) {
+		return nil, herr.NotFound(err, "Job not found")
+	}
+	if err != nil {
+		return nil, herr.Internal(err, "Error getting job")
+	}
+	if job.UserID != result.User.ID && !result.Can(store.PermAdminJobs) {
+		return nil, herr.NotFound(fmt.Errorf("job %s of another user", job.ID), "Job not found")
+	}
+	return job, nil
+}
+
+// track is the track of id, if the user of the request may see its job.
+func (t *Tracks) track(r *http.Request, id string) (*store.Track, *herr.Error) {
+	track, err := t.store.TrackByID(id)
+	if errors.Is(err, store.ErrTrackNotFound) {
+		return nil, herr.NotFound(err, "Track not found")
+	}
+	if err != nil {
+		return nil, herr.Internal(err, "Error getting track")
+	}
+	if _, e := t.job(r, track.JobID); e != nil {
+		if e.Code == http.StatusNotFound {
+			e.HTTPMessage = "Track not found"
+		}
+		return nil, e
+	}
+	return track, nil
+}
+
+// HandleJobSpectrogram serves the spectrogram of the original upload.
+func (t *Tracks) HandleJobSpectrogram(w http.ResponseWriter, r *http.Request) *herr.Error {
+	job, e := t.job(r, r.PathValue("id"))
+	if e != nil {
+		return e
+	}
+	return serveSpectrogram(w, r, job.Spectrogram)
+}
+
+// HandleTrackSpectrogram serves the spectrogram of a processed variant.
+func (t *Tracks) HandleTrackSpectrogram(w http.ResponseWriter, r *http.Request) *herr.Error {
+	track, e := t.track(r, r.PathValue("id"))
+	if e != nil {
+		return e
+	}
+	return serveSpectrogram(w, r, track.Spectrogram)
+}
+
+func serveSpectrogram(w http.ResponseWriter, r *http.Request, path string) *herr.Error {
+	if path == "" {
+		return herr.NotFound(errors.New("no spectrogram was rendered"), "Spectrogram not found")
+	}
+	// A stored spectrogram never changes.
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, path)
+	return nil
+}
@@ -0,0 +1,105 @@
+package tracks_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"screw/herr"
+	"screw/session"
+	"screw/store"
+	"screw/tracks"
+	"testing"
+	"time"
+)
+
+func setupTest(t *testing.T) (store.Store, http.Handler) {
+	t.Helper()
+	st, err := store.New("./test.db")
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Remove("./test.db"); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Failed to remove test database: %v", err)
+		}
+	})
+
+	h := tracks.New(st, []byte("key"))
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/jobs/{id}/spectrogram.png", herr.W(h.HandleJobSpectrogram))
+	mux.Handle("GET /api/tracks/{id}/spectrogram.png", herr.W(h.HandleTrackSpectrogram))
+	mux.Handle("GET /api/tracks/{id}/playlist.m3u8", herr.W(h.HandlePlaylist))
+	mux.Handle("GET /api/tracks/{id}/hls/{codec}/{name}", herr.W(h.HandleSegment))
+	return st, mux
+}
+
+// get requests path as user, like Protect puts them on the context.
+func get(h http.Handler, path string, user *store.User) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if user != nil {
+		result := &session.SessionValidationResult{User: user}
+		r = r.WithContext(context.WithValue(r.Context(), session.SessionContextKey, result))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// createUsers returns the owner of the test jobs, another user and an admin.
+func createUsers(t *testing.T, st store.Store) (owner, other, admin *store.User) {
+	t.Helper()
+	users := []*store.User{
+		{GoogleID: "1", Email: "owner@example.com", Role: store.RoleUser},
+		{GoogleID: "2", Email: "other@example.com", Role: store.RoleUser},
+		{GoogleID: "3", Email: "admin@example.com", Role: store.RoleAdmin},
+	}
+	for _, user := range users {
+		id, err := st.CreateUser(user)
+		if err != nil {
+			t.Fatalf("error creating user: %v", err)
+		}
+		user.ID = id
+	}
+	return users[0], users[1], users[2]
+}
+
+func TestSpectrograms(t *testing.T) {
+	st, h := setupTest(t)
+	owner, other, admin := createUsers(t, st)
+
+	png := filepath.Join(t.TempDir(), "job-1.png")
+	if err := os.WriteFile(png, []byte("\x89PNG\r\n\x1a\n"), 0o644); err != nil {
+		t.Fatalf("error writing spectrogram: %v", err)
+	}
+	err := st.CreateJob(&store.Job{ID: "job-1", UserID: owner.ID, CreatedAt: time.Now().Unix(), Spectrogram: png}, []*store.Track{
+		{ID: "track-0", Path: "track-0.aac"},
+	})
+	if err != nil {
+		t.Fatalf("error creating job: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		user *store.User
+		code int
+	}{
+		{"/api/jobs/job-1/spectrogram.png", owner, http.StatusOK},
+		{"/api/jobs/job-1/spectrogram.png", admin, http.StatusOK},
+		{"/api/jobs/job-1/spectrogram.png", other, http.StatusNotFound},
+		{"/api/jobs/job-1/spectrogram.png", nil, http.StatusUnauthorized},
+		{"/api/jobs/nope/spectrogram.png", owner, http.StatusNotFound},
+		{"/api/tracks/track-0/spectrogram.png", owner, http.StatusNotFound}, // none rendered
+		{"/api/tracks/nope/spectrogram.png", owner, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := get(h, tt.path, tt.user)
+		if rec.Code != tt.code {
+			t.Errorf("%s as %v: expected %d, got %d", tt.path, tt.user, tt.code, rec.Code)
+		}
+		if tt.code == http.StatusOK && rec.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("%s: expected a PNG, got %s", tt.path, rec.Header().Get("Content-Type"))
+		}
+	}
+}
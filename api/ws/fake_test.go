@@ -0,0 +1,182 @@
+package ws_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"screw/audio"
+	"screw/ffmpeg"
+	"screw/ws"
+	"sync"
+	"time"
+)
+
+// script tells the fake processor how to behave.
+type script struct {
+	echo      bool          // every output gets a copy of the input
+	delay     time.Duration // before writing every chunk of output
+	failAfter int           // bytes of upload before failing, 0 never
+	writeErr  error         // returned by the failing write without reporting it, like a broken stdin
+	stderr    string        // reported as a warning, like a line ffmpeg carries on after
+	fatal     string        // reported once the first bytes come in, like a fatal ffmpeg line
+	exitCode  int           // what the process exits with once the input ends
+	spectrum  bool          // renders the spectrograms it is asked for
+	killErr   bool          // reports an error once its context is cancelled, like ffmpeg killed by its signal
+}
+
+func (s script) backend() ws.Backend {
+	return ws.Backend{
+		New: func(ctx context.Context, opts audio.Options) (ws.Processor, error) {
+			return newFake(ctx, s, len(opts.Variants), opts.Spectrograms), nil
+		},
+		DefaultFormat: ffmpeg.DefaultFormat,
+	}
+}
+
+type fakeProcessor struct {
+	ctx      context.Context
+	script   script
+	chunks   chan []byte
+	outputs  []io.ReadCloser
+	writers  []*io.PipeWriter
+	errChan  chan error
+	exited   chan struct{}
+	mu       sync.Mutex
+	received int
+	closed   bool
+
+	spectrograms *audio.Spectrograms
+}
+
+func newFake(ctx context.Context, s script, variants int, spectrograms *audio.Spectrograms) *fakeProcessor {
+	f := &fakeProcessor{
+		ctx:          ctx,
+		script:       s,
+		chunks:       make(chan []byte, 64),
+		errChan:      make(chan error, 3+variants),
+		exited:       make(chan struct{}),
+		spectrograms: spectrograms,
+	}
+	for range variants {
+		r, w := io.Pipe()
+		f.outputs = append(f.outputs, r)
+		f.writers = append(f.writers, w)
+	}
+	go f.run()
+	return f
+}
+
+func (f *fakeProcessor) Streams() []io.ReadCloser { return f.outputs }
+func (f *fakeProcessor) Errors() chan error       { return f.errChan }
+
+func (f *fakeProcessor) Report() audio.Report {
+	report := audio.Report{Variants: make([]audio.VariantReport, len(f.outputs))}
+	if f.script.stderr != "" {
+		report.Warnings = []string{f.script.stderr}
+	}
+	return report
+}
+
+func (f *fakeProcessor) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if f.received == 0 && f.script.fatal != "" {
+		f.errChan <- &ffmpeg.Error{Kind: ffmpeg.LogFatal, Line: f.script.fatal}
+	}
+	f.received += len(p)
+	if f.script.failAfter > 0 && f.received >= f.script.failAfter {
+		if f.script.writeErr != nil {
+			return 0, f.script.writeErr
+		}
+		err := errors.New("fake failure")
+		f.errChan <- err
+		return 0, err
+	}
+	select {
+	case f.chunks <- append([]byte(nil), p...):
+	case <-f.ctx.Done():
+		return 0, f.ctx.Err()
+	}
+	return len(p), nil
+}
+
+func (f *fakeProcessor) CloseInput() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.chunks)
+	}
+	return nil
+}
+
+func (f *fakeProcessor) run() {
+	defer close(f.exited)
+	defer func() {
+		for _, w := range f.writers {
+			w.Close()
+		}
+	}()
+	defer f.renderSpectrograms()
+	// Like ffmpeg, the fake is killed with its context even while idle.
+	for {
+		var chunk []byte
+		select {
+		case <-f.ctx.Done():
+			if f.script.killErr {
+				f.errChan <- errors.New("signal: killed")
+			}
+			return
+		case c, ok := <-f.chunks:
+			if !ok {
+				return
+			}
+			chunk = c
+		}
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-time.After(f.script.delay):
+		}
+		if !f.script.echo {
+			continue
+		}
+		for _, w := range f.writers {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeProcessor) renderSpectrograms() {
+	if !f.script.spectrum || f.spectrograms == nil || f.ctx.Err() != nil {
+		return
+	}
+	for _, path := range append([]string{f.spectrograms.Source}, f.spectrograms.Variants...) {
+		os.WriteFile(path, pngSignature, 0o644)
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func (f *fakeProcessor) Wait() error {
+	<-f.exited
+	if f.ctx.Err() != nil {
+		return &ffmpeg.ExitError{Code: -1}
+	}
+	if f.script.exitCode != 0 {
+		return &ffmpeg.ExitError{Code: f.script.exitCode}
+	}
+	return nil
+}
+
+func (f *fakeProcessor) Close() {
+	for _, output := range f.outputs {
+		output.Close()
+	}
+}
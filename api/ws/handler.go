@@ -3,15 +3,22 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
 	"net/http"
+	"os"
+	"screw/audio"
+	"screw/dsp"
 	"screw/ffmpeg"
 	"screw/herr"
+	"screw/session"
 	"screw/store"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -25,10 +32,64 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+const (
+	defaultPreviewDuration = 20
+	maxPreviewDuration     = 30
+	fileDeadline           = 5 * time.Minute
+	liveDeadline           = time.Hour
+)
+
+// Metadata is the first message of every connection. With more than one
+// variant, every binary frame sent back is prefixed with one byte holding the
+// index of the variant it belongs to.
 type Metadata struct {
-	FileSize int64  `json:"fileSize"`
-	FileName string `json:"fileName"`
-	MimeType string `json:"mimeType"`
+	FileSize int64          `json:"fileSize"`
+	FileName string         `json:"fileName"`
+	MimeType string         `json:"mimeType"`
+	Preview  *Preview       `json:"preview,omitempty"`
+	Live     *audio.Live    `json:"live,omitempty"`
+	Variants []audio.Params `json:"variants,omitempty"`
+	Output   Output         `json:"output"`
+}
+
+// Preview asks for a short excerpt of the upload to be processed instead of
+// the whole file. Previews are auditions, they are not counted as jobs.
+type Preview struct {
+	Offset   float64 `json:"offset"`
+	Duration float64 `json:"duration"`
+}
+
+func (m *Metadata) ffmpegOptions() (audio.Options, error) {
+	variants, err := audio.ResolveVariants(m.Variants)
+	if err != nil {
+		return audio.Options{}, err
+	}
+	if m.Live != nil {
+		if m.Preview != nil {
+			return audio.Options{}, errors.New("live input can't be previewed")
+		}
+		return audio.Options{Variants: variants, Live: m.Live}, nil
+	}
+	if m.FileSize <= 0 {
+		return audio.Options{}, fmt.Errorf("fileSize must be positive, got %d", m.FileSize)
+	}
+	if m.Preview == nil {
+		return audio.Options{Variants: variants}, nil
+	}
+	if m.Preview.Offset < 0 || m.Preview.Duration < 0 {
+		return audio.Options{}, fmt.Errorf("invalid preview window: offset %v, duration %v", m.Preview.Offset, m.Preview.Duration)
+	}
+	duration := m.Preview.Duration
+	if duration == 0 {
+		duration = defaultPreviewDuration
+	}
+	duration = math.Min(duration, maxPreviewDuration)
+	return audio.Options{Offset: m.Preview.Offset, Duration: duration, Variants: variants}, nil
+}
+
+// stopMessage ends live input, what was sent before it is still processed.
+type stopMessage struct {
+	Type string `json:"type"`
 }
 
 type progressMessage struct {
@@ -36,6 +97,49 @@ type progressMessage struct {
 	Progress float64 `json:"progress"`
 }
 
+// completeMessage is sent once processing succeeds, right before closing.
+type completeMessage struct {
+	Type        string          `json:"type"`
+	JobID       string          `json:"jobId,omitempty"`
+	MimeType    string          `json:"mimeType"`
+	Source      dsp.Analysis    `json:"source"`
+	Spectrogram string          `json:"spectrogram,omitempty"` // URL of the source PNG
+	Variants    []variantResult `json:"variants"`
+	Warnings    []string        `json:"warnings,omitempty"` // logged by the processor without failing
+}
+
+type variantResult struct {
+	Variant     int      `json:"variant"`
+	TrackID     string   `json:"trackId,omitempty"`
+	Loudness    *float64 `json:"loudness,omitempty"` // integrated, LUFS
+	Spectrogram string   `json:"spectrogram,omitempty"`
+	dsp.Analysis
+}
+
+func newCompleteMessage(rec *recording, format ffmpeg.Format, report audio.Report) completeMessage {
+	msg := completeMessage{Type: "complete", MimeType: format.MimeType, Source: report.Source, Warnings: report.Warnings}
+	if rec != nil {
+		msg.JobID = rec.job.ID
+		if rec.job.Spectrogram != "" {
+			msg.Spectrogram = "/api/jobs/" + rec.job.ID + "/spectrogram.png"
+		}
+	}
+	for i, v := range report.Variants {
+		result := variantResult{Variant: i, Analysis: v.Analysis}
+		if rec != nil {
+			result.TrackID = rec.tracks[i].ID
+			if rec.tracks[i].Spectrogram != "" {
+				result.Spectrogram = "/api/tracks/" + rec.tracks[i].ID + "/spectrogram.png"
+			}
+		}
+		if !math.IsInf(v.Loudness, 0) && !math.IsNaN(v.Loudness) {
+			result.Loudness = &v.Loudness
+		}
+		msg.Variants = append(msg.Variants, result)
+	}
+	return msg
+}
+
 func writeMessage(messageType int, data []byte, conn *websocket.Conn, writeMu *sync.Mutex) error {
 	writeMu.Lock()
 	defer writeMu.Unlock()
@@ -43,11 +147,14 @@ func writeMessage(messageType int, data []byte, conn *websocket.Conn, writeMu *s
 }
 
 type WS struct {
-	store store.Store
+	store     store.Store
+	tracksDir string
+	backend   Backend
+	running   runningJobs
 }
 
-func New(store store.Store) *WS {
-	return &WS{store: store}
+func New(store store.Store, tracksDir string, backend Backend) *WS {
+	return &WS{store: store, tracksDir: tracksDir, backend: backend}
 }
 
 func (ws *WS) Handle(w http.ResponseWriter, r *http.Request) *herr.Error {
@@ -59,7 +166,7 @@ func (ws *WS) Handle(w http.ResponseWriter, r *http.Request) *herr.Error {
 	defer conn.Close()
 	slog.Info("Upgraded")
 
-	err = conn.NetConn().SetDeadline(time.Now().Add(5 * time.Minute))
+	err = conn.NetConn().SetDeadline(time.Now().Add(fileDeadline))
 	if err != nil {
 		herr.WS(conn, err, "Connection deadline error")
 		return nil
@@ -82,87 +189,268 @@ func (ws *WS) Handle(w http.ResponseWriter, r *http.Request) *herr.Error {
 		return nil
 	}
 
-	ctx, cancel := context.WithCancel(r.Context())
+	opts, err := meta.ffmpegOptions()
+	if err != nil {
+		herr.WS(conn, err, "Invalid processing parameters")
+		return nil
+	}
+
+	if meta.Live != nil {
+		if err := conn.NetConn().SetDeadline(time.Now().Add(liveDeadline)); err != nil {
+			herr.WS(conn, err, "Connection deadline error")
+			return nil
+		}
+		slog.Info("Live input", "input", meta.Live.Input, "rate", meta.Live.SampleRate, "channels", meta.Live.Channels)
+	}
+
+	format, head, cleanup, err := prepareOutput(conn, &meta, &opts, ws.backend.DefaultFormat)
+	if err != nil {
+		herr.WS(conn, err, "Invalid output parameters")
+		return nil
+	}
+	defer cleanup()
+
+	ctx, cancelCause := context.WithCancelCause(r.Context())
+	cancel := func() { cancelCause(nil) }
 	defer cancel()
+	// ReadMessage doesn't watch ctx, a deadline in the past wakes it up.
+	context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
 
 	var writeMu sync.Mutex
 
-	ffmpeg, err := ffmpeg.New(ctx)
+	if meta.Preview != nil {
+		slog.Info("Preview requested", "name", meta.FileName, "offset", opts.Offset, "duration", opts.Duration)
+	}
+
+	var userID int64
+	if result, ok := session.FromContext(r.Context()); ok {
+		userID = result.User.ID
+	}
+
+	// Previews and live input are not kept.
+	var rec *recording
+	if meta.Preview == nil && meta.Live == nil {
+		rec, err = ws.startRecording(userID, meta, opts.Variants, format)
+		if err != nil {
+			herr.WS(conn, err, "Error preparing track storage")
+			return nil
+		}
+		opts.Spectrograms = rec.spectrograms()
+	}
+
+	job := &RunningJob{Kind: "file", UserID: userID, FileName: meta.FileName, cancel: cancelCause}
+	if rec != nil {
+		job.ID = rec.job.ID
+	} else if meta.Live != nil {
+		job.Kind = "live"
+	} else {
+		job.Kind = "preview"
+	}
+	removeJob, err := ws.running.add(job)
 	if err != nil {
-		herr.WS(conn, err, "Error initializing ffmpeg")
+		if rec != nil {
+			rec.discard()
+		}
+		herr.WS(conn, err, "Error registering job")
+		return nil
+	}
+	defer removeJob()
+
+	proc, err := ws.backend.New(ctx, opts)
+	if err != nil {
+		if rec != nil {
+			rec.discard()
+		}
+		herr.WS(conn, err, "Error initializing processor")
 		return nil
 	}
 
 	defer func() {
-		ffmpeg.Close()
+		proc.Close()
 		slog.Info("Websocket connection ended")
 	}()
+
 	readDone := make(chan struct{})
-	writeDone := make(chan struct{})
+	processed := make(chan error, 1)
+
+	if meta.Live != nil {
+		go readLiveInput(ctx, proc, conn, readDone)
+	} else {
+		go readWebSocketAndPipeToFFMPEG(ctx, proc, conn, &writeMu, meta.FileSize, meta.FileName, meta.Preview != nil, head, readDone)
+	}
+	go func() {
+		processed <- readFFMPEGAndWriteToSocket(ctx, proc, conn, &writeMu, rec)
+	}()
 
-	go readWebSocketAndPipeToFFMPEG(ctx, ffmpeg, conn, &writeMu, meta.FileSize, meta.FileName, readDone)
-	go readFFMPEGAndWriteToSocket(ctx, ffmpeg, conn, &writeMu, writeDone)
+	// A kill stops the processor too, so any branch can see it first.
+	killed := func() bool {
+		if !errors.Is(context.Cause(ctx), errJobKilled) {
+			return false
+		}
+		herr.WSClose(conn, "Job was stopped by an admin")
+		return true
+	}
 
 	slog.Info("Listening to websocket. Waiting for processing completion or errors.")
 	select {
-	case err := <-ffmpeg.ErrChan:
+	case err := <-proc.Errors():
 		cancel()
 		<-readDone
-		<-writeDone
+		<-processed
+		if rec != nil {
+			rec.discard()
+		}
+		if killed() {
+			return nil
+		}
 		herr.WS(conn, err, "Stream processing error")
 		return nil
-	case <-ffmpeg.Done:
+	case err := <-processed:
 		cancel()
 		<-readDone
-		<-writeDone
+		if err != nil || errors.Is(context.Cause(ctx), errJobKilled) {
+			if rec != nil {
+				rec.discard()
+			}
+			if killed() {
+				return nil
+			}
+			herr.WS(conn, err, "Stream processing error")
+			return nil
+		}
+		report := proc.Report()
+		slog.Info("Processing complete", "name", meta.FileName, "report", report)
+		if rec != nil {
+			rec.annotate(report)
+			// Without the job its IDs lead nowhere, the client gets an
+			// error instead.
+			if err := rec.save(ws.store); err != nil {
+				herr.WS(conn, err, "Error saving job")
+				return nil
+			}
+		}
+		msg := newCompleteMessage(rec, format, report)
+		msgJSON, err := json.Marshal(msg)
+		if err != nil {
+			herr.WS(conn, err, "Error encoding completion message")
+			return nil
+		}
+		if err := writeMessage(websocket.TextMessage, msgJSON, conn, &writeMu); err != nil {
+			slog.Error("Error sending completion message", "err", err)
+		}
 		herr.WSClose(conn, "Processing complete")
 		return nil
 	case <-ctx.Done():
 		<-readDone
-		<-writeDone
+		<-processed
+		if rec != nil {
+			rec.discard()
+		}
+		if killed() {
+			return nil
+		}
 		slog.Info("The context was cancelled")
 		return nil
 	}
 }
 
+// reportError hands err to Handle, unless it already stopped waiting for
+// one. Errors() is buffered for a few errors only.
+func reportError(ctx context.Context, proc Processor, err error) {
+	select {
+	case proc.Errors() <- err:
+	case <-ctx.Done():
+	}
+}
+
+// readFFMPEGAndWriteToSocket streams every output to the client. Processing
+// only succeeded once every output was read to EOF and the processor exited
+// cleanly.
 func readFFMPEGAndWriteToSocket(
 	ctx context.Context,
-	ffmpeg *ffmpeg.FFMPEG,
+	proc Processor,
 	conn *websocket.Conn,
 	writeMu *sync.Mutex,
-	done chan struct{},
-) {
-	defer close(done)
-	buffer := make([]byte, 32*1024)
+	rec *recording,
+) error {
+	var wg sync.WaitGroup
+	var drained atomic.Int32
+	outputs := proc.Streams()
+	tagged := len(outputs) > 1
+	for variant, output := range outputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if readOutputAndWriteToSocket(ctx, proc, output, variant, tagged, rec.writer(variant), conn, writeMu) {
+				drained.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if int(drained.Load()) < len(outputs) {
+		return errors.New("processing stopped before the outputs were drained")
+	}
+	return proc.Wait()
+}
+
+// readOutputAndWriteToSocket reports whether the output was read until EOF.
+func readOutputAndWriteToSocket(
+	ctx context.Context,
+	proc Processor,
+	output io.Reader,
+	variant int,
+	tagged bool,
+	sink io.Writer,
+	conn *websocket.Conn,
+	writeMu *sync.Mutex,
+) bool {
+	// The first byte is reserved for the variant tag.
+	buffer := make([]byte, 1+32*1024)
+	buffer[0] = byte(variant)
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return false
 		default:
-			n, err := ffmpeg.Stdout.Read(buffer)
+			n, err := output.Read(buffer[1:])
 			if err != nil {
 				if err == io.EOF {
-					ffmpeg.Done <- true
-					return
+					return true
 				}
-				ffmpeg.ErrChan <- err
-				return
+				reportError(ctx, proc, err)
+				return false
 			}
-			if err := writeMessage(websocket.BinaryMessage, buffer[:n], conn, writeMu); err != nil {
-				ffmpeg.ErrChan <- err
-				return
+			if _, err := sink.Write(buffer[1 : n+1]); err != nil {
+				reportError(ctx, proc, fmt.Errorf("error writing track: %w", err))
+				return false
+			}
+			frame := buffer[1 : n+1]
+			if tagged {
+				frame = buffer[:n+1]
+			}
+			if err := writeMessage(websocket.BinaryMessage, frame, conn, writeMu); err != nil {
+				reportError(ctx, proc, err)
+				return false
 			}
 		}
 	}
 }
 
+// windowDone tells if a write failed because the processor stopped reading,
+// which a preview does once its window went through.
+func windowDone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
 func readWebSocketAndPipeToFFMPEG(
 	ctx context.Context,
-	ffmpeg *ffmpeg.FFMPEG,
+	proc Processor,
 	conn *websocket.Conn,
 	writeMu *sync.Mutex,
 	fileSize int64,
 	fileName string,
+	preview bool,
+	head [][]byte,
 	done chan struct{},
 ) {
 	defer close(done)
@@ -184,33 +472,44 @@ func readWebSocketAndPipeToFFMPEG(
 				"progress", math.Round(lastProgress))
 			continue
 		default:
-			messageType, message, err := conn.ReadMessage()
+			// Messages read ahead to sniff tags go first.
+			var messageType int
+			var message []byte
+			var err error
+			if len(head) > 0 {
+				messageType, message, head = websocket.BinaryMessage, head[0], head[1:]
+			} else {
+				messageType, message, err = conn.ReadMessage()
+			}
 			if err != nil {
-				if websocket.IsCloseError(
-					err,
-					websocket.CloseNormalClosure,
-					websocket.CloseGoingAway,
-					websocket.CloseNoStatusReceived,
-				) {
-					ffmpeg.Done <- true
-					return
-				}
-				ffmpeg.ErrChan <- fmt.Errorf("websocket read error: %w", err)
+				reportError(ctx, proc, fmt.Errorf("websocket read error: %w", err))
 				return
 			}
 
 			if messageType != websocket.BinaryMessage {
-				ffmpeg.ErrChan <- fmt.Errorf("unexpected message type: %v", messageType)
+				reportError(ctx, proc, fmt.Errorf("unexpected message type: %v", messageType))
 				return
 			}
 
-			if _, err := ffmpeg.Write(message); err != nil {
+			if _, err := proc.Write(message); err != nil {
+				if preview && windowDone(err) {
+					// ffmpeg is done with the window, the rest of the upload is not needed.
+					slog.Info("Preview window processed, ignoring remaining input", "name", fileName)
+					return
+				}
 				slog.Error("Error while writing to ffmpeg stdin", "err", err)
-				ffmpeg.ErrChan <- fmt.Errorf("error while writing to ffmpeg stdin: %w", err)
+				reportError(ctx, proc, fmt.Errorf("error while writing to ffmpeg stdin: %w", err))
 				return
 			}
 
 			receivedBytes += int64(len(message))
+			if receivedBytes >= fileSize {
+				// The processor finishes once it sees the end of the input.
+				if err := proc.CloseInput(); err != nil && !(preview && windowDone(err)) {
+					reportError(ctx, proc, fmt.Errorf("error closing ffmpeg stdin: %w", err))
+					return
+				}
+			}
 			progress := float64(receivedBytes) / float64(fileSize) * 100
 			progressMsg := progressMessage{
 				Type:     "progress",
@@ -219,15 +518,48 @@ func readWebSocketAndPipeToFFMPEG(
 
 			progressJSON, err := json.Marshal(progressMsg)
 			if err != nil {
-				ffmpeg.ErrChan <- fmt.Errorf("error parsing progress message: %w", err)
+				reportError(ctx, proc, fmt.Errorf("error parsing progress message: %w", err))
 				return
 			}
 			if err := writeMessage(websocket.TextMessage, progressJSON, conn, writeMu); err != nil {
-				ffmpeg.ErrChan <- fmt.Errorf("Failed to send progress: %w", err)
+				reportError(ctx, proc, fmt.Errorf("Failed to send progress: %w", err))
 				return
 			}
 			lastProgress = progress
+			if receivedBytes >= fileSize {
+				return
+			}
 			continue
 		}
 	}
 }
+
+// readLiveInput pipes frames to the processor as they come, until the client
+// sends a stop message.
+func readLiveInput(ctx context.Context, proc Processor, conn *websocket.Conn, done chan struct{}) {
+	defer close(done)
+	for ctx.Err() == nil {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			reportError(ctx, proc, fmt.Errorf("websocket read error: %w", err))
+			return
+		}
+
+		if messageType == websocket.TextMessage {
+			var msg stopMessage
+			if err := json.Unmarshal(message, &msg); err != nil || msg.Type != "stop" {
+				reportError(ctx, proc, fmt.Errorf("unexpected message during live input: %q", message))
+				return
+			}
+			if err := proc.CloseInput(); err != nil {
+				reportError(ctx, proc, fmt.Errorf("error closing ffmpeg stdin: %w", err))
+			}
+			return
+		}
+
+		if _, err := proc.Write(message); err != nil {
+			reportError(ctx, proc, fmt.Errorf("error while writing to ffmpeg stdin: %w", err))
+			return
+		}
+	}
+}
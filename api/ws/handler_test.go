@@ -0,0 +1,580 @@
+package ws_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"screw/audio"
+	"screw/ffmpeg"
+	"screw/herr"
+	"screw/middleware"
+	screwsession "screw/session"
+	"screw/store"
+	"screw/ws"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testServer struct {
+	handler   *ws.WS
+	store     store.Store
+	tracksDir string
+	url       string
+}
+
+func setupTest(t *testing.T, s script) *testServer {
+	t.Helper()
+	st, err := store.New("./test.db")
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Remove("./test.db"); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Failed to remove test database: %v", err)
+		}
+	})
+
+	return newTestServer(t, st, s)
+}
+
+func newTestServer(t *testing.T, st store.Store, s script) *testServer {
+	t.Helper()
+	tracksDir := t.TempDir()
+	handler := ws.New(st, tracksDir, s.backend())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.Handle(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &testServer{handler: handler, store: st, tracksDir: tracksDir, url: "ws" + strings.TrimPrefix(srv.URL, "http")}
+}
+
+// session is what a client saw on one connection.
+type session struct {
+	frames   [][]byte
+	text     []map[string]any
+	closeErr *websocket.CloseError
+}
+
+func (s *session) complete() map[string]any {
+	for _, msg := range s.text {
+		if msg["type"] == "complete" {
+			return msg
+		}
+	}
+	return nil
+}
+
+// run uploads input in chunks after the metadata and reads until the server
+// closes the connection.
+func (ts *testServer) run(t *testing.T, meta ws.Metadata, input []byte, chunk int) *session {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	if err := conn.WriteJSON(meta); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+	go func() {
+		for len(input) > 0 {
+			n := min(len(input), chunk)
+			if err := conn.WriteMessage(websocket.BinaryMessage, input[:n]); err != nil {
+				return
+			}
+			input = input[n:]
+		}
+	}()
+
+	s := &session{}
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatalf("expected a close frame, got %v", err)
+			}
+			s.closeErr = closeErr
+			return s
+		}
+		switch messageType {
+		case websocket.BinaryMessage:
+			s.frames = append(s.frames, message)
+		case websocket.TextMessage:
+			var msg map[string]any
+			if err := json.Unmarshal(message, &msg); err != nil {
+				t.Fatalf("invalid text message %q: %v", message, err)
+			}
+			s.text = append(s.text, msg)
+		}
+	}
+}
+
+func upload(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func pointer(v float64) *float64 {
+	return &v
+}
+
+func TestHandleEcho(t *testing.T) {
+	input := upload(100_000)
+	ts := setupTest(t, script{echo: true, stderr: "[mp3float @ 0x1] [error] Header missing"})
+
+	s := ts.run(t, ws.Metadata{FileSize: int64(len(input)), FileName: "song.mp3"}, input, 8192)
+
+	if s.closeErr.Code != websocket.CloseNormalClosure || s.closeErr.Text != "Processing complete" {
+		t.Fatalf("expected a normal close, got %v", s.closeErr)
+	}
+	if got := bytes.Join(s.frames, nil); !bytes.Equal(got, input) {
+		t.Errorf("expected the input echoed back, got %d bytes", len(got))
+	}
+	if s.text[0]["type"] != "progress" {
+		t.Errorf("expected progress messages first, got %v", s.text[0])
+	}
+
+	complete := s.complete()
+	if complete == nil {
+		t.Fatal("expected a completion message")
+	}
+	jobID, _ := complete["jobId"].(string)
+	tracks, err := ts.store.TracksByJobID(jobID)
+	if err != nil || len(tracks) != 1 {
+		t.Fatalf("expected one stored track, got %v, %v", tracks, err)
+	}
+	saved, err := os.ReadFile(tracks[0].Path)
+	if err != nil {
+		t.Fatalf("error reading track: %v", err)
+	}
+	if !bytes.Equal(saved, input) || tracks[0].Size != int64(len(input)) {
+		t.Errorf("expected the track file to hold the output, got %d bytes", len(saved))
+	}
+	if tracks[0].Spectrogram != "" || complete["spectrogram"] != nil {
+		t.Errorf("expected no spectrogram when the processor renders none, got %q", tracks[0].Spectrogram)
+	}
+	if warnings, _ := complete["warnings"].([]any); len(warnings) != 1 || warnings[0] != "[mp3float @ 0x1] [error] Header missing" {
+		t.Errorf("expected the warning in the completion, got %v", complete["warnings"])
+	}
+}
+
+// failingStore can't save jobs.
+type failingStore struct {
+	store.Store
+}
+
+func (failingStore) CreateJob(*store.Job, []*store.Track) error {
+	return errors.New("disk full")
+}
+
+func TestHandleSaveFailure(t *testing.T) {
+	input := upload(20_000)
+	ts := newTestServer(t, failingStore{setupTest(t, script{}).store}, script{echo: true})
+
+	s := ts.run(t, ws.Metadata{FileSize: int64(len(input)), FileName: "song.mp3"}, input, 8192)
+
+	if s.closeErr.Code != websocket.CloseInternalServerErr || s.closeErr.Text != "Error saving job" {
+		t.Errorf("expected the failed save to be reported, got %v", s.closeErr)
+	}
+	if complete := s.complete(); complete != nil {
+		t.Errorf("expected no completion with IDs of a job that wasn't saved, got %v", complete)
+	}
+	if entries, _ := os.ReadDir(ts.tracksDir); len(entries) != 0 {
+		t.Errorf("expected the track files to be removed, got %d", len(entries))
+	}
+}
+
+func TestHandleSpectrograms(t *testing.T) {
+	input := upload(50_000)
+	ts := setupTest(t, script{echo: true, spectrum: true})
+
+	meta := ws.Metadata{FileSize: int64(len(input)), Variants: make([]audio.Params, 2)}
+	s := ts.run(t, meta, input, 8192)
+
+	complete := s.complete()
+	if complete == nil {
+		t.Fatalf("expected a completion message, got %v", s.closeErr)
+	}
+	jobID, _ := complete["jobId"].(string)
+	if complete["spectrogram"] != "/api/jobs/"+jobID+"/spectrogram.png" {
+		t.Errorf("expected the source spectrogram URL, got %v", complete["spectrogram"])
+	}
+	job, err := ts.store.JobByID(jobID)
+	if err != nil {
+		t.Fatalf("error getting job: %v", err)
+	}
+	paths := []string{job.Spectrogram}
+
+	tracks, err := ts.store.TracksByJobID(jobID)
+	if err != nil || len(tracks) != 2 {
+		t.Fatalf("expected two stored tracks, got %v, %v", tracks, err)
+	}
+	for i, track := range tracks {
+		variant := complete["variants"].([]any)[i].(map[string]any)
+		if variant["spectrogram"] != "/api/tracks/"+track.ID+"/spectrogram.png" {
+			t.Errorf("variant %d: expected the track spectrogram URL, got %v", i, variant["spectrogram"])
+		}
+		paths = append(paths, track.Spectrogram)
+	}
+	for _, path := range paths {
+		if filepath.Dir(path) != ts.tracksDir {
+			t.Errorf("expected %s to be stored next to the tracks", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected the spectrogram on disk: %v", err)
+		}
+	}
+}
+
+func TestHandleVariants(t *testing.T) {
+	input := upload(50_000)
+	ts := setupTest(t, script{echo: true, delay: time.Millisecond})
+
+	meta := ws.Metadata{
+		FileSize: int64(len(input)),
+		FileName: "song.mp3",
+		Preview:  &ws.Preview{},
+		Variants: make([]audio.Params, 2),
+	}
+	s := ts.run(t, meta, input, 4096)
+
+	if s.closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("expected a normal close, got %v", s.closeErr)
+	}
+	perVariant := make([][]byte, 2)
+	for _, frame := range s.frames {
+		perVariant[frame[0]] = append(perVariant[frame[0]], frame[1:]...)
+	}
+	for i, got := range perVariant {
+		if !bytes.Equal(got, input) {
+			t.Errorf("variant %d: expected the input echoed back, got %d bytes", i, len(got))
+		}
+	}
+	complete := s.complete()
+	if complete == nil || complete["jobId"] != nil {
+		t.Errorf("expected a completion without a job for a preview, got %v", complete)
+	}
+}
+
+func TestHandleLive(t *testing.T) {
+	ts := setupTest(t, script{echo: true})
+
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	meta := ws.Metadata{Live: &audio.Live{Input: "pcm", SampleRate: 48000, Channels: 1}}
+	if err := conn.WriteJSON(meta); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+
+	// Every frame comes back before the next one is sent.
+	input := upload(4 * 960)
+	var echoed []byte
+	for i := 0; i < len(input); i += 960 {
+		if err := conn.WriteMessage(websocket.BinaryMessage, input[i:i+960]); err != nil {
+			t.Fatalf("error writing frame: %v", err)
+		}
+		for len(echoed) < i+960 {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("error reading frame: %v", err)
+			}
+			if messageType != websocket.BinaryMessage {
+				t.Fatalf("expected only processed frames while live, got %s", message)
+			}
+			echoed = append(echoed, message...)
+		}
+	}
+	if !bytes.Equal(echoed, input) {
+		t.Errorf("expected the frames echoed back")
+	}
+
+	if err := conn.WriteJSON(map[string]string{"type": "stop"}); err != nil {
+		t.Fatalf("error writing stop: %v", err)
+	}
+	var complete map[string]any
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok || closeErr.Code != websocket.CloseNormalClosure {
+				t.Fatalf("expected a normal close, got %v", err)
+			}
+			break
+		}
+		json.Unmarshal(message, &complete)
+	}
+	if complete["type"] != "complete" || complete["jobId"] != nil {
+		t.Errorf("expected a completion without a job, got %v", complete)
+	}
+	if complete["mimeType"] != ffmpeg.Formats[ffmpeg.LiveFormat].MimeType {
+		t.Errorf("expected raw PCM by default, got %v", complete["mimeType"])
+	}
+}
+
+func TestKillJob(t *testing.T) {
+	ts := setupTest(t, script{echo: true, killErr: true})
+	if ts.handler.Kill("unknown") {
+		t.Error("expected no job to kill")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	meta := ws.Metadata{FileName: "mic", Live: &audio.Live{Input: "pcm", SampleRate: 48000, Channels: 1}}
+	if err := conn.WriteJSON(meta); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, upload(960)); err != nil {
+		t.Fatalf("error writing frame: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("error reading frame: %v", err)
+	}
+
+	jobs := ts.handler.Jobs()
+	if len(jobs) != 1 || jobs[0].Kind != "live" || jobs[0].FileName != "mic" {
+		t.Fatalf("expected the live job to be running, got %+v", jobs)
+	}
+	if !ts.handler.Kill(jobs[0].ID) {
+		t.Fatal("expected the job to be killed")
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok || closeErr.Text != "Job was stopped by an admin" {
+				t.Fatalf("expected the connection to be closed by the admin, got %v", err)
+			}
+			break
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ts.handler.Jobs()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job to be gone, got %+v", ts.handler.Jobs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobUser(t *testing.T) {
+	ts := setupTest(t, script{echo: true})
+	userID, err := ts.store.CreateUser(&store.User{GoogleID: "1", Email: "producer@example.com"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	sm := screwsession.NewManager(ts.store, 30, 15)
+	cookie, _ := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), userID)
+	srv := httptest.NewServer(middleware.Protect(
+		map[string]bool{"/api/ws": true},
+		map[string]string{"/api/ws": store.PermJobsWrite},
+		sm,
+	)(herr.W(ts.handler.Handle)))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a connection without a session to be refused, got %v", err)
+	}
+	header := http.Header{"Cookie": {screwsession.SessionCookieName + "=" + cookie}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.WriteJSON(ws.Metadata{FileName: "mic", Live: &audio.Live{Input: "pcm", SampleRate: 48000, Channels: 1}}); err != nil {
+		t.Fatalf("error writing metadata: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, upload(960)); err != nil {
+		t.Fatalf("error writing frame: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("error reading frame: %v", err)
+	}
+
+	if jobs := ts.handler.Jobs(); len(jobs) != 1 || jobs[0].UserID != userID {
+		t.Fatalf("expected the job of the user, got %+v", jobs)
+	}
+	if killed := ts.handler.KillUser(userID + 1); killed != 0 {
+		t.Errorf("expected no job of another user to be killed, got %d", killed)
+	}
+	if killed := ts.handler.KillUser(userID); killed != 1 {
+		t.Fatalf("expected the job of the user to be killed, got %d", killed)
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				t.Fatalf("expected the connection to be closed, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestHandleFailures(t *testing.T) {
+	input := upload(100_000)
+	tests := []struct {
+		name   string
+		script script
+		meta   ws.Metadata
+		reason string
+	}{
+		{
+			name:   "fail after some bytes",
+			script: script{echo: true, failAfter: 30_000},
+			meta:   ws.Metadata{FileSize: int64(len(input))},
+			reason: "Stream processing error",
+		},
+		{
+			name:   "preview write error",
+			script: script{echo: true, failAfter: 30_000, writeErr: syscall.EIO},
+			meta:   ws.Metadata{FileSize: int64(len(input)), Preview: &ws.Preview{}},
+			reason: "Stream processing error",
+		},
+		// ffmpeg used to fail on any stderr output, stderr noise like
+		// "Header missing" is a warning now (see TestHandleEcho) and only
+		// fatal lines fail.
+		{
+			name:   "fatal log line",
+			script: script{echo: true, delay: 10 * time.Millisecond, fatal: "Invalid data found when processing input"},
+			meta:   ws.Metadata{FileSize: int64(len(input))},
+			reason: "Stream processing error",
+		},
+		{
+			name:   "exit code",
+			script: script{echo: true, exitCode: 1},
+			meta:   ws.Metadata{FileSize: int64(len(input))},
+			reason: "Stream processing error",
+		},
+		{
+			name:   "no file size",
+			script: script{},
+			meta:   ws.Metadata{},
+			reason: "Invalid processing parameters",
+		},
+		{
+			name:   "invalid parameters",
+			script: script{},
+			meta:   ws.Metadata{FileSize: int64(len(input)), Variants: []audio.Params{{Speed: pointer(5)}}},
+			reason: "Invalid processing parameters",
+		},
+		{
+			name:   "live preview",
+			script: script{},
+			meta:   ws.Metadata{Live: &audio.Live{Input: "webm"}, Preview: &ws.Preview{}},
+			reason: "Invalid processing parameters",
+		},
+		{
+			name:   "unknown format",
+			script: script{},
+			meta:   ws.Metadata{FileSize: int64(len(input)), Output: ws.Output{Format: "nope"}},
+			reason: "Invalid output parameters",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := setupTest(t, tt.script)
+			s := ts.run(t, tt.meta, input, 8192)
+
+			if s.closeErr.Code != websocket.CloseInternalServerErr || s.closeErr.Text != tt.reason {
+				t.Errorf("expected an internal error close with %q, got %v", tt.reason, s.closeErr)
+			}
+			if s.complete() != nil {
+				t.Error("expected no completion message")
+			}
+			entries, err := os.ReadDir(ts.tracksDir)
+			if err != nil {
+				t.Fatalf("error reading tracks dir: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("expected failed tracks to be removed, found %d files", len(entries))
+			}
+		})
+	}
+}
+
+func TestHandleClientDisconnect(t *testing.T) {
+	input := upload(100_000)
+	ts := setupTest(t, script{echo: true, delay: 50 * time.Millisecond})
+
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	conn.WriteJSON(ws.Metadata{FileSize: int64(len(input))})
+	conn.WriteMessage(websocket.BinaryMessage, input[:8192])
+	conn.ReadMessage() // the first progress message
+	conn.UnderlyingConn().Close()
+
+	waitForNoTracks(t, ts.tracksDir)
+}
+
+// waitForNoTracks waits for the handler to discard the tracks of a job that
+// didn't finish.
+func waitForNoTracks(t *testing.T, dir string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(dir)
+		if err == nil && len(entries) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected tracks to be discarded, found %d", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleClientClosesEarly(t *testing.T) {
+	input := upload(100_000)
+	ts := setupTest(t, script{echo: true})
+
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(ws.Metadata{FileSize: int64(len(input))})
+	conn.WriteMessage(websocket.BinaryMessage, input[:8192])
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	// A clean close before the upload is complete is not a finished job.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if messageType == websocket.TextMessage && strings.Contains(string(message), `"complete"`) {
+			t.Fatal("expected no completion message")
+		}
+	}
+	waitForNoTracks(t, ts.tracksDir)
+}
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"screw/cryptoutil"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errJobKilled is the cause of the context of a job an admin stopped.
+var errJobKilled = errors.New("job killed")
+
+// RunningJob is a connection that is processing audio right now.
+type RunningJob struct {
+	ID        string `json:"id"`      // ID of the stored job for recordings
+	UserID    int64  `json:"user_id"` // user of the session that started it
+	Kind      string `json:"kind"`    // file, preview or live
+	FileName  string `json:"file_name"`
+	StartedAt int64  `json:"started_at"`
+
+	cancel context.CancelCauseFunc
+}
+
+type runningJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*RunningJob
+}
+
+func (j *runningJobs) add(job *RunningJob) (remove func(), err error) {
+	if job.ID == "" {
+		if job.ID, err = cryptoutil.Random(); err != nil {
+			return nil, err
+		}
+	}
+	job.StartedAt = time.Now().Unix()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jobs == nil {
+		j.jobs = make(map[string]*RunningJob)
+	}
+	j.jobs[job.ID] = job
+	return func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		delete(j.jobs, job.ID)
+	}, nil
+}
+
+// Jobs lists the running jobs, oldest first.
+func (ws *WS) Jobs() []RunningJob {
+	ws.running.mu.Lock()
+	defer ws.running.mu.Unlock()
+	jobs := make([]RunningJob, 0, len(ws.running.jobs))
+	for _, job := range ws.running.jobs {
+		jobs = append(jobs, *job)
+	}
+	slices.SortFunc(jobs, func(a, b RunningJob) int {
+		if a.StartedAt != b.StartedAt {
+			return int(a.StartedAt - b.StartedAt)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return jobs
+}
+
+// Kill stops a running job, its connection is closed and nothing is saved.
+// It is false when no job has the ID.
+func (ws *WS) Kill(id string) bool {
+	ws.running.mu.Lock()
+	defer ws.running.mu.Unlock()
+	job, ok := ws.running.jobs[id]
+	if ok {
+		job.cancel(errJobKilled)
+	}
+	return ok
+}
+
+// KillUser stops every running job of the user, and returns how many.
+func (ws *WS) KillUser(userID int64) int {
+	ws.running.mu.Lock()
+	defer ws.running.mu.Unlock()
+	killed := 0
+	for _, job := range ws.running.jobs {
+		if job.UserID == userID {
+			job.cancel(errJobKilled)
+			killed++
+		}
+	}
+	return killed
+}
@@ -0,0 +1,143 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"screw/audio"
+	"screw/ffmpeg"
+	"screw/tags"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultTitleSuffix = " (slowed + reverb)"
+	maxCoverSize       = 5 << 20
+	// Enough for the tags and a cover in front of the title in most files.
+	headSize = 512 << 10
+)
+
+// Output picks the container of the processed audio. Containers that carry
+// tags get the source tags, with TitleSuffix appended to the title. Cover
+// only applies to mp3 and flac, the other containers get no cover.
+type Output struct {
+	Format      string  `json:"format"`
+	TitleSuffix *string `json:"titleSuffix,omitempty"`
+	Cover       string  `json:"cover,omitempty"`      // keep (default), drop or replace
+	CoverImage  []byte  `json:"coverImage,omitempty"` // base64 JPEG or PNG, for replace
+}
+
+// prepareOutput fills in the output options of opts. To find the source
+// title it reads ahead the first messages of the upload, which have to be
+// piped to ffmpeg before anything else.
+func prepareOutput(conn *websocket.Conn, meta *Metadata, opts *audio.Options, defaultFormat string) (ffmpeg.Format, [][]byte, func(), error) {
+	cleanup := func() {}
+	name := meta.Output.Format
+	if name == "" {
+		name = defaultFormat
+		if meta.Live != nil {
+			name = ffmpeg.LiveFormat
+		}
+	}
+	format, err := ffmpeg.FormatByName(name)
+	if err != nil {
+		return format, nil, cleanup, err
+	}
+	opts.Format = format.Name
+
+	if format.Cover {
+		switch meta.Output.Cover {
+		case "", "keep":
+		case "drop":
+			opts.DropCover = true
+		case "replace":
+			path, err := writeCover(meta.Output.CoverImage)
+			if err != nil {
+				return format, nil, cleanup, err
+			}
+			opts.CoverPath = path
+			cleanup = func() { os.Remove(path) }
+		default:
+			return format, nil, cleanup, fmt.Errorf("unknown cover mode %q", meta.Output.Cover)
+		}
+	}
+
+	// Live input has neither tags nor an end to read ahead to.
+	if !format.Tags || meta.Live != nil {
+		return format, nil, cleanup, nil
+	}
+
+	head, err := readHead(conn, meta.FileSize)
+	if err != nil {
+		cleanup()
+		return format, nil, func() {}, err
+	}
+	suffix := defaultTitleSuffix
+	if meta.Output.TitleSuffix != nil {
+		suffix = *meta.Output.TitleSuffix
+	}
+	opts.Title = sourceTitle(head, meta.FileName) + suffix
+	return format, head, cleanup, nil
+}
+
+func readHead(conn *websocket.Conn, fileSize int64) ([][]byte, error) {
+	var head [][]byte
+	var size int64
+	for size < headSize && size < fileSize {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("websocket read error: %w", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			return nil, fmt.Errorf("unexpected message type: %v", messageType)
+		}
+		head = append(head, message)
+		size += int64(len(message))
+	}
+	return head, nil
+}
+
+func sourceTitle(head [][]byte, fileName string) string {
+	var b []byte
+	for _, message := range head {
+		b = append(b, message...)
+	}
+	if title, ok := tags.Title(b); ok {
+		return title
+	}
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
+}
+
+func writeCover(image []byte) (string, error) {
+	if len(image) == 0 {
+		return "", errors.New("cover replace needs a cover image")
+	}
+	if len(image) > maxCoverSize {
+		return "", fmt.Errorf("cover image is too big: %d bytes, max is %d", len(image), maxCoverSize)
+	}
+
+	var ext string
+	switch contentType := http.DetectContentType(image); contentType {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png":
+		ext = ".png"
+	default:
+		return "", fmt.Errorf("unsupported cover image type %q", contentType)
+	}
+
+	file, err := os.CreateTemp("", "cover-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("error creating cover file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(image); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error writing cover file: %w", err)
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,59 @@
+package ws
+
+import (
+	"context"
+	"io"
+	"screw/audio"
+	"screw/ffmpeg"
+	"screw/native"
+)
+
+// Processor turns the upload written to it into one encoded stream per
+// variant.
+type Processor interface {
+	io.Writer
+	// CloseInput marks the end of the upload.
+	CloseInput() error
+	Streams() []io.ReadCloser // one per variant
+	Errors() chan error
+	// Wait returns once processing stopped, call it after the streams are
+	// drained. Processing only succeeded if it returns nil.
+	Wait() error
+	// Report waits for the measurements, call it once processing is done.
+	Report() audio.Report
+	// Close stops processing if it is still running and releases it.
+	Close()
+}
+
+type NewProcessor func(ctx context.Context, opts audio.Options) (Processor, error)
+
+// Backend is a processor implementation, picked by name in the config.
+type Backend struct {
+	New           NewProcessor
+	DefaultFormat string // used when the client doesn't ask for a format
+}
+
+const DefaultBackend = "ffmpeg"
+
+var Backends = map[string]Backend{
+	"ffmpeg": {
+		New: func(ctx context.Context, opts audio.Options) (Processor, error) {
+			f, err := ffmpeg.New(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
+		},
+		DefaultFormat: ffmpeg.DefaultFormat,
+	},
+	"native": {
+		New: func(ctx context.Context, opts audio.Options) (Processor, error) {
+			p, err := native.New(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		},
+		DefaultFormat: native.Format,
+	},
+}
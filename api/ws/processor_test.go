@@ -0,0 +1,82 @@
+package ws_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"os/exec"
+	"screw/audio"
+	"screw/ws"
+	"testing"
+)
+
+// sineWAV is a quiet stereo tone, so neither backend clips it.
+func sineWAV(seconds float64) []byte {
+	const rate = 44100
+	frames := int(seconds * rate)
+	var data bytes.Buffer
+	for i := 0; i < frames; i++ {
+		t := float64(i) / rate
+		binary.Write(&data, binary.LittleEndian, int16(300*math.Sin(2*math.Pi*220*t)))
+		binary.Write(&data, binary.LittleEndian, int16(300*math.Sin(2*math.Pi*330*t)))
+	}
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+data.Len()))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, struct {
+		Size                   uint32
+		Format, Channels       uint16
+		Rate, ByteRate         uint32
+		BlockAlign, SampleBits uint16
+	}{16, 1, 2, rate, rate * 4, 4, 16})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(data.Len()))
+	return append(b.Bytes(), data.Bytes()...)
+}
+
+func runBackend(t *testing.T, name string, opts audio.Options, input []byte) ([]byte, audio.Report) {
+	t.Helper()
+	proc, err := ws.Backends[name].New(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", name, err)
+	}
+	defer proc.Close()
+
+	go func() {
+		proc.Write(input)
+		proc.CloseInput()
+	}()
+	output, err := io.ReadAll(proc.Streams()[0])
+	if err != nil {
+		t.Fatalf("%s: unexpected error reading output: %v", name, err)
+	}
+	if err := proc.Wait(); err != nil {
+		t.Fatalf("%s: unexpected error: %v", name, err)
+	}
+	return output, proc.Report()
+}
+
+func TestBackendsMatch(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	t.Setenv("IR_PATH", "../audio/ir.wav")
+
+	input := sineWAV(3)
+	opts := audio.Options{Format: "wav", Variants: []audio.Params{{}}}
+	ffmpegOut, ffmpegReport := runBackend(t, "ffmpeg", opts, input)
+	nativeOut, nativeReport := runBackend(t, "native", opts, input)
+
+	// Both write 16 bit stereo at 44.1kHz, the headers differ by a few bytes.
+	if d := math.Abs(float64(len(ffmpegOut) - len(nativeOut))); d > 0.01*float64(len(ffmpegOut)) {
+		t.Errorf("expected outputs of the same length, got %d and %d bytes", len(ffmpegOut), len(nativeOut))
+	}
+	ffmpegLoudness, nativeLoudness := ffmpegReport.Variants[0].Loudness, nativeReport.Variants[0].Loudness
+	if math.Abs(ffmpegLoudness-nativeLoudness) > 1.5 {
+		t.Errorf("expected about the same loudness, got %.1f LUFS from ffmpeg and %.1f from native", ffmpegLoudness, nativeLoudness)
+	}
+}
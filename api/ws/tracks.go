@@ -0,0 +1,159 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"screw/audio"
+	"screw/cryptoutil"
+	"screw/ffmpeg"
+	"screw/store"
+	"time"
+)
+
+// recording keeps a copy of every variant on disk while it streams to the
+// client. It only becomes a job in the store once processing succeeds.
+type recording struct {
+	job    *store.Job
+	tracks []*store.Track
+	files  []*os.File
+}
+
+func (ws *WS) startRecording(userID int64, meta Metadata, variants []audio.Params, format ffmpeg.Format) (*recording, error) {
+	if err := os.MkdirAll(ws.tracksDir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating tracks dir: %w", err)
+	}
+
+	jobID, err := cryptoutil.Random()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recording{
+		job: &store.Job{
+			ID:          jobID,
+			UserID:      userID,
+			FileName:    meta.FileName,
+			MimeType:    meta.MimeType,
+			CreatedAt:   time.Now().Unix(),
+			Spectrogram: filepath.Join(ws.tracksDir, jobID+".png"),
+		},
+	}
+
+	for i, params := range variants {
+		trackID, err := cryptoutil.Random()
+		if err != nil {
+			rec.discard()
+			return nil, err
+		}
+
+		paramsJSON, err := json.Marshal(params)
+		if err != nil {
+			rec.discard()
+			return nil, fmt.Errorf("error encoding params: %w", err)
+		}
+
+		path := filepath.Join(ws.tracksDir, trackID+format.Ext)
+		file, err := os.Create(path)
+		if err != nil {
+			rec.discard()
+			return nil, fmt.Errorf("error creating track file: %w", err)
+		}
+
+		rec.files = append(rec.files, file)
+		rec.tracks = append(rec.tracks, &store.Track{
+			ID:          trackID,
+			Variant:     i,
+			Params:      string(paramsJSON),
+			Path:        path,
+			Spectrogram: filepath.Join(ws.tracksDir, trackID+".png"),
+		})
+	}
+	return rec, nil
+}
+
+func (r *recording) annotate(report audio.Report) {
+	r.job.BPM = report.Source.BPM
+	r.job.Key = report.Source.Key
+	for i, v := range report.Variants {
+		r.tracks[i].BPM = v.BPM
+		r.tracks[i].Key = v.Key
+	}
+}
+
+// spectrograms are rendered next to the tracks.
+func (r *recording) spectrograms() *audio.Spectrograms {
+	s := &audio.Spectrograms{Source: r.job.Spectrogram}
+	for _, track := range r.tracks {
+		s.Variants = append(s.Variants, track.Spectrogram)
+	}
+	return s
+}
+
+func (r *recording) writer(variant int) io.Writer {
+	if r == nil {
+		return io.Discard
+	}
+	return r.files[variant]
+}
+
+func (r *recording) save(s store.Store) error {
+	var errs []error
+	for i, file := range r.files {
+		info, err := file.Stat()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			r.tracks[i].Size = info.Size()
+		}
+		errs = append(errs, file.Close())
+	}
+	if err := errors.Join(errs...); err != nil {
+		r.remove()
+		return fmt.Errorf("error closing track files: %w", err)
+	}
+
+	// Not every processor renders spectrograms.
+	if !exists(r.job.Spectrogram) {
+		r.job.Spectrogram = ""
+	}
+	for _, track := range r.tracks {
+		if !exists(track.Spectrogram) {
+			track.Spectrogram = ""
+		}
+	}
+
+	if err := s.CreateJob(r.job, r.tracks); err != nil {
+		r.remove()
+		return err
+	}
+	return nil
+}
+
+func (r *recording) discard() {
+	for _, file := range r.files {
+		file.Close()
+	}
+	r.remove()
+}
+
+func (r *recording) remove() {
+	for _, file := range r.files {
+		os.Remove(file.Name())
+	}
+	os.Remove(r.job.Spectrogram)
+	for _, track := range r.tracks {
+		os.Remove(track.Spectrogram)
+	}
+}
+
+func exists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
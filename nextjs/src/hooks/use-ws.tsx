@@ -7,6 +7,11 @@ interface ProgressMessage {
   totalSize: number;
 }
 
+interface CompleteMessage {
+  type: "complete";
+  mimeType: string;
+}
+
 type Status = "streaming" | "init" | "error";
 
 export default function useWebSocket(file: File) {
@@ -78,12 +83,17 @@ export default function useWebSocket(file: File) {
 
       try {
         const message = JSON.parse(event.data);
-        if (message.type !== "progress") return;
-        const { progress } = message as ProgressMessage;
-        setProcessProgress(progress);
-        if (progress !== 100) return;
+        if (message.type === "progress") {
+          const { progress } = message as ProgressMessage;
+          setProcessProgress(progress);
+          return;
+        }
+        // The output keeps coming after the upload is done, it is only
+        // complete once the server says so.
+        if (message.type !== "complete") return;
+        const { mimeType } = message as CompleteMessage;
         const blob = new Blob(audioChunks.current, {
-          type: "audio/aac",
+          type: mimeType,
         });
         setAudioBlob(blob);
         socket.close();